@@ -14,10 +14,15 @@ func setupCommands() {
 	CMD_FUNCS["ingest"] = cmd.RunIngestCmdLine
 	CMD_FUNCS["digest"] = cmd.RunDigestCmdLine
 	CMD_FUNCS["trim"] = cmd.RunTrimCmdLine
+	CMD_FUNCS["compact"] = cmd.RunCompactCmdLine
+	CMD_FUNCS["cache"] = cmd.RunCacheCmdLine
 	CMD_FUNCS["query"] = cmd.RunQueryCmdLine
 	CMD_FUNCS["index"] = cmd.RunIndexCmdLine
 	CMD_FUNCS["rebuild"] = cmd.RunRebuildCmdLine
 	CMD_FUNCS["inspect"] = cmd.RunInspectCmdLine
+	CMD_FUNCS["fsck"] = cmd.RunFsckCmdLine
+	CMD_FUNCS["stats"] = cmd.RunStatsCmdLine
+	CMD_FUNCS["alter"] = cmd.RunAlterCmdLine
 	CMD_FUNCS["aggregate"] = cmd.RunAggregateCmdLine
 	CMD_FUNCS["version"] = cmd.RunVersionCmdLine
 
@@ -28,7 +33,7 @@ func setupCommands() {
 
 var USAGE = `sybil: a fast and simple NoSQL column store
 
-Commands: ingest, digest, trim, query, index, rebuild, inspect, aggregate, version, serve
+Commands: ingest, digest, trim, compact, alter, cache, query, index, stats, rebuild, inspect, fsck, aggregate, version, serve
 
 Storage Commands:
 
@@ -36,16 +41,46 @@ Storage Commands:
 
     example: sybil ingest -table TABLE < my_record.json
     example: sybil ingest -table TABLE -csv < my_records.csv
+    # rename, cast, drop or hash columns using a JSON mapping file
+    example: sybil ingest -table TABLE -mapping mapping.json < my_record.json
 
   digest: collate row store records into column blocks
 
     example: sybil digest -table TABLE
+    # put new blocks into day partitions of the time column
+    example: sybil digest -table TABLE -partition day -partition-col time
+    # hold the table's locks with flock instead of PID files
+    example: sybil digest -table TABLE -lock-backend flock
+    # keep a block manifest so queries read a consistent snapshot
+    example: sybil digest -table TABLE -snapshots on
 
   trim: trim a table to fit into a set amount of space or time limit
 
     example: sybil trim -table TABLE -mb 100 -list
     example: sybil trim -table TABLE -mb 100 -delete
 
+  compact: merge undersized and time overlapping blocks into full blocks
+
+    example: sybil compact -table TABLE -time-col time -list
+    example: sybil compact -table TABLE -time-col time
+
+  alter: drop, rename or retype a column in every block of a table
+
+    example: sybil alter -table TABLE -drop COL
+    example: sybil alter -table TABLE -rename COL -to NEW_COL
+    # turn a str column of numbers into an int column
+    example: sybil alter -table TABLE -int COL
+    # finish an alter that died half way
+    example: sybil alter -table TABLE -resume
+
+  cache: list, size up and purge the per block query cache of a table
+
+    example: sybil cache -table TABLE
+    example: sybil cache -table TABLE -list
+    example: sybil cache -table TABLE -block BLOCK -purge
+    # keep the query cache under 50MB, evicting the least recently used results
+    example: sybil cache -table TABLE -mb 50
+
 Query Commands:
 
   query: run aggregation queries on records inside a table
@@ -54,6 +89,13 @@ Query Commands:
     example: sybil query -table TABLE -print -group col1 -int col2 -op hist
     # reads the row store log (off by default)
     example: sybil query -table TABLE -read-log -print -group col1 -int col2 -op hist
+    # repeated queries only read the blocks added since the last run
+    example: sybil query -table TABLE -group col1 -int col2 -cache-results
+
+  stats: show which columns take up the disk, with their encoding, cardinality and nulls
+
+    example: sybil stats -table TABLE
+    example: sybil stats -table TABLE -blocks -json
 
 Emergency Maintenance Commands:
 
@@ -61,11 +103,20 @@ Emergency Maintenance Commands:
 
     example: sybil rebuild -table TABLE
 
-  inspect: examine sybil .db files
+  inspect: summarize sybil .db files or every column of a block
 
     example: sybil inspect -file ./db/TABLE/info.db
     example: sybil inspect -file ./db/TABLE/BLOCK/info.db
-    example: sybil inspect -file ./db/TABLE/BLOCK/str_COL.db
+    example: sybil inspect -file ./db/TABLE/BLOCK/str_COL.db -top 20
+    example: sybil inspect -file ./db/TABLE/BLOCK -json
+
+  fsck: check a table's blocks and look for records that were lost or saved twice
+
+    example: sybil fsck -table TABLE
+    # finish or undo a digest that died half way and clean up after it
+    example: sybil fsck -table TABLE -fix
+    # move blocks that don't read out of the way, so queries skip them
+    example: sybil fsck -table TABLE -quarantine
 
 `
 
@@ -4,6 +4,7 @@ import "testing"
 
 import "os"
 import "fmt"
+import "strconv"
 
 var TEST_DB = "testdb"
 
@@ -285,6 +286,226 @@ func TestDigestTable(t *testing.T) {
 	}
 }
 
+func TestNativeIngest(t *testing.T) {
+	config := SybilConfig{Dir: TEST_DB, Table: "test_native_ingest"}
+	table := NewTable(&config)
+
+	num_samples := 500
+	records := make([]*SybilRecord, 0)
+	for i := 0; i < num_samples; i++ {
+		r := NewRecord()
+		r.Int("age", i%70+10)
+		r.Str("name", NAMES[i%len(NAMES)])
+		r.Set("abc", []string{"a", "b"})
+		records = append(records, r)
+	}
+
+	err := table.WriteSybilRecords(records)
+	if err != nil {
+		t.Error("COULDNT WRITE SYBIL RECORDS", err)
+	}
+
+	map_record := SybilMapRecord{}
+	map_record["name"] = "foobar"
+	map_record["age"] = 123
+	map_record["friends"] = []string{"peter", "paul", "mary"}
+	map_record["nested"] = map[string]interface{}{"page": 5}
+	err = table.WriteMapRecords([]SybilMapRecord{map_record})
+	if err != nil {
+		t.Error("COULDNT WRITE MAP RECORDS", err)
+	}
+
+	table.AddRecords(genStructRecords(num_samples))
+	err = table.WriteRecords()
+	if err != nil {
+		t.Error("COULDNT WRITE PENDING RECORDS", err)
+	}
+
+	if len(table.NewRecords) != 0 {
+		t.Error("PENDING RECORDS WERE NOT CLEARED AFTER WRITING THEM")
+	}
+
+	sq := table.Query().Limit(num_samples)
+	res, err := sq.Execute()
+	if err != nil {
+		t.Error("ERROR WHILE QUERYING TABLE", err)
+	}
+
+	if len(res) == 0 || res[0]["Count"] != float64(num_samples*2+1) {
+		t.Error("READ WRONG NUMBER OF RECORDS BACK", res)
+	}
+
+	table_info := table.GetTableInfo()
+	found := false
+	for _, col := range table_info.Columns.Ints {
+		if col == "nested_page" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("NESTED MAP FIELD WAS NOT FLATTENED", table_info.Columns)
+	}
+}
+
+func TestNativeIngestTypeMismatch(t *testing.T) {
+	config := SybilConfig{Dir: TEST_DB, Table: "test_native_mismatch"}
+	table := NewTable(&config)
+
+	record := SybilMapRecord{}
+	record["age"] = 10
+	err := table.WriteMapRecords([]SybilMapRecord{record})
+	if err != nil {
+		t.Error("COULDNT WRITE MAP RECORDS", err)
+	}
+
+	table.DigestRecords()
+
+	record["age"] = "ten"
+	err = table.WriteMapRecords([]SybilMapRecord{record})
+	if err == nil {
+		t.Error("WROTE A STR INTO AN INT COLUMN WITHOUT AN ERROR")
+	}
+
+	bad := []SybilMapRecord{{"weight": 10}, {"weight": "heavy"}}
+	err = table.WriteMapRecords(bad)
+	if err == nil {
+		t.Error("WROTE CONFLICTING TYPES IN ONE BATCH WITHOUT AN ERROR")
+	}
+}
+
+func TestNativeIngestLargeInts(t *testing.T) {
+	type bigRecord struct {
+		Id int64 `json:"id"`
+	}
+
+	big := int64(1<<53 + 1)
+	record, err := structRecord(bigRecord{Id: big})
+	if err != nil {
+		t.Fatal("COULDNT CONVERT STRUCT RECORD", err)
+	}
+
+	val, err := intValue(record["id"])
+	if err != nil || val != big {
+		t.Error("LOST PRECISION CONVERTING", big, "GOT", val, err)
+	}
+}
+
+func TestNativeQuery(t *testing.T) {
+	config := SybilConfig{Dir: TEST_DB, Table: "test_native_query"}
+	table := NewTable(&config)
+
+	num_samples := 700
+	records := make([]*SybilRecord, 0)
+	for i := 0; i < num_samples; i++ {
+		r := NewRecord()
+		r.Int("age", i%70+10)
+		r.Int("time", 3600*(i%7))
+		r.Str("name", NAMES[i%len(NAMES)])
+		r.Set("abc", []string{strconv.Itoa(i % 2)})
+		records = append(records, r)
+	}
+
+	err := table.WriteSybilRecords(records)
+	if err != nil {
+		t.Fatal("COULDNT WRITE SYBIL RECORDS", err)
+	}
+
+	res, err := table.Query().Aggregate("age").Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING ROLLUP", err)
+	}
+
+	if len(res.Results) != 1 || res.Results[0].Count != int64(num_samples) {
+		t.Fatal("ROLLUP RETURNED WRONG COUNT", res.Results)
+	}
+
+	age := res.Results[0].Columns["age"]
+	if age == nil || age.Max != 79 || age.Avg < 44.49 || age.Avg > 44.51 || age.Samples != int64(num_samples) {
+		t.Error("ROLLUP RETURNED WRONG STATS FOR AGE", age)
+	}
+
+	if res.Stats.RecordsScanned != int64(num_samples) || res.Stats.RecordsMatched != int64(num_samples) {
+		t.Error("ROLLUP RETURNED WRONG QUERY STATS", res.Stats)
+	}
+
+	res, err = table.Query().GroupBy("name").Hist().Aggregate("age").Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING GROUP BY", err)
+	}
+
+	if len(res.Results) != len(NAMES) {
+		t.Error("GROUP BY RETURNED WRONG NUMBER OF GROUPS", len(res.Results))
+	}
+
+	for _, r := range res.Results {
+		if r.Count != int64(num_samples/len(NAMES)) || r.Groups["name"] == "" {
+			t.Error("GROUP BY RETURNED WRONG RESULT", r.Groups, r.Count)
+		}
+
+		if len(r.Columns["age"].Percentiles) == 0 {
+			t.Error("HIST QUERY IS MISSING PERCENTILES", r.Groups)
+		}
+	}
+
+	res, err = table.Query().StrFilterEq("name", "john").SetFilterIn("abc", "1").Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING FILTERED QUERY", err)
+	}
+
+	if len(res.Results) != 1 || res.Results[0].Count != int64(num_samples/len(NAMES)/2) {
+		t.Error("FILTERED QUERY RETURNED WRONG COUNT", res.Results)
+	}
+
+	res, err = table.Query().StrFilterRegex("name", "^p").IntFilterLt("age", 20).Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING REGEX QUERY", err)
+	}
+
+	// paul and peter with ages 13 and 14
+	if len(res.Results) != 1 || res.Results[0].Count != 20 {
+		t.Error("REGEX QUERY RETURNED WRONG COUNT", res.Results)
+	}
+
+	res, err = table.Query().TimeSeries("time", 3600).Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING TIME SERIES", err)
+	}
+
+	if len(res.TimeSeries) != 7 || res.TimeSeries[1].Time != 3600 || res.TimeSeries[1].Results[0].Count != 100 {
+		t.Error("TIME SERIES RETURNED WRONG BUCKETS", res.TimeSeries)
+	}
+
+	res, err = table.Query().Samples().Limit(10).Run()
+	if err != nil {
+		t.Fatal("ERROR RUNNING SAMPLES", err)
+	}
+
+	if len(res.Samples) != 10 || res.Samples[0].Strs["name"] == "" || len(res.Samples[0].Sets["abc"]) != 1 {
+		t.Error("SAMPLES QUERY RETURNED WRONG SAMPLES", res.Samples)
+	}
+
+	table.DigestRecords()
+	res, err = table.Query().ReadRowLog(false).GroupBy("name").Run()
+	if err != nil {
+		t.Fatal("ERROR QUERYING DIGESTED TABLE", err)
+	}
+
+	if len(res.Results) != len(NAMES) || res.Matched != num_samples {
+		t.Error("QUERY ON DIGESTED TABLE RETURNED WRONG RESULTS", res.Matched)
+	}
+
+	_, err = table.Query().StrFilterRegex("name", "(").Run()
+	if err == nil {
+		t.Error("BAD REGEX DID NOT RETURN AN ERROR")
+	}
+
+	_, err = table.Query().GroupBy("abc").Run()
+	if err == nil {
+		t.Error("GROUPING BY A SET DID NOT RETURN AN ERROR")
+	}
+}
+
 // NOT YET IMPLEMENTED
 func testQueryTimeSeries(t *testing.T) {
 
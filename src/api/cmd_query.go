@@ -21,6 +21,12 @@ type SybilQuery struct {
 	TimeBucket int
 	TimeCol    string
 
+	Op           string // "avg" or "hist"
+	LogHistogram bool
+	SamplesQuery bool
+	Weight       string
+	MaxResults   int
+
 	Strs []string
 	Ints []string
 	Sets []string
@@ -45,6 +51,8 @@ func (t *SybilTable) Query() *SybilQuery {
 	sq.Sets = make([]string, 0)
 	sq.Ints = make([]string, 0)
 
+	sq.Op = "avg"
+	sq.MaxResults = 100
 	sq.ReadLog = true
 
 	return &sq
@@ -53,7 +61,9 @@ func (t *SybilTable) Query() *SybilQuery {
 // SELECTING QUERY TYPE
 
 func (sq *SybilQuery) TimeSeries(timeCol string, bucket int) *SybilQuery {
-	sq.Flags = append(sq.Flags, "-time-bucket", strconv.Itoa(bucket), "-time-col", timeCol)
+	sq.TimeBucket = bucket
+	sq.TimeCol = timeCol
+	sq.Flags = append(sq.Flags, "-time", "-time-bucket", strconv.Itoa(bucket), "-time-col", timeCol)
 	return sq
 
 }
@@ -69,6 +79,7 @@ func (sq *SybilQuery) Rollup() *SybilQuery {
 }
 
 func (sq *SybilQuery) Samples() *SybilQuery {
+	sq.SamplesQuery = true
 	sq.Flags = append(sq.Flags, "-samples")
 	return sq
 }
@@ -80,11 +91,14 @@ func (sq *SybilQuery) Aggregate(field string) *SybilQuery {
 }
 
 func (sq *SybilQuery) Hist() *SybilQuery {
+	sq.Op = "hist"
 	sq.Flags = append(sq.Flags, "-op", "hist")
 	return sq
 }
 
 func (sq *SybilQuery) LogHist() *SybilQuery {
+	sq.Op = "hist"
+	sq.LogHistogram = true
 	sq.Flags = append(sq.Flags, "-op", "hist", "-loghist")
 	return sq
 
@@ -96,11 +110,13 @@ func (sq *SybilQuery) GroupBy(field string) *SybilQuery {
 }
 
 func (sq *SybilQuery) WeightCol(field string) *SybilQuery {
+	sq.Weight = field
 	sq.Flags = append(sq.Flags, "-weight-col", field)
 	return sq
 }
 
 func (sq *SybilQuery) Limit(limit int) *SybilQuery {
+	sq.MaxResults = limit
 	sq.Flags = append(sq.Flags, "-limit", strconv.Itoa(limit))
 	return sq
 }
@@ -129,11 +145,33 @@ func (sq *SybilQuery) IntFilterNeq(field string, value int) *SybilQuery {
 }
 
 func (sq *SybilQuery) StrFilterEq(field string, value string) *SybilQuery {
+	sq.StrFilters = append(sq.StrFilters, SybilFilter{field, "eq", value})
 	return sq
 
 }
 
+func (sq *SybilQuery) StrFilterNeq(field string, value string) *SybilQuery {
+	sq.StrFilters = append(sq.StrFilters, SybilFilter{field, "neq", value})
+	return sq
+}
+
 func (sq *SybilQuery) StrFilterRegex(field string, value string) *SybilQuery {
+	sq.StrFilters = append(sq.StrFilters, SybilFilter{field, "re", value})
+	return sq
+}
+
+func (sq *SybilQuery) StrFilterNotRegex(field string, value string) *SybilQuery {
+	sq.StrFilters = append(sq.StrFilters, SybilFilter{field, "nre", value})
+	return sq
+}
+
+func (sq *SybilQuery) SetFilterIn(field string, value string) *SybilQuery {
+	sq.SetFilters = append(sq.SetFilters, SybilFilter{field, "in", value})
+	return sq
+}
+
+func (sq *SybilQuery) SetFilterNotIn(field string, value string) *SybilQuery {
+	sq.SetFilters = append(sq.SetFilters, SybilFilter{field, "nin", value})
 	return sq
 }
 
@@ -0,0 +1,46 @@
+package api
+
+import "sync"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+// {{{ IN PROCESS ACCESS
+// The native APIs call into the sybil lib directly instead of exec'ing
+// SYBIL_BIN. The lib keeps its settings (like the db dir and the query
+// flags) in globals and caches tables by name, so every in-process call is
+// serialized and the globals are restored once the call is done.
+
+var native_m sync.Mutex
+
+type sybilState struct {
+	flags         sybil.FlagDefs
+	opts          sybil.OptionDefs
+	hold_matches  bool
+	delete_blocks bool
+}
+
+var native_saved sybilState
+
+func (config *SybilConfig) enterSybil() *sybil.Table {
+	native_m.Lock()
+	native_saved = sybilState{sybil.FLAGS, sybil.OPTS, sybil.HOLD_MATCHES, sybil.DELETE_BLOCKS_AFTER_QUERY}
+
+	sybil.FLAGS.DIR = config.Dir
+	sybil.FLAGS.TABLE = config.Table
+
+	return sybil.GetTable(config.Table)
+}
+
+func (config *SybilConfig) exitSybil() {
+	sybil.UnloadTable(config.Table)
+
+	sybil.FLAGS = native_saved.flags
+	sybil.OPTS = native_saved.opts
+	sybil.HOLD_MATCHES = native_saved.hold_matches
+	sybil.DELETE_BLOCKS_AFTER_QUERY = native_saved.delete_blocks
+	native_m.Unlock()
+}
+
+// }}} IN PROCESS ACCESS
+
+// vim: foldmethod=marker
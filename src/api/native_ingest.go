@@ -0,0 +1,361 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+import sybil "github.com/logv/sybil/src/lib"
+
+// {{{ NATIVE INGESTION
+// The native writer turns records into a sybil.SavedRecordBlock and saves it
+// into the table's ingestion log in-process, the same file that `sybil ingest
+// -save-srb` would write. The records are picked up by the next digest (or by
+// queries that read the row store).
+//
+// Column types are checked against the table's info.db before anything is
+// written: a column that is already an int can't receive strings and so on.
+// Like `sybil ingest`, new columns are then saved into the table's info.db
+// and records whose dedup key was already seen are dropped.
+
+var NATIVE_INGEST_BLOCKNAME = "ingest"
+
+type nativeBlock struct {
+	srb      sybil.SavedRecordBlock
+	keyTable map[string]int16
+	keyTypes map[string]int8
+
+	// column types that are already in the table's info.db
+	tableTypes map[string]int8
+}
+
+func typeName(col_type int8) string {
+	switch col_type {
+	case sybil.INT_VAL:
+		return "int"
+	case sybil.STR_VAL:
+		return "str"
+	case sybil.SET_VAL:
+		return "set"
+	}
+
+	return "unknown"
+}
+
+func (b *nativeBlock) keyId(name string, col_type int8) (int16, error) {
+	if name == "" {
+		return 0, errors.New("record has a column without a name")
+	}
+
+	existing, ok := b.tableTypes[name]
+	if ok && existing != col_type {
+		return 0, fmt.Errorf("column %s is %s in the table, can't write %s values into it", name, typeName(existing), typeName(col_type))
+	}
+
+	existing, ok = b.keyTypes[name]
+	if ok && existing != col_type {
+		return 0, fmt.Errorf("column %s is both %s and %s in the written records", name, typeName(existing), typeName(col_type))
+	}
+
+	id, ok := b.keyTable[name]
+	if !ok {
+		id = int16(len(b.keyTable))
+		b.keyTable[name] = id
+		b.keyTypes[name] = col_type
+	}
+
+	return id, nil
+}
+
+func (b *nativeBlock) addSybilRecord(r *SybilRecord) error {
+	sr := sybil.SavedRecord{}
+	for k, v := range r.Ints {
+		id, err := b.keyId(k, sybil.INT_VAL)
+		if err != nil {
+			return err
+		}
+		sr.Ints = append(sr.Ints, sybil.RowSavedInt{Name: id, Value: int64(v)})
+	}
+
+	for k, v := range r.Strs {
+		id, err := b.keyId(k, sybil.STR_VAL)
+		if err != nil {
+			return err
+		}
+		sr.Strs = append(sr.Strs, sybil.RowSavedStr{Name: id, Value: v})
+	}
+
+	for k, v := range r.Sets {
+		id, err := b.keyId(k, sybil.SET_VAL)
+		if err != nil {
+			return err
+		}
+		sr.Sets = append(sr.Sets, sybil.RowSavedSet{Name: id, Value: v})
+	}
+
+	b.srb.RecordList = append(b.srb.RecordList, &sr)
+	return nil
+}
+
+// map records follow the same rules as JSON records given to `sybil ingest`:
+// numbers and bools become ints, lists become sets and nested maps are
+// flattened into prefix_key columns
+func (b *nativeBlock) addMapFields(sr *sybil.SavedRecord, record map[string]interface{}, prefix string) error {
+	for k, v := range record {
+		key_name := prefix + k
+
+		var id int16
+		var err error
+		switch iv := v.(type) {
+		case nil:
+			continue
+		case string:
+			if id, err = b.keyId(key_name, sybil.STR_VAL); err == nil {
+				sr.Strs = append(sr.Strs, sybil.RowSavedStr{Name: id, Value: iv})
+			}
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool, json.Number:
+			var val int64
+			if val, err = intValue(iv); err == nil {
+				if id, err = b.keyId(key_name, sybil.INT_VAL); err == nil {
+					sr.Ints = append(sr.Ints, sybil.RowSavedInt{Name: id, Value: val})
+				}
+			}
+		case []string:
+			if id, err = b.keyId(key_name, sybil.SET_VAL); err == nil {
+				sr.Sets = append(sr.Sets, sybil.RowSavedSet{Name: id, Value: iv})
+			}
+		case []interface{}:
+			set := make([]string, 0, len(iv))
+			for _, sv := range iv {
+				switch av := sv.(type) {
+				case string:
+					set = append(set, av)
+				case float64:
+					set = append(set, fmt.Sprintf("%.0f", av))
+				case int:
+					set = append(set, strconv.Itoa(av))
+				case int64:
+					set = append(set, strconv.FormatInt(av, 10))
+				case json.Number:
+					set = append(set, av.String())
+				}
+			}
+
+			if id, err = b.keyId(key_name, sybil.SET_VAL); err == nil {
+				sr.Sets = append(sr.Sets, sybil.RowSavedSet{Name: id, Value: set})
+			}
+		case map[string]interface{}:
+			err = b.addMapFields(sr, iv, key_name+"_")
+		case SybilMapRecord:
+			err = b.addMapFields(sr, iv, key_name+"_")
+		default:
+			err = fmt.Errorf("can't write value of type %T into column %s", v, key_name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *nativeBlock) addMapRecord(record map[string]interface{}) error {
+	sr := sybil.SavedRecord{}
+	err := b.addMapFields(&sr, record, "")
+	if err != nil {
+		return err
+	}
+
+	b.srb.RecordList = append(b.srb.RecordList, &sr)
+	return nil
+}
+
+func intValue(v interface{}) (int64, error) {
+	switch iv := v.(type) {
+	case int:
+		return int64(iv), nil
+	case int8:
+		return int64(iv), nil
+	case int16:
+		return int64(iv), nil
+	case int32:
+		return int64(iv), nil
+	case int64:
+		return iv, nil
+	case uint:
+		return int64(iv), nil
+	case uint8:
+		return int64(iv), nil
+	case uint16:
+		return int64(iv), nil
+	case uint32:
+		return int64(iv), nil
+	case uint64:
+		return int64(iv), nil
+	case float32:
+		return int64(iv), nil
+	case float64:
+		return int64(iv), nil
+	case json.Number:
+		ival, err := iv.Int64()
+		if err == nil {
+			return ival, nil
+		}
+		fval, err := iv.Float64()
+		return int64(fval), err
+	case bool:
+		if iv {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// structs are converted through JSON, just like FlushRecords does. numbers
+// are kept as json.Number, so ints above 2^53 don't lose precision in a float
+func structRecord(r interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var record map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err = dec.Decode(&record)
+	return record, err
+}
+
+func (t *SybilTable) writeNativeBlock(fill func(b *nativeBlock) error) error {
+	table := t.Config.enterSybil()
+	defer t.Config.exitSybil()
+
+	os.MkdirAll(path.Join(t.Config.Dir, t.Config.Table), 0755)
+
+	if !table.LoadTableInfo() && table.HasFlagFile() {
+		return fmt.Errorf("couldn't read table info for %s", t.Config.Table)
+	}
+
+	b := nativeBlock{}
+	b.keyTable = make(map[string]int16)
+	b.keyTypes = make(map[string]int8)
+	b.tableTypes = make(map[string]int8)
+	for name, id := range table.KeyTable {
+		col_type, ok := table.KeyTypes[id]
+		if ok {
+			b.tableTypes[name] = col_type
+		}
+	}
+
+	err := fill(&b)
+	if err != nil {
+		return err
+	}
+
+	if len(b.srb.RecordList) == 0 {
+		return nil
+	}
+
+	b.srb.KeyTable = &b.keyTable
+	err = table.AppendRecordBlockToLog(&b.srb, NATIVE_INGEST_BLOCKNAME)
+	if err != nil {
+		return err
+	}
+
+	Debug("WROTE", len(b.srb.RecordList), "RECORDS TO", t.Config.Table)
+
+	// new columns are added to the table info, so later writes (and `sybil
+	// ingest`) see their types before the records are digested
+	new_columns := 0
+	for name, col_type := range b.keyTypes {
+		_, ok := b.tableTypes[name]
+		if !ok {
+			table.AddColumnType(name, col_type)
+			new_columns++
+		}
+	}
+
+	if new_columns > 0 {
+		return table.WriteTableInfo("info")
+	}
+
+	return nil
+}
+
+// WriteSybilRecords writes records into the table's ingestion log without
+// going through SYBIL_BIN. Either all records are written or none are.
+func (t *SybilTable) WriteSybilRecords(records []*SybilRecord) error {
+	return t.writeNativeBlock(func(b *nativeBlock) error {
+		for _, r := range records {
+			err := b.addSybilRecord(r)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// WriteMapRecords is the map based counterpart of WriteSybilRecords
+func (t *SybilTable) WriteMapRecords(records []SybilMapRecord) error {
+	return t.writeNativeBlock(func(b *nativeBlock) error {
+		for _, r := range records {
+			err := b.addMapRecord(r)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// WriteRecords is the in-process version of FlushRecords: the records added
+// with AddRecords (and friends) are written into the ingestion log and the
+// pending list is cleared. If an error is returned, the pending records are
+// kept so they can be written again.
+func (t *SybilTable) WriteRecords() error {
+	err := t.writeNativeBlock(func(b *nativeBlock) error {
+		for _, r := range t.NewRecords {
+			var record map[string]interface{}
+			switch v := r.(type) {
+			case map[string]interface{}:
+				record = v
+			case SybilMapRecord:
+				record = v
+			default:
+				var err error
+				record, err = structRecord(r)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := b.addMapRecord(record)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		t.NewRecords = make([]interface{}, 0)
+	}
+
+	return err
+}
+
+// }}} NATIVE INGESTION
+
+// vim: foldmethod=marker
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import sybil "github.com/logv/sybil/src/lib"
+
+// {{{ NATIVE QUERIES
+// Run is the in-process version of Execute: it builds a sybil.QuerySpec from
+// the SybilQuery and runs it against the table with the sybil lib, returning
+// typed results. Anything that would make the sybil binary exit (bad regexes,
+// unknown filter ops, grouping by a set column, missing tables) is returned
+// as an error instead.
+
+type SybilColumnStats struct {
+	Avg     float64
+	Sum     float64
+	StdDev  float64
+	Min     int64
+	Max     int64
+	Samples int64
+
+	// only filled in for Hist() and LogHist() queries
+	Percentiles []int64
+	Buckets     map[string]int64
+}
+
+type SybilGroupResult struct {
+	Groups  map[string]string // group by column -> value
+	Count   int64
+	Samples int64
+	Columns map[string]*SybilColumnStats
+}
+
+type SybilTimeBucket struct {
+	Time    int64
+	Results []*SybilGroupResult
+}
+
+type SybilSample struct {
+	Ints map[string]int64
+	Strs map[string]string
+	Sets map[string][]string
+}
+
+type SybilQueryResults struct {
+	Matched    int
+	Results    []*SybilGroupResult // sorted by count and limited
+	TimeSeries []*SybilTimeBucket  // sorted by time, only for TimeSeries() queries
+	Samples    []*SybilSample      // only for Samples() queries
+
+	Incomplete bool // the query was cancelled or skipped blocks over the memory budget
+	Stats      sybil.QueryStats
+}
+
+var INT_FILTER_OPS = map[string]bool{"eq": true, "neq": true, "gt": true, "lt": true}
+var STR_FILTER_OPS = map[string]bool{"eq": true, "neq": true, "re": true, "nre": true}
+var SET_FILTER_OPS = map[string]bool{"in": true, "nin": true}
+
+func (sq *SybilQuery) validate() error {
+	if sq.Op != "avg" && sq.Op != "hist" {
+		return fmt.Errorf("unknown op %s", sq.Op)
+	}
+
+	if sq.TimeBucket < 0 || (sq.TimeCol != "" && sq.TimeBucket == 0) {
+		return fmt.Errorf("invalid time bucket %d", sq.TimeBucket)
+	}
+
+	for _, f := range sq.IntFilters {
+		if !INT_FILTER_OPS[f.Op] {
+			return fmt.Errorf("unknown int filter op %s on %s", f.Op, f.Field)
+		}
+		if _, err := strconv.ParseInt(f.Value, 10, 64); err != nil {
+			return fmt.Errorf("int filter on %s has a non int value %s", f.Field, f.Value)
+		}
+	}
+
+	for _, f := range sq.StrFilters {
+		if !STR_FILTER_OPS[f.Op] {
+			return fmt.Errorf("unknown str filter op %s on %s", f.Op, f.Field)
+		}
+		if f.Op == "re" || f.Op == "nre" {
+			if _, err := regexp.Compile(f.Value); err != nil {
+				return fmt.Errorf("invalid regex in filter on %s: %v", f.Field, err)
+			}
+		}
+	}
+
+	for _, f := range sq.SetFilters {
+		if !SET_FILTER_OPS[f.Op] {
+			return fmt.Errorf("unknown set filter op %s on %s", f.Op, f.Field)
+		}
+	}
+
+	return nil
+}
+
+func joinFilters(filters []SybilFilter) string {
+	allFilters := []string{}
+	for _, f := range filters {
+		allFilters = append(allFilters, strings.Join([]string{f.Field, f.Op, f.Value}, FILTER_SEPARATOR))
+	}
+
+	return strings.Join(allFilters, FIELD_SEPARATOR)
+}
+
+func (sq *SybilQuery) Run() (*SybilQueryResults, error) {
+	return sq.RunContext(context.Background())
+}
+
+// RunContext stops reading blocks once ctx is done, the results read up to
+// then are returned with Incomplete set
+func (sq *SybilQuery) RunContext(ctx context.Context) (*SybilQueryResults, error) {
+	err := sq.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	t := sq.Config.enterSybil()
+	defer sq.Config.exitSybil()
+
+	if t.IsNotExist() {
+		return nil, fmt.Errorf("table %s does not exist in %s", sq.Config.Table, sq.Config.Dir)
+	}
+
+	sybil.FLAGS.FIELD_SEPARATOR = FIELD_SEPARATOR
+	sybil.FLAGS.FILTER_SEPARATOR = FILTER_SEPARATOR
+	sybil.FLAGS.OP = sq.Op
+	sybil.FLAGS.LOG_HIST = sq.LogHistogram
+	sybil.FLAGS.LIMIT = sq.MaxResults
+	sybil.FLAGS.SAMPLES = sq.SamplesQuery
+	sybil.FLAGS.READ_ROWSTORE = sq.ReadLog
+	sybil.FLAGS.READ_INGESTION_LOG = sq.ReadLog
+	sybil.FLAGS.LOAD_AND_QUERY = true
+	sybil.FLAGS.PRINT = false
+	sybil.FLAGS.JSON = false
+	sybil.FLAGS.EXPORT = false
+	sybil.FLAGS.STR_REPLACE = ""
+	sybil.FLAGS.NUM_DISTINCT = -1
+	sybil.FLAGS.WEIGHT_COL = sq.Weight
+	sybil.FLAGS.TIME = sq.TimeBucket > 0
+	sybil.FLAGS.TIME_BUCKET = sq.TimeBucket
+	if sq.TimeCol != "" {
+		sybil.FLAGS.TIME_COL = sq.TimeCol
+	}
+
+	if !t.LoadTableInfo() && t.HasFlagFile() {
+		return nil, fmt.Errorf("couldn't read table info for %s", sq.Config.Table)
+	}
+
+	for _, g := range sq.Strs {
+		if t.GetColumnType(g) == sybil.SET_VAL {
+			return nil, fmt.Errorf("grouping by set column %s is not supported", g)
+		}
+	}
+
+	loadSpec := t.NewLoadSpec()
+	filterSpec := sybil.FilterSpec{Int: joinFilters(sq.IntFilters), Str: joinFilters(sq.StrFilters), Set: joinFilters(sq.SetFilters)}
+	filters := sybil.BuildFilters(t, &loadSpec, filterSpec)
+
+	groupings := []sybil.Grouping{}
+	for _, g := range sq.Strs {
+		groupings = append(groupings, t.Grouping(g))
+		switch t.GetColumnType(g) {
+		case sybil.INT_VAL:
+			loadSpec.Int(g)
+		default:
+			loadSpec.Str(g)
+		}
+	}
+
+	aggs := []sybil.Aggregation{}
+	for _, agg := range sq.Ints {
+		loadSpec.Int(agg)
+		if !sq.SamplesQuery {
+			aggs = append(aggs, t.Aggregation(agg, sq.Op))
+		}
+	}
+
+	for _, v := range sq.Sets {
+		loadSpec.Set(v)
+	}
+
+	query_params := sybil.QueryParams{Groups: groupings, Filters: filters, Aggregations: aggs}
+	querySpec := sybil.QuerySpec{QueryParams: query_params}
+	querySpec.OrderBy = sybil.SORT_COUNT
+	querySpec.PruneBy = sybil.SORT_COUNT
+	querySpec.Limit = sq.MaxResults
+	querySpec.Samples = sq.SamplesQuery
+
+	if sq.TimeBucket > 0 {
+		querySpec.TimeBucket = sq.TimeBucket
+		loadSpec.Int(sybil.FLAGS.TIME_COL)
+		time_col_id, ok := t.KeyTable[sybil.FLAGS.TIME_COL]
+		if ok {
+			sybil.OPTS.TIME_COL_ID = time_col_id
+		}
+	}
+
+	if sq.Weight != "" {
+		sybil.OPTS.WEIGHT_COL = true
+		loadSpec.Int(sq.Weight)
+		sybil.OPTS.WEIGHT_COL_ID = t.KeyTable[sq.Weight]
+	}
+
+	results := SybilQueryResults{}
+	if sq.SamplesQuery {
+		sybil.HOLD_MATCHES = true
+		sybil.DELETE_BLOCKS_AFTER_QUERY = false
+		if len(sq.Ints) == 0 && len(sq.Strs) == 0 && len(sq.Sets) == 0 {
+			loadSpec = t.NewLoadSpec()
+			loadSpec.LoadAllColumns = true
+		}
+
+		results.Matched = t.LoadAndQueryRecordsContext(ctx, &loadSpec, &querySpec)
+		results.Incomplete = querySpec.Incomplete
+		results.Stats = querySpec.Stats
+		for _, s := range t.GetSamples(&querySpec) {
+			results.Samples = append(results.Samples, toSybilSample(s))
+		}
+
+		return &results, nil
+	}
+
+	t.LoadAndQueryRecordsContext(ctx, &loadSpec, &querySpec)
+	results.Matched = querySpec.MatchedCount
+	results.Incomplete = querySpec.Incomplete
+	results.Stats = querySpec.Stats
+
+	sorted := querySpec.Sorted
+	if len(sorted) > querySpec.Limit {
+		sorted = sorted[:querySpec.Limit]
+	}
+
+	is_top_result := make(map[string]bool)
+	for _, r := range sorted {
+		is_top_result[r.GroupByKey] = true
+		results.Results = append(results.Results, sq.toGroupResult(&querySpec, r))
+	}
+
+	if querySpec.TimeBucket > 0 {
+		for bucket, time_results := range querySpec.TimeResults {
+			tb := SybilTimeBucket{Time: int64(bucket)}
+			for _, r := range time_results {
+				if is_top_result[r.GroupByKey] {
+					tb.Results = append(tb.Results, sq.toGroupResult(&querySpec, r))
+				}
+			}
+
+			results.TimeSeries = append(results.TimeSeries, &tb)
+		}
+
+		sort.Sort(timeBucketsByTime(results.TimeSeries))
+	}
+
+	return &results, nil
+}
+
+type timeBucketsByTime []*SybilTimeBucket
+
+func (a timeBucketsByTime) Len() int           { return len(a) }
+func (a timeBucketsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a timeBucketsByTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
+
+func (sq *SybilQuery) toGroupResult(querySpec *sybil.QuerySpec, r *sybil.Result) *SybilGroupResult {
+	res := SybilGroupResult{Count: r.Count, Samples: r.Samples}
+	res.Groups = make(map[string]string)
+	res.Columns = make(map[string]*SybilColumnStats)
+
+	group_key := strings.Split(r.GroupByKey, sybil.GROUP_DELIMITER)
+	for i, g := range querySpec.Groups {
+		if i < len(group_key) {
+			res.Groups[g.Name] = group_key[i]
+		}
+	}
+
+	for _, agg := range querySpec.Aggregations {
+		h, ok := r.Hists[agg.Name]
+		if !ok || h == nil {
+			continue
+		}
+
+		stats := SybilColumnStats{}
+		stats.Avg = h.Mean()
+		stats.Samples = h.TotalCount()
+		stats.Sum = h.Mean() * float64(h.TotalCount())
+		stats.StdDev = h.StdDev()
+		stats.Min = h.Min()
+		stats.Max = h.Max()
+
+		if sq.Op == "hist" {
+			stats.Percentiles = h.GetPercentiles()
+			stats.Buckets = make(map[string]int64)
+			for k, v := range h.GetStrBuckets() {
+				if v > 0 {
+					stats.Buckets[k] = v
+				}
+			}
+		}
+
+		res.Columns[agg.Name] = &stats
+	}
+
+	return &res
+}
+
+func toSybilSample(s *sybil.Sample) *SybilSample {
+	sample := SybilSample{}
+	sample.Ints = make(map[string]int64)
+	sample.Strs = make(map[string]string)
+	sample.Sets = make(map[string][]string)
+
+	for k, v := range *s {
+		switch iv := v.(type) {
+		case sybil.IntField:
+			sample.Ints[k] = int64(iv)
+		case string:
+			sample.Strs[k] = iv
+		case []string:
+			sample.Sets[k] = iv
+		}
+	}
+
+	return &sample
+}
+
+// }}} NATIVE QUERIES
+
+// vim: foldmethod=marker
@@ -30,18 +30,18 @@ type SybilMapRecord map[string]interface{}
 type SybilResult map[string]interface{}
 
 func (sr SybilResult) Int(field string) (int, bool) {
-	val, ok := sr[field]
-	return int(val.(float64)), ok
+	val, ok := sr[field].(float64)
+	return int(val), ok
 }
 
 func (sr SybilResult) Str(field string) (string, bool) {
-	val, ok := sr[field]
-	return val.(string), ok
+	val, ok := sr[field].(string)
+	return val, ok
 }
 
 func (sr SybilResult) Set(field string) (map[string]string, bool) {
-	val, ok := sr[field]
-	return val.(map[string]string), ok
+	val, ok := sr[field].(map[string]string)
+	return val, ok
 
 }
 
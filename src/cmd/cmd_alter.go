@@ -0,0 +1,61 @@
+package sybil_cmd
+
+import "flag"
+import "fmt"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func RunAlterCmdLine() {
+	DROP := flag.String("drop", "", "column to drop from every block")
+	RENAME := flag.String("rename", "", "column to rename, to the name given with -to")
+	TO := flag.String("to", "", "new name of the column given with -rename")
+	INT := flag.String("int", "", "str column of integers to turn into an int column")
+	RESUME := flag.Bool("resume", false, "finish an alter that died half way")
+	flag.Parse()
+
+	if sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	var spec *sybil.AlterSpec
+	ops := 0
+	if *DROP != "" {
+		spec = &sybil.AlterSpec{Op: sybil.ALTER_DROP, Column: *DROP}
+		ops++
+	}
+	if *RENAME != "" {
+		spec = &sybil.AlterSpec{Op: sybil.ALTER_RENAME, Column: *RENAME, NewName: *TO}
+		ops++
+	}
+	if *INT != "" {
+		spec = &sybil.AlterSpec{Op: sybil.ALTER_INT, Column: *INT}
+		ops++
+	}
+
+	if ops > 1 || (ops == 0 && !*RESUME) {
+		sybil.Print("Please specify one of -drop, -rename or -int, or -resume")
+		flag.PrintDefaults()
+		return
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	if spec == nil && !t.HasUnfinishedAlter() {
+		fmt.Println("NO UNFINISHED ALTER")
+		return
+	}
+
+	altered, err := t.AlterTable(spec)
+	if err != nil {
+		sybil.Error(err)
+	}
+
+	fmt.Println("ALTERED", altered, "BLOCKS")
+}
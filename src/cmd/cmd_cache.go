@@ -0,0 +1,76 @@
+package sybil_cmd
+
+import "flag"
+import "fmt"
+import "path"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func RunCacheCmdLine() {
+	LIST := flag.Bool("list", false, "list the cached query results")
+	PURGE := flag.Bool("purge", false, "remove the cached query results")
+	BLOCK := flag.String("block", "", "only look at the query cache of this block")
+	MB_LIMIT := flag.Int("mb", -1, "set the table's query cache budget in MB, 0 is no limit")
+	flag.Parse()
+
+	if sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	if *MB_LIMIT >= 0 {
+		t.SetQueryCacheBudget(int64(*MB_LIMIT) * 1024 * 1024)
+		t.SaveTableInfo("info")
+		if t.Settings.QueryCacheBytes > 0 {
+			t.EvictQueryCache(t.Settings.QueryCacheBytes)
+		}
+	}
+
+	if *PURGE {
+		count, size := t.PurgeQueryCache(*BLOCK)
+		fmt.Println("PURGED", count, "CACHED QUERIES,", size, "BYTES")
+		return
+	}
+
+	entries := t.ListQueryCache(*BLOCK)
+	if *LIST {
+		for _, entry := range entries {
+			name := path.Base(entry.Block)
+			if entry.Block == "" {
+				name = sybil.RESULTS_CACHE_DIR
+			}
+			fmt.Println(name, entry.Key, entry.Size, entry.Used.Format("2006-01-02 15:04:05"))
+		}
+		return
+	}
+
+	blocks := make(map[string]bool)
+	results := 0
+	total := int64(0)
+	for _, entry := range entries {
+		if entry.Block == "" {
+			results++
+		} else {
+			blocks[entry.Block] = true
+		}
+		total += entry.Size
+	}
+
+	fmt.Println("CACHED QUERIES", len(entries)-results)
+	fmt.Println("CACHED TABLE RESULTS", results)
+	fmt.Println("BLOCKS WITH CACHED QUERIES", len(blocks))
+	fmt.Println("CACHE SIZE", total)
+	if t.Settings.QueryCacheBytes > 0 {
+		fmt.Println("CACHE BUDGET", t.Settings.QueryCacheBytes)
+	} else {
+		fmt.Println("CACHE BUDGET", "none")
+	}
+}
@@ -0,0 +1,50 @@
+package sybil_cmd
+
+import "flag"
+import "fmt"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func RunCompactCmdLine() {
+	LIST := flag.Bool("list", false, "only list the groups of blocks that would be merged")
+	MAX_BLOCKS := flag.Int("max-blocks", sybil.COMPACT_MAX_BLOCKS, "most blocks to merge at once")
+	OVERLAPPING := flag.Bool("overlapping", true, "also merge blocks whose time ranges overlap (needs -time-col)")
+
+	flag.StringVar(&sybil.FLAGS.TIME_COL, "time-col", "", "which column to treat as a timestamp")
+	flag.Parse()
+
+	if sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	if sybil.FLAGS.PROFILE {
+		profile := sybil.RUN_PROFILER()
+		defer profile.Start().Stop()
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	compactSpec := sybil.CompactSpec{}
+	compactSpec.MaxBlocks = *MAX_BLOCKS
+	compactSpec.Overlapping = *OVERLAPPING
+
+	if *LIST {
+		for _, group := range t.FindCompactionGroups(&compactSpec) {
+			for _, name := range group {
+				fmt.Println(name)
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	removed := t.CompactTable(&compactSpec)
+	sybil.Debug("MERGED", removed, "BLOCKS")
+}
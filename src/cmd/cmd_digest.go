@@ -1,10 +1,17 @@
 package sybil_cmd
 
 import "flag"
+import "strings"
 
 import sybil "github.com/logv/sybil/src/lib"
 
 func RunDigestCmdLine() {
+	var f_SORT_KEY = flag.String("sort-key", "", "Columns to order digested records by (instead of time), saved in the table's settings")
+	var f_PARTITION = flag.String("partition", "", "Put new blocks into time partitions (day or hour) of -partition-col, saved in the table's settings")
+	var f_PARTITION_COL = flag.String("partition-col", "time", "Int column holding the timestamps to partition by")
+	var f_LOCK_BACKEND = flag.String("lock-backend", "", "How the table's locks are held: pid (PID files) or flock, saved in the table's settings")
+	var f_SNAPSHOTS = flag.String("snapshots", "", "Keep a versioned manifest of the table's blocks, so queries read a consistent snapshot: on or off")
+	var f_CODEC = flag.String("codec", "", "Compression codec for new column files ("+strings.Join(sybil.CodecNames(), ", ")+"), saved in the table's settings")
 	flag.Parse()
 
 	if sybil.FLAGS.TABLE == "" {
@@ -24,5 +31,49 @@ func RunDigestCmdLine() {
 		sybil.Warn("Couldn't read table info, exiting early")
 		return
 	}
+
+	if *f_SORT_KEY != "" {
+		t.SetSortKey(strings.Split(*f_SORT_KEY, sybil.FLAGS.FIELD_SEPARATOR))
+		t.SaveTableInfo("info")
+	}
+
+	if *f_PARTITION != "" {
+		err := t.SetPartitioning(*f_PARTITION, *f_PARTITION_COL)
+		if err != nil {
+			sybil.Error(err)
+		}
+		t.SaveTableInfo("info")
+	}
+
+	if *f_LOCK_BACKEND != "" {
+		err := t.SetLockBackend(*f_LOCK_BACKEND)
+		if err != nil {
+			sybil.Error(err)
+		}
+		t.SaveTableInfo("info")
+	}
+
+	switch *f_SNAPSHOTS {
+	case "":
+	case "on":
+		if t.EnableManifest() == false {
+			sybil.Error("Couldn't start the manifest of", t.Name)
+		}
+	case "off":
+		if t.DisableManifest() == false {
+			sybil.Error("Couldn't remove the manifest of", t.Name)
+		}
+	default:
+		sybil.Error("-snapshots is on or off")
+	}
+
+	if *f_CODEC != "" {
+		err := t.SetCodec(*f_CODEC)
+		if err != nil {
+			sybil.Error(err)
+		}
+		t.SaveTableInfo("info")
+	}
+
 	t.DigestRecords()
 }
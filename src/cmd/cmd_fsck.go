@@ -0,0 +1,58 @@
+package sybil_cmd
+
+import "flag"
+import "fmt"
+import "os"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func RunFsckCmdLine() {
+	FIX := flag.Bool("fix", false, "finish or undo an unfinished digest, restore left over stomache dirs, remove orphaned locks and stale caches and start the record ledger")
+	QUARANTINE := flag.Bool("quarantine", false, "move blocks that don't read into the table's quarantine dir")
+	flag.Parse()
+
+	if sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	report, err := t.Fsck(&sybil.FsckSpec{Fix: *FIX, Quarantine: *QUARANTINE})
+	if err != nil {
+		sybil.Error(err)
+	}
+
+	if report.Digest != "" {
+		fmt.Println("UNFINISHED DIGEST", report.Digest)
+	}
+
+	fmt.Println("RECORDS IN BLOCKS", report.BlockRecords)
+	fmt.Println("BROKEN BLOCKS", len(report.BrokenBlocks))
+	if report.HasLedger {
+		fmt.Println("RECORDS IN LEDGER", report.LedgerRecords)
+	} else {
+		fmt.Println("RECORDS IN LEDGER", "none, run with -fix to start one")
+	}
+
+	for _, line := range report.Fixed {
+		fmt.Println("FIXED:", line)
+	}
+
+	for _, line := range report.Problems {
+		fmt.Println("PROBLEM:", line)
+	}
+
+	if len(report.Problems) > 0 {
+		fmt.Println("FOUND", len(report.Problems), "PROBLEMS")
+		os.Exit(1)
+	}
+
+	fmt.Println("OK")
+}
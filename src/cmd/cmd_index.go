@@ -6,22 +6,49 @@ import "strings"
 
 func RunIndexCmdLine() {
 	var f_INTS = flag.String("int", "", "Integer values to index")
+	var f_STRS = flag.String("str", "", "String columns to index")
+	var f_SETS = flag.String("set", "", "Set columns to index")
 	flag.Parse()
 	if sybil.FLAGS.TABLE == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	var ints []string
+	var ints, strs, sets []string
 	if *f_INTS != "" {
 		ints = strings.Split(*f_INTS, sybil.FLAGS.FIELD_SEPARATOR)
 	}
+	if *f_STRS != "" {
+		strs = strings.Split(*f_STRS, sybil.FLAGS.FIELD_SEPARATOR)
+	}
+	if *f_SETS != "" {
+		sets = strings.Split(*f_SETS, sybil.FLAGS.FIELD_SEPARATOR)
+	}
 
 	sybil.FLAGS.UPDATE_TABLE_INFO = true
 
 	t := sybil.GetTable(sybil.FLAGS.TABLE)
 
 	t.LoadRecords(nil)
+
+	for _, v := range strs {
+		if t.GetColumnType(v) != sybil.STR_VAL {
+			sybil.Error("CANT INDEX", v, "IT IS NOT A STRING COLUMN")
+		}
+	}
+	for _, v := range sets {
+		if t.GetColumnType(v) != sybil.SET_VAL {
+			sybil.Error("CANT INDEX", v, "IT IS NOT A SET COLUMN")
+		}
+	}
+
+	// without any columns, the existing index gets rebuilt. Int columns
+	// aren't kept in the index, their block infos already prune blocks
+	index_cols := append(append([]string{}, strs...), sets...)
+	if len(index_cols) > 0 {
+		t.SetIndexColumns(index_cols)
+	}
+
 	t.SaveTableInfo("info")
 	sybil.DELETE_BLOCKS_AFTER_QUERY = true
 	sybil.OPTS.WRITE_BLOCK_INFO = true
@@ -32,4 +59,13 @@ func RunIndexCmdLine() {
 	}
 	t.LoadRecords(&loadSpec)
 	t.SaveTableInfo("info")
+
+	if len(t.Settings.IndexCols) > 0 {
+		err := t.BuildIndex()
+		if err != nil {
+			sybil.Error("COULDNT BUILD INDEX FOR", t.Name, err)
+		}
+
+		sybil.Debug("INDEXED", t.Name, "ON", t.Settings.IndexCols)
+	}
 }
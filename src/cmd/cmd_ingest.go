@@ -25,26 +25,30 @@ var TABLE_INFO_GRABS = 10
 
 func ingest_dictionary(r *sybil.Record, recordmap *Dictionary, prefix string, timestampFormat string) {
 	for k, v := range *recordmap {
-		key_name := fmt.Sprint(prefix, k)
-		_, ok := EXCLUDES[key_name]
-		if ok {
+		input_name := fmt.Sprint(prefix, k)
+		key_name := mapped_column_name(input_name)
+		if excluded_column(input_name, key_name) {
 			continue
 		}
 
 		prefix_name := fmt.Sprint(key_name, "_")
 		switch iv := v.(type) {
 		case string:
+			if HASHES[key_name] {
+				r.AddStrField(key_name, hash_value(iv))
+				continue
+			}
 			if TIMESTAMPS[key_name] {
-				t, err := time.Parse(timestampFormat, iv)
+				val, err := parse_timestamp(key_name, iv, timestampFormat)
 				if err != nil {
-					sybil.Debug(fmt.Sprintf("PROBLEM PARSING '%v' as '%v'", iv, timestampFormat), key_name)
+					sybil.Debug(fmt.Sprintf("PROBLEM PARSING '%v' as timestamp", iv), key_name, err)
 					continue
 				}
-				r.AddIntField(key_name, t.Local().Unix())
+				r.AddIntField(key_name, val)
 				continue
 			}
 			if INT_CAST[key_name] {
-				val, err := strconv.ParseInt(iv, 10, 64)
+				val, err := parse_int(iv)
 				if err != nil {
 					sybil.Debug(fmt.Sprintf("PROBLEM PARSING '%v' as int", iv), key_name)
 					continue
@@ -55,8 +59,16 @@ func ingest_dictionary(r *sybil.Record, recordmap *Dictionary, prefix string, ti
 
 			}
 		case int64:
+			if HASHES[key_name] {
+				r.AddStrField(key_name, hash_value(strconv.FormatInt(iv, 10)))
+				continue
+			}
 			r.AddIntField(key_name, int64(iv))
 		case float64:
+			if HASHES[key_name] {
+				r.AddStrField(key_name, hash_value(strconv.FormatFloat(iv, 'f', -1, 64)))
+				continue
+			}
 			r.AddIntField(key_name, int64(iv))
 		case bool:
 			if iv {
@@ -92,7 +104,47 @@ func ingest_dictionary(r *sybil.Record, recordmap *Dictionary, prefix string, ti
 
 var IMPORTED_COUNT = 0
 
-func import_csv_records() {
+func ingest_csv_field(r *sybil.Record, field_name string, v string, timestampFormat string) {
+	input_name := field_name
+	field_name = mapped_column_name(input_name)
+	if excluded_column(input_name, field_name) {
+		return
+	}
+
+	if HASHES[field_name] {
+		r.AddStrField(field_name, hash_value(v))
+		return
+	}
+
+	if TIMESTAMPS[field_name] {
+		val, err := parse_timestamp(field_name, v, timestampFormat)
+		if err != nil {
+			sybil.Debug(fmt.Sprintf("PROBLEM PARSING '%v' as timestamp", v), field_name, err)
+			return
+		}
+		r.AddIntField(field_name, val)
+		return
+	}
+
+	if INT_CAST[field_name] {
+		val, err := parse_int(v)
+		if err != nil {
+			sybil.Debug(fmt.Sprintf("PROBLEM PARSING '%v' as int", v), field_name)
+			return
+		}
+		r.AddIntField(field_name, val)
+		return
+	}
+
+	val, err := strconv.ParseFloat(v, 64)
+	if err == nil {
+		r.AddIntField(field_name, int64(val))
+	} else {
+		r.AddStrField(field_name, v)
+	}
+}
+
+func import_csv_records(timestampFormat string) {
 	// For importing CSV records, we need to validate the headers, then we just
 	// read in and fill out record fields!
 	scanner := csv.NewReader(os.Stdin)
@@ -128,13 +180,7 @@ func import_csv_records() {
 				continue
 			}
 
-			val, err := strconv.ParseFloat(v, 64)
-			if err == nil {
-				r.AddIntField(field_name, int64(val))
-			} else {
-				r.AddStrField(field_name, v)
-			}
-
+			ingest_csv_field(r, field_name, v, timestampFormat)
 		}
 
 		t.ChunkAndSave()
@@ -230,7 +276,7 @@ func RunIngestCmdLine() {
 	ingestfile := flag.String("file", sybil.INGEST_DIR, "name of dir to ingest into")
 	f_INTS := flag.String("ints", "", "columns to treat as ints (comma delimited)")
 	f_CSV := flag.Bool("csv", false, "expect incoming data in CSV format")
-	f_EXCLUDES := flag.String("exclude", "", "Columns to exclude (comma delimited)")
+	f_EXCLUDES := flag.String("exclude", "", "Input columns to exclude (comma delimited), matched by their name before -mapping renames them")
 	f_JSON_PATH := flag.String("path", "$", "Path to JSON record, ex: $.foo.bar")
 	flag.BoolVar(&sybil.FLAGS.SKIP_COMPACT, "skip-compact", false, "skip auto compaction during ingest")
 
@@ -238,6 +284,9 @@ func RunIngestCmdLine() {
 	f_REOPEN := flag.String("infile", "", "input file to use (instead of stdin)")
 	f_TIMESTAMPS := flag.String("timestamps", "", "columns to treat as ints (comma delimited), parsed via timestamp-format")
 	f_TIMESTAMP_FORMAT := flag.String("timestamp-format", time.RFC3339, "when -timestamps is provided, this is the parsing string used")
+	f_MAPPING := flag.String("mapping", "", "JSON file with column renames, int casts, timestamp formats, drops and hashes")
+	f_DEDUP_KEY := flag.String("dedup-key", "", "columns that identify a record, records with an already seen key are dropped (saved with the table)")
+	f_DEDUP_WINDOW := flag.Int("dedup-window", 0, "how long (in seconds) to remember dedup keys, defaults to a day (saved with the table)")
 
 	flag.Parse()
 
@@ -276,9 +325,16 @@ func RunIngestCmdLine() {
 		EXCLUDES[v] = true
 	}
 
+	if *f_MAPPING != "" {
+		loadIngestMapping(*f_MAPPING)
+	}
+
 	for k, _ := range EXCLUDES {
 		sybil.Debug("EXCLUDING COLUMN", k)
 	}
+	for k, _ := range DROPS {
+		sybil.Debug("DROPPING COLUMN", k)
+	}
 
 	t := sybil.GetTable(sybil.FLAGS.TABLE)
 
@@ -301,10 +357,20 @@ func RunIngestCmdLine() {
 		}
 	}
 
+	if *f_DEDUP_KEY != "" {
+		window := int64(*f_DEDUP_WINDOW)
+		if window == 0 {
+			window = t.Settings.DedupWindow
+		}
+		t.SetDedupKey(strings.Split(*f_DEDUP_KEY, sybil.FLAGS.FIELD_SEPARATOR), window)
+	} else if *f_DEDUP_WINDOW > 0 {
+		t.Settings.DedupWindow = int64(*f_DEDUP_WINDOW)
+	}
+
 	if *f_CSV == false {
 		import_json_records(*f_TIMESTAMP_FORMAT)
 	} else {
-		import_csv_records()
+		import_csv_records(*f_TIMESTAMP_FORMAT)
 	}
 
 	t.IngestRecords(digestfile)
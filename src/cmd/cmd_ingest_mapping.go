@@ -0,0 +1,134 @@
+package sybil_cmd
+
+import sybil "github.com/logv/sybil/src/lib"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// An IngestMapping is read from the file passed to `sybil ingest -mapping`.
+// It lets producers that disagree on column names and types write into the
+// same table. Renames are applied first, every other rule refers to the
+// renamed (destination) column name. The -exclude flag isn't affected by the
+// renames, it still matches the input column names.
+//
+//	{
+//	  "rename": { "userId": "user_id", "uid": "user_id" },
+//	  "ints": [ "user_id" ],
+//	  "timestamps": { "created_at": "2006-01-02 15:04:05" },
+//	  "drop": [ "password" ],
+//	  "hash": [ "email" ],
+//	  "hash_salt": "some secret"
+//	}
+type IngestMapping struct {
+	Rename     map[string]string `json:"rename"`
+	Ints       []string          `json:"ints"`
+	Timestamps map[string]string `json:"timestamps"`
+	Drop       []string          `json:"drop"`
+	Hash       []string          `json:"hash"`
+	HashSalt   string            `json:"hash_salt"`
+}
+
+var RENAMES = make(map[string]string)
+var DROPS = make(map[string]bool)
+var HASHES = make(map[string]bool)
+var HASH_SALT = ""
+
+// per column timestamp formats, columns without an entry use the
+// -timestamp-format flag
+var TIMESTAMP_FORMATS = make(map[string]string)
+
+func loadIngestMapping(filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		sybil.Error("COULDNT READ INGEST MAPPING", filename, err)
+	}
+
+	mapping := IngestMapping{}
+	err = json.Unmarshal(data, &mapping)
+	if err != nil {
+		sybil.Error("COULDNT PARSE INGEST MAPPING", filename, err)
+	}
+
+	for from, to := range mapping.Rename {
+		sybil.Debug("RENAMING COLUMN", from, "TO", to)
+		RENAMES[from] = to
+	}
+
+	for _, v := range mapping.Ints {
+		INT_CAST[v] = true
+	}
+
+	for col, format := range mapping.Timestamps {
+		TIMESTAMPS[col] = true
+		if format != "" {
+			TIMESTAMP_FORMATS[col] = format
+		}
+	}
+
+	for _, v := range mapping.Drop {
+		DROPS[v] = true
+	}
+
+	for _, v := range mapping.Hash {
+		HASHES[v] = true
+	}
+
+	HASH_SALT = mapping.HashSalt
+}
+
+func mapped_column_name(key_name string) string {
+	renamed, ok := RENAMES[key_name]
+	if ok {
+		return renamed
+	}
+
+	return key_name
+}
+
+// excluded_column is true for input columns passed to -exclude and for
+// renamed columns the mapping drops
+func excluded_column(input_name string, key_name string) bool {
+	return EXCLUDES[input_name] || DROPS[key_name]
+}
+
+func hash_value(val string) string {
+	h := sha256.New()
+	h.Write([]byte(HASH_SALT))
+	h.Write([]byte(val))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func parse_timestamp(key_name string, val string, timestampFormat string) (int64, error) {
+	format, ok := TIMESTAMP_FORMATS[key_name]
+	if !ok {
+		format = timestampFormat
+	}
+
+	t, err := time.Parse(format, val)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Local().Unix(), nil
+}
+
+// casts a string encoded number into an int, accepting both "12" and "12.0"
+func parse_int(val string) (int64, error) {
+	ival, err := strconv.ParseInt(val, 10, 64)
+	if err == nil {
+		return ival, nil
+	}
+
+	fval, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(fval), nil
+}
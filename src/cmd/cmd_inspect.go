@@ -2,128 +2,209 @@ package sybil_cmd
 
 import sybil "github.com/logv/sybil/src/lib"
 
+import "encoding/json"
 import "flag"
-
-import "strconv"
-
-func decodeTableInfo(digest_file *string) bool {
-	dec := sybil.GetFileDecoder(*digest_file)
-
-	saved_table := sybil.Table{}
-	err := dec.Decode(&saved_table)
-
-	if err != nil || len(saved_table.KeyTable) == 0 {
-		return false
+import "fmt"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "text/tabwriter"
+
+func printJson(data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		sybil.Error("JSON encoding error", err)
 	}
 
-	sybil.Print("TABLE INFO", saved_table)
-
-	return true
-
+	os.Stdout.Write(b)
+	fmt.Println()
 }
 
-func decodeInfoCol(digest_file *string) bool {
-	dec := sybil.GetFileDecoder(*digest_file)
-
-	info := sybil.SavedColumnInfo{}
-	err := dec.Decode(&info)
-
-	if err != nil {
-		return false
+func sortedKeys(m map[string]int) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
 	}
+	sort.Strings(ret)
 
-	sybil.Print("BLOCK INFO", info)
-
-	return true
-
+	return ret
 }
 
-func decodeIntCol(digest_file *string) bool {
-	dec := sybil.GetFileDecoder(*digest_file)
-
-	info := sybil.SavedIntColumn{}
-	err := dec.Decode(&info)
-
-	if err != nil {
-		sybil.Print("ERROR", err)
-		return false
+func columnEncoding(col *sybil.ColumnSummary) string {
+	parts := []string{"values"}
+	if col.BucketEncoded {
+		parts[0] = "buckets"
+	}
+	if col.DeltaEncodedIDs {
+		parts = append(parts, "delta ids")
+	}
+	if col.ValueEncoded {
+		parts = append(parts, "delta values")
 	}
 
-	sybil.Print("INT COL", info)
-
-	return true
-
+	return strings.Join(parts, ", ")
 }
 
-func decodeStrCol(digest_file *string) bool {
-	dec := sybil.GetFileDecoder(*digest_file)
-
-	info := sybil.SavedStrColumn{}
-	err := dec.Decode(&info)
+func printColumnSummary(col *sybil.ColumnSummary) {
+	fmt.Println("COLUMN", col.Name, "("+col.Type+")")
+	fmt.Println("ENCODING", columnEncoding(col))
+	if col.BucketEncoded {
+		fmt.Println("BUCKETS", col.Buckets)
+	}
+	fmt.Println("RECORDS", col.Records)
+	if col.Range != nil {
+		fmt.Println("RANGE", col.Range.Min, "TO", col.Range.Max)
+	}
+	if col.Type != "int" {
+		fmt.Println("STRING TABLE", col.StringTable, "STRINGS")
+	}
 
-	bins := make([]string, 0)
-	for _, bin := range info.Bins {
-		bins = append(bins, strconv.FormatInt(int64(len(bin.Records)), 10))
+	fmt.Println("TOP VALUES")
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, vc := range col.TopValues {
+		fmt.Fprintf(w, "  %s\t%d\n", vc.Value, vc.Count)
 	}
+	w.Flush()
+}
 
-	if err != nil {
-		sybil.Print("ERROR", err)
-		return false
+func printFileSummary(summary *sybil.FileSummary) {
+	fmt.Println("FILE", summary.File)
+	fmt.Println("TYPE", summary.Type+",", summary.Size, "BYTES")
+	if summary.Error != "" {
+		fmt.Println("ERROR", summary.Error)
+		return
 	}
 
-	sybil.Print("STR COL", info)
-	sybil.Print("BINS ARE", bins)
+	switch {
+	case summary.Table != nil:
+		fmt.Println("TABLE", summary.Table.Name)
+		names := make([]string, 0, len(summary.Table.Columns))
+		for name := range summary.Table.Columns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println("  ", summary.Table.Columns[name], name)
+		}
+		fmt.Printf("SETTINGS %+v\n", summary.Table.Settings)
 
-	return true
+	case summary.Info != nil:
+		fmt.Println("RECORDS", summary.Info.Records)
+		if summary.Info.Codec != "" {
+			fmt.Println("CODEC", summary.Info.Codec)
+		}
+		ints := make([]string, 0, len(summary.Info.Ints))
+		for name := range summary.Info.Ints {
+			ints = append(ints, name)
+		}
+		sort.Strings(ints)
+		for _, name := range ints {
+			r := summary.Info.Ints[name]
+			fmt.Println("   int", name, r.Min, "TO", r.Max)
+		}
+		for _, name := range sortedKeys(summary.Info.Strs) {
+			fmt.Println("   str", name, summary.Info.Strs[name], "VALUES")
+		}
 
-}
-func decodeIngestFile(digest_file *string) bool {
-	dec := sybil.GetFileDecoder(*digest_file)
+	case summary.Column != nil:
+		printColumnSummary(summary.Column)
 
-	var srb sybil.SavedRecordBlock
-	err := dec.Decode(&srb)
+	case summary.Cache != nil:
+		if summary.Type != sybil.QUERY_CACHE_FILE {
+			fmt.Println("BLOCKS", summary.Cache.Blocks)
+		}
+		if summary.Type == sybil.BLOCK_CACHE_FILE {
+			fmt.Println("RECORDS", summary.Cache.Records)
+			break
+		}
+		fmt.Println("RESULTS", summary.Cache.Results)
+		fmt.Println("MATCHED", summary.Cache.Matched)
+		fmt.Println("SAMPLES", summary.Cache.Samples)
 
-	if err != nil {
-		dec := sybil.GetFileDecoder(*digest_file)
-		err := dec.Decode(&srb.RecordList)
-		if err != nil {
-			return false
+	default:
+		if summary.Type == sybil.INGEST_FILE {
+			fmt.Println("RECORDS", summary.Records)
+		}
+		for _, name := range sortedKeys(summary.Columns) {
+			fmt.Println("  ", name, summary.Columns[name], "VALUES")
 		}
 	}
+}
 
-	sybil.Print("INGEST FILE, NUM RECORDS", len(srb.RecordList), "KEY TABLE", srb.KeyTable)
-
-	return true
+func printDirSummary(summary *sybil.DirSummary) {
+	fmt.Println("DIR", summary.Dir)
+	fmt.Println("RECORDS", summary.Records)
+	fmt.Println("SIZE", summary.Size, "BYTES")
+	fmt.Println("CACHED QUERIES", summary.QueryCache)
+	fmt.Println("")
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTYPE\tSIZE\tCOLUMN\tENCODING\tBUCKETS\tRECORDS\tRANGE / STRINGS\tTOP VALUE")
+	for _, f := range summary.Files {
+		fmt.Fprintf(w, "%s\t%s\t%d", path.Base(f.File), f.Type, f.Size)
+		// every row has all the cells, so the columns line up
+		col := f.Column
+		switch {
+		case f.Error != "":
+			fmt.Fprintf(w, "\tERROR %s\t\t\t\t\t\n", f.Error)
+			continue
+		case col == nil:
+			fmt.Fprintln(w, "\t\t\t\t\t\t")
+			continue
+		}
 
+		fmt.Fprintf(w, "\t%s\t%s\t%d\t%d", col.Name, columnEncoding(col), col.Buckets, col.Records)
+		if col.Range != nil {
+			fmt.Fprintf(w, "\t%d to %d", col.Range.Min, col.Range.Max)
+		} else {
+			fmt.Fprintf(w, "\t%d strings", col.StringTable)
+		}
+		if len(col.TopValues) > 0 {
+			fmt.Fprintf(w, "\t%s (%d)\n", col.TopValues[0].Value, col.TopValues[0].Count)
+		} else {
+			fmt.Fprintln(w, "\t")
+		}
+	}
+	w.Flush()
 }
 
-// TODO: make a list of potential types that can be decoded into
 func RunInspectCmdLine() {
-	digest_file := flag.String("file", "", "Name of file to inspect")
+	digest_file := flag.String("file", "", "Name of file or block dir to inspect")
+	flag.BoolVar(&sybil.FLAGS.JSON, "json", false, "Print the summary in JSON format")
+	flag.IntVar(&sybil.INSPECT_TOP_VALUES, "top", sybil.INSPECT_TOP_VALUES, "How many of the most common values of a column to list")
 	flag.Parse()
 
 	if *digest_file == "" || digest_file == nil {
-		sybil.Print("Please specify a file to inspect with the -file flag")
+		sybil.Print("Please specify a file or block dir to inspect with the -file flag")
 		return
 	}
 
-	if decodeTableInfo(digest_file) {
-		return
+	stat, err := os.Stat(*digest_file)
+	if err != nil {
+		sybil.Error(err)
 	}
 
-	if decodeInfoCol(digest_file) {
-		return
-	}
+	if stat.IsDir() {
+		summary, err := sybil.InspectDir(*digest_file)
+		if err != nil {
+			sybil.Error(err)
+		}
 
-	if decodeIngestFile(digest_file) {
+		if sybil.FLAGS.JSON {
+			printJson(summary)
+		} else {
+			printDirSummary(summary)
+		}
 		return
 	}
 
-	if decodeStrCol(digest_file) {
-		return
+	summary := sybil.InspectFile(*digest_file)
+	if sybil.FLAGS.JSON {
+		printJson(summary)
+	} else {
+		printFileSummary(summary)
 	}
-	if decodeIntCol(digest_file) {
-		return
-	}
-
 }
@@ -1,6 +1,7 @@
 package sybil_cmd
 
 import (
+	"context"
 	"flag"
 	"path"
 	"runtime/debug"
@@ -21,6 +22,7 @@ func addPrintFlags() {
 	flag.BoolVar(&sybil.FLAGS.LIST_TABLES, "tables", false, "List tables")
 	flag.BoolVar(&sybil.FLAGS.PRINT_INFO, "info", false, "Print table info")
 	flag.IntVar(&sybil.FLAGS.LIMIT, "limit", 100, "Number of results to return")
+	flag.DurationVar(&sybil.FLAGS.TIMEOUT, "timeout", 0, "Stop the query after this long (e.g. 30s) and print the partial results, with a warning on stderr")
 	flag.BoolVar(&sybil.FLAGS.PRINT, "print", true, "Print some records")
 	flag.BoolVar(&sybil.FLAGS.SAMPLES, "samples", false, "Grab samples")
 	flag.BoolVar(&sybil.FLAGS.JSON, "json", false, "Print results in JSON format")
@@ -70,6 +72,11 @@ func addQueryFlags() {
 	flag.BoolVar(&sybil.FLAGS.SHORTEN_KEY_TABLE, "shorten-key-table", true, "faster queries on wide tabes by shortening the key lookup")
 
 	flag.BoolVar(&sybil.FLAGS.CACHED_QUERIES, "cache-queries", false, "Cache query results per block")
+	flag.BoolVar(&sybil.FLAGS.CACHED_RESULTS, "cache-results", false, "Cache whole query results per table, so repeated queries only read new blocks")
+	flag.IntVar(&sybil.FLAGS.MEM_BUDGET, "mem-budget", 0, "Max MB of records to load at once, blocks wait their turn when it is used up and blocks bigger than it are skipped (0 is unlimited)")
+	flag.IntVar(&sybil.FLAGS.WORKERS, "workers", 0, "Number of blocks to load and query at the same time (0 is one per CPU)")
+	flag.BoolVar(&sybil.FLAGS.STATS, "stats", false, "Print stats about the blocks, records and time the query used (with -json, results are wrapped in {Results, Stats})")
+	flag.BoolVar(&sybil.FLAGS.EXPLAIN, "explain", false, "Print which blocks the query would read, prune or take from the cache, without running it")
 
 }
 
@@ -327,6 +334,23 @@ func runQueryCmdLine() {
 		querySpec.Limit = querySpec.NumDistinct
 	}
 
+	if sybil.FLAGS.EXPLAIN {
+		if sybil.FLAGS.SAMPLES && !has_sample_cols {
+			loadSpec = t.NewLoadSpec()
+			loadSpec.LoadAllColumns = true
+		}
+
+		t.ExplainQuery(&loadSpec, &querySpec).Print()
+		return
+	}
+
+	ctx := context.Background()
+	if sybil.FLAGS.TIMEOUT > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sybil.FLAGS.TIMEOUT)
+		defer cancel()
+	}
+
 	if sybil.FLAGS.SAMPLES {
 		sybil.HOLD_MATCHES = true
 		sybil.DELETE_BLOCKS_AFTER_QUERY = false
@@ -336,7 +360,8 @@ func runQueryCmdLine() {
 			loadSpec.LoadAllColumns = true
 		}
 
-		t.LoadAndQueryRecords(&loadSpec, &querySpec)
+		t.LoadAndQueryRecordsContext(ctx, &loadSpec, &querySpec)
+		warnIncomplete(&querySpec)
 
 		t.PrintSamples(&querySpec)
 
@@ -359,10 +384,11 @@ func runQueryCmdLine() {
 		start := time.Now()
 		// We can load and query at the same time
 		if sybil.FLAGS.LOAD_AND_QUERY {
-			count = t.LoadAndQueryRecords(&loadSpec, &querySpec)
+			count = t.LoadAndQueryRecordsContext(ctx, &loadSpec, &querySpec)
 
 			end := time.Now()
 			sybil.Debug("LOAD AND QUERY RECORDS TOOK", end.Sub(start))
+			warnIncomplete(&querySpec)
 			querySpec.PrintResults()
 		}
 
@@ -381,6 +407,18 @@ func runQueryCmdLine() {
 
 }
 
+func warnIncomplete(querySpec *sybil.QuerySpec) {
+	if !querySpec.Incomplete {
+		return
+	}
+
+	if over_budget := querySpec.Stats.BlocksOverBudget; over_budget > 0 {
+		sybil.Warn(over_budget, "BLOCKS DONT FIT INTO THE MEMORY BUDGET OF", sybil.FLAGS.MEM_BUDGET, "MB, RESULTS ARE INCOMPLETE")
+	} else {
+		sybil.Warn("QUERY TIMED OUT AFTER", sybil.FLAGS.TIMEOUT, "RESULTS ARE INCOMPLETE")
+	}
+}
+
 func split(s, sep string) []string {
 	if s == "" {
 		return nil
@@ -0,0 +1,98 @@
+package sybil_cmd
+
+import "flag"
+import "fmt"
+import "os"
+import "strconv"
+import "text/tabwriter"
+
+import sybil "github.com/logv/sybil/src/lib"
+
+func percent(part, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+
+	return strconv.FormatFloat(float64(part)*100/float64(total), 'f', 1, 64) + "%"
+}
+
+// encodedIn says in how many of the column's blocks it uses an encoding
+func encodedIn(count int, blocks int) string {
+	if count == blocks {
+		return "yes"
+	}
+	if count == 0 {
+		return "no"
+	}
+
+	return fmt.Sprintf("%d/%d", count, blocks)
+}
+
+func printColumnStats(stats *sybil.TableStats) {
+	fmt.Println("BLOCKS", stats.Blocks)
+	fmt.Println("RECORDS", stats.Count)
+	fmt.Println("SIZE", stats.Size, "BYTES")
+	fmt.Println("")
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "COLUMN\tTYPE\tBYTES\tDISK\tBLOCKS\tBUCKETS\tDELTA IDS\tDELTA VALUES\tCARDINALITY\tNULLS\tSTRINGS")
+	for _, cs := range stats.ColumnStats {
+		cardinality := strconv.Itoa(cs.Cardinality)
+		if cs.CardinalityCapped {
+			cardinality = ">" + cardinality
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\t%.1f%%\t%d\n", cs.Name, cs.Type, cs.Bytes,
+			percent(cs.Bytes, stats.Size), cs.Blocks, encodedIn(cs.BucketEncoded, cs.Blocks),
+			encodedIn(cs.DeltaEncodedIDs, cs.Blocks), encodedIn(cs.ValueEncoded, cs.Blocks),
+			cardinality, cs.NullRatio*100, cs.StringTable)
+	}
+	w.Flush()
+}
+
+func printBlockColumnStats(stats *sybil.TableStats) {
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCK\tCOLUMN\tBYTES\tBUCKETS\tDELTA IDS\tDELTA VALUES\tRECORDS\tCARDINALITY\tNULLS\tSTRINGS")
+	for _, cs := range stats.ColumnStats {
+		for _, bs := range cs.PerBlock {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%t\t%t\t%d\t%d\t%.1f%%\t%d\n", bs.Block, cs.Name, bs.Bytes,
+				bs.BucketEncoded, bs.DeltaEncodedIDs, bs.ValueEncoded, bs.Records, bs.Cardinality,
+				bs.NullRatio*100, bs.StringTable)
+		}
+	}
+	w.Flush()
+}
+
+func RunStatsCmdLine() {
+	BLOCKS := flag.Bool("blocks", false, "list the stats of every column in every block, too")
+	flag.BoolVar(&sybil.FLAGS.JSON, "json", false, "Print the stats in JSON format")
+	flag.IntVar(&sybil.STATS_MAX_CARDINALITY, "max-cardinality", sybil.STATS_MAX_CARDINALITY, "stop counting the distinct values of a column after this many")
+	flag.Parse()
+
+	if sybil.FLAGS.TABLE == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	sybil.DELETE_BLOCKS_AFTER_QUERY = false
+
+	t := sybil.GetTable(sybil.FLAGS.TABLE)
+	if t.LoadTableInfo() == false {
+		sybil.Warn("Couldn't read table info, exiting early")
+		return
+	}
+
+	stats := t.TableStats(*BLOCKS)
+	if sybil.FLAGS.JSON {
+		printJson(stats)
+		return
+	}
+
+	printColumnStats(stats)
+	if *BLOCKS {
+		fmt.Println("")
+		printBlockColumnStats(stats)
+	}
+}
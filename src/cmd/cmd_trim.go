@@ -3,7 +3,6 @@ package sybil_cmd
 import "flag"
 
 import "fmt"
-import "os"
 
 import sybil "github.com/logv/sybil/src/lib"
 
@@ -63,6 +62,12 @@ func RunTrimCmdLine() {
 	trimSpec.MBLimit = int64(*MB_LIMIT)
 
 	to_trim := t.TrimTable(&trimSpec)
+	to_drop := t.TrimPartitions(&trimSpec)
+
+	sybil.Debug("FOUND", len(to_drop), "CANDIDATE PARTITIONS FOR TRIMMING")
+	for _, p := range to_drop {
+		fmt.Println(p)
+	}
 
 	sybil.Debug("FOUND", len(to_trim), "CANDIDATE BLOCKS FOR TRIMMING")
 	if len(to_trim) > 0 {
@@ -82,15 +87,29 @@ func RunTrimCmdLine() {
 
 		}
 
+		sybil.Debug("DELETING CANDIDATE PARTITIONS")
+		partitions := make([]string, 0)
+		for _, p := range to_drop {
+			sybil.Debug("DELETING", p)
+			if len(p) > 5 {
+				partitions = append(partitions, p)
+			} else {
+				sybil.Debug("REFUSING TO DELETE", p)
+			}
+		}
+		t.DropPartitions(partitions)
+
 		sybil.Debug("DELETING CANDIDATE BLOCKS")
+		blocks := make([]string, 0)
 		for _, b := range to_trim {
 			sybil.Debug("DELETING", b.Name)
 			if len(b.Name) > 5 {
-				os.RemoveAll(b.Name)
+				blocks = append(blocks, b.Name)
 			} else {
 				sybil.Debug("REFUSING TO DELETE", b.Name)
 			}
 		}
+		t.DropBlocks(blocks)
 
 	}
 }
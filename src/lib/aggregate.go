@@ -2,6 +2,7 @@ package sybil
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
@@ -345,6 +346,13 @@ func CombineMatches(block_specs map[string]*QuerySpec) RecordList {
 }
 
 func CombineAndPrune(querySpec *QuerySpec, block_specs map[string]*QuerySpec) *QuerySpec {
+	// specs without a PruneBy have nothing to rank their results by:
+	// SortResults leaves Sorted empty and pruning would drop every result.
+	// The query command and the api always set one (the count by default),
+	// so this only keeps hand built specs from losing their results
+	if querySpec.PruneBy == "" {
+		return CombineResults(querySpec, block_specs)
+	}
 
 	for _, spec := range block_specs {
 		spec.SortResults(spec.PruneBy, false)
@@ -526,6 +534,12 @@ func (qs *QuerySpec) SortResults(orderBy string, orderAsc bool) {
 
 // OLD SEARCHING FUNCTIONS BELOW HERE
 func SearchBlocks(querySpec *QuerySpec, block_list map[string]*TableBlock) map[string]*QuerySpec {
+	return SearchBlocksContext(context.Background(), querySpec, block_list)
+}
+
+// SearchBlocksContext skips the blocks that haven't been searched yet once
+// ctx is done and marks the querySpec as Incomplete
+func SearchBlocksContext(ctx context.Context, querySpec *QuerySpec, block_list map[string]*TableBlock) map[string]*QuerySpec {
 	var wg sync.WaitGroup
 	// Each block gets its own querySpec (for locking and combining purposes)
 	// after all queries finish executing, the specs are combined
@@ -535,12 +549,25 @@ func SearchBlocks(querySpec *QuerySpec, block_list map[string]*TableBlock) map[s
 	// and aggregating while loading them? (and then releasing the blocks)
 	// That would mean pushing the call to 'FilterAndAggRecords' to the loading area
 	spec_lock := sync.Mutex{}
+	incomplete := false
 	for _, block := range block_list {
+		if ctx.Err() != nil {
+			incomplete = true
+			break
+		}
+
 		wg.Add(1)
 		this_block := block
 		go func() {
 			defer wg.Done()
 
+			if ctx.Err() != nil {
+				spec_lock.Lock()
+				incomplete = true
+				spec_lock.Unlock()
+				return
+			}
+
 			blockQuery := CopyQuerySpec(querySpec)
 
 			FilterAndAggRecords(blockQuery, &this_block.RecordList)
@@ -554,14 +581,23 @@ func SearchBlocks(querySpec *QuerySpec, block_list map[string]*TableBlock) map[s
 
 	wg.Wait()
 
+	if incomplete {
+		Debug("QUERY WAS CANCELLED, SEARCHED", len(block_specs), "OF", len(block_list), "BLOCKS")
+		querySpec.Incomplete = true
+	}
+
 	return block_specs
 }
 
 func (t *Table) MatchAndAggregate(querySpec *QuerySpec) {
+	t.MatchAndAggregateContext(context.Background(), querySpec)
+}
+
+func (t *Table) MatchAndAggregateContext(ctx context.Context, querySpec *QuerySpec) {
 	start := time.Now()
 
 	querySpec.Table = t
-	block_specs := SearchBlocks(querySpec, t.BlockList)
+	block_specs := SearchBlocksContext(ctx, querySpec, t.BlockList)
 	querySpec.ResetResults()
 
 	// COMBINE THE PER BLOCK RESULTS
@@ -583,7 +619,7 @@ func (t *Table) MatchAndAggregate(querySpec *QuerySpec) {
 
 	querySpec.SortResults(querySpec.OrderBy, querySpec.OrderAsc)
 
-	Debug(string(len(matched)), "RECORDS FILTERED AND AGGREGATED INTO", len(querySpec.Results), "RESULTS, TOOK", end.Sub(start))
+	Debug(len(matched), "RECORDS FILTERED AND AGGREGATED INTO", len(querySpec.Results), "RESULTS, TOOK", end.Sub(start))
 
 }
 
@@ -411,3 +411,48 @@ func TestOrderByDesc(t *testing.T) {
 	deleteTestDb(tableName)
 
 }
+
+func TestCombineAndPrune(t *testing.T) {
+	num_groups := FLAGS.LIMIT * 20
+	block_specs := make(map[string]*QuerySpec)
+	for i := 0; i < 4; i++ {
+		spec := newQuerySpec()
+		spec.Results = make(ResultMap)
+		for j := 0; j < num_groups; j++ {
+			result := spec.NewResult()
+			result.GroupByKey = strconv.Itoa(j)
+			result.Count = int64(j + 1)
+			spec.Results[result.GroupByKey] = result
+		}
+
+		block_specs[strconv.Itoa(i)] = spec
+	}
+
+	// without a PruneBy, results are only combined
+	querySpec := newQuerySpec()
+	resultSpec := CombineAndPrune(querySpec, block_specs)
+	if len(resultSpec.Results) != num_groups {
+		t.Error("COMBINING WITHOUT A PRUNE BY KEPT", len(resultSpec.Results), "OF", num_groups, "RESULTS")
+	}
+
+	// with one, only the top results are kept
+	querySpec = newQuerySpec()
+	querySpec.OrderBy = SORT_COUNT
+	querySpec.PruneBy = SORT_COUNT
+	for _, spec := range block_specs {
+		spec.OrderBy = SORT_COUNT
+		spec.PruneBy = SORT_COUNT
+	}
+
+	resultSpec = CombineAndPrune(querySpec, block_specs)
+	if len(resultSpec.Results) != FLAGS.LIMIT*10 {
+		t.Error("PRUNING KEPT", len(resultSpec.Results), "RESULTS, EXPECTED", FLAGS.LIMIT*10)
+	}
+
+	for _, result := range resultSpec.Results {
+		if result.Count <= int64(num_groups-FLAGS.LIMIT*10)*4 {
+			t.Error("PRUNING KEPT A RESULT THAT ISNT IN THE TOP", result.GroupByKey, result.Count)
+			break
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package sybil
 
 import (
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path"
 	"strconv"
 	"testing"
 )
@@ -49,3 +52,45 @@ func BenchmarkAddRecordsB(b *testing.B) {
 		r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
 	}
 }
+
+// compares how fast a block loads with each codec, the size of the block on
+// disk is logged with -v
+func BenchmarkLoadBlockCodecs(b *testing.B) {
+	for _, name := range CodecNames() {
+		b.Run(name, func(b *testing.B) {
+			tableName := getTestTableName(nil) + "_" + name
+			deleteTestDb(tableName)
+			defer deleteTestDb(tableName)
+
+			tbl := GetTable(tableName)
+			tbl.SetCodec(name)
+			records := addRecords(tableName, func(r *Record, index int) {
+				r.AddIntField("id", int64(index))
+				age := int64(rand.Intn(20)) + 10
+				r.AddIntField("age", age)
+				r.AddStrField("age_str", strconv.FormatInt(int64(age), 10))
+			}, 1)
+
+			os.MkdirAll(path.Join(FLAGS.DIR, tableName), 0777)
+			blockname, err := tbl.getNewIngestBlockName()
+			if err != nil {
+				b.Fatal(err)
+			}
+			tbl.SaveRecordsToBlock(records, blockname)
+
+			size := int64(0)
+			files, _ := ioutil.ReadDir(blockname)
+			for _, f := range files {
+				size += f.Size()
+			}
+			b.Logf("%s: %d RECORDS TAKE %d BYTES", name, len(records), size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tbl.LoadBlockFromDir(blockname, nil, true) == nil {
+					b.Fatal("COULDNT LOAD BLOCK", blockname)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package sybil
+
+import "context"
+import "os"
+import "runtime"
+import "sort"
+import "sync"
+
+// BLOCK SCHEDULING
+// Queries read their blocks newest first, so samples queries with a -limit
+// and queries on recent time ranges can stop early. A block's age comes
+// from the max of the time column in its info.db, blocks without a time
+// column are ordered by the modification time of their dir. Once the query
+// is cancelled, the scheduler stops reading infos and returns the blocks
+// unordered, the query stops before loading any of them.
+
+type scheduledBlock struct {
+	filename string
+	newest   int64
+}
+
+type scheduledBlocksByNewest []scheduledBlock
+
+func (a scheduledBlocksByNewest) Len() int      { return len(a) }
+func (a scheduledBlocksByNewest) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a scheduledBlocksByNewest) Less(i, j int) bool {
+	if a[i].newest == a[j].newest {
+		return a[i].filename > a[j].filename
+	}
+
+	return a[i].newest > a[j].newest
+}
+
+// the number of blocks a query loads at the same time
+func queryWorkers() int {
+	if FLAGS.WORKERS > 0 {
+		return FLAGS.WORKERS
+	}
+
+	return runtime.NumCPU()
+}
+
+// returns the block dirs ordered newest first
+func (t *Table) scheduleBlocks(ctx context.Context, block_dirs []string) []string {
+	blocks := make(scheduledBlocksByNewest, 0, len(block_dirs))
+	for _, filename := range block_dirs {
+		blocks = append(blocks, scheduledBlock{filename, 0})
+	}
+
+	// the block infos end up in the BlockInfoCache, so reading them here
+	// doesn't cost the query another read later
+	var wg sync.WaitGroup
+	workers := make(chan bool, queryWorkers())
+	for i := range blocks {
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		workers <- true
+		go func(b *scheduledBlock) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			info := t.LoadBlockInfo(b.filename)
+			time_info, ok := info.IntInfoMap[FLAGS.TIME_COL]
+			if ok && time_info != nil {
+				b.newest = time_info.Max
+			} else if fi, err := os.Stat(b.filename); err == nil {
+				b.newest = fi.ModTime().Unix()
+			}
+		}(&blocks[i])
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		Debug("QUERY CANCELLED, NOT SCHEDULING BLOCKS:", ctx.Err())
+		return block_dirs
+	}
+
+	sort.Sort(blocks)
+
+	ret := make([]string, len(blocks))
+	for i, b := range blocks {
+		ret[i] = b.filename
+	}
+
+	return ret
+}
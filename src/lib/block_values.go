@@ -0,0 +1,213 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "hash/fnv"
+import "io/ioutil"
+import "os"
+
+// BLOCK VALUES
+// When a block is digested, the values of its str and set columns are saved
+// in values.db next to info.db. Columns with few values keep the exact
+// values, the rest get a bloom filter. ShouldLoadBlockFromDir uses them to
+// skip blocks for str eq and set in filters whose value is not in the block.
+// Blocks written before values.db existed are always loaded.
+
+var MAX_EXACT_BLOCK_VALUES = 256
+var BLOOM_BITS_PER_VALUE = 10
+var BLOOM_HASHES = 7
+
+type SavedColumnValues struct {
+	Values []string // exact values, nil when the column uses the bloom filter
+
+	Bloom  []uint64
+	Hashes int
+}
+
+type SavedBlockValues struct {
+	Columns map[string]*SavedColumnValues
+}
+
+func bloomHashes(value string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	h1 := h.Sum64()
+
+	// the second hash for double hashing, it has to be odd so that every
+	// bit can be reached
+	h2 := (h1>>33 | h1<<31) | 1
+
+	return h1, h2
+}
+
+func newSavedColumnValues(values []string) *SavedColumnValues {
+	cv := SavedColumnValues{}
+	if len(values) <= MAX_EXACT_BLOCK_VALUES {
+		cv.Values = values
+		return &cv
+	}
+
+	words := (len(values)*BLOOM_BITS_PER_VALUE + 63) / 64
+	bits := uint64(words * 64)
+	cv.Bloom = make([]uint64, words)
+	cv.Hashes = BLOOM_HASHES
+
+	for _, v := range values {
+		h1, h2 := bloomHashes(v)
+		for i := 0; i < cv.Hashes; i++ {
+			bit := (h1 + uint64(i)*h2) % bits
+			cv.Bloom[bit/64] |= 1 << (bit % 64)
+		}
+	}
+
+	return &cv
+}
+
+// false means the value is definitely not in the column
+func (cv *SavedColumnValues) mayContain(value string) bool {
+	if cv.Bloom == nil {
+		for _, v := range cv.Values {
+			if v == value {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	bits := uint64(len(cv.Bloom) * 64)
+	h1, h2 := bloomHashes(value)
+	for i := 0; i < cv.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bits
+		if cv.Bloom[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// returns the values of each str and set column in the block
+func (tb *TableBlock) columnValues(separated_columns SeparatedColumns) map[string][]string {
+	ret := make(map[string][]string)
+	for _, same := range []map[int16]ValueMap{separated_columns.strs, separated_columns.sets} {
+		for k, v := range same {
+			col_name := tb.get_string_for_key(k)
+			if col_name == "" {
+				continue
+			}
+
+			tb_col := tb.GetColumnInfo(k)
+			values := make([]string, 0, len(v))
+			for bucket := range v {
+				values = append(values, tb_col.get_string_for_val(int32(bucket)))
+			}
+
+			ret[col_name] = values
+		}
+	}
+
+	return ret
+}
+
+func (tb *TableBlock) SaveValuesToColumns(dirname string, column_values map[string][]string) {
+	saved := SavedBlockValues{Columns: make(map[string]*SavedColumnValues)}
+	for col_name, values := range column_values {
+		saved.Columns[col_name] = newSavedColumnValues(values)
+	}
+
+	col_fname := fmt.Sprintf("%s/values.db", dirname)
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(saved)
+
+	if err != nil {
+		Error("encode:", err)
+	}
+
+	if DEBUG_TIMING {
+		Debug("SERIALIZED BLOCK VALUES", col_fname, network.Len(), "BYTES")
+	}
+
+	// blocks without a values.db are always loaded, so a failed write only
+	// costs the pruning
+	tempfile, err := ioutil.TempFile(dirname, "values.db")
+	if err != nil {
+		Warn("COULDNT SAVE BLOCK VALUES", col_fname, err)
+		return
+	}
+
+	_, err = network.WriteTo(tempfile)
+	if cerr := tempfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = RenameAndMod(tempfile.Name(), col_fname)
+	}
+
+	if err != nil {
+		os.Remove(tempfile.Name())
+		Warn("COULDNT SAVE BLOCK VALUES", col_fname, err)
+	}
+}
+
+// returns nil if the block has no values.db
+func (t *Table) LoadBlockValues(dirname string) *SavedBlockValues {
+	t.block_m.Lock()
+	cached, ok := t.block_values[dirname]
+	t.block_m.Unlock()
+	if ok {
+		return cached
+	}
+
+	saved := &SavedBlockValues{}
+	err := decodeInto(fmt.Sprintf("%s/values.db", dirname), saved)
+	if err != nil {
+		saved = nil
+	}
+
+	t.block_m.Lock()
+	t.block_values[dirname] = saved
+	t.block_m.Unlock()
+
+	return saved
+}
+
+// returns false when the block's values.db rules out a str eq or set in filter
+func (t *Table) blockMayMatchValues(dirname string, filters []Filter) bool {
+	var values *SavedBlockValues
+	for _, f := range filters {
+		col, value := "", ""
+		switch fil := f.(type) {
+		case StrFilter:
+			if fil.Op != "eq" {
+				continue
+			}
+			col, value = fil.Field, fil.Value
+		case SetFilter:
+			if fil.Op != "in" {
+				continue
+			}
+			col, value = fil.Field, fil.Value
+		default:
+			continue
+		}
+
+		if values == nil {
+			values = t.LoadBlockValues(dirname)
+			if values == nil {
+				return true
+			}
+		}
+
+		// records without the column never match the filter
+		cv, ok := values.Columns[col]
+		if !ok || !cv.mayContain(value) {
+			return false
+		}
+	}
+
+	return true
+}
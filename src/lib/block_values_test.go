@@ -0,0 +1,110 @@
+package sybil
+
+import "context"
+import "path"
+import "path/filepath"
+import "strconv"
+import "testing"
+
+func TestBlockValuesPruneBlocks(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		block := strconv.Itoa(index / CHUNK_SIZE)
+		r.AddIntField("age", int64(index%20)+10)
+		r.AddStrField("name", "name_"+block)
+		r.AddSetField("tags", []string{"tag_" + block, "common"})
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	block_dirs, _ := nt.listBlockDirs(nil)
+	blocks := nt.scheduleBlocks(context.Background(), block_dirs)
+
+	// values.db is written through a temp file that is renamed into place
+	for _, b := range blocks {
+		files, _ := filepath.Glob(path.Join(b, "values.db*"))
+		if len(files) != 1 || path.Base(files[0]) != "values.db" {
+			t.Error("BLOCK", b, "HAS UNEXPECTED VALUES FILES", files)
+		}
+	}
+
+	// a block values.db that can't be written is left out
+	missing_dir := path.Join(FLAGS.DIR, tableName, "missing_block")
+	tb := newTableBlock()
+	tb.table = nt
+	tb.SaveValuesToColumns(missing_dir, map[string][]string{"name": {"name_0"}})
+	if nt.LoadBlockValues(missing_dir) != nil {
+		t.Error("LOADED VALUES OF A BLOCK THAT WASNT WRITTEN")
+	}
+
+	countBlocks := func(filters ...Filter) int {
+		querySpec := newQuerySpec()
+		querySpec.Filters = filters
+
+		count := 0
+		for _, b := range blocks {
+			if nt.ShouldLoadBlockFromDir(b, querySpec) {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	if n := countBlocks(nt.StrFilter("name", "eq", "name_2")); n != 1 {
+		t.Error("STR EQ FILTER LOADS", n, "BLOCKS, EXPECTED 1")
+	}
+
+	if n := countBlocks(nt.StrFilter("name", "eq", "nobody")); n != 0 {
+		t.Error("STR EQ FILTER ON A MISSING VALUE LOADS", n, "BLOCKS")
+	}
+
+	if n := countBlocks(nt.StrFilter("name", "neq", "name_2")); n != blockCount {
+		t.Error("STR NEQ FILTER LOADS", n, "BLOCKS, EXPECTED", blockCount)
+	}
+
+	if n := countBlocks(nt.SetFilter("tags", "in", "tag_1")); n != 1 {
+		t.Error("SET IN FILTER LOADS", n, "BLOCKS, EXPECTED 1")
+	}
+
+	if n := countBlocks(nt.SetFilter("tags", "in", "common")); n != blockCount {
+		t.Error("SET IN FILTER ON A SHARED VALUE LOADS", n, "BLOCKS, EXPECTED", blockCount)
+	}
+}
+
+func TestBlockValuesBloomFilter(t *testing.T) {
+	values := make([]string, 0)
+	for i := 0; i < MAX_EXACT_BLOCK_VALUES*4; i++ {
+		values = append(values, "value_"+strconv.Itoa(i))
+	}
+
+	cv := newSavedColumnValues(values)
+	if cv.Bloom == nil {
+		t.Fatal("COLUMN WITH", len(values), "VALUES DIDNT GET A BLOOM FILTER")
+	}
+
+	for _, v := range values {
+		if !cv.mayContain(v) {
+			t.Fatal("BLOOM FILTER IS MISSING", v)
+		}
+	}
+
+	false_positives := 0
+	for i := 0; i < 1000; i++ {
+		if cv.mayContain("missing_" + strconv.Itoa(i)) {
+			false_positives++
+		}
+	}
+
+	if false_positives > 50 {
+		t.Error("BLOOM FILTER HAS", false_positives, "FALSE POSITIVES OUT OF 1000")
+	}
+}
@@ -0,0 +1,14 @@
+// +build lz4
+
+package sybil
+
+import "io"
+import "io/ioutil"
+
+import "github.com/pierrec/lz4"
+
+func init() {
+	RegisterCodec(&FileCodec{Name: "lz4", Ext: ".lz4",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(lz4.NewReader(r)), nil }})
+}
@@ -0,0 +1,14 @@
+// +build snappy
+
+package sybil
+
+import "io"
+import "io/ioutil"
+
+import "github.com/golang/snappy"
+
+func init() {
+	RegisterCodec(&FileCodec{Name: "snappy", Ext: ".sz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return snappy.NewBufferedWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(snappy.NewReader(r)), nil }})
+}
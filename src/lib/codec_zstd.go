@@ -0,0 +1,20 @@
+// +build zstd
+
+package sybil
+
+import "io"
+
+import "github.com/klauspost/compress/zstd"
+
+func init() {
+	RegisterCodec(&FileCodec{Name: "zstd", Ext: ".zst",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+
+			return dec.IOReadCloser(), nil
+		}})
+}
@@ -41,6 +41,8 @@ type SavedColumnInfo struct {
 
 	StrInfoMap SavedStrInfo
 	IntInfoMap SavedIntInfo
+
+	Codec string // codec of the column files, see file_codec.go
 }
 
 type SavedIntColumn struct {
@@ -129,9 +129,10 @@ func (tb *TableBlock) SaveIntsToColumns(dirname string, same_ints map[int16]Valu
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
-		w, _ := os.Create(col_fname)
-
-		network.WriteTo(w)
+		err = tb.writeColumnFile(col_fname, &network)
+		if err != nil {
+			Error("COULDNT SAVE COLUMN", col_fname, err)
+		}
 	}
 
 }
@@ -210,9 +211,10 @@ func (tb *TableBlock) SaveSetsToColumns(dirname string, same_sets map[int16]Valu
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
-		w, _ := os.Create(col_fname)
-		network.WriteTo(w)
-
+		err = tb.writeColumnFile(col_fname, &network)
+		if err != nil {
+			Error("COULDNT SAVE COLUMN", col_fname, err)
+		}
 	}
 }
 
@@ -296,9 +298,10 @@ func (tb *TableBlock) SaveStrsToColumns(dirname string, same_strs map[int16]Valu
 
 		Debug(action, "COLUMN BLOCK", col_fname, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(tb.RecordList), ")")
 
-		w, _ := os.Create(col_fname)
-		network.WriteTo(w)
-
+		err = tb.writeColumnFile(col_fname, &network)
+		if err != nil {
+			Error("COULDNT SAVE COLUMN", col_fname, err)
+		}
 	}
 }
 
@@ -338,6 +341,7 @@ func (tb *TableBlock) SaveInfoToColumns(dirname string) {
 	}
 
 	colInfo := SavedColumnInfo{NumRecords: int32(len(records)), IntInfoMap: savedIntInfo, StrInfoMap: savedStrInfo}
+	colInfo.Codec = tb.table.columnCodec().Name
 	err := enc.Encode(colInfo)
 
 	if err != nil {
@@ -441,6 +445,8 @@ func (tb *TableBlock) SaveToColumns(filename string) bool {
 	tb.SaveIntsToColumns(partialname, separated_columns.ints)
 	tb.SaveStrsToColumns(partialname, separated_columns.strs)
 	tb.SaveSetsToColumns(partialname, separated_columns.sets)
+	column_values := tb.columnValues(separated_columns)
+	tb.SaveValuesToColumns(partialname, column_values)
 	tb.SaveInfoToColumns(partialname)
 
 	end = time.Now()
@@ -485,6 +491,8 @@ func (tb *TableBlock) SaveToColumns(filename string) bool {
 		Error("ERROR SAVING BLOCK", partialname, dirname, err)
 	}
 
+	tb.table.stageIndexBlock(dirname, column_values)
+
 	Debug("RELEASING BLOCK", tb.Name)
 	return true
 
@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"flag"
 	"os"
+	"time"
 )
 
 func init() {
@@ -76,12 +77,18 @@ type FlagDefs struct {
 	RECYCLE_MEM       bool
 	FAST_RECYCLE      bool
 	CACHED_QUERIES    bool
+	CACHED_RESULTS    bool // cache whole query results, see table_results_cache.go
 	SHORTEN_KEY_TABLE bool
 
 	WEIGHT_COL string
 
 	LIMIT        int
 	NUM_DISTINCT int
+	TIMEOUT      time.Duration // stop loading blocks after this long, 0 is no timeout
+	MEM_BUDGET   int           // MB the blocks loading at once may use, 0 is unlimited
+	WORKERS      int           // blocks loaded at the same time, 0 is one per CPU
+	STATS        bool          // print the QueryStats with the results
+	EXPLAIN      bool          // print the QueryPlan instead of running the query
 
 	DEBUG bool
 	JSON  bool
@@ -158,6 +165,7 @@ func setDefaults() {
 	FLAGS.RECYCLE_MEM = true
 	FLAGS.FAST_RECYCLE = false
 	FLAGS.CACHED_QUERIES = false
+	FLAGS.CACHED_RESULTS = false
 
 	FLAGS.HDR_HIST = false
 	FLAGS.LOG_HIST = false
@@ -0,0 +1,136 @@
+package sybil
+
+import "bytes"
+import "compress/gzip"
+import "compress/zlib"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "sort"
+import "strings"
+
+// COLUMN CODECS
+// Column files are gob encoded and then compressed with the table's codec
+// (Settings.Codec). The codec's extension goes after the .db of the file
+// name (int_age.db.gz), so the decoder is picked by the file name and blocks
+// written before a codec change (or before codecs, as plain .db or gzipped
+// .db.gz files) stay readable. The codec a block was written with is also
+// kept in its info.db. info.db and values.db are never compressed.
+// Codecs that need outside packages are compiled in with the build tag of
+// the same name (zstd, snappy, lz4) and register themselves in init().
+
+type FileCodec struct {
+	Name      string
+	Ext       string // appended to the .db of the column files
+	NewWriter func(io.Writer) (io.WriteCloser, error)
+	NewReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var DEFAULT_CODEC = "none"
+var FILE_CODECS = make(map[string]*FileCodec)
+
+func RegisterCodec(codec *FileCodec) {
+	FILE_CODECS[codec.Name] = codec
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterCodec(&FileCodec{Name: "none",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }})
+
+	RegisterCodec(&FileCodec{Name: "gzip", Ext: GZIP_EXT,
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }})
+
+	RegisterCodec(&FileCodec{Name: "zlib", Ext: ".zlib",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) }})
+}
+
+// CodecNames lists the codecs compiled into this binary
+func CodecNames() []string {
+	ret := make([]string, 0, len(FILE_CODECS))
+	for name := range FILE_CODECS {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// SetCodec picks the codec new column files of the table are written with
+func (t *Table) SetCodec(name string) error {
+	if _, ok := FILE_CODECS[name]; !ok {
+		return fmt.Errorf("unknown codec %s, available codecs: %s", name, strings.Join(CodecNames(), ", "))
+	}
+
+	t.Settings.Codec = name
+	return nil
+}
+
+func (t *Table) columnCodec() *FileCodec {
+	if t.Settings.Codec == "" {
+		return FILE_CODECS[DEFAULT_CODEC]
+	}
+
+	codec, ok := FILE_CODECS[t.Settings.Codec]
+	if !ok {
+		Warn("CODEC", t.Settings.Codec, "ISNT COMPILED IN, SAVING COLUMNS WITH", DEFAULT_CODEC)
+		return FILE_CODECS[DEFAULT_CODEC]
+	}
+
+	return codec
+}
+
+// codecForFile returns the codec a .db file was written with, going by its
+// name
+func codecForFile(filename string) *FileCodec {
+	for _, codec := range FILE_CODECS {
+		if codec.Ext != "" && strings.HasSuffix(filename, ".db"+codec.Ext) {
+			return codec
+		}
+	}
+
+	return FILE_CODECS["none"]
+}
+
+// trimCodecExt turns int_age.db.gz back into int_age.db
+func trimCodecExt(filename string) string {
+	return strings.TrimSuffix(filename, codecForFile(filename).Ext)
+}
+
+// writeColumnFile saves an encoded column into col_fname plus the extension
+// of the table's codec
+func (tb *TableBlock) writeColumnFile(col_fname string, data *bytes.Buffer) error {
+	codec := tb.table.columnCodec()
+
+	f, err := os.Create(col_fname + codec.Ext)
+	if err != nil {
+		return err
+	}
+
+	w, err := codec.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	_, err = data.WriteTo(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,87 @@
+package sybil
+
+import "io/ioutil"
+import "math/rand"
+import "path"
+import "strconv"
+import "strings"
+import "testing"
+
+func TestColumnCodecs(t *testing.T) {
+	for _, name := range []string{"gzip", "zlib"} {
+		testColumnCodec(t, name)
+	}
+}
+
+func testColumnCodec(t *testing.T, name string) {
+	tableName := getTestTableName(t) + "_" + name
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	codec := FILE_CODECS[name]
+
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+		r.AddStrField("age_str", strconv.Itoa(index%50))
+		r.AddSetField("tags", []string{"a", strconv.Itoa(index % 3)})
+	}, 2)
+
+	tbl := GetTable(tableName)
+	if tbl.SetCodec("nope") == nil {
+		t.Fatal("UNKNOWN CODEC SHOULD BE AN ERROR")
+	}
+	tbl.SetCodec(name)
+	saveAndReloadTable(t, tableName, 2)
+
+	// the next blocks get written without compression, the compressed ones
+	// need to stay readable
+	unloadTestTable(tableName)
+	tbl = GetTable(tableName)
+	tbl.LoadTableInfo()
+	if tbl.Settings.Codec != name {
+		t.Fatal("CODEC WASNT SAVED IN THE TABLE INFO", tbl.Settings.Codec)
+	}
+
+	tbl.SetCodec("none")
+	tbl.SaveTableInfo("info")
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, 1)
+	tbl.SaveRecordsToColumns()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	compressed := 0
+	for _, block := range listBlocksIn(path.Join(FLAGS.DIR, tableName)) {
+		info := nt.LoadBlockInfo(block)
+		files, _ := ioutil.ReadDir(block)
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name(), "int_") && !strings.HasPrefix(f.Name(), "str_") && !strings.HasPrefix(f.Name(), "set_") {
+				continue
+			}
+
+			if codecForFile(f.Name()).Name != info.Codec {
+				t.Error("COLUMN FILE", f.Name(), "DOESNT MATCH THE BLOCK'S CODEC", info.Codec)
+			}
+		}
+
+		if info.Codec == name {
+			compressed++
+		}
+	}
+
+	if compressed != 2 {
+		t.Error("EXPECTED 2 BLOCKS WRITTEN WITH", codec.Name, "FOUND", compressed)
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	loadSpec.Str("age_str")
+	loadSpec.Set("tags")
+	count := nt.LoadRecords(&loadSpec)
+	if count != 3*CHUNK_SIZE {
+		t.Error("READ BACK", count, "RECORDS, EXPECTED", 3*CHUNK_SIZE)
+	}
+}
@@ -3,15 +3,16 @@ package sybil
 import "fmt"
 
 import "os"
-import "strings"
 import "encoding/gob"
-import "compress/gzip"
+import "io"
 
 var GOB_GZIP_EXT = ".db.gz"
 
 type GobFileDecoder struct {
 	*gob.Decoder
 	File *os.File
+
+	reader io.ReadCloser // the codec's reader, if the file is compressed
 }
 
 type FileDecoder interface {
@@ -20,6 +21,9 @@ type FileDecoder interface {
 }
 
 func (gfd GobFileDecoder) CloseFile() bool {
+	if gfd.reader != nil {
+		gfd.reader.Close()
+	}
 	gfd.File.Close()
 	return true
 }
@@ -32,50 +36,47 @@ func decodeInto(filename string, obj interface{}) error {
 	return err
 }
 
-func getGobGzipDecoder(filename string) FileDecoder {
-
-	var dec *gob.Decoder
-
+func getCodecDecoder(codec *FileCodec, filename string) FileDecoder {
 	file, err := os.Open(filename)
 	if err != nil {
-		Debug("COULDNT OPEN GZ", filename)
-		return GobFileDecoder{gob.NewDecoder(file), file}
+		Debug("COULDNT OPEN", codec.Name, filename)
+		return GobFileDecoder{Decoder: gob.NewDecoder(file), File: file}
 	}
 
-	reader, err := gzip.NewReader(file)
+	reader, err := codec.NewReader(file)
 	if err != nil {
-		Debug("COULDNT DECOMPRESS GZ", filename)
-		return GobFileDecoder{gob.NewDecoder(reader), file}
+		Debug("COULDNT DECOMPRESS", codec.Name, filename)
+		return GobFileDecoder{Decoder: gob.NewDecoder(file), File: file}
 	}
 
-	dec = gob.NewDecoder(reader)
-	return GobFileDecoder{dec, file}
+	return GobFileDecoder{Decoder: gob.NewDecoder(reader), File: file, reader: reader}
 }
 
 func GetFileDecoder(filename string) FileDecoder {
-	// if the file ends with GZ ext, we use compressed decoder
-	if strings.HasSuffix(filename, GOB_GZIP_EXT) {
-		dec := getGobGzipDecoder(filename)
-		return dec
+	// if the file ends with a codec's ext, we use that codec's decoder
+	codec := codecForFile(filename)
+	if codec.Ext != "" {
+		return getCodecDecoder(codec, filename)
 	}
 
 	file, err := os.Open(filename)
-	// if we try to open the file and its missing, maybe there is a .gz version of it
+	// if we try to open the file and its missing, maybe there is a compressed
+	// version of it
 	if err != nil {
-		zfilename := fmt.Sprintf("%s%s", filename, GZIP_EXT)
-		_, err = os.Open(zfilename)
-
-		// if we can open this file, we return compressed file decoder
-		if err == nil {
-			if strings.HasSuffix(zfilename, GOB_GZIP_EXT) {
-				dec := getGobGzipDecoder(zfilename)
-				return dec
+		for _, codec := range FILE_CODECS {
+			if codec.Ext == "" {
+				continue
+			}
+
+			zfilename := fmt.Sprintf("%s%s", filename, codec.Ext)
+			if _, err = os.Stat(zfilename); err == nil && codecForFile(zfilename) == codec {
+				return getCodecDecoder(codec, zfilename)
 			}
 		}
 	}
 
 	// otherwise, we just return vanilla decoder for this file
-	dec := GobFileDecoder{gob.NewDecoder(file), file}
+	dec := GobFileDecoder{Decoder: gob.NewDecoder(file), File: file}
 	return dec
 
 }
@@ -0,0 +1,530 @@
+package sybil
+
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+
+// FILE INSPECTION
+// InspectFile summarizes one of the files sybil writes, instead of dumping
+// the struct inside it: the kind of file is told by its name (and by where
+// it is, for ingest and cache files) and the summary has what is useful to
+// look at, like the encoding of a column, its buckets, value range, string
+// table size and most common values. InspectDir summarizes every file in a
+// block dir. Files with names sybil doesn't use are decoded as a table info,
+// block info or ingest file, whichever works.
+
+var INSPECT_TOP_VALUES = 10
+
+const (
+	TABLE_INFO_FILE    = "table info"
+	BLOCK_INFO_FILE    = "block info"
+	INT_COLUMN_FILE    = "int column"
+	STR_COLUMN_FILE    = "str column"
+	SET_COLUMN_FILE    = "set column"
+	BLOCK_VALUES_FILE  = "block values"
+	INGEST_FILE        = "ingest file"
+	BLOCK_CACHE_FILE   = "block cache"
+	QUERY_CACHE_FILE   = "query cache"
+	RESULTS_CACHE_FILE = "results cache"
+	UNKNOWN_FILE       = "unknown"
+)
+
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type valueCountsByCount []ValueCount
+
+func (a valueCountsByCount) Len() int      { return len(a) }
+func (a valueCountsByCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a valueCountsByCount) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+
+	return a[i].Value < a[j].Value
+}
+
+type IntRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+func (r *IntRange) add(v int64) *IntRange {
+	if r == nil {
+		return &IntRange{Min: v, Max: v}
+	}
+
+	if v < r.Min {
+		r.Min = v
+	}
+	if v > r.Max {
+		r.Max = v
+	}
+
+	return r
+}
+
+type ColumnSummary struct {
+	Name            string       `json:"name"`
+	Type            string       `json:"type"` // int, str or set
+	BucketEncoded   bool         `json:"bucketEncoded"`
+	DeltaEncodedIDs bool         `json:"deltaEncodedIds"`
+	ValueEncoded    bool         `json:"valueEncoded"`
+	Buckets         int          `json:"buckets"`
+	Records         int          `json:"records"`               // records with a value
+	Range           *IntRange    `json:"range,omitempty"`       // int columns
+	StringTable     int          `json:"stringTable,omitempty"` // str and set columns
+	TopValues       []ValueCount `json:"topValues,omitempty"`   // most common values first
+}
+
+type BlockInfoSummary struct {
+	Records int32                `json:"records"`
+	Codec   string               `json:"codec,omitempty"`
+	Ints    map[string]*IntRange `json:"ints"`
+	Strs    map[string]int       `json:"strs"` // column -> cardinality
+}
+
+type TableInfoSummary struct {
+	Name     string            `json:"name"`
+	Columns  map[string]string `json:"columns"` // column -> int, str or set
+	Settings TableSettings     `json:"settings"`
+}
+
+type CacheSummary struct {
+	Blocks  int   `json:"blocks,omitempty"` // blocks the file has infos or results of
+	Records int64 `json:"records,omitempty"`
+	Results int   `json:"results,omitempty"` // groups of the cached results
+	Matched int   `json:"matched,omitempty"`
+	Samples int   `json:"samples,omitempty"`
+}
+
+type FileSummary struct {
+	File  string `json:"file"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+
+	Table  *TableInfoSummary `json:"table,omitempty"`
+	Info   *BlockInfoSummary `json:"info,omitempty"`
+	Column *ColumnSummary    `json:"column,omitempty"`
+	Cache  *CacheSummary     `json:"cache,omitempty"`
+
+	// ingest files and block values
+	Records int            `json:"records,omitempty"`
+	Columns map[string]int `json:"columns,omitempty"` // column -> values in the file
+}
+
+type DirSummary struct {
+	Dir        string         `json:"dir"`
+	Size       int64          `json:"size"`
+	Records    int32          `json:"records"`
+	Files      []*FileSummary `json:"files"`
+	QueryCache int            `json:"queryCache"` // cached query results in the block's cache dir
+}
+
+func colType(col_type int8) string {
+	switch col_type {
+	case INT_VAL:
+		return "int"
+	case STR_VAL:
+		return "str"
+	case SET_VAL:
+		return "set"
+	}
+
+	return "unknown"
+}
+
+// inspectFileType tells the kind of file by its name and dir
+func inspectFileType(filename string) string {
+	base := path.Base(filename)
+	dir := path.Base(path.Dir(filename))
+	name := trimCodecExt(base)
+
+	switch {
+	case strings.HasSuffix(base, QUERY_CACHE_EXT) && dir == RESULTS_CACHE_DIR:
+		return RESULTS_CACHE_FILE
+	case strings.HasSuffix(base, QUERY_CACHE_EXT) && dir == QUERY_CACHE_DIR:
+		return QUERY_CACHE_FILE
+	case dir == CACHE_DIR:
+		return BLOCK_CACHE_FILE
+	case name == "info.db" || name == "info.bak":
+		return TABLE_INFO_FILE
+	case strings.HasPrefix(name, "int_"):
+		return INT_COLUMN_FILE
+	case strings.HasPrefix(name, "str_"):
+		return STR_COLUMN_FILE
+	case strings.HasPrefix(name, "set_"):
+		return SET_COLUMN_FILE
+	case name == "values.db":
+		return BLOCK_VALUES_FILE
+	case dir == INGEST_DIR || dir == TEMP_INGEST_DIR || strings.HasPrefix(dir, STOMACHE_DIR):
+		return INGEST_FILE
+	}
+
+	return UNKNOWN_FILE
+}
+
+// topValues turns value counts into the INSPECT_TOP_VALUES most common ones
+func topValues(counts map[string]int) []ValueCount {
+	ret := make([]ValueCount, 0, len(counts))
+	for value, count := range counts {
+		ret = append(ret, ValueCount{Value: value, Count: count})
+	}
+
+	sort.Sort(valueCountsByCount(ret))
+	if len(ret) > INSPECT_TOP_VALUES {
+		ret = ret[:INSPECT_TOP_VALUES]
+	}
+
+	return ret
+}
+
+func countRecordIds(records []uint32, delta_encoded bool, seen map[uint32]bool) {
+	prev := uint32(0)
+	for _, r := range records {
+		if delta_encoded {
+			r = prev + r
+		}
+
+		seen[r] = true
+		prev = r
+	}
+}
+
+func lookupString(string_table []string, id int32) string {
+	if id < 0 || int(id) >= len(string_table) {
+		return "#" + strconv.FormatInt(int64(id), 10)
+	}
+
+	return string_table[id]
+}
+
+func summarizeIntColumn(col *SavedIntColumn) *ColumnSummary {
+	ret := ColumnSummary{Name: col.Name, Type: "int", BucketEncoded: col.BucketEncoded,
+		DeltaEncodedIDs: col.DeltaEncodedIDs, ValueEncoded: col.ValueEncoded}
+	counts := make(map[string]int)
+
+	if col.BucketEncoded {
+		ret.Buckets = len(col.Bins)
+		for _, bucket := range col.Bins {
+			ret.Records += len(bucket.Records)
+			ret.Range = ret.Range.add(bucket.Value)
+			counts[strconv.FormatInt(bucket.Value, 10)] += len(bucket.Records)
+		}
+	} else {
+		ret.Records = len(col.Values)
+		prev := int64(0)
+		for _, v := range col.Values {
+			if col.ValueEncoded {
+				v = v + prev
+				prev = v
+			}
+
+			ret.Range = ret.Range.add(v)
+			counts[strconv.FormatInt(v, 10)]++
+		}
+	}
+
+	ret.TopValues = topValues(counts)
+	return &ret
+}
+
+func summarizeStrColumn(col *SavedStrColumn) *ColumnSummary {
+	ret := ColumnSummary{Name: col.Name, Type: "str", BucketEncoded: col.BucketEncoded,
+		DeltaEncodedIDs: col.DeltaEncodedIDs, StringTable: len(col.StringTable)}
+	counts := make(map[string]int)
+
+	if col.BucketEncoded {
+		ret.Buckets = len(col.Bins)
+		for _, bucket := range col.Bins {
+			ret.Records += len(bucket.Records)
+			counts[lookupString(col.StringTable, bucket.Value)] += len(bucket.Records)
+		}
+	} else {
+		ret.Records = len(col.Values)
+		for _, v := range col.Values {
+			counts[lookupString(col.StringTable, v)]++
+		}
+	}
+
+	ret.TopValues = topValues(counts)
+	return &ret
+}
+
+func summarizeSetColumn(col *SavedSetColumn) *ColumnSummary {
+	ret := ColumnSummary{Name: col.Name, Type: "set", BucketEncoded: col.BucketEncoded,
+		DeltaEncodedIDs: col.DeltaEncodedIDs, StringTable: len(col.StringTable)}
+	counts := make(map[string]int)
+
+	if col.BucketEncoded {
+		// a record is in the bucket of every member of its set
+		ret.Buckets = len(col.Bins)
+		seen := make(map[uint32]bool)
+		for _, bucket := range col.Bins {
+			countRecordIds(bucket.Records, col.DeltaEncodedIDs, seen)
+			counts[lookupString(col.StringTable, bucket.Value)] += len(bucket.Records)
+		}
+		ret.Records = len(seen)
+	} else {
+		for _, set := range col.Values {
+			if len(set) > 0 {
+				ret.Records++
+			}
+			for _, v := range set {
+				counts[lookupString(col.StringTable, v)]++
+			}
+		}
+	}
+
+	ret.TopValues = topValues(counts)
+	return &ret
+}
+
+func summarizeBlockInfo(info *SavedColumnInfo) *BlockInfoSummary {
+	ret := BlockInfoSummary{Records: info.NumRecords, Codec: info.Codec,
+		Ints: make(map[string]*IntRange), Strs: make(map[string]int)}
+
+	for name, int_info := range info.IntInfoMap {
+		if int_info != nil {
+			ret.Ints[name] = &IntRange{Min: int_info.Min, Max: int_info.Max}
+		}
+	}
+
+	for name, str_info := range info.StrInfoMap {
+		if str_info != nil {
+			ret.Strs[name] = str_info.Cardinality
+		}
+	}
+
+	return &ret
+}
+
+func summarizeTableInfo(t *Table) *TableInfoSummary {
+	ret := TableInfoSummary{Name: t.Name, Columns: make(map[string]string), Settings: t.Settings}
+	for name, id := range t.KeyTable {
+		ret.Columns[name] = colType(t.KeyTypes[id])
+	}
+
+	return &ret
+}
+
+func summarizeQueryResults(results *QueryResults) *CacheSummary {
+	return &CacheSummary{Results: len(results.Results), Matched: results.MatchedCount,
+		Samples: len(results.CachedSamples)}
+}
+
+// inspectInfo decodes an info.db, which is a table's or a block's
+func inspectInfo(summary *FileSummary) error {
+	saved_table := Table{}
+	err := decodeInto(summary.File, &saved_table)
+	if err == nil && len(saved_table.KeyTable) > 0 {
+		summary.Type = TABLE_INFO_FILE
+		summary.Table = summarizeTableInfo(&saved_table)
+		return nil
+	}
+
+	info := SavedColumnInfo{}
+	err = decodeInto(summary.File, &info)
+	if err != nil {
+		return err
+	}
+
+	summary.Type = BLOCK_INFO_FILE
+	summary.Info = summarizeBlockInfo(&info)
+	return nil
+}
+
+func inspectIngestFile(summary *FileSummary) error {
+	srb := SavedRecordBlock{}
+	err := decodeInto(summary.File, &srb)
+	if err != nil {
+		// ingest files written before the key table was saved with them
+		srb = SavedRecordBlock{}
+		err = decodeInto(summary.File, &srb.RecordList)
+		if err != nil {
+			return err
+		}
+	}
+
+	summary.Type = INGEST_FILE
+	summary.Records = len(srb.RecordList)
+
+	// files without their own key table use the one of the table they were
+	// ingested into
+	key_table := srb.KeyTable
+	if key_table == nil {
+		saved_table := Table{}
+		table_info := path.Join(path.Dir(path.Dir(summary.File)), "info.db")
+		if decodeInto(table_info, &saved_table) == nil {
+			key_table = &saved_table.KeyTable
+		}
+	}
+
+	names := make(map[int16]string)
+	if key_table != nil {
+		for name, id := range *key_table {
+			names[id] = name
+		}
+	}
+
+	column := func(id int16) string {
+		name, ok := names[id]
+		if !ok {
+			return "#" + strconv.FormatInt(int64(id), 10)
+		}
+		return name
+	}
+
+	summary.Columns = make(map[string]int)
+	for _, r := range srb.RecordList {
+		for _, v := range r.Ints {
+			summary.Columns[column(v.Name)]++
+		}
+		for _, v := range r.Strs {
+			summary.Columns[column(v.Name)]++
+		}
+		for _, v := range r.Sets {
+			summary.Columns[column(v.Name)]++
+		}
+	}
+
+	return nil
+}
+
+func inspectFileAs(summary *FileSummary) error {
+	switch summary.Type {
+	case TABLE_INFO_FILE:
+		return inspectInfo(summary)
+	case INT_COLUMN_FILE:
+		col := SavedIntColumn{}
+		err := decodeInto(summary.File, &col)
+		if err == nil {
+			summary.Column = summarizeIntColumn(&col)
+		}
+		return err
+	case STR_COLUMN_FILE:
+		col := SavedStrColumn{}
+		err := decodeInto(summary.File, &col)
+		if err == nil {
+			summary.Column = summarizeStrColumn(&col)
+		}
+		return err
+	case SET_COLUMN_FILE:
+		col := SavedSetColumn{}
+		err := decodeInto(summary.File, &col)
+		if err == nil {
+			summary.Column = summarizeSetColumn(&col)
+		}
+		return err
+	case BLOCK_VALUES_FILE:
+		values := SavedBlockValues{}
+		err := decodeInto(summary.File, &values)
+		if err != nil {
+			return err
+		}
+
+		// columns with a bloom filter instead of their values have 0
+		summary.Columns = make(map[string]int)
+		for name, cv := range values.Columns {
+			summary.Columns[name] = len(cv.Values)
+		}
+		return nil
+	case INGEST_FILE:
+		return inspectIngestFile(summary)
+	case BLOCK_CACHE_FILE:
+		block_cache := SavedBlockCache{}
+		err := decodeInto(summary.File, &block_cache)
+		if err != nil {
+			return err
+		}
+
+		summary.Cache = &CacheSummary{Blocks: len(block_cache)}
+		for _, info := range block_cache {
+			if info != nil {
+				summary.Cache.Records += int64(info.NumRecords)
+			}
+		}
+		return nil
+	case QUERY_CACHE_FILE:
+		results := QueryResults{}
+		err := decodeInto(summary.File, &results)
+		if err == nil {
+			summary.Cache = summarizeQueryResults(&results)
+		}
+		return err
+	case RESULTS_CACHE_FILE:
+		saved := savedTableResults{}
+		err := decodeInto(summary.File, &saved)
+		if err != nil {
+			return err
+		}
+
+		summary.Cache = summarizeQueryResults(&saved.Results)
+		summary.Cache.Blocks = len(saved.Blocks)
+		return nil
+	}
+
+	// files with names sybil doesn't give out are tried as the files that
+	// get copied around by hand
+	for _, try := range []func(*FileSummary) error{inspectInfo, inspectIngestFile} {
+		if try(summary) == nil {
+			return nil
+		}
+	}
+
+	summary.Type = UNKNOWN_FILE
+	return nil
+}
+
+// InspectFile summarizes filename. Files that don't decode get an Error
+func InspectFile(filename string) *FileSummary {
+	summary := FileSummary{File: filename, Type: inspectFileType(filename)}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		summary.Error = err.Error()
+		return &summary
+	}
+	summary.Size = stat.Size()
+
+	err = inspectFileAs(&summary)
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	return &summary
+}
+
+// InspectDir summarizes every file in dirname, which is usually a block
+func InspectDir(dirname string) (*DirSummary, error) {
+	files, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := DirSummary{Dir: dirname, Files: make([]*FileSummary, 0, len(files))}
+	for _, f := range files {
+		if f.IsDir() {
+			if f.Name() == QUERY_CACHE_DIR {
+				summary.QueryCache = len(listQueryCacheDir(path.Join(dirname, f.Name()), dirname))
+			}
+			continue
+		}
+
+		file_summary := InspectFile(path.Join(dirname, f.Name()))
+		summary.Size += file_summary.Size
+		if file_summary.Info != nil {
+			summary.Records = file_summary.Info.Records
+		}
+
+		summary.Files = append(summary.Files, file_summary)
+	}
+
+	return &summary, nil
+}
@@ -0,0 +1,91 @@
+package sybil
+
+import "path"
+import "strconv"
+import "testing"
+
+func TestInspectBlock(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(index%5))
+		r.AddStrField("age_str", strconv.FormatInt(int64(index%5), 10))
+		r.AddSetField("age_set", []string{"a", strconv.FormatInt(int64(index%2), 10)})
+	}, 1)
+
+	nt := saveAndReloadTable(t, tableName, 1)
+	block_dirs, _ := nt.listBlockDirs(nil)
+	if len(block_dirs) != 1 {
+		t.Fatal("EXPECTED 1 BLOCK, GOT", block_dirs)
+	}
+
+	summary, err := InspectDir(block_dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Records != int32(CHUNK_SIZE) {
+		t.Error("EXPECTED", CHUNK_SIZE, "RECORDS IN BLOCK, GOT", summary.Records)
+	}
+
+	columns := make(map[string]*ColumnSummary)
+	for _, f := range summary.Files {
+		if f.Error != "" {
+			t.Error("COULDNT INSPECT", f.File, f.Error)
+		}
+		if f.Column != nil {
+			columns[f.Column.Name] = f.Column
+		}
+	}
+
+	age := columns["age"]
+	if age == nil || age.Type != "int" || age.Records != CHUNK_SIZE || age.Range.Min != 0 || age.Range.Max != 4 {
+		t.Error("WRONG SUMMARY OF INT COLUMN", age)
+	}
+
+	age_str := columns["age_str"]
+	if age_str == nil || age_str.StringTable != 5 || len(age_str.TopValues) != 5 {
+		t.Error("WRONG SUMMARY OF STR COLUMN", age_str)
+	}
+
+	// every record has "a" in its set
+	age_set := columns["age_set"]
+	if age_set == nil || age_set.Records != CHUNK_SIZE || age_set.TopValues[0] != (ValueCount{Value: "a", Count: CHUNK_SIZE}) {
+		t.Error("WRONG SUMMARY OF SET COLUMN", age_set)
+	}
+
+	table_info := InspectFile(path.Join(FLAGS.DIR, tableName, "info.db"))
+	if table_info.Type != TABLE_INFO_FILE || table_info.Table.Columns["age_set"] != "set" {
+		t.Error("WRONG SUMMARY OF TABLE INFO", table_info.Type, table_info.Table)
+	}
+
+	block_info := InspectFile(path.Join(block_dirs[0], "info.db"))
+	if block_info.Type != BLOCK_INFO_FILE || block_info.Info.Records != int32(CHUNK_SIZE) {
+		t.Error("WRONG SUMMARY OF BLOCK INFO", block_info.Type, block_info.Info)
+	}
+}
+
+func TestInspectFileType(t *testing.T) {
+	types := map[string]string{
+		"db/t/block1/int_age.db":         INT_COLUMN_FILE,
+		"db/t/block1/str_name.db.gz":     STR_COLUMN_FILE,
+		"db/t/block1/set_tags.db":        SET_COLUMN_FILE,
+		"db/t/block1/values.db":          BLOCK_VALUES_FILE,
+		"db/t/block1/cache/abc.db.gz":    QUERY_CACHE_FILE,
+		"db/t/results/abc.db.gz":         RESULTS_CACHE_FILE,
+		"db/t/cache/info123.db":          BLOCK_CACHE_FILE,
+		"db/t/ingest/ingest_123.db":      INGEST_FILE,
+		"db/t/stomache123/ingest_123.db": INGEST_FILE,
+		"db/t/info.db":                   TABLE_INFO_FILE,
+		"db/t/block1/something.else":     UNKNOWN_FILE,
+	}
+
+	for filename, expected := range types {
+		if got := inspectFileType(filename); got != expected {
+			t.Error("EXPECTED", filename, "TO BE A", expected, "GOT", got)
+		}
+	}
+}
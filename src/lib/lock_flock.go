@@ -0,0 +1,18 @@
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package sybil
+
+import "os"
+import "syscall"
+
+var FLOCK_SUPPORTED = true
+
+// flockFile blocks until it holds the flock on f
+func flockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
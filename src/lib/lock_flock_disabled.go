@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package sybil
+
+import "errors"
+import "os"
+
+var FLOCK_SUPPORTED = false
+
+func flockFile(f *os.File) error {
+	return errors.New("flock is not supported on this platform")
+}
@@ -59,7 +59,7 @@ func printTimeResults(querySpec *QuerySpec) {
 			}
 		}
 
-		printJson(marshalled_results)
+		querySpec.printResultsJson(marshalled_results)
 		return
 	}
 
@@ -165,7 +165,7 @@ func printSortedResults(querySpec *QuerySpec) {
 			results = append(results, res)
 		}
 
-		printJson(results)
+		querySpec.printResultsJson(results)
 		return
 	}
 
@@ -249,7 +249,7 @@ func printResults(querySpec *QuerySpec) {
 			results = append(results, res)
 		}
 
-		printJson(results)
+		querySpec.printResultsJson(results)
 		return
 	}
 
@@ -297,6 +297,7 @@ func (qs *QuerySpec) PrintResults() {
 	}
 
 	if FLAGS.PRINT {
+		qs.print_start = time.Now()
 		if qs.TimeBucket > 0 {
 			printTimeResults(qs)
 		} else if qs.OrderBy != "" {
@@ -304,9 +305,55 @@ func (qs *QuerySpec) PrintResults() {
 		} else {
 			printResults(qs)
 		}
+
+		qs.printStats()
 	}
 }
 
+// with -stats, the JSON results are wrapped in an object that also holds the
+// query's stats and whether it is Incomplete. Without it they are printed as
+// is, an incomplete query only warns about it on stderr
+func (qs *QuerySpec) printResultsJson(results interface{}) {
+	if !FLAGS.STATS {
+		printJson(results)
+		return
+	}
+
+	qs.Stats.PrintTime = time.Now().Sub(qs.print_start)
+	printJson(map[string]interface{}{"Results": results, "Incomplete": qs.Incomplete, "Stats": qs.Stats})
+}
+
+func (qs *QuerySpec) printStats() {
+	if !FLAGS.STATS || FLAGS.JSON {
+		return
+	}
+
+	stats := &qs.Stats
+	stats.PrintTime = time.Now().Sub(qs.print_start)
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, ' ', 0)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "QUERY STATS")
+	fmt.Fprintln(w, "  blocks considered\t", stats.BlocksConsidered)
+	fmt.Fprintln(w, "  blocks pruned\t", stats.BlocksPruned)
+	fmt.Fprintln(w, "  blocks cached\t", stats.BlocksCached)
+	fmt.Fprintln(w, "  records scanned\t", stats.RecordsScanned)
+	fmt.Fprintln(w, "  records matched\t", stats.RecordsMatched)
+	fmt.Fprintln(w, "  columns loaded\t", stats.ColumnsLoaded)
+	fmt.Fprintln(w, "  bytes read\t", stats.BytesRead)
+	fmt.Fprintln(w, "  peak memory\t", stats.PeakMemory)
+	fmt.Fprintln(w, "  blocks over budget\t", stats.BlocksOverBudget)
+	fmt.Fprintln(w, "  load time\t", stats.LoadTime)
+	fmt.Fprintln(w, "  filter time\t", stats.FilterTime)
+	fmt.Fprintln(w, "  combine time\t", stats.CombineTime)
+	fmt.Fprintln(w, "  print time\t", stats.PrintTime)
+	fmt.Fprintln(w, "  query time\t", stats.QueryTime)
+
+	w.Flush()
+}
+
 type Sample map[string]interface{}
 
 func (r *Record) toTSVRow() []string {
@@ -413,8 +460,9 @@ func (a SortMatchedByCol) Less(i, j int) bool {
 	return t1 > t2
 }
 
-func (t *Table) PrintSamples(qs *QuerySpec) {
-	count := 0
+// returns the records a samples query matched, in the order they should be
+// printed in
+func (t *Table) sampleRecords(qs *QuerySpec) RecordList {
 	records := make(RecordList, 0)
 	for _, b := range t.BlockList {
 		for _, r := range b.Matched {
@@ -423,7 +471,6 @@ func (t *Table) PrintSamples(qs *QuerySpec) {
 			}
 
 			records = append(records, r)
-			count++
 		}
 	}
 
@@ -455,6 +502,16 @@ func (t *Table) PrintSamples(qs *QuerySpec) {
 		records = records[:FLAGS.LIMIT]
 	}
 
+	return records
+}
+
+// GetSamples returns the records matched by a samples query (after sorting
+// and limiting them) as samples
+func (t *Table) GetSamples(qs *QuerySpec) []*Sample {
+	return toSamples(t.sampleRecords(qs))
+}
+
+func toSamples(records RecordList) []*Sample {
 	samples := make([]*Sample, 0)
 	for _, r := range records {
 		if r == nil {
@@ -465,6 +522,14 @@ func (t *Table) PrintSamples(qs *QuerySpec) {
 		samples = append(samples, s)
 	}
 
+	return samples
+}
+
+func (t *Table) PrintSamples(qs *QuerySpec) {
+	qs.print_start = time.Now()
+	records := t.sampleRecords(qs)
+	samples := toSamples(records)
+
 	if FLAGS.ENCODE_RESULTS {
 		Debug("NUMBER SAMPLES", len(samples))
 		PrintBytes(NodeResults{Samples: samples})
@@ -472,7 +537,7 @@ func (t *Table) PrintSamples(qs *QuerySpec) {
 	}
 
 	if FLAGS.JSON {
-		printJson(samples)
+		qs.printResultsJson(samples)
 		return
 	}
 
@@ -483,6 +548,8 @@ func (t *Table) PrintSamples(qs *QuerySpec) {
 
 		t.PrintRecord(r)
 	}
+
+	qs.printStats()
 }
 
 func ListTables() []string {
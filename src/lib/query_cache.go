@@ -3,8 +3,8 @@ package sybil
 import "encoding/gob"
 
 import "bytes"
-import "fmt"
 import "path"
+import "sort"
 import "io/ioutil"
 import "os"
 import "compress/gzip"
@@ -52,6 +52,12 @@ func (t *Table) getCachedQueryForBlock(dirname string, querySpec *QuerySpec) (*T
 
 	blockQuery := CopyQuerySpec(querySpec)
 	if blockQuery.LoadCachedResults(tb.Name) {
+		if FLAGS.SAMPLES {
+			tb.Matched = tb.recordsFromSamples(blockQuery.CachedSamples)
+			blockQuery.Matched = tb.Matched
+			blockQuery.CachedSamples = nil
+		}
+
 		t.block_m.Lock()
 		t.BlockList[dirname] = &tb
 		t.block_m.Unlock()
@@ -136,6 +142,18 @@ func (qs *QuerySpec) GetCacheStruct(blockname string) QueryParams {
 	// kick out trivial filters
 	cache_spec.Filters = qs.GetCacheRelevantFilters(blockname)
 
+	// time series are bucketed by OPTS.TIME_COL_ID and samples are limited by
+	// FLAGS.LIMIT, so those go into the key too
+	if cache_spec.TimeBucket > 0 {
+		cache_spec.TimeCol = qs.Table.get_string_for_key(int(OPTS.TIME_COL_ID))
+	}
+
+	if FLAGS.SAMPLES {
+		cache_spec.Samples = true
+		cache_spec.Limit = FLAGS.LIMIT
+		cache_spec.SampleCols = FLAGS.SAMPLE_COLS
+	}
+
 	return cache_spec
 }
 
@@ -143,21 +161,115 @@ func (qs *QuerySpec) GetCacheKey(blockname string) string {
 	return qs.GetCacheStruct(blockname).cacheKey()
 }
 
+// the file a block's cached results are saved in and loaded from
+func (qs *QuerySpec) cachedResultsFile(blockname string) string {
+	return queryCacheFile(blockname, qs.GetCacheKey(blockname))
+}
+
+// cacheable is false for samples queries whose samples can't be picked
+// block by block: string ids are local to a block, so only an int column (or
+// $COUNT, the order the records were added in) orders samples the same way
+// across blocks
+func (qs *QuerySpec) cacheable() bool {
+	if !FLAGS.SAMPLES || qs.OrderBy == SORT_COUNT {
+		return true
+	}
+
+	return qs.OrderBy != "" && qs.Table.GetColumnType(qs.OrderBy) == INT_VAL
+}
+
+// cachedSamples picks the matched records of a block that a samples query
+// could print (see sampleRecords): the last FLAGS.LIMIT ones when ordering by
+// $COUNT, the first FLAGS.LIMIT in the query's order otherwise
+func (qs *QuerySpec) cachedSamples(matched RecordList) []*Sample {
+	records := make(RecordList, 0, len(matched))
+	for _, r := range matched {
+		if r == nil {
+			break
+		}
+
+		records = append(records, r)
+	}
+
+	if qs.OrderBy == SORT_COUNT {
+		if len(records) > FLAGS.LIMIT {
+			records = records[len(records)-FLAGS.LIMIT:]
+		}
+
+		return toSamples(records)
+	}
+
+	sort.Sort(SortMatchedByCol{Matched: records, Col: qs.OrderBy})
+	if qs.OrderAsc {
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+
+	if len(records) > FLAGS.LIMIT {
+		records = records[:FLAGS.LIMIT]
+	}
+
+	return toSamples(records)
+}
+
+// recordsFromSamples turns cached samples back into records of tb, so they
+// are printed like the records of a loaded block
+func (tb *TableBlock) recordsFromSamples(samples []*Sample) RecordList {
+	t := tb.table
+	records := make(RecordList, 0, len(samples))
+	for _, sample := range samples {
+		r := Record{Ints: IntArr{}, Strs: StrArr{}}
+		r.block = tb
+
+		for name, val := range *sample {
+			name_id := t.get_key_id(name)
+			r.ResizeFields(name_id)
+
+			switch v := val.(type) {
+			case IntField:
+				r.Ints[name_id] = v
+				r.Populated[name_id] = INT_VAL
+			case string:
+				col := tb.GetColumnInfo(name_id)
+				r.Strs[name_id] = StrField(col.get_val_id(v))
+				r.Populated[name_id] = STR_VAL
+			case []string:
+				col := tb.GetColumnInfo(name_id)
+				vals := make(SetField, len(v))
+				for i, sv := range v {
+					vals[i] = col.get_val_id(sv)
+				}
+
+				if r.SetMap == nil {
+					r.SetMap = make(map[int16]SetField)
+				}
+				r.SetMap[name_id] = vals
+				r.Populated[name_id] = SET_VAL
+			}
+		}
+
+		records = append(records, &r)
+	}
+
+	return records
+}
+
 func (qs *QuerySpec) LoadCachedResults(blockname string) bool {
 	if FLAGS.CACHED_QUERIES == false {
 		return false
 	}
 
-	if FLAGS.SAMPLES {
+	if !qs.cacheable() {
 		return false
-
 	}
 
-	cache_key := qs.GetCacheKey(blockname)
-
-	cache_dir := path.Join(blockname, "cache")
-	cache_name := fmt.Sprintf("%s.db", cache_key)
-	filename := path.Join(cache_dir, cache_name)
+	filename := qs.cachedResultsFile(blockname)
+	if queryCacheIsStale(blockname, filename) {
+		// missing, or saved before the block was rewritten
+		os.Remove(filename)
+		return false
+	}
 
 	cachedSpec := QueryResults{}
 	err := decodeInto(filename, &cachedSpec)
@@ -167,41 +279,45 @@ func (qs *QuerySpec) LoadCachedResults(blockname string) bool {
 	}
 
 	qs.QueryResults = cachedSpec
+	touchQueryCache(filename)
 
 	return true
 }
 
-func (qs *QuerySpec) SaveCachedResults(blockname string) {
+func (qs *QuerySpec) SaveCachedResults(blockname string) int64 {
 	if FLAGS.CACHED_QUERIES == false {
-		return
+		return 0
 	}
 
-	if FLAGS.SAMPLES {
-		return
+	if !qs.cacheable() {
+		return 0
 	}
 
+	// a partial block is cached too: filling it up rewrites the block, which
+	// makes its cached results stale
 	info := qs.Table.LoadBlockInfo(blockname)
-
-	if info.NumRecords < int32(CHUNK_SIZE) {
-		return
+	if info == nil || info.NumRecords <= 0 {
+		return 0
 	}
 
-	cache_key := qs.GetCacheKey(blockname)
-
 	cachedInfo := qs.QueryResults
+	if FLAGS.SAMPLES {
+		cachedInfo.CachedSamples = qs.cachedSamples(qs.Matched)
+	}
+	cachedInfo.Matched = nil
 
-	cache_dir := path.Join(blockname, "cache")
+	filename := qs.cachedResultsFile(blockname)
+	cache_dir := path.Dir(filename)
 	err := os.MkdirAll(cache_dir, 0777)
 	if err != nil {
 		Debug("COULDNT CREATE CACHE DIR", err, "NOT CACHING QUERY")
-		return
+		return 0
 	}
 
-	cache_name := fmt.Sprintf("%s.db.gz", cache_key)
-	filename := path.Join(cache_dir, cache_name)
-	tempfile, err := ioutil.TempFile(cache_dir, cache_name)
+	tempfile, err := ioutil.TempFile(cache_dir, path.Base(filename))
 	if err != nil {
 		Debug("TEMPFILE ERROR", err)
+		return 0
 	}
 
 	var buf bytes.Buffer
@@ -216,27 +332,34 @@ func (qs *QuerySpec) SaveCachedResults(blockname string) {
 	if err != nil {
 		Warn("cached query encoding error:", err)
 		tempfile.Close()
-		return
+		return 0
 	}
 
 	if err != nil {
 		Warn("ERROR CREATING TEMP FILE FOR QUERY CACHED INFO", err)
 		tempfile.Close()
-		return
+		return 0
+	}
+
+	// results that are replaced don't count twice
+	size := int64(gbuf.Len())
+	if old, err := os.Stat(filename); err == nil {
+		size -= old.Size()
 	}
 
 	_, err = gbuf.WriteTo(tempfile)
 	tempfile.Close()
 	if err != nil {
 		Warn("ERROR SAVING QUERY CACHED INFO INTO TEMPFILE", err)
-		return
+		return 0
 	}
 
 	err = RenameAndMod(tempfile.Name(), filename)
 	if err != nil {
 		Warn("ERROR RENAMING", tempfile.Name())
+		return 0
 	}
 
-	return
+	return size
 
 }
@@ -0,0 +1,256 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "time"
+
+// QUERY CACHE STORE
+// The per block query cache keeps each block's results in
+// <block>/cache/<key>.db.gz. A file's mtime is its LRU clock: it is set when
+// the results are saved and bumped on every hit. When a table has a byte
+// budget (Settings.QueryCacheBytes), the least recently used results of the
+// whole table are evicted once it goes over budget. Saving results only adds
+// their size to a running total (QUERY_CACHE_SIZE_FILE), the cache dirs are
+// listed when the total is over budget or unknown, and eviction stores the
+// real size. Stale results that are dropped aren't subtracted, so the total
+// can only be too large, which just makes eviction list the cache early.
+// Results older than their block's info.db are stale (the block was rewritten
+// since) and get dropped when they are read. The whole query results of the
+// table results cache (table_results_cache.go) are listed, evicted and purged
+// along with the block results.
+
+var QUERY_CACHE_DIR = "cache"
+var QUERY_CACHE_EXT = ".db.gz"
+var QUERY_CACHE_SIZE_FILE = "query_cache_size.db"
+var QUERY_CACHE_LOCK = "query_cache"
+
+type SavedQueryCacheSize struct {
+	Bytes int64
+}
+
+type QueryCacheEntry struct {
+	Block string // empty for whole query results
+	Key   string
+	Path  string
+	Size  int64
+	Used  time.Time
+}
+
+type queryCacheEntriesByUse []QueryCacheEntry
+
+func (a queryCacheEntriesByUse) Len() int      { return len(a) }
+func (a queryCacheEntriesByUse) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a queryCacheEntriesByUse) Less(i, j int) bool {
+	if !a[i].Used.Equal(a[j].Used) {
+		return a[i].Used.Before(a[j].Used)
+	}
+
+	return a[i].Path < a[j].Path
+}
+
+func queryCacheFile(blockname string, key string) string {
+	return path.Join(blockname, QUERY_CACHE_DIR, key+QUERY_CACHE_EXT)
+}
+
+func listQueryCacheDir(dirname string, blockname string) []QueryCacheEntry {
+	ret := make([]QueryCacheEntry, 0)
+	files, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return ret
+	}
+
+	for _, f := range files {
+		// skips the temp files of results that are being saved
+		if f.IsDir() || !strings.HasSuffix(f.Name(), QUERY_CACHE_EXT) {
+			continue
+		}
+
+		ret = append(ret, QueryCacheEntry{
+			Block: blockname,
+			Key:   strings.TrimSuffix(f.Name(), QUERY_CACHE_EXT),
+			Path:  path.Join(dirname, f.Name()),
+			Size:  f.Size(),
+			Used:  f.ModTime()})
+	}
+
+	return ret
+}
+
+// SetQueryCacheBudget caps the bytes the query cache of the table can use, 0
+// means no limit
+func (t *Table) SetQueryCacheBudget(bytes int64) {
+	if bytes < 0 {
+		bytes = 0
+	}
+
+	t.Settings.QueryCacheBytes = bytes
+
+	// the running size isn't kept up to date without a budget
+	os.Remove(t.queryCacheSizeFile())
+}
+
+func (t *Table) queryCacheSizeFile() string {
+	return path.Join(FLAGS.DIR, t.Name, QUERY_CACHE_SIZE_FILE)
+}
+
+func (t *Table) loadQueryCacheSize() (int64, bool) {
+	size := SavedQueryCacheSize{}
+	err := decodeInto(t.queryCacheSizeFile(), &size)
+	if err != nil {
+		return 0, false
+	}
+
+	return size.Bytes, true
+}
+
+func (t *Table) saveQueryCacheSize(size int64) {
+	dirname := path.Join(FLAGS.DIR, t.Name)
+
+	var network bytes.Buffer
+	err := gob.NewEncoder(&network).Encode(SavedQueryCacheSize{Bytes: size})
+	if err != nil {
+		Warn("COULDNT ENCODE QUERY CACHE SIZE", err)
+		return
+	}
+
+	tempfile, err := ioutil.TempFile(dirname, QUERY_CACHE_SIZE_FILE)
+	if err != nil {
+		Warn("COULDNT CREATE TEMP FILE FOR QUERY CACHE SIZE", err)
+		return
+	}
+
+	_, err = network.WriteTo(tempfile)
+	tempfile.Close()
+	if err != nil {
+		Warn("COULDNT WRITE QUERY CACHE SIZE", err)
+		os.Remove(tempfile.Name())
+		return
+	}
+
+	RenameAndMod(tempfile.Name(), t.queryCacheSizeFile())
+}
+
+// addQueryCacheBytes adds newly cached results to the running size of the
+// table's query cache, and evicts results when it is over budget
+func (t *Table) addQueryCacheBytes(size int64) {
+	budget := t.Settings.QueryCacheBytes
+	if budget <= 0 || size == 0 {
+		return
+	}
+
+	if t.GrabQueryCacheLock() == false {
+		Debug("COULDNT GRAB QUERY CACHE LOCK, NOT EVICTING")
+		return
+	}
+	defer t.ReleaseQueryCacheLock()
+
+	total, ok := t.loadQueryCacheSize()
+	if ok && total+size <= budget {
+		t.saveQueryCacheSize(total + size)
+		return
+	}
+
+	t.EvictQueryCache(budget)
+}
+
+func matchesBlock(blockname string, block string) bool {
+	return block == "" || blockname == block || path.Base(blockname) == block
+}
+
+// ListQueryCache returns the cached query results of the table, or of one of
+// its blocks when block is given (by path or by name), oldest used first
+func (t *Table) ListQueryCache(block string) []QueryCacheEntry {
+	ret := make([]QueryCacheEntry, 0)
+	if block == "" {
+		ret = append(ret, listQueryCacheDir(t.resultsCacheDir(), "")...)
+	}
+
+	block_dirs, _ := t.listBlockDirs(nil)
+	for _, blockname := range block_dirs {
+		if matchesBlock(blockname, block) {
+			ret = append(ret, listQueryCacheDir(path.Join(blockname, QUERY_CACHE_DIR), blockname)...)
+		}
+	}
+
+	sort.Sort(queryCacheEntriesByUse(ret))
+	return ret
+}
+
+// PurgeQueryCache removes the cached query results of the table, or of one of
+// its blocks, and returns how many results and bytes were removed
+func (t *Table) PurgeQueryCache(block string) (int, int64) {
+	count := 0
+	size := int64(0)
+	for _, entry := range t.ListQueryCache(block) {
+		if os.Remove(entry.Path) == nil {
+			count++
+			size += entry.Size
+		}
+	}
+
+	// the running size is listed again when results are saved next
+	os.Remove(t.queryCacheSizeFile())
+
+	Debug("PURGED", count, "CACHED QUERIES,", size, "BYTES")
+	return count, size
+}
+
+// EvictQueryCache removes the least recently used query results until the
+// table's query cache fits into budget bytes, and stores the size that is
+// left as the table's running size
+func (t *Table) EvictQueryCache(budget int64) (int, int64) {
+	entries := t.ListQueryCache("")
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	count := 0
+	size := int64(0)
+	for _, entry := range entries {
+		if total <= budget {
+			break
+		}
+
+		if os.Remove(entry.Path) == nil {
+			count++
+			size += entry.Size
+		}
+		total -= entry.Size
+	}
+
+	t.saveQueryCacheSize(total)
+
+	if count > 0 {
+		Debug("EVICTED", count, "CACHED QUERIES,", size, "BYTES FROM", t.Name)
+	}
+
+	return count, size
+}
+
+// queryCacheIsStale is true when the block was rewritten after the results
+// in filename were cached
+func queryCacheIsStale(blockname string, filename string) bool {
+	cache_stat, err := os.Stat(filename)
+	if err != nil {
+		return true
+	}
+
+	info_stat, err := os.Stat(path.Join(blockname, "info.db"))
+	if err != nil {
+		return true
+	}
+
+	return cache_stat.ModTime().Before(info_stat.ModTime())
+}
+
+// touchQueryCache marks cached results as just used for LRU eviction
+func touchQueryCache(filename string) {
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+}
@@ -3,7 +3,10 @@ package sybil
 import "testing"
 import "math/rand"
 import "math"
+import "os"
+import "path"
 import "strconv"
+import "time"
 
 func TestCachedQueries(t *testing.T) {
 	tableName := getTestTableName(t)
@@ -233,6 +236,353 @@ func testCachedBasicHist(t *testing.T, tableName string) {
 
 }
 
+func TestQueryCacheStore(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.CACHED_QUERIES = true
+	defer func() { FLAGS.CACHED_QUERIES = false }()
+
+	addRecords(tableName, func(r *Record, i int) {
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+	nt := saveAndReloadTable(t, tableName, blockCount)
+
+	aggs := []Aggregation{nt.Aggregation("age", "avg")}
+	querySpec := QuerySpec{Table: nt, QueryParams: QueryParams{Aggregations: aggs}}
+	loadSpec := NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+
+	entries := nt.ListQueryCache("")
+	if len(entries) != blockCount {
+		t.Fatal("EXPECTED", blockCount, "CACHED QUERIES, FOUND", len(entries))
+	}
+
+	for _, entry := range entries {
+		if entry.Path != querySpec.cachedResultsFile(entry.Block) {
+			t.Error("CACHED RESULTS SAVED AS", entry.Path, "BUT LOADED FROM", querySpec.cachedResultsFile(entry.Block))
+		}
+	}
+
+	// age the entries so the first block's results are the least recently
+	// used, then hit the last block's results to make them the most recent
+	written := time.Now().Add(-time.Hour)
+	for i, entry := range entries {
+		os.Chtimes(path.Join(entry.Block, "info.db"), written, written)
+		used := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(entry.Path, used, used)
+	}
+	last := entries[len(entries)-1]
+	if !querySpec.LoadCachedResults(last.Block) {
+		t.Fatal("COULDNT LOAD CACHED RESULTS OF", last.Block)
+	}
+
+	count, _ := nt.EvictQueryCache(entries[0].Size + last.Size)
+	if count != blockCount-1 && count != blockCount-2 {
+		t.Error("EVICTION REMOVED", count, "CACHED QUERIES")
+	}
+
+	left := nt.ListQueryCache("")
+	if len(left) == 0 || left[len(left)-1].Block != last.Block {
+		t.Error("EVICTION DIDNT KEEP THE MOST RECENTLY USED RESULTS")
+	}
+
+	// a rewritten block invalidates its cached results
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(last.Block, "info.db"), later, later)
+	if querySpec.LoadCachedResults(last.Block) {
+		t.Error("LOADED CACHED RESULTS OF A REWRITTEN BLOCK")
+	}
+	if _, err := os.Stat(last.Path); err == nil {
+		t.Error("STALE CACHED RESULTS WERENT REMOVED")
+	}
+
+	nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+	count, _ = nt.PurgeQueryCache(path.Base(last.Block))
+	if count != 1 || len(nt.ListQueryCache(last.Block)) != 0 {
+		t.Error("PURGING A BLOCK REMOVED", count, "CACHED QUERIES")
+	}
+
+	nt.PurgeQueryCache("")
+	if len(nt.ListQueryCache("")) != 0 {
+		t.Error("PURGING THE TABLE LEFT CACHED QUERIES BEHIND")
+	}
+
+	// with a budget, saved results are added to the running size
+	nt.SetQueryCacheBudget(1 << 30)
+	nt.SaveTableInfo("info")
+	nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+	countSpec := QuerySpec{Table: nt, QueryParams: QueryParams{Aggregations: []Aggregation{nt.Aggregation("age", "hist")}}}
+	nt.LoadAndQueryRecords(&loadSpec, &countSpec)
+
+	total := int64(0)
+	for _, entry := range nt.ListQueryCache("") {
+		total += entry.Size
+	}
+	if size, ok := nt.loadQueryCacheSize(); !ok || size != total {
+		t.Error("RUNNING QUERY CACHE SIZE IS", size, "BUT THE CACHE HAS", total, "BYTES")
+	}
+
+	// and going over it evicts results
+	nt.SetQueryCacheBudget(total / 2)
+	nt.SaveTableInfo("info")
+	nt.PurgeQueryCache(path.Base(last.Block))
+	nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+
+	cached := int64(0)
+	for _, entry := range nt.ListQueryCache("") {
+		cached += entry.Size
+	}
+	if cached > total/2 {
+		t.Error("QUERY CACHE HAS", cached, "BYTES, OVER ITS BUDGET OF", total/2)
+	}
+}
+
+func TestTableResultsCache(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.CACHED_RESULTS = true
+	defer func() { FLAGS.CACHED_RESULTS = false }()
+
+	addAges := func(block_count int) {
+		addRecords(tableName, func(r *Record, i int) {
+			age := int64(rand.Intn(20)) + 10
+			r.AddIntField("age", age)
+			r.AddStrField("age_str", strconv.FormatInt(age, 10))
+		}, block_count)
+	}
+
+	runQuery := func() *QuerySpec {
+		nt := GetTable(tableName)
+		groups := []Grouping{nt.Grouping("age_str")}
+		aggs := []Aggregation{nt.Aggregation("age", "avg")}
+		querySpec := QuerySpec{Table: nt,
+			QueryParams: QueryParams{Groups: groups, Aggregations: aggs}}
+		loadSpec := NewLoadSpec()
+		loadSpec.LoadAllColumns = true
+		nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+		return &querySpec
+	}
+
+	checkCounts := func(querySpec *QuerySpec, blocks int) {
+		if querySpec.MatchedCount != blocks*CHUNK_SIZE {
+			t.Error("QUERY MATCHED", querySpec.MatchedCount, "RECORDS, EXPECTED", blocks*CHUNK_SIZE)
+		}
+
+		total := int64(0)
+		for _, r := range querySpec.Results {
+			total += r.Count
+		}
+		if total != int64(blocks*CHUNK_SIZE) {
+			t.Error("RESULTS COUNT", total, "RECORDS, EXPECTED", blocks*CHUNK_SIZE)
+		}
+	}
+
+	addAges(3)
+	saveAndReloadTable(t, tableName, 3)
+
+	first := runQuery()
+	checkCounts(first, 3)
+	if first.Stats.BlocksCached != 0 {
+		t.Error("FIRST QUERY USED", first.Stats.BlocksCached, "CACHED BLOCKS")
+	}
+
+	again := runQuery()
+	checkCounts(again, 3)
+	if again.Stats.BlocksCached != 3 || again.Stats.BlocksConsidered != 0 {
+		t.Error("REPEATED QUERY READ", again.Stats.BlocksConsidered, "BLOCKS, EXPECTED ALL 3 CACHED")
+	}
+
+	for k, v := range first.Results {
+		v2, ok := again.Results[k]
+		if !ok || v.Count != v2.Count {
+			t.Error("CACHED RESULTS DIFFER FOR", k)
+		}
+	}
+
+	// only the new block is read, the rest come from the cached results
+	addAges(1)
+	nt := saveAndReloadTable(t, tableName, 4)
+	added := runQuery()
+	checkCounts(added, 4)
+	if added.Stats.BlocksConsidered != 1 {
+		t.Error("QUERY AFTER A NEW BLOCK READ", added.Stats.BlocksConsidered, "BLOCKS, EXPECTED 1")
+	}
+
+	// a rewritten block makes the cached results stale
+	block_dirs, _ := nt.listBlockDirs(nil)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(block_dirs[0], "info.db"), later, later)
+	rewritten := runQuery()
+	checkCounts(rewritten, 4)
+	if rewritten.Stats.BlocksConsidered != 4 {
+		t.Error("QUERY AFTER A REWRITE READ", rewritten.Stats.BlocksConsidered, "BLOCKS, EXPECTED 4")
+	}
+
+	entries := nt.ListQueryCache("")
+	if len(entries) != 1 || entries[0].Block != "" {
+		t.Error("EXPECTED ONE CACHED TABLE RESULT, FOUND", entries)
+	}
+}
+
+func TestCachedSamples(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 3
+
+	addRecords(tableName, func(r *Record, i int) {
+		age := int64(rand.Intn(20)) + 10
+		r.AddIntField("id", int64(i))
+		r.AddIntField("age", age)
+		r.AddStrField("age_str", strconv.FormatInt(age, 10))
+	}, blockCount)
+	saveAndReloadTable(t, tableName, blockCount)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.CACHED_QUERIES = true
+	FLAGS.SAMPLES = true
+	HOLD_MATCHES = true
+	old_limit := FLAGS.LIMIT
+	FLAGS.LIMIT = 10
+	defer func() {
+		FLAGS.CACHED_QUERIES = false
+		FLAGS.SAMPLES = false
+		HOLD_MATCHES = false
+		FLAGS.LIMIT = old_limit
+	}()
+
+	runSamples := func(orderBy string) ([]*Sample, *QuerySpec) {
+		unloadTestTable(tableName)
+		nt := GetTable(tableName)
+		nt.LoadTableInfo()
+		filters := []Filter{nt.IntFilter("age", "lt", 20)}
+		querySpec := QuerySpec{Table: nt,
+			QueryParams: QueryParams{Filters: filters, OrderBy: orderBy, Limit: FLAGS.LIMIT}}
+		loadSpec := NewLoadSpec()
+		loadSpec.LoadAllColumns = true
+		nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+		return nt.GetSamples(&querySpec), &querySpec
+	}
+
+	for _, orderBy := range []string{"id", SORT_COUNT} {
+		samples, querySpec := runSamples(orderBy)
+		if len(samples) != FLAGS.LIMIT {
+			t.Fatal("EXPECTED", FLAGS.LIMIT, "SAMPLES ORDERED BY", orderBy, "GOT", len(samples))
+		}
+		if querySpec.Stats.BlocksCached != 0 {
+			t.Error("FIRST SAMPLES QUERY BY", orderBy, "USED THE QUERY CACHE")
+		}
+
+		cached, cachedSpec := runSamples(orderBy)
+		if cachedSpec.Stats.BlocksCached == 0 {
+			t.Error("SAMPLES ORDERED BY", orderBy, "WERENT CACHED")
+		}
+		if len(cached) != len(samples) {
+			t.Fatal("CACHED SAMPLES ORDERED BY", orderBy, "RETURNED", len(cached), "SAMPLES")
+		}
+
+		for i, sample := range cached {
+			if (*sample)["age_str"] == nil || (*sample)["age"].(IntField) >= 20 {
+				t.Error("CACHED SAMPLE", sample, "DOESNT MATCH THE QUERY")
+			}
+
+			if orderBy == "id" && (*sample)["id"] != (*samples[i])["id"] {
+				t.Error("CACHED SAMPLE", i, "IS", sample, "EXPECTED", samples[i])
+			}
+		}
+	}
+
+	// string ids are local to a block, so samples ordered by a string
+	// column are never cached
+	runSamples("age_str")
+	_, querySpec := runSamples("age_str")
+	if querySpec.Stats.BlocksCached != 0 {
+		t.Error("SAMPLES ORDERED BY A STRING COLUMN WERE CACHED")
+	}
+}
+
+func TestCachedTimeSeries(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 3
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.CACHED_QUERIES = true
+	old_time_col_id := OPTS.TIME_COL_ID
+	defer func() {
+		FLAGS.CACHED_QUERIES = false
+		OPTS.TIME_COL_ID = old_time_col_id
+	}()
+
+	addRecords(tableName, func(r *Record, i int) {
+		r.AddIntField("time", int64(i*10))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+	saveAndReloadTable(t, tableName, blockCount)
+
+	runQuery := func(time_col string) *QuerySpec {
+		unloadTestTable(tableName)
+		nt := GetTable(tableName)
+		nt.LoadTableInfo()
+		OPTS.TIME_COL_ID = nt.get_key_id(time_col)
+
+		aggs := []Aggregation{nt.Aggregation("age", "avg")}
+		querySpec := QuerySpec{Table: nt,
+			QueryParams: QueryParams{Aggregations: aggs, TimeBucket: 1000}}
+		loadSpec := NewLoadSpec()
+		loadSpec.LoadAllColumns = true
+		nt.LoadAndQueryRecords(&loadSpec, &querySpec)
+		return &querySpec
+	}
+
+	first := runQuery("time")
+	if len(first.TimeResults) == 0 {
+		t.Fatal("TIME SERIES QUERY HAS NO TIME BUCKETS")
+	}
+
+	cached := runQuery("time")
+	if cached.Stats.BlocksCached != blockCount {
+		t.Error("EXPECTED", blockCount, "CACHED BLOCKS, GOT", cached.Stats.BlocksCached)
+	}
+
+	if len(cached.TimeResults) != len(first.TimeResults) {
+		t.Fatal("CACHED TIME SERIES HAS", len(cached.TimeResults), "BUCKETS, EXPECTED", len(first.TimeResults))
+	}
+
+	for bucket, results := range first.TimeResults {
+		cached_results, ok := cached.TimeResults[bucket]
+		if !ok {
+			t.Error("CACHED TIME SERIES IS MISSING BUCKET", bucket)
+			continue
+		}
+
+		for k, v := range results {
+			v2, ok := cached_results[k]
+			if !ok || v.Count != v2.Count {
+				t.Error("CACHED TIME SERIES DIFFERS IN BUCKET", bucket, k)
+			}
+		}
+	}
+
+	// bucketing by another column is another query
+	other := runQuery("age")
+	if other.Stats.BlocksCached != 0 {
+		t.Error("TIME SERIES OVER ANOTHER TIME COLUMN USED THE CACHE")
+	}
+}
+
 func TestCacheKeyGeneration(t *testing.T) {
 	tests := []struct {
 		name string
@@ -0,0 +1,183 @@
+package sybil
+
+import "context"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "text/tabwriter"
+
+// QUERY PLANS
+// ExplainQuery walks the blocks a query would read, in the order it would
+// read them, and decides for each one whether it gets pruned by the block
+// extents in its info.db, served from the query cache or read from disk.
+// Only info.db files and dir listings are read, no column data is loaded.
+
+const (
+	PLAN_READ   = "read"
+	PLAN_PRUNED = "pruned"
+	PLAN_CACHED = "cached"
+	PLAN_BROKEN = "broken"
+)
+
+type BlockPlan struct {
+	Name    string
+	Action  string // one of the PLAN_* actions
+	Reason  string
+	Columns []string // column files the block has for the query
+	Records int64
+	Bytes   int64 // size of the column files that will be read
+}
+
+type QueryPlan struct {
+	Table   string
+	Columns []string // columns the LoadSpec asks for, nil when loading all columns
+	Workers int
+
+	PartitionsPruned []string // partitions the time filters rule out
+
+	Blocks       []*BlockPlan
+	BlocksRead   int
+	BlocksPruned int
+	BlocksCached int
+	BlocksBroken int
+	Records      int64
+	Bytes        int64
+
+	ReadsIngestionLog bool
+}
+
+func (t *Table) ExplainQuery(loadSpec *LoadSpec, querySpec *QuerySpec) *QueryPlan {
+	querySpec.Table = t
+
+	load_all := loadSpec == nil || loadSpec.LoadAllColumns
+
+	plan := QueryPlan{Table: t.Name, Workers: queryWorkers()}
+	if !load_all {
+		for name := range loadSpec.columns {
+			plan.Columns = append(plan.Columns, name)
+		}
+		sort.Strings(plan.Columns)
+	}
+
+	use_cache := FLAGS.CACHED_QUERIES && querySpec.cacheable()
+
+	block_dirs, pruned_partitions := t.listBlockDirs(querySpec)
+	for _, partition := range pruned_partitions {
+		plan.PartitionsPruned = append(plan.PartitionsPruned, path.Base(partition))
+	}
+
+	var results_cache *tableResultsCache
+	if t.useResultsCache(querySpec) {
+		results_cache = t.openResultsCache(querySpec, block_dirs)
+	}
+
+	for _, filename := range t.scheduleBlocks(context.Background(), block_dirs) {
+		block := BlockPlan{Name: filename}
+		plan.Blocks = append(plan.Blocks, &block)
+
+		info := t.LoadBlockInfo(filename)
+		block.Records = int64(info.NumRecords)
+
+		switch {
+		case info.NumRecords <= 0:
+			block.Action = PLAN_BROKEN
+			block.Reason = "info.db is missing or has no records"
+			plan.BlocksBroken++
+			continue
+		case !t.ShouldLoadBlockFromDir(filename, querySpec):
+			block.Action = PLAN_PRUNED
+			block.Reason = "filters rule out the block's min and max or its values"
+			plan.BlocksPruned++
+			continue
+		}
+
+		if results_cache != nil && results_cache.saved != nil {
+			if _, ok := results_cache.saved.Blocks[t.tableBlockName(filename)]; ok {
+				block.Action = PLAN_CACHED
+				block.Reason = "covered by the cached results of the whole query"
+				plan.BlocksCached++
+				continue
+			}
+		}
+
+		if use_cache {
+			cache_file := querySpec.cachedResultsFile(filename)
+			if _, err := os.Stat(cache_file); err == nil {
+				block.Action = PLAN_CACHED
+				block.Reason = fmt.Sprintf("results cached in %s", path.Base(cache_file))
+				plan.BlocksCached++
+				continue
+			}
+		}
+
+		block.Action = PLAN_READ
+		if use_cache {
+			block.Reason = "no cached results for the query"
+		} else {
+			block.Reason = "query cache is off"
+		}
+
+		col_files, _ := ioutil.ReadDir(filename)
+		for _, f := range col_files {
+			fname := trimCodecExt(f.Name())
+			if !strings.HasPrefix(fname, "int_") && !strings.HasPrefix(fname, "str_") && !strings.HasPrefix(fname, "set_") {
+				continue
+			}
+
+			if !load_all && !loadSpec.files[fname] {
+				continue
+			}
+
+			block.Columns = append(block.Columns, strings.TrimSuffix(fname[4:], ".db"))
+			block.Bytes += f.Size()
+		}
+
+		plan.BlocksRead++
+		plan.Records += block.Records
+		plan.Bytes += block.Bytes
+	}
+
+	plan.ReadsIngestionLog = FLAGS.READ_INGESTION_LOG
+
+	return &plan
+}
+
+func (plan *QueryPlan) Print() {
+	if FLAGS.JSON {
+		printJson(plan)
+		return
+	}
+
+	columns := "all"
+	if plan.Columns != nil {
+		columns = strings.Join(plan.Columns, ",")
+	}
+
+	fmt.Println("TABLE", plan.Table)
+	fmt.Println("COLUMNS", columns)
+	fmt.Println("WORKERS", plan.Workers)
+	fmt.Println()
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "BLOCK\tACTION\tRECORDS\tBYTES\tCOLUMNS\tREASON")
+	for _, b := range plan.Blocks {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", path.Base(b.Name), b.Action, b.Records, b.Bytes,
+			strings.Join(b.Columns, ","), b.Reason)
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("READING", plan.BlocksRead, "BLOCKS,", plan.Records, "RECORDS,", plan.Bytes, "BYTES")
+	if len(plan.PartitionsPruned) > 0 {
+		fmt.Println("SKIPPED", len(plan.PartitionsPruned), "PARTITIONS:", strings.Join(plan.PartitionsPruned, ","))
+	}
+	fmt.Println("PRUNED", plan.BlocksPruned, "BLOCKS, CACHED", plan.BlocksCached, "BLOCKS, BROKEN", plan.BlocksBroken, "BLOCKS")
+	if plan.ReadsIngestionLog {
+		fmt.Println("THE INGESTION LOG IS READ TOO")
+	}
+}
@@ -0,0 +1,57 @@
+package sybil
+
+import "testing"
+
+func TestExplainQuery(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(index%20)+10)
+		r.AddStrField("name", "bob")
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	loadSpec.Int("id")
+	querySpec := newQuerySpec()
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("id", "lt", CHUNK_SIZE/2))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	plan := nt.ExplainQuery(&loadSpec, querySpec)
+
+	if len(plan.Blocks) != blockCount {
+		t.Fatal("PLAN HAS", len(plan.Blocks), "BLOCKS, EXPECTED", blockCount)
+	}
+
+	if plan.BlocksRead != 1 || plan.BlocksPruned != blockCount-1 {
+		t.Error("PLAN READS", plan.BlocksRead, "AND PRUNES", plan.BlocksPruned, "BLOCKS")
+	}
+
+	if plan.Records != int64(CHUNK_SIZE) || plan.Bytes <= 0 {
+		t.Error("PLAN ESTIMATES", plan.Records, "RECORDS AND", plan.Bytes, "BYTES")
+	}
+
+	for _, b := range plan.Blocks {
+		if b.Action != PLAN_READ {
+			continue
+		}
+
+		if len(b.Columns) != 2 || b.Columns[0] != "age" || b.Columns[1] != "id" {
+			t.Error("PLAN READS COLUMNS", b.Columns, "EXPECTED [age id]")
+		}
+	}
+
+	if len(nt.BlockList) != 0 {
+		t.Error("EXPLAINING THE QUERY LOADED", len(nt.BlockList), "BLOCKS")
+	}
+}
@@ -0,0 +1,80 @@
+package sybil
+
+import "sync"
+
+// QUERY MEMORY BUDGET
+// FLAGS.MEM_BUDGET (in MB) caps how much memory the blocks a query is
+// loading at the same time may use. A block's memory is estimated from its
+// NumRecords and the number of columns the query loads. Blocks wait for
+// their share of the budget before they are loaded and give it back once
+// they are queried. A block that is bigger than the whole budget is not
+// loaded at all, the query skips it and marks its results as Incomplete.
+
+var BYTES_PER_RECORD = int64(64)        // record struct + slab overhead
+var BYTES_PER_RECORD_COLUMN = int64(16) // one loaded value
+
+type memBudget struct {
+	limit int64 // 0 means unlimited
+	used  int64
+	peak  int64
+
+	cond *sync.Cond
+}
+
+func newMemBudget(limit_mb int) *memBudget {
+	b := memBudget{}
+	b.limit = int64(limit_mb) * 1024 * 1024
+	b.cond = sync.NewCond(&sync.Mutex{})
+
+	return &b
+}
+
+// acquire waits until size bytes of the budget are free, it returns false
+// right away when size is more than the whole budget
+func (b *memBudget) acquire(size int64) bool {
+	if b.limit > 0 && size > b.limit {
+		return false
+	}
+
+	b.cond.L.Lock()
+	for b.limit > 0 && b.used > 0 && b.used+size > b.limit {
+		b.cond.Wait()
+	}
+
+	b.used += size
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	b.cond.L.Unlock()
+
+	return true
+}
+
+func (b *memBudget) release(size int64) {
+	b.cond.L.Lock()
+	b.used -= size
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *memBudget) peakUsage() int64 {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.peak
+}
+
+// estimates the bytes needed to hold a block's records in memory
+func (t *Table) estimateBlockMemory(dirname string, loadSpec *LoadSpec, load_all bool) int64 {
+	info := t.LoadBlockInfo(dirname)
+
+	columns := 0
+	if load_all || loadSpec == nil {
+		t.string_id_m.RLock()
+		columns = len(t.KeyTable)
+		t.string_id_m.RUnlock()
+	} else {
+		columns = len(loadSpec.columns)
+	}
+
+	return int64(info.NumRecords) * (BYTES_PER_RECORD + int64(columns)*BYTES_PER_RECORD_COLUMN)
+}
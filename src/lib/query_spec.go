@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	hll "github.com/logv/loglogbeta"
 )
@@ -20,6 +21,37 @@ type savedQueryResults struct {
 	MatchedCount int
 	Sorted       []*Result
 	Matched      RecordList
+
+	// the samples a block can contribute to a samples query, kept in the
+	// per block query cache instead of Matched
+	CachedSamples []*Sample `json:",omitempty"`
+
+	// set when the query was cancelled before every block was read or
+	// blocks were skipped for not fitting into the memory budget
+	Incomplete bool
+
+	Stats QueryStats
+}
+
+// QueryStats is an account of what a query did. LoadTime and FilterTime are
+// summed over the blocks, so they can add up to more than QueryTime when
+// blocks are read in parallel.
+type QueryStats struct {
+	BlocksConsidered int
+	BlocksPruned     int // skipped by ShouldLoadBlockFromDir
+	BlocksCached     int // served from the query cache
+	RecordsScanned   int64
+	RecordsMatched   int64
+	ColumnsLoaded    int
+	BytesRead        int64
+	PeakMemory       int64 // estimated bytes held by blocks loading at the same time
+	BlocksOverBudget int   // skipped, bigger than the whole memory budget
+
+	LoadTime    time.Duration
+	FilterTime  time.Duration // filtering and aggregating
+	CombineTime time.Duration
+	PrintTime   time.Duration
+	QueryTime   time.Duration // wall time from the first block load to the combined results
 }
 
 type savedQueryParams struct {
@@ -35,9 +67,11 @@ type savedQueryParams struct {
 	Limit       int    `json:",omitempty"`
 	NumDistinct int    `json:",omitempty"` // Exit early once we have NumDistinct records
 	TimeBucket  int    `json:",omitempty"`
+	TimeCol     string `json:",omitempty"` // only set in cache keys
 
-	Samples       bool `json:",omitempty"`
-	CachedQueries bool `json:",omitempty"`
+	Samples       bool   `json:",omitempty"`
+	SampleCols    string `json:",omitempty"` // only set in cache keys
+	CachedQueries bool   `json:",omitempty"`
 }
 
 func Min(x, y int64) int64 {
@@ -64,6 +98,8 @@ type QuerySpec struct {
 
 	BlockList map[string]TableBlock
 	Table     *Table
+
+	print_start time.Time
 }
 
 type Filter interface {
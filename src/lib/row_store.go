@@ -3,6 +3,7 @@ package sybil
 import "fmt"
 import "path"
 import "bytes"
+import "errors"
 import "encoding/gob"
 import "io/ioutil"
 import "time"
@@ -54,7 +55,13 @@ func (srb *SavedRecordBlock) init_data_structures(t *Table) {
 
 func get_short_key_id(t *Table, key_exchange map[int16]int16, key_id int16) int16 {
 	if t.ShortKeyInfo == nil || t.ShortKeyInfo.KeyExchange == nil {
-		return key_id
+		// the SRB's own key ids still need to be exchanged for the table's
+		exchanged, ok := key_exchange[key_id]
+		if !ok {
+			return key_id
+		}
+
+		return exchanged
 	}
 	key_id, ok := key_exchange[key_id]
 	if !ok {
@@ -195,51 +202,115 @@ func get_key_table(t *Table) *map[string]int16 {
 }
 
 func (t *Table) AppendRecordsToLog(records RecordList, blockname string) {
-	if len(records) == 0 {
-		return
+	err := t.appendRecordsToLog(records, blockname)
+	if err != nil {
+		Warn("COULDNT INGEST INTO ROW STORE", err)
 	}
+}
 
-	// TODO: fix this up, so that we don't
-	ingestdir := path.Join(FLAGS.DIR, t.Name, INGEST_DIR)
-	tempingestdir := path.Join(FLAGS.DIR, t.Name, TEMP_INGEST_DIR)
-
-	os.MkdirAll(ingestdir, 0777)
-	os.MkdirAll(tempingestdir, 0777)
-
-	w, err := ioutil.TempFile(tempingestdir, fmt.Sprintf("%s_", blockname))
+func (t *Table) appendRecordsToLog(records RecordList, blockname string) error {
+	if len(records) == 0 {
+		return nil
+	}
 
 	marshalled_records := make([]*SavedRecord, len(records))
 	for i, r := range records {
 		marshalled_records[i] = r.toSavedRecord()
 	}
 
-	var network bytes.Buffer // Stand-in for the network.
-
 	Debug("SAVING RECORDS", len(marshalled_records), "TO INGESTION LOG")
 
-	// Create an encoder and send a value.
-	enc := gob.NewEncoder(&network)
-
+	var err error
 	if FLAGS.SAVE_AS_SRB {
 		Debug("SAVING INTO SRB")
 		srb := SavedRecordBlock{}
 		srb.RecordList = marshalled_records
 		srb.KeyTable = get_key_table(t)
-		err = enc.Encode(srb)
+		err = t.writeIngestionLog(srb, len(marshalled_records), blockname)
 	} else {
-		err = enc.Encode(marshalled_records)
+		err = t.writeIngestionLog(marshalled_records, len(marshalled_records), blockname)
+	}
+
+	return err
+}
+
+// AppendRecordBlockToLog saves an already marshalled SavedRecordBlock into
+// the table's ingestion log. The block's KeyTable describes the column ids
+// used in its records, so the table's own KeyTable does not need to be
+// loaded. Records whose dedup key was already seen are dropped, like
+// IngestRecords does. Unlike AppendRecordsToLog, errors are returned to the
+// caller.
+func (t *Table) AppendRecordBlockToLog(srb *SavedRecordBlock, blockname string) error {
+	if len(srb.RecordList) == 0 {
+		return nil
+	}
+
+	if srb.KeyTable == nil {
+		return errors.New("record block is missing its key table")
 	}
 
+	if len(t.Settings.DedupKey) == 0 {
+		return t.writeIngestionLog(srb, len(srb.RecordList), blockname)
+	}
+
+	keys := make([]string, len(srb.RecordList))
+	for i, r := range srb.RecordList {
+		key, ok := t.savedRecordDedupKey(r, *srb.KeyTable)
+		if ok {
+			keys[i] = key
+		}
+	}
+
+	return t.dedupAndWrite(keys, func(keep []bool) error {
+		kept := SavedRecordBlock{KeyTable: srb.KeyTable}
+		for i, r := range srb.RecordList {
+			if keep[i] {
+				kept.RecordList = append(kept.RecordList, r)
+			}
+		}
+
+		if len(kept.RecordList) == 0 {
+			return nil
+		}
+
+		return t.writeIngestionLog(&kept, len(kept.RecordList), blockname)
+	})
+}
+
+// the ingestion log is written into a temp dir first and then moved into the
+// ingest dir, so digestion never picks up a half written file
+func (t *Table) writeIngestionLog(obj interface{}, num_records int, blockname string) error {
+	ingestdir := path.Join(FLAGS.DIR, t.Name, INGEST_DIR)
+	tempingestdir := path.Join(FLAGS.DIR, t.Name, TEMP_INGEST_DIR)
+
+	os.MkdirAll(ingestdir, 0777)
+	os.MkdirAll(tempingestdir, 0777)
+
+	var network bytes.Buffer // Stand-in for the network.
+
+	// Create an encoder and send a value.
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(obj)
+	if err != nil {
+		return err
+	}
+
+	w, err := ioutil.TempFile(tempingestdir, fmt.Sprintf("%s_", blockname))
 	if err != nil {
-		Error("encode:", err)
+		return err
 	}
 
 	filename := fmt.Sprintf("%s.db", w.Name())
 	basename := path.Base(filename)
 
-	Debug("SERIALIZED INTO LOG", filename, network.Len(), "BYTES", "( PER RECORD", network.Len()/len(marshalled_records), ")")
+	Debug("SERIALIZED INTO LOG", filename, network.Len(), "BYTES", "( PER RECORD", network.Len()/num_records, ")")
 
-	network.WriteTo(w)
+	_, err = network.WriteTo(w)
+	w.Close()
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
 
 	for i := 0; i < 3; i++ {
 		fullname := path.Join(ingestdir, basename)
@@ -247,13 +318,11 @@ func (t *Table) AppendRecordsToLog(records RecordList, blockname string) {
 		err = RenameAndMod(w.Name(), fullname)
 		if err == nil {
 			// we are done writing, time to exit
-			return
+			return nil
 		}
 
-		if err != nil {
-			time.Sleep(time.Millisecond * 10)
-		}
+		time.Sleep(time.Millisecond * 10)
 	}
 
-	Warn("COULDNT INGEST INTO ROW STORE")
+	return err
 }
@@ -23,6 +23,9 @@ type Table struct {
 	StrInfo StrInfoTable
 	IntInfo IntInfoTable
 
+	// Per table options that are saved into info.db
+	Settings TableSettings
+
 	BlockInfoCache map[string]*SavedColumnInfo
 	NewBlockInfos  []string
 
@@ -35,9 +38,25 @@ type Table struct {
 	// This is used for join tables
 	join_lookup map[string]*Record
 
+	// values.db of the blocks, nil for blocks without one
+	block_values map[string]*SavedBlockValues
+
+	index        *SavedTableIndex
+	index_loaded bool
+	// blocks saved since the last commitIndex and their column values
+	index_staged map[string]map[string][]string
+
+	// journal of the digest this process is running, see table_journal.go
+	digest_journal *SavedDigestJournal
+
+	// blocks saved and retired since the last CommitManifest
+	manifest_added   map[string]bool
+	manifest_retired map[string]bool
+
 	string_id_m *sync.RWMutex
 	record_m    *sync.Mutex
 	block_m     *sync.Mutex
+	manifest_m  *sync.Mutex
 }
 
 var LOADED_TABLES = make(map[string]*Table)
@@ -82,6 +101,9 @@ func (t *Table) init_data_structures() {
 
 	t.BlockInfoCache = make(map[string]*SavedColumnInfo, 0)
 	t.NewBlockInfos = make([]string, 0)
+	t.block_values = make(map[string]*SavedBlockValues)
+	t.manifest_added = make(map[string]bool)
+	t.manifest_retired = make(map[string]bool)
 
 	t.StrInfo = make(StrInfoTable)
 	t.IntInfo = make(IntInfoTable)
@@ -95,6 +117,7 @@ func (t *Table) init_locks() {
 	t.string_id_m = &sync.RWMutex{}
 	t.record_m = &sync.Mutex{}
 	t.block_m = &sync.Mutex{}
+	t.manifest_m = &sync.Mutex{}
 
 }
 
@@ -169,6 +192,12 @@ func (t *Table) set_key_type(name_id int16, col_type int8) bool {
 
 }
 
+// AddColumnType registers a column with the given type in the table's key
+// table. It returns false if the column already has a different type.
+func (t *Table) AddColumnType(name string, col_type int8) bool {
+	return t.set_key_type(t.get_key_id(name), col_type)
+}
+
 func (t *Table) NewRecord() *Record {
 	r := Record{Ints: IntArr{}, Strs: StrArr{}}
 
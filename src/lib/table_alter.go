@@ -0,0 +1,868 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+
+// ALTERING COLUMNS
+// AlterTable drops a column, renames it or turns a str column of numbers into
+// an int column, in every block of the table. It holds the digest lock, so
+// no digest or compaction writes blocks in the meantime, and alters one block
+// at a time under its block lock. The alter journal (<table>/alter.db)
+// records the change and the blocks that are done: an alter that died half
+// way is finished by running it again (or sybil alter -resume), and digest
+// and compaction refuse to run on the table until it is. Each step of a
+// block can be redone: new column files are written before the old ones are
+// removed. Once every block is done the column is changed in the table info,
+// its settings and index, and the query caches are purged.
+//
+// Tables without a manifest are altered in place, so queries that run during
+// an alter can see it half done. Tables with a manifest alter a copy of each
+// block instead, saved as a new block. The copies are committed in place of
+// the blocks all at once when every block is done, so queries see the table
+// from before or after the alter.
+//
+// Column ids are handed out by the size of the key table, so the id of a
+// dropped column stays taken: its name in the key table is replaced by
+// DROPPED_COLUMN_PREFIX and the id, without a type.
+
+var ALTER_JOURNAL = "alter.db"
+var DROPPED_COLUMN_PREFIX = "__dropped_"
+
+const (
+	ALTER_DROP   = "drop"
+	ALTER_RENAME = "rename"
+	ALTER_INT    = "int"
+)
+
+type AlterSpec struct {
+	Op      string // ALTER_DROP, ALTER_RENAME or ALTER_INT
+	Column  string
+	NewName string // for ALTER_RENAME
+}
+
+type SavedAlterJournal struct {
+	AlterSpec
+	Done   map[string]bool   // blocks (relative to the table dir) that are altered
+	Copies map[string]string // with a manifest: blocks -> their altered copy
+}
+
+func (t *Table) alterJournalFile() string {
+	return path.Join(FLAGS.DIR, t.Name, ALTER_JOURNAL)
+}
+
+// LoadAlterJournal reads the journal of the running or unfinished alter, it
+// is nil when there is none
+func (t *Table) LoadAlterJournal() (*SavedAlterJournal, error) {
+	if _, err := os.Stat(t.alterJournalFile()); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	journal := SavedAlterJournal{}
+	err := decodeInto(t.alterJournalFile(), &journal)
+	if err != nil {
+		return nil, err
+	}
+
+	if journal.Done == nil {
+		journal.Done = make(map[string]bool)
+	}
+	if journal.Copies == nil {
+		journal.Copies = make(map[string]string)
+	}
+
+	return &journal, nil
+}
+
+// HasUnfinishedAlter is true while an alter is running or after one died
+func (t *Table) HasUnfinishedAlter() bool {
+	_, err := os.Stat(t.alterJournalFile())
+	return err == nil
+}
+
+// writeAlterFile gob encodes obj into filename through a temp file in the
+// same dir, so a crash leaves the old or the new file
+func writeAlterFile(filename string, obj interface{}) error {
+	tempfile, err := ioutil.TempFile(path.Dir(filename), ".alter_")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(tempfile).Encode(obj)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	tempfile.Close()
+
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), filename)
+}
+
+// writeAlteredColumn saves a column into col_fname (without the codec
+// extension) with codec, through a temp file
+func writeAlteredColumn(col_fname string, codec *FileCodec, col interface{}) error {
+	var network bytes.Buffer
+	err := gob.NewEncoder(&network).Encode(col)
+	if err != nil {
+		return err
+	}
+
+	tempfile, err := ioutil.TempFile(path.Dir(col_fname), ".alter_")
+	if err != nil {
+		return err
+	}
+
+	w, err := codec.NewWriter(tempfile)
+	if err == nil {
+		_, err = network.WriteTo(w)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := tempfile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), col_fname+codec.Ext)
+}
+
+// columnFiles lists the files of a column in a block, by their type prefix
+func columnFiles(blockname string, name string) map[string]string {
+	ret := make(map[string]string)
+	files, _ := ioutil.ReadDir(blockname)
+	for _, f := range files {
+		cname := trimCodecExt(f.Name())
+		for _, prefix := range []string{"int_", "str_", "set_"} {
+			if cname == prefix+name+".db" {
+				ret[prefix] = path.Join(blockname, f.Name())
+			}
+		}
+	}
+
+	return ret
+}
+
+type recordIds []uint32
+
+func (a recordIds) Len() int           { return len(a) }
+func (a recordIds) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a recordIds) Less(i, j int) bool { return a[i] < a[j] }
+
+// parseIntColumn reads a str column file and parses its values as ints. It
+// returns the (not delta encoded) records of each value
+func parseIntColumn(filename string) (ValueMap, error) {
+	col := SavedStrColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := make(map[int32]int64)
+	parse := func(id int32) (int64, error) {
+		if v, ok := parsed[id]; ok {
+			return v, nil
+		}
+
+		if id < 0 || int(id) >= len(col.StringTable) {
+			return 0, fmt.Errorf("value id %d isn't in the string table", id)
+		}
+
+		v, err := strconv.ParseInt(strings.TrimSpace(col.StringTable[id]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't an integer", col.StringTable[id])
+		}
+
+		parsed[id] = v
+		return v, nil
+	}
+
+	buckets := ValueMap{}
+	if !col.BucketEncoded {
+		for r, id := range col.Values {
+			v, err := parse(id)
+			if err != nil {
+				return nil, err
+			}
+			buckets[v] = append(buckets[v], uint32(r))
+		}
+
+		return buckets, nil
+	}
+
+	// strings that parse to the same int share a bucket
+	merged := make(map[int64]bool)
+	for _, bucket := range col.Bins {
+		v, err := parse(bucket.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := buckets[v]; ok {
+			merged[v] = true
+		}
+
+		prev := uint32(0)
+		for _, r := range bucket.Records {
+			if col.DeltaEncodedIDs {
+				r = prev + r
+			}
+			buckets[v] = append(buckets[v], r)
+			prev = r
+		}
+	}
+
+	for v := range merged {
+		sort.Sort(recordIds(buckets[v]))
+	}
+
+	return buckets, nil
+}
+
+// newAlteredIntColumn encodes the buckets of an int column the way
+// SaveIntsToColumns does, high cardinality columns are saved as delta
+// encoded values
+func newAlteredIntColumn(name string, buckets ValueMap) *SavedIntColumn {
+	col := NewSavedIntColumn()
+	col.Name = name
+	col.DeltaEncodedIDs = true
+	col.BucketEncoded = len(buckets) <= CARDINALITY_THRESHOLD
+
+	if col.BucketEncoded {
+		for value, records := range buckets {
+			delta_encoded := make([]uint32, len(records))
+			prev := uint32(0)
+			for i, r := range records {
+				delta_encoded[i] = r - prev
+				prev = r
+			}
+
+			col.Bins = append(col.Bins, SavedIntBucket{Value: value, Records: delta_encoded})
+		}
+
+		return &col
+	}
+
+	max_r := 0
+	for _, records := range buckets {
+		if last := int(records[len(records)-1]); last >= max_r {
+			max_r = last + 1
+		}
+	}
+
+	col.ValueEncoded = true
+	col.Values = make([]int64, max_r)
+	for value, records := range buckets {
+		for _, r := range records {
+			col.Values[r] = value
+		}
+	}
+
+	prev := int64(0)
+	for r, value := range col.Values {
+		col.Values[r] = value - prev
+		prev = value
+	}
+
+	return &col
+}
+
+// bucketsIntInfo is the IntInfo of an int column's values, each value
+// counted once per record that has it. Unlike update_int_info, it doesn't
+// skip outliers: the values were all saved before
+func bucketsIntInfo(buckets ValueMap) *IntInfo {
+	info := &IntInfo{}
+	for value, records := range buckets {
+		if len(records) == 0 {
+			continue
+		}
+
+		same := IntInfo{Min: value, Max: value, Avg: float64(value), Count: len(records)}
+		info = mergeIntInfo(info, &same)
+	}
+
+	return info
+}
+
+// mergeIntInfo adds the IntInfo of another block to info, which can be nil
+func mergeIntInfo(info *IntInfo, other *IntInfo) *IntInfo {
+	if info == nil || info.Count == 0 {
+		merged := *other
+		return &merged
+	}
+
+	count := info.Count + other.Count
+	delta := other.Avg - info.Avg
+	merged := IntInfo{Min: info.Min, Max: info.Max, Count: count}
+	if other.Min < merged.Min {
+		merged.Min = other.Min
+	}
+	if other.Max > merged.Max {
+		merged.Max = other.Max
+	}
+
+	merged.Avg = info.Avg + delta*float64(other.Count)/float64(count)
+	merged.M2 = info.M2 + other.M2 + delta*delta*float64(info.Count)*float64(other.Count)/float64(count)
+
+	return &merged
+}
+
+// renameColumnFile saves a column file under the new name of its column,
+// the old file is left for the caller to remove
+func renameColumnFile(filename string, prefix string, new_name string) error {
+	var col interface{}
+	switch prefix {
+	case "int_":
+		int_col := SavedIntColumn{}
+		err := decodeInto(filename, &int_col)
+		if err != nil {
+			return err
+		}
+		int_col.Name = new_name
+		col = &int_col
+	case "str_":
+		str_col := SavedStrColumn{}
+		err := decodeInto(filename, &str_col)
+		if err != nil {
+			return err
+		}
+		str_col.Name = new_name
+		col = &str_col
+	default:
+		set_col := SavedSetColumn{}
+		err := decodeInto(filename, &set_col)
+		if err != nil {
+			return err
+		}
+		set_col.Name = new_name
+		col = &set_col
+	}
+
+	col_fname := path.Join(path.Dir(filename), prefix+new_name+".db")
+	return writeAlteredColumn(col_fname, codecForFile(filename), col)
+}
+
+// copyBlockDir copies the files of a block into dst, leaving out its query
+// cache
+func copyBlockDir(dst string, src string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		err = cp(path.Join(dst, f.Name()), path.Join(src, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readAlteredBlockInfo reads the info of a block, it is nil when the block
+// doesn't have the column
+func (t *Table) readAlteredBlockInfo(blockname string, name string) *SavedColumnInfo {
+	info := SavedColumnInfo{}
+	err := decodeInto(path.Join(blockname, "info.db"), &info)
+	if err != nil {
+		Warn("SKIPPING UNREADABLE BLOCK", blockname, err, "RUN sybil fsck ON", t.Name)
+		return nil
+	}
+
+	files := columnFiles(blockname, name)
+	if len(files) == 0 && info.IntInfoMap[name] == nil && info.StrInfoMap[name] == nil {
+		return nil
+	}
+
+	return &info
+}
+
+// alterBlock makes the change of spec in one block and returns whether the
+// block had the column. Running it again on a block that is (half) done
+// finishes it
+func (t *Table) alterBlock(blockname string, spec *AlterSpec) (bool, error) {
+	info_file := path.Join(blockname, "info.db")
+	info := t.readAlteredBlockInfo(blockname, spec.Column)
+	if info == nil {
+		return false, nil
+	}
+
+	var err error
+	values := t.LoadBlockValues(blockname)
+	files := columnFiles(blockname, spec.Column)
+
+	var values_changed bool
+	var int_col *SavedIntColumn
+	remove := files
+	switch spec.Op {
+	case ALTER_DROP:
+		delete(info.IntInfoMap, spec.Column)
+		delete(info.StrInfoMap, spec.Column)
+		if values != nil {
+			_, values_changed = values.Columns[spec.Column]
+			delete(values.Columns, spec.Column)
+		}
+
+	case ALTER_RENAME:
+		// the new files go first, so a crash leaves the old ones to
+		// rename again
+		for prefix, filename := range files {
+			err = renameColumnFile(filename, prefix, spec.NewName)
+			if err != nil {
+				return true, err
+			}
+		}
+
+		if int_info, ok := info.IntInfoMap[spec.Column]; ok {
+			info.IntInfoMap[spec.NewName] = int_info
+			delete(info.IntInfoMap, spec.Column)
+		}
+		if str_info, ok := info.StrInfoMap[spec.Column]; ok {
+			info.StrInfoMap[spec.NewName] = str_info
+			delete(info.StrInfoMap, spec.Column)
+		}
+		if values != nil {
+			if col_values, ok := values.Columns[spec.Column]; ok {
+				values.Columns[spec.NewName] = col_values
+				delete(values.Columns, spec.Column)
+				values_changed = true
+			}
+		}
+
+	case ALTER_INT:
+		filename, ok := files["str_"]
+		if !ok {
+			// converted before a crash, the info went first
+			return true, nil
+		}
+		remove = map[string]string{"str_": filename}
+
+		buckets, err := parseIntColumn(filename)
+		if err != nil {
+			return true, err
+		}
+		int_col = newAlteredIntColumn(spec.Column, buckets)
+
+		if info.IntInfoMap == nil {
+			info.IntInfoMap = SavedIntInfo{}
+		}
+		delete(info.StrInfoMap, spec.Column)
+		if len(buckets) > 0 {
+			info.IntInfoMap[spec.Column] = bucketsIntInfo(buckets)
+		}
+		if values != nil {
+			_, values_changed = values.Columns[spec.Column]
+			delete(values.Columns, spec.Column)
+		}
+	}
+
+	err = writeAlterFile(info_file, info)
+	if err == nil && values_changed {
+		err = writeAlterFile(path.Join(blockname, "values.db"), values)
+	}
+	if err == nil && int_col != nil {
+		col_fname := path.Join(blockname, "int_"+spec.Column+".db")
+		err = writeAlteredColumn(col_fname, codecForFile(remove["str_"]), int_col)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	for _, filename := range remove {
+		err = os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// alterBlockCopy makes the change of the journal's spec in a copy of the
+// block, which is saved as a new block. The block itself is left alone for
+// queries until the copy is committed in its place
+func (t *Table) alterBlockCopy(blockname string, journal *SavedAlterJournal) (bool, error) {
+	if t.readAlteredBlockInfo(blockname, journal.Column) == nil {
+		return false, nil
+	}
+
+	// the copy of a crashed alter may be half written
+	name := t.tableBlockName(blockname)
+	if copy_name, ok := journal.Copies[name]; ok {
+		os.RemoveAll(path.Join(FLAGS.DIR, t.Name, copy_name))
+	}
+
+	copy_dir, err := t.getNewBlockNameIn(path.Dir(blockname))
+	if err != nil {
+		return true, err
+	}
+
+	journal.Copies[name] = t.tableBlockName(copy_dir)
+	err = writeAlterFile(t.alterJournalFile(), journal)
+	if err == nil {
+		err = copyBlockDir(copy_dir, blockname)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	return t.alterBlock(copy_dir, &journal.AlterSpec)
+}
+
+// stageAlterCopies stages the altered copies of blocks in the manifest in
+// place of the blocks and returns the blocks of the table after the alter
+func (t *Table) stageAlterCopies(journal *SavedAlterJournal, block_dirs []string) []string {
+	ret := make([]string, 0, len(block_dirs))
+	for _, blockname := range block_dirs {
+		copy_name, ok := journal.Copies[t.tableBlockName(blockname)]
+		if !ok {
+			ret = append(ret, blockname)
+			continue
+		}
+
+		copy_dir := path.Join(FLAGS.DIR, t.Name, copy_name)
+		t.stageManifestBlock(copy_dir)
+		t.retireBlocks([]string{blockname})
+		ret = append(ret, copy_dir)
+	}
+
+	return ret
+}
+
+func (t *Table) hasRowStoreFiles() bool {
+	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, t.Name, INGEST_DIR))
+	return len(files) > 0
+}
+
+func removeColumnName(cols []string, name string) []string {
+	ret := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if col != name {
+			ret = append(ret, col)
+		}
+	}
+
+	return ret
+}
+
+func renameColumnName(cols []string, name string, new_name string) []string {
+	ret := make([]string, len(cols))
+	for i, col := range cols {
+		ret[i] = col
+		if col == name {
+			ret[i] = new_name
+		}
+	}
+
+	return ret
+}
+
+func hasColumnName(cols []string, name string) bool {
+	for _, col := range cols {
+		if col == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAlter looks for reasons not to start an alter: columns that aren't
+// there or are in use, undigested records (the row store has its own key
+// table) and, for ALTER_INT, values that aren't integers
+func (t *Table) checkAlter(spec *AlterSpec) error {
+	t.string_id_m.RLock()
+	id, ok := t.KeyTable[spec.Column]
+	col_type, typed := t.KeyTypes[id]
+	new_id, new_ok := t.KeyTable[spec.NewName]
+	_, new_typed := t.KeyTypes[new_id]
+	t.string_id_m.RUnlock()
+
+	if !ok || !typed {
+		return fmt.Errorf("table %s has no column %s", t.Name, spec.Column)
+	}
+
+	switch spec.Op {
+	case ALTER_DROP:
+		if spec.Column == t.Settings.PartitionCol {
+			return fmt.Errorf("can't drop %s, the table is partitioned by it", spec.Column)
+		}
+		if hasColumnName(t.Settings.DedupKey, spec.Column) {
+			return fmt.Errorf("can't drop %s, it is part of the dedup key", spec.Column)
+		}
+
+	case ALTER_RENAME:
+		if spec.NewName == "" || spec.NewName == spec.Column {
+			return fmt.Errorf("%s needs a new name", spec.Column)
+		}
+		if new_ok && new_typed {
+			return fmt.Errorf("table %s already has a column %s", t.Name, spec.NewName)
+		}
+
+	case ALTER_INT:
+		if col_type != STR_VAL {
+			return fmt.Errorf("%s isn't a str column", spec.Column)
+		}
+
+	default:
+		return fmt.Errorf("unknown alter %q", spec.Op)
+	}
+
+	if t.hasRowStoreFiles() {
+		return fmt.Errorf("table %s has undigested records, digest it first", t.Name)
+	}
+
+	journal, err := t.LoadDigestJournal()
+	if err != nil {
+		return fmt.Errorf("couldn't read digest journal of table %s: %v", t.Name, err)
+	}
+	if journal != nil {
+		return fmt.Errorf("table %s has an unfinished digest, run sybil fsck -fix first", t.Name)
+	}
+
+	if spec.Op != ALTER_INT {
+		return nil
+	}
+
+	// every block is parsed before the first one is changed, so a value
+	// that isn't an integer doesn't leave the column half converted
+	block_dirs, _ := t.listBlockDirs(nil)
+	for _, blockname := range block_dirs {
+		filename, ok := columnFiles(blockname, spec.Column)["str_"]
+		if !ok {
+			continue
+		}
+
+		_, err := parseIntColumn(filename)
+		if err != nil {
+			return fmt.Errorf("can't convert %s in block %s: %v", spec.Column, t.tableBlockName(blockname), err)
+		}
+	}
+
+	return nil
+}
+
+// retireKeyName keeps the id of a column name that goes away taken, see the
+// top of this file. The string_id_m lock has to be held
+func (t *Table) retireKeyName(name string) {
+	id, ok := t.KeyTable[name]
+	if !ok {
+		return
+	}
+
+	delete(t.KeyTable, name)
+	t.KeyTable[DROPPED_COLUMN_PREFIX+strconv.Itoa(int(id))] = id
+	delete(t.KeyTypes, id)
+	delete(t.IntInfo, id)
+	delete(t.StrInfo, id)
+}
+
+// finishAlter changes the column in the table info, settings and index once
+// every block is altered. altered_dirs are the blocks of the table after the
+// alter, they differ from block_dirs when altered copies were made
+func (t *Table) finishAlter(spec *AlterSpec, block_dirs []string, altered_dirs []string) error {
+	gone := make(map[string]bool)
+	t.block_m.Lock()
+	for _, name := range block_dirs {
+		gone[name] = true
+		delete(t.BlockList, name)
+		delete(t.BlockInfoCache, name)
+		delete(t.block_values, name)
+	}
+
+	new_infos := make([]string, 0)
+	for _, name := range t.NewBlockInfos {
+		if !gone[name] {
+			new_infos = append(new_infos, name)
+		}
+	}
+	t.NewBlockInfos = new_infos
+	t.block_m.Unlock()
+	t.forgetCachedBlockInfos(gone)
+
+	// the table's int info of a converted column comes from its blocks
+	var int_info *IntInfo
+	if spec.Op == ALTER_INT {
+		for _, blockname := range altered_dirs {
+			info := t.LoadBlockInfo(blockname)
+			if col_info := info.IntInfoMap[spec.Column]; col_info != nil {
+				int_info = mergeIntInfo(int_info, col_info)
+			}
+		}
+	}
+	t.WriteBlockCache()
+
+	// the index is kept by block name, so altered copies need indexing too
+	indexed := hasColumnName(t.Settings.IndexCols, spec.Column)
+	indexed = indexed || (t.HasManifest() && len(t.Settings.IndexCols) > 0)
+
+	t.string_id_m.Lock()
+	id, ok := t.KeyTable[spec.Column]
+	switch {
+	case !ok:
+		// the table info was saved before a crash
+	case spec.Op == ALTER_DROP:
+		t.retireKeyName(spec.Column)
+	case spec.Op == ALTER_RENAME:
+		if new_id, ok := t.KeyTable[spec.NewName]; ok && new_id != id {
+			t.retireKeyName(spec.NewName)
+		}
+		delete(t.KeyTable, spec.Column)
+		t.KeyTable[spec.NewName] = id
+	case spec.Op == ALTER_INT:
+		t.KeyTypes[id] = INT_VAL
+		delete(t.StrInfo, id)
+		delete(t.IntInfo, id)
+		if int_info != nil {
+			t.IntInfo[id] = int_info
+		}
+	}
+	t.string_id_m.Unlock()
+	t.populate_string_id_lookup()
+
+	switch spec.Op {
+	case ALTER_DROP:
+		t.Settings.IndexCols = removeColumnName(t.Settings.IndexCols, spec.Column)
+		t.Settings.SortKey = removeColumnName(t.Settings.SortKey, spec.Column)
+	case ALTER_INT:
+		// the table index only keeps str and set columns
+		t.Settings.IndexCols = removeColumnName(t.Settings.IndexCols, spec.Column)
+	case ALTER_RENAME:
+		t.SetIndexColumns(renameColumnName(t.Settings.IndexCols, spec.Column, spec.NewName))
+		t.Settings.SortKey = renameColumnName(t.Settings.SortKey, spec.Column, spec.NewName)
+		t.Settings.DedupKey = renameColumnName(t.Settings.DedupKey, spec.Column, spec.NewName)
+		if t.Settings.PartitionCol == spec.Column {
+			t.Settings.PartitionCol = spec.NewName
+		}
+	}
+
+	if !t.CommitManifest() {
+		return fmt.Errorf("couldn't commit the altered blocks of table %s", t.Name)
+	}
+
+	err := t.WriteTableInfo("info")
+	if err != nil {
+		return err
+	}
+
+	if indexed {
+		err = t.BuildIndex()
+		if err != nil {
+			Warn("COULDNT REBUILD INDEX OF", t.Name, err, "RUN sybil index")
+		}
+	}
+
+	t.PurgeQueryCache("")
+	os.RemoveAll(t.resultsCacheDir())
+
+	return nil
+}
+
+// AlterTable makes the change of spec in every block of the table and then
+// in its info. With a nil spec, it finishes an unfinished alter. It returns
+// how many blocks had the column
+func (t *Table) AlterTable(spec *AlterSpec) (int, error) {
+	if t.GrabDigestLock() == false {
+		return 0, fmt.Errorf("couldn't grab digest lock of table %s", t.Name)
+	}
+	defer t.ReleaseDigestLock()
+
+	journal, err := t.LoadAlterJournal()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read alter journal of table %s: %v", t.Name, err)
+	}
+
+	switch {
+	case journal != nil && spec != nil && journal.AlterSpec != *spec:
+		return 0, fmt.Errorf("table %s has an unfinished alter (%s %s), resume it first", t.Name, journal.Op, journal.Column)
+	case journal == nil && spec == nil:
+		return 0, nil
+	case journal == nil:
+		err = t.checkAlter(spec)
+		if err != nil {
+			return 0, err
+		}
+
+		journal = &SavedAlterJournal{AlterSpec: *spec, Done: make(map[string]bool)}
+		err = writeAlterFile(t.alterJournalFile(), journal)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		Debug("RESUMING ALTER", journal.Op, journal.Column, "OF", t.Name, "AFTER", len(journal.Done), "BLOCKS")
+	}
+
+	block_dirs, _ := t.listBlockDirs(nil)
+	sort.Strings(block_dirs)
+
+	// copies are already in the manifest when an alter died after its commit
+	with_copies := t.HasManifest()
+	is_copy := make(map[string]bool)
+	for _, copy_name := range journal.Copies {
+		is_copy[copy_name] = true
+	}
+
+	altered := 0
+	for _, blockname := range block_dirs {
+		name := t.tableBlockName(blockname)
+		if journal.Done[name] || is_copy[name] {
+			continue
+		}
+
+		if t.GrabBlockLock(blockname) == false {
+			return altered, fmt.Errorf("couldn't grab lock of block %s", name)
+		}
+		var had_column bool
+		if with_copies {
+			had_column, err = t.alterBlockCopy(blockname, journal)
+		} else {
+			had_column, err = t.alterBlock(blockname, &journal.AlterSpec)
+		}
+		t.ReleaseBlockLock(blockname)
+
+		if err != nil {
+			return altered, fmt.Errorf("couldn't alter %s in block %s: %v", journal.Column, name, err)
+		}
+		if had_column {
+			altered++
+		}
+
+		journal.Done[name] = true
+		err = writeAlterFile(t.alterJournalFile(), journal)
+		if err != nil {
+			return altered, err
+		}
+	}
+
+	altered_dirs := block_dirs
+	if with_copies {
+		altered_dirs = t.stageAlterCopies(journal, block_dirs)
+	}
+
+	err = t.finishAlter(&journal.AlterSpec, block_dirs, altered_dirs)
+	if err != nil {
+		return altered, err
+	}
+
+	Debug("ALTERED", journal.Op, journal.Column, "IN", altered, "BLOCKS OF", t.Name)
+	return altered, os.Remove(t.alterJournalFile())
+}
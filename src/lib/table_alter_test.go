@@ -0,0 +1,249 @@
+package sybil
+
+import "math"
+import "path"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "testing"
+
+func reloadAlteredTable(tableName string) *Table {
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	return nt
+}
+
+func countColumnFiles(t *testing.T, tableName string, pattern string) int {
+	files, err := filepath.Glob(path.Join(FLAGS.DIR, tableName, "*", pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(files)
+}
+
+func TestAlterTable(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.TABLE = tableName // TODO: eliminate global use
+
+	blockCount := 2
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("age", int64(index%20))
+		r.AddStrField("age_str", strconv.FormatInt(int64(index%20), 10))
+		r.AddStrField("name", "name_"+strconv.Itoa(index%3))
+		r.AddSetField("tags", []string{"a", strconv.Itoa(index % 2)})
+	}, blockCount)
+
+	GetTable(tableName).SetIndexColumns([]string{"age_str"})
+	saveAndReloadTable(t, tableName, blockCount)
+	nt := reloadAlteredTable(tableName)
+	key_table_len := len(nt.KeyTable)
+
+	// rename
+	altered, err := nt.AlterTable(&AlterSpec{Op: ALTER_RENAME, Column: "age_str", NewName: "code"})
+	if err != nil || altered != blockCount {
+		t.Fatal("COULDNT RENAME COLUMN", altered, err)
+	}
+
+	nt = reloadAlteredTable(tableName)
+	if _, ok := nt.KeyTable["age_str"]; ok || nt.KeyTypes[nt.KeyTable["code"]] != STR_VAL {
+		t.Error("COLUMN WASNT RENAMED IN THE TABLE INFO", nt.KeyTable)
+	}
+	if len(nt.Settings.IndexCols) != 1 || nt.Settings.IndexCols[0] != "code" {
+		t.Error("COLUMN WASNT RENAMED IN THE INDEX COLUMNS", nt.Settings.IndexCols)
+	}
+	if countColumnFiles(t, tableName, "str_age_str.db*") != 0 || countColumnFiles(t, tableName, "str_code.db*") != blockCount {
+		t.Error("COLUMN FILES WERENT RENAMED")
+	}
+
+	// a column that isn't all numbers can't be converted
+	_, err = nt.AlterTable(&AlterSpec{Op: ALTER_INT, Column: "name"})
+	if err == nil || nt.HasUnfinishedAlter() {
+		t.Error("CONVERTED A COLUMN OF NAMES TO INT")
+	}
+
+	// retype
+	_, err = nt.AlterTable(&AlterSpec{Op: ALTER_INT, Column: "code"})
+	if err != nil {
+		t.Fatal("COULDNT CONVERT COLUMN", err)
+	}
+
+	nt = reloadAlteredTable(tableName)
+	code_id := nt.KeyTable["code"]
+	if nt.KeyTypes[code_id] != INT_VAL {
+		t.Error("COLUMN ISNT AN INT COLUMN", nt.KeyTypes)
+	}
+	if info := nt.IntInfo[code_id]; info == nil || info.Min != 0 || info.Max != 19 || info.Count != CHUNK_SIZE*blockCount {
+		t.Error("WRONG INT INFO FOR CONVERTED COLUMN", info)
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	loadSpec.Int("code")
+	block_dirs, _ := nt.listBlockDirs(nil)
+	for _, blockname := range block_dirs {
+		block := nt.LoadBlockFromDir(blockname, &loadSpec, true)
+		if block == nil {
+			t.Fatal("COULDNT LOAD BLOCK", blockname)
+		}
+
+		age_id := nt.KeyTable["age"]
+		for _, r := range block.RecordList {
+			if r.Populated[code_id] != INT_VAL || r.Ints[code_id] != r.Ints[age_id] {
+				t.Fatal("CONVERTED VALUE", r.Ints[code_id], "DOESNT MATCH", r.Ints[age_id])
+			}
+		}
+	}
+
+	if len(nt.Settings.IndexCols) != 0 || nt.loadIndexFile().Columns["code"] != nil {
+		t.Error("CONVERTED COLUMN SHOULD BE TAKEN OUT OF THE INDEX", nt.Settings.IndexCols)
+	}
+
+	// drop
+	_, err = nt.AlterTable(&AlterSpec{Op: ALTER_DROP, Column: "name"})
+	if err != nil {
+		t.Fatal("COULDNT DROP COLUMN", err)
+	}
+
+	nt = reloadAlteredTable(tableName)
+	if _, ok := nt.KeyTable["name"]; ok || len(nt.KeyTable) != key_table_len {
+		t.Error("DROPPED COLUMN SHOULD GIVE UP ITS NAME AND KEEP ITS ID", nt.KeyTable)
+	}
+	if countColumnFiles(t, tableName, "str_name.db*") != 0 {
+		t.Error("DROPPED COLUMN STILL HAS FILES")
+	}
+
+	// an alter that died after its first block
+	spec := AlterSpec{Op: ALTER_DROP, Column: "tags"}
+	journal := SavedAlterJournal{AlterSpec: spec, Done: make(map[string]bool)}
+	block_dirs, _ = nt.listBlockDirs(nil)
+	_, err = nt.alterBlock(block_dirs[0], &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Done[nt.tableBlockName(block_dirs[0])] = true
+	writeAlterFile(nt.alterJournalFile(), &journal)
+
+	nt = reloadAlteredTable(tableName)
+	if nt.CompactTable(&CompactSpec{MaxBlocks: COMPACT_MAX_BLOCKS}) != 0 {
+		t.Error("COMPACTED A TABLE WITH AN UNFINISHED ALTER")
+	}
+
+	_, err = nt.AlterTable(&AlterSpec{Op: ALTER_DROP, Column: "age"})
+	if err == nil {
+		t.Error("STARTED AN ALTER BEFORE THE UNFINISHED ONE WAS RESUMED")
+	}
+
+	altered, err = nt.AlterTable(nil)
+	if err != nil || altered != blockCount-1 {
+		t.Fatal("COULDNT RESUME ALTER", altered, err)
+	}
+
+	nt = reloadAlteredTable(tableName)
+	if nt.HasUnfinishedAlter() || countColumnFiles(t, tableName, "set_tags.db*") != 0 {
+		t.Error("RESUMED ALTER DIDNT DROP THE COLUMN FROM EVERY BLOCK")
+	}
+	if _, ok := nt.KeyTable["tags"]; ok {
+		t.Error("RESUMED ALTER DIDNT DROP THE COLUMN FROM THE TABLE INFO")
+	}
+}
+
+func TestAlterManifestTable(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.TABLE = tableName // TODO: eliminate global use
+
+	blockCount := 3
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("age", int64(index%20))
+		r.AddStrField("name", "name_"+strconv.Itoa(index%3))
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+	nt := reloadAlteredTable(tableName)
+	if nt.EnableManifest() == false {
+		t.Fatal("COULDNT START MANIFEST")
+	}
+
+	// an alter that died after its first block
+	spec := AlterSpec{Op: ALTER_RENAME, Column: "name", NewName: "label"}
+	journal := SavedAlterJournal{AlterSpec: spec, Done: make(map[string]bool), Copies: make(map[string]string)}
+	block_dirs, _ := nt.listBlockDirs(nil)
+	sort.Strings(block_dirs)
+	_, err := nt.alterBlockCopy(block_dirs[0], &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Done[nt.tableBlockName(block_dirs[0])] = true
+	writeAlterFile(nt.alterJournalFile(), &journal)
+
+	// queries still see every block as it was
+	nt = reloadAlteredTable(tableName)
+	listed, _ := nt.listBlockDirs(nil)
+	if len(listed) != blockCount {
+		t.Fatal("HALF DONE ALTER CHANGED THE LISTED BLOCKS", listed)
+	}
+	for _, blockname := range listed {
+		if _, ok := columnFiles(blockname, "name")["str_"]; !ok {
+			t.Error("HALF DONE ALTER CHANGED BLOCK", blockname)
+		}
+	}
+
+	altered, err := nt.AlterTable(nil)
+	if err != nil || altered != blockCount-1 {
+		t.Fatal("COULDNT RESUME ALTER", altered, err)
+	}
+
+	// the altered copies replace every block at once
+	nt = reloadAlteredTable(tableName)
+	listed, _ = nt.listBlockDirs(nil)
+	if len(listed) != blockCount {
+		t.Fatal("EXPECTED", blockCount, "BLOCKS AFTER THE ALTER, FOUND", listed)
+	}
+	for _, blockname := range listed {
+		files := columnFiles(blockname, "label")
+		if _, ok := files["str_"]; !ok || len(columnFiles(blockname, "name")) != 0 {
+			t.Error("BLOCK", blockname, "WASNT ALTERED")
+		}
+		for _, original := range block_dirs {
+			if blockname == original {
+				t.Error("ALTERED BLOCK", blockname, "WASNT REPLACED BY ITS COPY")
+			}
+		}
+	}
+
+	// the blocks of the old version stay on disk for queries still reading it
+	for _, original := range block_dirs {
+		if _, ok := columnFiles(original, "name")["str_"]; !ok {
+			t.Error("RETIRED BLOCK", original, "WAS CHANGED")
+		}
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Str("label")
+	if count := nt.LoadRecords(&loadSpec); count != CHUNK_SIZE*blockCount {
+		t.Error("EXPECTED", CHUNK_SIZE*blockCount, "RECORDS AFTER THE ALTER, FOUND", count)
+	}
+}
+
+func TestBucketsIntInfo(t *testing.T) {
+	// 1 three times and 10 once
+	info := bucketsIntInfo(ValueMap{1: []uint32{0, 1, 2}, 10: []uint32{3}})
+	if info.Count != 4 || info.Min != 1 || info.Max != 10 || info.Avg != 3.25 {
+		t.Error("INT INFO DOESNT WEIGH VALUES BY THEIR RECORDS", info)
+	}
+
+	// the deltas from the avg are -2.25 (three times) and 6.75
+	if m2 := 3*2.25*2.25 + 6.75*6.75; math.Abs(info.M2-m2) > 1e-9 {
+		t.Error("INT INFO HAS M2", info.M2, "EXPECTED", m2)
+	}
+}
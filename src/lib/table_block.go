@@ -8,6 +8,7 @@ type TableBlock struct {
 	RecordList RecordList
 	Info       *SavedColumnInfo
 	Size       int64
+	BytesRead  int64 // size of the column files that were unpacked
 	Matched    RecordList
 
 	IntInfo IntInfoTable
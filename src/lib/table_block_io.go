@@ -1,6 +1,7 @@
 package sybil
 
 import "bytes"
+import "context"
 import "fmt"
 import "time"
 import "os"
@@ -20,7 +21,13 @@ func (t *Table) SaveRecordsToBlock(records RecordList, filename string) bool {
 	temp_block.RecordList = records
 	temp_block.table = t
 
-	return temp_block.SaveToColumns(filename)
+	t.journalBlock(filename, len(records))
+	if temp_block.SaveToColumns(filename) == false {
+		return false
+	}
+
+	t.stageManifestBlock(filename)
+	return true
 }
 
 func (t *Table) FindPartialBlocks() []*TableBlock {
@@ -63,11 +70,19 @@ func (t *Table) FillPartialBlock() bool {
 		filename = b.Name
 	}
 
+	left, ok := t.fillPartialBlock(filename, t.newRecords)
+	t.newRecords = left
+	return ok
+}
+
+// fillPartialBlock tops up the partial block in filename with records and
+// returns the records that didn't fit
+func (t *Table) fillPartialBlock(filename string, records RecordList) (RecordList, bool) {
 	Debug("OPENING PARTIAL BLOCK", filename)
 
 	if t.GrabBlockLock(filename) == false {
 		Debug("CANT FILL PARTIAL BLOCK DUE TO LOCK", filename)
-		return true
+		return records, true
 	}
 
 	defer t.ReleaseBlockLock(filename)
@@ -77,7 +92,7 @@ func (t *Table) FillPartialBlock() bool {
 
 	block := t.LoadBlockFromDir(filename, nil, true /* LOAD ALL RECORDS */)
 	if block == nil {
-		return true
+		return records, true
 	}
 
 	partialRecords := block.RecordList
@@ -85,25 +100,46 @@ func (t *Table) FillPartialBlock() bool {
 
 	if len(partialRecords) < CHUNK_SIZE {
 		delta := CHUNK_SIZE - len(partialRecords)
-		if delta > len(t.newRecords) {
-			delta = len(t.newRecords)
+		if delta > len(records) {
+			delta = len(records)
 		}
 
 		Debug("SAVING PARTIAL RECORDS", delta, "TO", filename)
-		partialRecords = append(partialRecords, t.newRecords[0:delta]...)
-		if t.SaveRecordsToBlock(partialRecords, filename) == false {
-			Debug("COULDNT SAVE PARTIAL RECORDS TO", filename)
-			return false
+		partialRecords = append(partialRecords, records[0:delta]...)
+		if len(t.Settings.SortKey) > 0 {
+			t.SortRecords(partialRecords)
+		}
+
+		// blocks in a manifest are never rewritten in place, queries of an
+		// older version may still read them. Neither are blocks that a
+		// journaled digest may have to put back
+		target := filename
+		if t.HasManifest() || t.digest_journal != nil {
+			var err error
+			target, err = t.getNewBlockNameIn(path.Dir(filename))
+			if err != nil {
+				Debug("COULDNT CREATE BLOCK TO REPLACE", filename, err)
+				return records, false
+			}
+		}
+
+		if t.SaveRecordsToBlock(partialRecords, target) == false {
+			Debug("COULDNT SAVE PARTIAL RECORDS TO", target)
+			return records, false
+		}
+
+		if target != filename {
+			t.replaceBlock(filename)
 		}
 
-		if delta < len(t.newRecords) {
-			t.newRecords = t.newRecords[delta:]
-		} else {
-			t.newRecords = make(RecordList, 0)
+		if delta < len(records) {
+			return records[delta:], true
 		}
+
+		return make(RecordList, 0), true
 	}
 
-	return true
+	return records, true
 }
 
 // optimizing for integer pre-cached info
@@ -112,13 +148,17 @@ func (t *Table) ShouldLoadBlockFromDir(dirname string, querySpec *QuerySpec) boo
 		return true
 	}
 
+	if !t.blockInIndex(dirname, querySpec.Filters) {
+		return false
+	}
+
 	info := t.LoadBlockInfo(dirname)
 
 	max_record := Record{Ints: IntArr{}, Strs: StrArr{}}
 	min_record := Record{Ints: IntArr{}, Strs: StrArr{}}
 
 	if len(info.IntInfoMap) == 0 {
-		return true
+		return t.blockMayMatchValues(dirname, querySpec.Filters)
 	}
 
 	for field_name, _ := range info.StrInfoMap {
@@ -178,6 +218,10 @@ func (t *Table) ShouldLoadBlockFromDir(dirname string, querySpec *QuerySpec) boo
 		}
 	}
 
+	if add && !t.blockMayMatchValues(dirname, querySpec.Filters) {
+		add = false
+	}
+
 	return add
 }
 
@@ -223,6 +267,12 @@ func (t *Table) LoadBlockInfo(dirname string) *SavedColumnInfo {
 // TODO: have this only pull the blocks into column format and not materialize
 // the columns immediately
 func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_records bool) *TableBlock {
+	return t.LoadBlockFromDirContext(context.Background(), dirname, loadSpec, load_records)
+}
+
+// LoadBlockFromDirContext stops unpacking the block's columns once ctx is
+// done and returns nil, like for a block that can't be read
+func (t *Table) LoadBlockFromDirContext(ctx context.Context, dirname string, loadSpec *LoadSpec, load_records bool) *TableBlock {
 	tb := newTableBlock()
 
 	tb.Name = dirname
@@ -270,7 +320,7 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 		// over here, we have to accomodate .gz extension, i guess
 		if loadSpec != nil {
 			// we cut off extensions to check our loadSpec
-			cname := strings.TrimRight(fname, GZIP_EXT)
+			cname := trimCodecExt(fname)
 
 			if loadSpec.files[cname] != true && load_records == false {
 				continue
@@ -279,8 +329,21 @@ func (t *Table) LoadBlockFromDir(dirname string, loadSpec *LoadSpec, load_record
 			continue
 		}
 
+		if ctx.Err() != nil {
+			Debug("QUERY CANCELLED, NOT LOADING THE REST OF", dirname)
+			file.Close()
+			t.block_m.Lock()
+			if loadSpec != nil {
+				tb.RecycleSlab(loadSpec)
+			}
+			delete(t.BlockList, dirname)
+			t.block_m.Unlock()
+			return nil
+		}
+
 		filename := fmt.Sprintf("%s/%s", dirname, fname)
 
+		tb.BytesRead += fsize
 		dec := GetFileDecoder(filename)
 
 		err := error(nil)
@@ -314,7 +377,8 @@ type AfterLoadQueryCB struct {
 	wg        *sync.WaitGroup
 	records   RecordList
 
-	count int
+	count   int
+	scanned int
 }
 
 func (cb *AfterLoadQueryCB) CB(digestname string, records RecordList) {
@@ -328,6 +392,7 @@ func (cb *AfterLoadQueryCB) CB(digestname string, records RecordList) {
 	}
 
 	querySpec := cb.querySpec
+	cb.scanned += len(records)
 
 	for _, r := range records {
 		add := true
@@ -0,0 +1,339 @@
+package sybil
+
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+
+// COMPACTION
+// Digest only tops up the last partial block, so tables that get many small
+// digests end up with lots of undersized blocks. CompactTable rewrites the
+// undersized blocks (and blocks whose time ranges overlap) into full
+// CHUNK_SIZE blocks: the records of a group of blocks are loaded, sorted and
+// saved into new blocks, then the old blocks are removed (or retired, in
+// tables with a manifest) along with their query cache and their entries in
+// the table's block cache and index.
+
+type CompactSpec struct {
+	MaxBlocks   int  // most blocks rewritten at once, bounds memory use
+	Overlapping bool // also rewrite blocks whose FLAGS.TIME_COL ranges overlap
+}
+
+var COMPACT_MAX_BLOCKS = 64
+
+type compactBlock struct {
+	name string
+	info *SavedColumnInfo
+}
+
+type compactBlocksByStart []compactBlock
+
+func (a compactBlocksByStart) Len() int      { return len(a) }
+func (a compactBlocksByStart) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a compactBlocksByStart) Less(i, j int) bool {
+	mi := a[i].info.IntInfoMap[FLAGS.TIME_COL].Min
+	mj := a[j].info.IntInfoMap[FLAGS.TIME_COL].Min
+	if mi != mj {
+		return mi < mj
+	}
+
+	return a[i].name < a[j].name
+}
+
+func (t *Table) listCompactBlocks() []compactBlock {
+	ret := make([]compactBlock, 0)
+	block_dirs, _ := t.listBlockDirs(nil)
+	for _, filename := range block_dirs {
+		info := t.LoadBlockInfo(filename)
+		if info.NumRecords <= 0 {
+			Debug("SKIPPING BROKEN BLOCK", filename, "FOR COMPACTION")
+			continue
+		}
+
+		ret = append(ret, compactBlock{filename, info})
+	}
+
+	return ret
+}
+
+// FindCompactionGroups lists the groups of blocks that CompactTable rewrites
+// together. Blocks are only merged with blocks of the same partition
+func (t *Table) FindCompactionGroups(spec *CompactSpec) [][]string {
+	max_blocks := spec.MaxBlocks
+	if max_blocks <= 1 {
+		max_blocks = COMPACT_MAX_BLOCKS
+	}
+
+	by_dir := make(map[string][]compactBlock)
+	for _, b := range t.listCompactBlocks() {
+		dirname := path.Dir(b.name)
+		by_dir[dirname] = append(by_dir[dirname], b)
+	}
+
+	dirs := make([]string, 0, len(by_dir))
+	for dirname := range by_dir {
+		dirs = append(dirs, dirname)
+	}
+	sort.Strings(dirs)
+
+	ret := make([][]string, 0)
+	for _, dirname := range dirs {
+		for _, group := range t.compactionGroups(by_dir[dirname], spec) {
+			for len(group) > max_blocks {
+				ret = append(ret, group[:max_blocks])
+				group = group[max_blocks:]
+			}
+
+			if len(group) > 1 {
+				ret = append(ret, group)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (t *Table) compactionGroups(blocks []compactBlock, spec *CompactSpec) [][]string {
+	groups := make([][]string, 0)
+	grouped := make(map[string]bool)
+
+	// records in a table with a sort key are ordered by the key, not time,
+	// so its blocks are expected to overlap in time
+	if spec.Overlapping && FLAGS.TIME_COL != "" && len(t.Settings.SortKey) == 0 {
+		timed := make([]compactBlock, 0)
+		for _, b := range blocks {
+			if b.info.IntInfoMap[FLAGS.TIME_COL] != nil {
+				timed = append(timed, b)
+			}
+		}
+
+		sort.Sort(compactBlocksByStart(timed))
+
+		run := make([]string, 0)
+		run_end := int64(0)
+		for _, b := range timed {
+			time_info := b.info.IntInfoMap[FLAGS.TIME_COL]
+			// blocks that only share a boundary timestamp don't overlap
+			if len(run) > 0 && time_info.Min >= run_end {
+				if len(run) > 1 {
+					groups = append(groups, run)
+				}
+				run = make([]string, 0)
+			}
+
+			if len(run) == 0 || time_info.Max > run_end {
+				run_end = time_info.Max
+			}
+			run = append(run, b.name)
+		}
+
+		if len(run) > 1 {
+			groups = append(groups, run)
+		}
+
+		for _, group := range groups {
+			for _, name := range group {
+				grouped[name] = true
+			}
+		}
+	}
+
+	undersized := make([]string, 0)
+	for _, b := range blocks {
+		if b.info.NumRecords < int32(CHUNK_SIZE) && !grouped[b.name] {
+			undersized = append(undersized, b.name)
+		}
+	}
+	sort.Strings(undersized)
+
+	if len(undersized) > 1 {
+		groups = append(groups, undersized)
+	}
+
+	return groups
+}
+
+// CompactTable rewrites the blocks found by FindCompactionGroups and returns
+// how many blocks were removed
+func (t *Table) CompactTable(spec *CompactSpec) int {
+	if t.GrabDigestLock() == false {
+		Warn("CANT COMPACT", t.Name, "WHILE IT IS BEING DIGESTED")
+		return 0
+	}
+	defer t.ReleaseDigestLock()
+
+	if t.HasUnfinishedAlter() {
+		Warn("CANT COMPACT", t.Name, "UNTIL ITS UNFINISHED ALTER IS RESUMED")
+		return 0
+	}
+
+	// a digest or compaction that died half way is finished or undone first
+	_, err := t.RecoverDigest()
+	if err != nil {
+		Warn("COULDNT READ DIGEST JOURNAL OF", t.Name, err, "NOT COMPACTING")
+		return 0
+	}
+
+	t.LoadBlockCache()
+
+	// each group is forgotten once it is saved, so only one group of
+	// blocks is held in memory at a time
+	removed := make([]string, 0)
+	for _, group := range t.FindCompactionGroups(spec) {
+		if t.compactBlocks(group) {
+			removed = append(removed, group...)
+			t.forgetBlocks(group)
+		}
+	}
+
+	if len(removed) > 0 {
+		t.WriteBlockCache()
+	}
+
+	Debug("COMPACTED", len(removed), "BLOCKS OF", t.Name)
+	return len(removed)
+}
+
+func (t *Table) compactBlocks(blocks []string) bool {
+	locked := make([]string, 0)
+	defer func() {
+		for _, name := range locked {
+			t.ReleaseBlockLock(name)
+		}
+	}()
+
+	for _, name := range blocks {
+		if t.GrabBlockLock(name) == false {
+			Debug("CANT COMPACT BLOCK DUE TO LOCK", name)
+			return false
+		}
+		locked = append(locked, name)
+	}
+
+	// the loaded blocks are only needed until their records are saved
+	defer func() {
+		t.block_m.Lock()
+		for _, name := range blocks {
+			delete(t.BlockList, name)
+		}
+		t.block_m.Unlock()
+	}()
+
+	records := make(RecordList, 0)
+	for _, name := range blocks {
+		block := t.LoadBlockFromDir(name, nil, true /* LOAD ALL RECORDS */)
+		if block == nil {
+			Debug("CANT COMPACT UNREADABLE BLOCK", name)
+			return false
+		}
+
+		records = append(records, block.RecordList...)
+	}
+
+	// the journal keeps a crash from leaving both the new blocks and the
+	// blocks they replace in the table, see table_journal.go
+	err := t.startCompactJournal()
+	if err != nil {
+		Warn("COULDNT START COMPACTION JOURNAL OF", t.Name, err)
+		return false
+	}
+
+	Debug("COMPACTING", len(blocks), "BLOCKS WITH", len(records), "RECORDS")
+	t.SortRecords(records)
+	if !t.saveRecordListIn(path.Dir(blocks[0]), records) {
+		Warn("COULDNT SAVE COMPACTED BLOCKS, KEEPING", len(blocks), "BLOCKS")
+		journal := t.digest_journal
+		t.digest_journal = nil
+		t.rollDigestBack(journal)
+		return false
+	}
+
+	// the query cache of a block lives inside its dir and goes with it
+	for _, name := range blocks {
+		t.replaceBlock(name)
+	}
+	t.finishDigest()
+	t.commitIndex()
+
+	return true
+}
+
+// forgetBlocks drops removed blocks from the in memory caches and from the
+// block cache and index files
+func (t *Table) forgetBlocks(blocks []string) {
+	gone := make(map[string]bool)
+	for _, name := range blocks {
+		gone[name] = true
+	}
+
+	t.block_m.Lock()
+	for _, name := range blocks {
+		delete(t.BlockList, name)
+		delete(t.BlockInfoCache, name)
+		delete(t.block_values, name)
+	}
+
+	new_infos := make([]string, 0)
+	for _, name := range t.NewBlockInfos {
+		if !gone[name] {
+			new_infos = append(new_infos, name)
+		}
+	}
+	t.NewBlockInfos = new_infos
+	t.block_m.Unlock()
+
+	t.forgetCachedBlockInfos(gone)
+	t.unindexBlocks(blocks)
+}
+
+func (t *Table) forgetCachedBlockInfos(gone map[string]bool) {
+	if t.GrabCacheLock() == false {
+		Warn("COULDNT GRAB CACHE LOCK, BLOCK CACHE OF", t.Name, "IS STALE")
+		return
+	}
+	defer t.ReleaseCacheLock()
+
+	cache_dir := path.Join(FLAGS.DIR, t.Name, CACHE_DIR)
+	files, err := ioutil.ReadDir(cache_dir)
+	if err != nil {
+		return
+	}
+
+	for _, block_file := range files {
+		filename := path.Join(cache_dir, block_file.Name())
+		block_cache := SavedBlockCache{}
+		err = decodeInto(filename, &block_cache)
+		if err != nil {
+			continue
+		}
+
+		changed := false
+		for name := range block_cache {
+			if gone[name] {
+				delete(block_cache, name)
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		// the left over infos get written out again with the next
+		// WriteBlockCache
+		t.block_m.Lock()
+		outstanding := make(map[string]bool)
+		for _, name := range t.NewBlockInfos {
+			outstanding[name] = true
+		}
+		for name, info := range block_cache {
+			t.BlockInfoCache[name] = info
+			if !outstanding[name] {
+				t.NewBlockInfos = append(t.NewBlockInfos, name)
+			}
+		}
+		t.block_m.Unlock()
+
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,226 @@
+package sybil
+
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "path"
+import "sort"
+import "testing"
+
+func listTestBlocks(t *Table) []string {
+	ret := make([]string, 0)
+	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, t.Name))
+	for _, v := range files {
+		if v.IsDir() && file_looks_like_block(v) {
+			ret = append(ret, path.Join(FLAGS.DIR, t.Name, v.Name()))
+		}
+	}
+
+	return ret
+}
+
+func TestCompactUndersizedBlocks(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 2
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	// write the records out as many small blocks, like frequent digests do
+	tbl := GetTable(tableName)
+	os.MkdirAll(path.Join(FLAGS.DIR, tableName), 0777)
+	small := CHUNK_SIZE / 4
+	for i := 0; i < len(records); i += small {
+		name, err := tbl.getNewIngestBlockName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.SaveRecordsToBlock(records[i:i+small], name)
+	}
+	tbl.SaveTableInfo("info")
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	if len(listTestBlocks(nt)) != 8 {
+		t.Fatal("EXPECTED 8 SMALL BLOCKS, FOUND", len(listTestBlocks(nt)))
+	}
+
+	spec := CompactSpec{MaxBlocks: 64}
+	groups := nt.FindCompactionGroups(&spec)
+	if len(groups) != 1 || len(groups[0]) != 8 {
+		t.Fatal("EXPECTED ONE GROUP OF 8 BLOCKS, GOT", groups)
+	}
+
+	removed := nt.CompactTable(&spec)
+	if removed != 8 {
+		t.Fatal("COMPACTION REMOVED", removed, "BLOCKS, EXPECTED 8")
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	blocks := listTestBlocks(nt)
+	if len(blocks) != blockCount {
+		t.Fatal("EXPECTED", blockCount, "FULL BLOCKS AFTER COMPACTION, FOUND", len(blocks))
+	}
+
+	for _, name := range blocks {
+		info := nt.LoadBlockInfo(name)
+		if info.NumRecords != int32(CHUNK_SIZE) {
+			t.Error("BLOCK", name, "HAS", info.NumRecords, "RECORDS AFTER COMPACTION")
+		}
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	count := nt.LoadRecords(&loadSpec)
+	if count != len(records) {
+		t.Error("COMPACTED TABLE HAS", count, "RECORDS, EXPECTED", len(records))
+	}
+
+	if len(nt.FindCompactionGroups(&spec)) != 0 {
+		t.Error("COMPACTED TABLE SHOULDNT HAVE ANYTHING LEFT TO COMPACT")
+	}
+}
+
+func TestCompactOverlappingBlocks(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	old_time_col := FLAGS.TIME_COL
+	FLAGS.TIME_COL = "time"
+	defer func() { FLAGS.TIME_COL = old_time_col }()
+
+	blockCount := 3
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(rand.Intn(100000)))
+	}, blockCount)
+
+	// full blocks that each cover the whole time range
+	tbl := GetTable(tableName)
+	os.MkdirAll(path.Join(FLAGS.DIR, tableName), 0777)
+	for i := 0; i < len(records); i += CHUNK_SIZE {
+		name, err := tbl.getNewIngestBlockName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.SaveRecordsToBlock(records[i:i+CHUNK_SIZE], name)
+	}
+	tbl.SaveTableInfo("info")
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	if len(nt.FindCompactionGroups(&CompactSpec{})) != 0 {
+		t.Fatal("FULL BLOCKS SHOULDNT BE COMPACTED WITHOUT -overlapping")
+	}
+
+	removed := nt.CompactTable(&CompactSpec{Overlapping: true})
+	if removed != blockCount {
+		t.Fatal("COMPACTION REMOVED", removed, "BLOCKS, EXPECTED", blockCount)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	ranges := make([]*IntInfo, 0)
+	for _, name := range listTestBlocks(nt) {
+		ranges = append(ranges, nt.LoadBlockInfo(name).IntInfoMap["time"])
+	}
+
+	if len(ranges) != blockCount {
+		t.Fatal("EXPECTED", blockCount, "BLOCKS AFTER COMPACTION, FOUND", len(ranges))
+	}
+
+	sort.Sort(intInfosByMin(ranges))
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Min < ranges[i-1].Max {
+			t.Error("BLOCKS STILL OVERLAP IN TIME", ranges[i-1].Min, ranges[i-1].Max, ranges[i].Min, ranges[i].Max)
+		}
+	}
+
+	// blocks that only share a boundary timestamp are left alone
+	if groups := nt.FindCompactionGroups(&CompactSpec{Overlapping: true}); len(groups) != 0 {
+		t.Error("COMPACTED TABLE STILL HAS GROUPS TO COMPACT", groups)
+	}
+	if removed := nt.CompactTable(&CompactSpec{Overlapping: true}); removed != 0 {
+		t.Error("SECOND COMPACTION REWROTE", removed, "BLOCKS")
+	}
+	if len(nt.BlockList) != 0 {
+		t.Error("COMPACTION KEPT", len(nt.BlockList), "BLOCKS IN MEMORY")
+	}
+}
+
+func TestCompactJournal(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+	}, 1)
+
+	tbl := GetTable(tableName)
+	os.MkdirAll(path.Join(FLAGS.DIR, tableName), 0777)
+	small := CHUNK_SIZE / 4
+	for i := 0; i < len(records); i += small {
+		name, err := tbl.getNewIngestBlockName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.SaveRecordsToBlock(records[i:i+small], name)
+	}
+	tbl.SaveTableInfo("info")
+
+	// a compaction that died after saving its block and moving the small
+	// blocks aside is rolled back by the next one
+	blocks := listTestBlocks(tbl)
+	err := tbl.startCompactJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tbl.saveRecordListIn(path.Join(FLAGS.DIR, tableName), records) {
+		t.Fatal("COULDNT SAVE COMPACTED BLOCK")
+	}
+	for _, name := range blocks {
+		tbl.replaceBlock(name)
+	}
+	tbl.digest_journal = nil
+
+	if n := len(listTestBlocks(tbl)); n != 1 {
+		t.Fatal("EXPECTED ONLY THE COMPACTED BLOCK, FOUND", n)
+	}
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	removed := nt.CompactTable(&CompactSpec{MaxBlocks: 64})
+	if removed != len(blocks) {
+		t.Error("COMPACTION REMOVED", removed, "BLOCKS, EXPECTED", len(blocks))
+	}
+
+	if journal, _ := nt.LoadDigestJournal(); journal != nil {
+		t.Error("COMPACTION LEFT ITS JOURNAL BEHIND")
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	if count := nt.LoadRecords(&loadSpec); count != len(records) {
+		t.Error("RECOVERED COMPACTION LEFT", count, "RECORDS, EXPECTED", len(records))
+	}
+}
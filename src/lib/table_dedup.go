@@ -0,0 +1,368 @@
+package sybil
+
+import "bytes"
+import "crypto/md5"
+import "encoding/gob"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "time"
+
+// DEDUPLICATION OF INGESTED RECORDS
+// when a table has a dedup key (Settings.DedupKey), ingestion drops any record
+// whose key was already seen within the last Settings.DedupWindow seconds.
+// The seen keys are kept in DEDUP_DIR next to the table's info.db and are
+// guarded by the dedup lock. Digestion drops duplicate keys within the batch
+// of records it is digesting.
+//
+// Each ingest adds a new segment file holding only the keys it saw first, so
+// the seen keys are never rewritten as a whole: a segment is named after the
+// time it was written and is deleted once that time falls out of the window.
+// When a table has more than DEDUP_MAX_SEGMENTS live segments, they are
+// merged into one. A segment is only written after its records were saved,
+// so records whose write failed can be ingested again.
+
+var DEDUP_DIR = "dedup"
+var DEDUP_LOCK = "dedup"
+var DEDUP_MAX_SEGMENTS = 64
+var DEFAULT_DEDUP_WINDOW = int64(60 * 60 * 24)
+
+type SavedDedupState struct {
+	Seen map[string]int64 // md5 of the dedup key -> unix time it was first seen
+}
+
+func (t *Table) SetDedupKey(cols []string, window int64) {
+	t.Settings.DedupKey = cols
+	t.Settings.DedupWindow = window
+}
+
+func (t *Table) dedupWindow() int64 {
+	if t.Settings.DedupWindow > 0 {
+		return t.Settings.DedupWindow
+	}
+
+	return DEFAULT_DEDUP_WINDOW
+}
+
+// returns the dedup key for a record. if the record has none of the dedup
+// columns populated, it can't be deduplicated and we return false
+func (t *Table) record_dedup_key(r *Record) (string, bool) {
+	var buf bytes.Buffer
+	found := false
+
+	for _, name := range t.Settings.DedupKey {
+		t.string_id_m.RLock()
+		id, ok := t.KeyTable[name]
+		t.string_id_m.RUnlock()
+
+		if ok && int(id) < len(r.Populated) {
+			switch r.Populated[id] {
+			case INT_VAL:
+				buf.WriteString(strconv.FormatInt(int64(r.Ints[id]), 10))
+				found = true
+			case STR_VAL:
+				col := r.block.GetColumnInfo(id)
+				buf.WriteString(col.get_string_for_val(int32(r.Strs[id])))
+				found = true
+			case SET_VAL:
+				col := r.block.GetColumnInfo(id)
+				for _, v := range r.SetMap[id] {
+					buf.WriteString(col.get_string_for_val(v))
+					buf.WriteString(",")
+				}
+				found = true
+			}
+		}
+
+		buf.WriteString(GROUP_DELIMITER)
+	}
+
+	if !found {
+		return "", false
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(buf.Bytes())), true
+}
+
+// savedRecordDedupKey is record_dedup_key for a record that is already
+// marshalled, key_table gives the ids of its columns
+func (t *Table) savedRecordDedupKey(r *SavedRecord, key_table map[string]int16) (string, bool) {
+	var buf bytes.Buffer
+	found := false
+
+	for _, name := range t.Settings.DedupKey {
+		id, ok := key_table[name]
+		if ok {
+			for _, v := range r.Ints {
+				if v.Name == id {
+					buf.WriteString(strconv.FormatInt(v.Value, 10))
+					found = true
+				}
+			}
+			for _, v := range r.Strs {
+				if v.Name == id {
+					buf.WriteString(v.Value)
+					found = true
+				}
+			}
+			for _, v := range r.Sets {
+				if v.Name == id {
+					for _, s := range v.Value {
+						buf.WriteString(s)
+						buf.WriteString(",")
+					}
+					found = true
+				}
+			}
+		}
+
+		buf.WriteString(GROUP_DELIMITER)
+	}
+
+	if !found {
+		return "", false
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(buf.Bytes())), true
+}
+
+func (t *Table) dedupDir() string {
+	return path.Join(FLAGS.DIR, t.Name, DEDUP_DIR)
+}
+
+// segments are named <unix nanos>.db, after the time they were written. every
+// key in a segment was seen at or before that time
+func dedupSegmentTime(fname string) (int64, bool) {
+	if !strings.HasSuffix(fname, ".db") {
+		return 0, false
+	}
+
+	nanos, err := strconv.ParseInt(strings.TrimSuffix(fname, ".db"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return nanos / int64(time.Second), true
+}
+
+// listDedupSegments returns the segments that are still within the dedup
+// window and removes the ones that aren't
+func (t *Table) listDedupSegments(cutoff int64) []string {
+	dirname := t.dedupDir()
+	files, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil
+	}
+
+	ret := make([]string, 0, len(files))
+	for _, f := range files {
+		written, ok := dedupSegmentTime(f.Name())
+		if !ok {
+			continue
+		}
+
+		filename := path.Join(dirname, f.Name())
+		if written < cutoff {
+			Debug("REMOVING EXPIRED DEDUP SEGMENT", filename)
+			os.Remove(filename)
+			continue
+		}
+
+		ret = append(ret, filename)
+	}
+
+	return ret
+}
+
+func (t *Table) loadDedupState(segments []string, cutoff int64) *SavedDedupState {
+	state := SavedDedupState{Seen: make(map[string]int64)}
+
+	for _, filename := range segments {
+		segment := SavedDedupState{}
+		err := decodeInto(filename, &segment)
+		if err != nil {
+			Debug("COULDNT READ DEDUP SEGMENT, SKIPPING IT", filename, err)
+			continue
+		}
+
+		for k, v := range segment.Seen {
+			if v >= cutoff {
+				state.Seen[k] = v
+			}
+		}
+	}
+
+	return &state
+}
+
+func (t *Table) saveDedupSegment(state *SavedDedupState) error {
+	dirname := t.dedupDir()
+	os.MkdirAll(dirname, 0755)
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(state)
+	if err != nil {
+		return err
+	}
+
+	tempfile, err := ioutil.TempFile(dirname, ".segment")
+	if err != nil {
+		return err
+	}
+
+	_, err = network.WriteTo(tempfile)
+	tempfile.Close()
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	filename := path.Join(dirname, fmt.Sprintf("%d.db", time.Now().UnixNano()))
+	return RenameAndMod(tempfile.Name(), filename)
+}
+
+// mergeDedupSegments replaces segments with a single segment holding state.
+// the merged segment is written first, so a crash in between only leaves
+// keys in two segments
+func (t *Table) mergeDedupSegments(segments []string, state *SavedDedupState) {
+	Debug("MERGING", len(segments), "DEDUP SEGMENTS")
+	err := t.saveDedupSegment(state)
+	if err != nil {
+		Warn("COULDNT MERGE DEDUP SEGMENTS", err)
+		return
+	}
+
+	for _, filename := range segments {
+		os.Remove(filename)
+	}
+}
+
+func (t *Table) recordDedupKeys(records RecordList) []string {
+	keys := make([]string, len(records))
+	for i, r := range records {
+		key, ok := t.record_dedup_key(r)
+		if ok {
+			keys[i] = key
+		}
+	}
+
+	return keys
+}
+
+// dedupAndWrite decides which records to keep from their dedup keys ("" is a
+// record without one) and hands that to write. The dedup lock is held until
+// write returns and the kept keys are only remembered if it succeeds.
+func (t *Table) dedupAndWrite(keys []string, write func(keep []bool) error) error {
+	keep := make([]bool, len(keys))
+
+	os.MkdirAll(path.Join(FLAGS.DIR, t.Name), 0755)
+	if t.GrabDedupLock() == false {
+		Warn("COULDNT GRAB DEDUP LOCK, INGESTING WITHOUT DEDUPLICATION")
+		for i := range keep {
+			keep[i] = true
+		}
+		return write(keep)
+	}
+	defer t.ReleaseDedupLock()
+
+	now := time.Now().Unix()
+	cutoff := now - t.dedupWindow()
+
+	segments := t.listDedupSegments(cutoff)
+	state := t.loadDedupState(segments, cutoff)
+
+	added := SavedDedupState{Seen: make(map[string]int64)}
+	dropped := 0
+	for i, key := range keys {
+		if key == "" {
+			keep[i] = true
+			continue
+		}
+
+		_, seen := state.Seen[key]
+		_, added_now := added.Seen[key]
+		if seen || added_now {
+			dropped++
+			continue
+		}
+
+		added.Seen[key] = now
+		keep[i] = true
+	}
+
+	if dropped > 0 {
+		Debug("DEDUP DROPPED", dropped, "OF", len(keys), "RECORDS")
+	}
+
+	err := write(keep)
+	if err != nil {
+		return err
+	}
+
+	if len(added.Seen) == 0 {
+		return nil
+	}
+
+	if len(segments) >= DEDUP_MAX_SEGMENTS {
+		for k, v := range added.Seen {
+			state.Seen[k] = v
+		}
+		t.mergeDedupSegments(segments, state)
+		return nil
+	}
+
+	err = t.saveDedupSegment(&added)
+	if err != nil {
+		Warn("COULDNT SAVE DEDUP SEGMENT", err)
+	}
+
+	return nil
+}
+
+// writeDedupedRecords drops the records whose dedup key was seen within the
+// dedup window (or earlier in records) and writes the rest with write
+func (t *Table) writeDedupedRecords(records RecordList, write func(RecordList) error) error {
+	if len(t.Settings.DedupKey) == 0 || len(records) == 0 {
+		return write(records)
+	}
+
+	return t.dedupAndWrite(t.recordDedupKeys(records), func(keep []bool) error {
+		kept := make(RecordList, 0, len(records))
+		for i, r := range records {
+			if keep[i] {
+				kept = append(kept, r)
+			}
+		}
+
+		if len(kept) == 0 {
+			return nil
+		}
+
+		return write(kept)
+	})
+}
+
+// DedupRecords returns records without the ones whose dedup key was already
+// seen earlier in records
+func (t *Table) DedupRecords(records RecordList) RecordList {
+	if len(t.Settings.DedupKey) == 0 || len(records) == 0 {
+		return records
+	}
+
+	seen := make(map[string]bool)
+	ret := make(RecordList, 0, len(records))
+	for i, key := range t.recordDedupKeys(records) {
+		if key != "" && seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		ret = append(ret, records[i])
+	}
+
+	return ret
+}
@@ -0,0 +1,184 @@
+package sybil
+
+import "errors"
+import "os"
+import "path"
+import "testing"
+
+func TestDedupIngestedRecords(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	tbl := GetTable(tableName)
+	tbl.SetDedupKey([]string{"id", "host"}, 60)
+
+	// every record is added twice within the same ingestion
+	blockCount := 2
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index/2))
+		r.AddStrField("host", "localhost")
+	}, blockCount)
+	tbl.IngestRecords("ingest")
+
+	// and then retried in a second ingestion
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index%CHUNK_SIZE))
+		r.AddStrField("host", "localhost")
+	}, 1)
+	tbl.IngestRecords("ingest")
+
+	FLAGS.READ_INGESTION_LOG = true
+	READ_ROWS_ONLY = true
+	defer func() {
+		FLAGS.READ_INGESTION_LOG = false
+		READ_ROWS_ONLY = false
+	}()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	if len(nt.Settings.DedupKey) != 2 || nt.Settings.DedupWindow != 60 {
+		t.Error("DEDUP SETTINGS WERE NOT SAVED WITH TABLE INFO", nt.Settings)
+	}
+
+	count := nt.LoadRecords(nil)
+	if count != CHUNK_SIZE*blockCount/2 {
+		t.Error("EXPECTED", CHUNK_SIZE*blockCount/2, "RECORDS AFTER DEDUP, FOUND", count)
+	}
+
+	// records that have none of the key columns are never dropped
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddStrField("other", "value")
+	}, 1)
+	nt.IngestRecords("ingest")
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	count = nt.LoadRecords(nil)
+	if count != CHUNK_SIZE*blockCount/2+CHUNK_SIZE {
+		t.Error("DEDUP DROPPED RECORDS WITHOUT A DEDUP KEY", count)
+	}
+}
+
+func TestDedupFailedWrite(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	tbl := GetTable(tableName)
+	tbl.SetDedupKey([]string{"id"}, 60)
+
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+	}, 1)
+
+	// the keys of records that couldn't be written aren't remembered, so
+	// they can be ingested again
+	err := tbl.writeDedupedRecords(tbl.newRecords, func(records RecordList) error {
+		return errors.New("disk full")
+	})
+	if err == nil {
+		t.Fatal("FAILED WRITE DIDNT RETURN AN ERROR")
+	}
+
+	tbl.IngestRecords("ingest")
+
+	FLAGS.READ_INGESTION_LOG = true
+	READ_ROWS_ONLY = true
+	defer func() {
+		FLAGS.READ_INGESTION_LOG = false
+		READ_ROWS_ONLY = false
+	}()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+	count := nt.LoadRecords(nil)
+	if count != CHUNK_SIZE {
+		t.Error("EXPECTED", CHUNK_SIZE, "RECORDS AFTER A FAILED WRITE, FOUND", count)
+	}
+}
+
+func TestDedupSegments(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	max_segments := DEDUP_MAX_SEGMENTS
+	DEDUP_MAX_SEGMENTS = 2
+	defer func() { DEDUP_MAX_SEGMENTS = max_segments }()
+
+	tbl := GetTable(tableName)
+	tbl.SetDedupKey([]string{"id"}, 60)
+
+	ingests := 4
+	for i := 0; i < ingests; i++ {
+		addRecords(tableName, func(r *Record, index int) {
+			r.AddIntField("id", int64(i*CHUNK_SIZE+index))
+		}, 1)
+		tbl.IngestRecords("ingest")
+	}
+
+	segments := tbl.listDedupSegments(0)
+	if len(segments) > DEDUP_MAX_SEGMENTS {
+		t.Error("DEDUP SEGMENTS WERENT MERGED", len(segments))
+	}
+
+	state := tbl.loadDedupState(segments, 0)
+	if len(state.Seen) != ingests*CHUNK_SIZE {
+		t.Error("EXPECTED", ingests*CHUNK_SIZE, "SEEN KEYS, FOUND", len(state.Seen))
+	}
+
+	// the settings survive a table info rebuilt from the blocks
+	os.Remove(path.Join(FLAGS.DIR, tableName, "info.db"))
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.DeduceTableInfoFromBlocks()
+	if len(nt.Settings.DedupKey) != 1 || nt.Settings.DedupWindow != 60 {
+		t.Error("REBUILT TABLE INFO LOST THE DEDUP SETTINGS", nt.Settings)
+	}
+}
+
+func TestDedupRecordBlock(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	tbl := GetTable(tableName)
+	tbl.SetDedupKey([]string{"id"}, 60)
+
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+	}, 1)
+	tbl.IngestRecords("ingest")
+
+	// a marshalled block shares the seen keys with IngestRecords
+	key_table := map[string]int16{"id": 0}
+	srb := SavedRecordBlock{KeyTable: &key_table}
+	for i := 0; i < CHUNK_SIZE*2; i++ {
+		srb.RecordList = append(srb.RecordList, &SavedRecord{Ints: []RowSavedInt{{Name: 0, Value: int64(i)}}})
+	}
+
+	err := tbl.AppendRecordBlockToLog(&srb, "ingest")
+	if err != nil {
+		t.Fatal("COULDNT APPEND RECORD BLOCK", err)
+	}
+
+	FLAGS.READ_INGESTION_LOG = true
+	READ_ROWS_ONLY = true
+	defer func() {
+		FLAGS.READ_INGESTION_LOG = false
+		READ_ROWS_ONLY = false
+	}()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+	count := nt.LoadRecords(nil)
+	if count != CHUNK_SIZE*2 {
+		t.Error("EXPECTED", CHUNK_SIZE*2, "RECORDS AFTER DEDUP, FOUND", count)
+	}
+}
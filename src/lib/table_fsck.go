@@ -0,0 +1,360 @@
+package sybil
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "time"
+
+// FSCK
+// Fsck checks that no records of a table were lost or saved twice: it checks
+// an unfinished digest against its journal (table_journal.go), looks for
+// stomache dirs, replaced blocks and partial blocks that were left behind and
+// compares the records in the table's blocks with its record ledger
+// (table_ledger.go). It also reads every block (table_fsck_block.go) and
+// looks for lock files whose owner died and for cached block infos and query
+// results that are stale. With fix, the unfinished digest is rolled forward
+// or back, left over stomache dirs go back into the row store, left over
+// dirs, orphaned locks and stale caches are removed and tables without a
+// ledger get one. With quarantine, blocks that don't read are moved into the
+// quarantine dir.
+
+// lock files without a PID in them are only orphaned once they are older than
+// this, a new lock file is empty until its owner writes its PID
+var FSCK_EMPTY_LOCK_AGE = time.Minute
+
+type FsckSpec struct {
+	Fix        bool // repair what can be repaired
+	Quarantine bool // move the blocks that don't read into the quarantine dir
+}
+
+type FsckReport struct {
+	Digest    string   // state of the unfinished digest, "" when there is none
+	Stomaches []string // stomache dirs that aren't part of a digest
+	Replaced  []string // replaced blocks that aren't part of a digest
+	Partials  []string // blocks that were left half written
+
+	Locks       []string // lock files whose owner is gone
+	StaleCaches []string // cached block infos and query results that are stale
+
+	HasLedger     bool
+	LedgerRecords int64
+	BlockRecords  int64
+	BrokenBlocks  []string // blocks that don't read
+	Quarantined   []string
+
+	Problems []string
+	Fixed    []string
+}
+
+func (r *FsckReport) problem(args ...interface{}) {
+	r.Problems = append(r.Problems, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func (r *FsckReport) fixed(args ...interface{}) {
+	r.Fixed = append(r.Fixed, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+// checkDigestJournal looks for records of an unfinished digest that would be
+// lost or duplicated when it is rolled forward or back
+func (t *Table) checkDigestJournal(journal *SavedDigestJournal, report *FsckReport) {
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	stomache := path.Join(table_dir, journal.Stomache)
+	ingestdir := path.Join(table_dir, INGEST_DIR)
+
+	for _, filename := range journal.Files {
+		_, err := os.Stat(path.Join(stomache, filename))
+		in_stomache := err == nil
+		_, err = os.Stat(path.Join(ingestdir, filename))
+		in_ingest := err == nil
+
+		switch {
+		case journal.State == DIGEST_SAVED && in_ingest:
+			report.problem("DIGESTED FILE", filename, "IS BACK IN THE ROW STORE, ITS RECORDS ARE DUPLICATED")
+		case journal.State == DIGEST_STARTED && !in_stomache && !in_ingest:
+			report.problem("FILE", filename, "OF UNFINISHED DIGEST IS GONE, ITS RECORDS ARE LOST")
+		}
+	}
+
+	if journal.State != DIGEST_SAVED {
+		return
+	}
+
+	for name, records := range journal.Blocks {
+		blockname := path.Join(table_dir, name)
+		if _, err := os.Stat(blockname); err != nil {
+			report.problem("BLOCK", name, "OF SAVED DIGEST IS GONE, ITS RECORDS ARE LOST")
+			continue
+		}
+
+		info := t.LoadBlockInfo(blockname)
+		if info.NumRecords != records {
+			report.problem("BLOCK", name, "OF SAVED DIGEST HAS", info.NumRecords, "RECORDS INSTEAD OF", records)
+		}
+	}
+}
+
+// leftoverDirs lists the stomache dirs, replaced blocks and partial blocks in
+// dirname that don't belong to journal
+func (t *Table) leftoverDirs(dirname string, journal *SavedDigestJournal, report *FsckReport) {
+	journaled := make(map[string]bool)
+	if journal != nil {
+		journaled[journal.Stomache] = true
+		for _, name := range journal.Replaced {
+			journaled[name+REPLACED_BLOCK_EXT] = true
+		}
+		for name := range journal.Blocks {
+			journaled[name+".partial"] = true
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dirname)
+	for _, f := range files {
+		filename := path.Join(dirname, f.Name())
+		name := t.tableBlockName(filename)
+		if !f.IsDir() || journaled[name] {
+			continue
+		}
+
+		if strings.HasPrefix(f.Name(), STOMACHE_DIR) {
+			report.Stomaches = append(report.Stomaches, filename)
+		}
+
+		if strings.HasSuffix(f.Name(), REPLACED_BLOCK_EXT) {
+			report.Replaced = append(report.Replaced, filename)
+		}
+
+		if strings.HasSuffix(f.Name(), ".partial") {
+			report.Partials = append(report.Partials, filename)
+		}
+	}
+}
+
+// orphanedLocks lists the lock files of the table whose owner died without
+// releasing them. The locks this process holds are left alone
+func (t *Table) orphanedLocks() []string {
+	ret := make([]string, 0)
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	files, _ := ioutil.ReadDir(table_dir)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".lock") {
+			continue
+		}
+
+		lockfile := path.Join(table_dir, f.Name())
+		val, err := ioutil.ReadFile(lockfile)
+		if err != nil {
+			continue
+		}
+
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 32)
+		switch {
+		case err != nil && time.Since(f.ModTime()) < FSCK_EMPTY_LOCK_AGE:
+			continue
+		case err == nil && (pid == int64(os.Getpid()) || pid_is_alive(pid)):
+			continue
+		}
+
+		ret = append(ret, lockfile)
+	}
+
+	return ret
+}
+
+// staleCaches lists the block cache files that don't decode and the cached
+// query results of blocks that were rewritten since. gone gets the blocks
+// the block cache has infos for that aren't there anymore
+func (t *Table) staleCaches(gone map[string]bool) []string {
+	ret := make([]string, 0)
+	cache_dir := path.Join(FLAGS.DIR, t.Name, CACHE_DIR)
+	files, _ := ioutil.ReadDir(cache_dir)
+	for _, f := range files {
+		filename := path.Join(cache_dir, f.Name())
+		block_cache := SavedBlockCache{}
+		err := decodeInto(filename, &block_cache)
+		if err != nil {
+			ret = append(ret, filename)
+			continue
+		}
+
+		for name := range block_cache {
+			if _, err := os.Stat(path.Join(name, "info.db")); err != nil {
+				gone[name] = true
+			}
+		}
+	}
+
+	for _, entry := range t.ListQueryCache("") {
+		if entry.Block != "" && queryCacheIsStale(entry.Block, entry.Path) {
+			ret = append(ret, entry.Path)
+		}
+	}
+
+	return ret
+}
+
+// Fsck checks the table for lost and duplicated records and blocks that
+// don't read, and fixes what it can when the spec says so. It holds the
+// digest lock while it runs
+func (t *Table) Fsck(spec *FsckSpec) (*FsckReport, error) {
+	if t.GrabDigestLock() == false {
+		return nil, fmt.Errorf("table %s is being digested, try again later", t.Name)
+	}
+	defer t.ReleaseDigestLock()
+
+	fix := spec.Fix
+	report := FsckReport{}
+
+	journal, err := t.LoadDigestJournal()
+	if err != nil {
+		return nil, fmt.Errorf("can't read the digest journal of %s: %s", t.Name, err)
+	}
+
+	if journal != nil {
+		report.Digest = journal.State
+		t.checkDigestJournal(journal, &report)
+
+		if fix && len(report.Problems) == 0 {
+			t.RecoverDigest()
+			if journal.State == DIGEST_SAVED {
+				report.fixed("ROLLED UNFINISHED DIGEST FORWARD")
+			} else {
+				report.fixed("ROLLED UNFINISHED DIGEST BACK")
+			}
+			journal = nil
+		} else {
+			report.problem("DIGEST", journal.Stomache, "IS UNFINISHED, IT WAS", journal.State)
+		}
+	}
+
+	alter, err := t.LoadAlterJournal()
+	switch {
+	case err != nil:
+		report.problem("ALTER JOURNAL DOESNT DECODE:", err)
+	case alter != nil:
+		report.problem("ALTER", alter.Op, alter.Column, "IS UNFINISHED AFTER", len(alter.Done), "BLOCKS, RUN sybil alter -resume")
+	}
+
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	t.leftoverDirs(table_dir, journal, &report)
+	for _, partition := range t.listPartitions() {
+		t.leftoverDirs(partition, journal, &report)
+	}
+
+	for _, dirname := range report.Stomaches {
+		if fix {
+			t.restoreStomache(dirname)
+			report.fixed("RESTORED STOMACHE DIR", t.tableBlockName(dirname), "INTO THE ROW STORE")
+		} else {
+			report.problem("STOMACHE DIR", t.tableBlockName(dirname), "WAS LEFT BEHIND")
+		}
+	}
+
+	for _, dirname := range report.Replaced {
+		if fix {
+			os.RemoveAll(dirname)
+			report.fixed("REMOVED REPLACED BLOCK", t.tableBlockName(dirname))
+		} else {
+			report.problem("REPLACED BLOCK", t.tableBlockName(dirname), "WAS LEFT BEHIND")
+		}
+	}
+
+	for _, dirname := range report.Partials {
+		if fix {
+			os.RemoveAll(dirname)
+			report.fixed("REMOVED PARTIAL BLOCK", t.tableBlockName(dirname))
+		} else {
+			report.problem("PARTIAL BLOCK", t.tableBlockName(dirname), "WAS LEFT BEHIND")
+		}
+	}
+
+	report.Locks = t.orphanedLocks()
+	for _, lockfile := range report.Locks {
+		if fix {
+			os.Remove(lockfile)
+			report.fixed("REMOVED ORPHANED LOCK", path.Base(lockfile))
+		} else {
+			report.problem("LOCK", path.Base(lockfile), "IS ORPHANED, ITS OWNER IS GONE")
+		}
+	}
+
+	block_dirs, _ := t.listBlockDirs(nil)
+	for _, blockname := range block_dirs {
+		problems := t.checkBlock(blockname)
+		if len(problems) == 0 {
+			continue
+		}
+
+		name := t.tableBlockName(blockname)
+		report.BrokenBlocks = append(report.BrokenBlocks, blockname)
+		if spec.Quarantine {
+			err = t.quarantineBlock(blockname)
+			if err == nil {
+				report.Quarantined = append(report.Quarantined, blockname)
+				report.fixed("QUARANTINED BLOCK", name+":", strings.Join(problems, ", "))
+				continue
+			}
+
+			report.problem("COULDNT QUARANTINE BLOCK", name, err)
+		}
+
+		for _, problem := range problems {
+			report.problem("BLOCK", name, problem)
+		}
+	}
+
+	gone := make(map[string]bool)
+	report.StaleCaches = t.staleCaches(gone)
+	for name := range gone {
+		report.StaleCaches = append(report.StaleCaches, name)
+	}
+
+	for _, filename := range report.StaleCaches {
+		name := t.tableBlockName(filename)
+		switch {
+		case gone[filename] && fix:
+			report.fixed("FORGOT CACHED INFO OF MISSING BLOCK", name)
+		case gone[filename]:
+			report.problem("BLOCK CACHE HAS INFO OF MISSING BLOCK", name)
+		case fix:
+			os.Remove(filename)
+			report.fixed("REMOVED STALE CACHE FILE", name)
+		default:
+			report.problem("CACHE FILE", name, "IS STALE")
+		}
+	}
+
+	if fix && len(gone) > 0 {
+		t.forgetCachedBlockInfos(gone)
+	}
+
+	// the block cache files that held forgotten infos are written again
+	if fix || len(report.Quarantined) > 0 {
+		t.WriteBlockCache()
+	}
+
+	report.BlockRecords, _ = t.CountBlockRecords()
+
+	if !t.HasLedger() && fix && journal == nil {
+		if t.StartLedger() {
+			report.fixed("STARTED RECORD LEDGER WITH", report.BlockRecords, "RECORDS")
+		}
+	}
+
+	report.LedgerRecords, report.HasLedger = t.LedgerRecords()
+	if !report.HasLedger || journal != nil {
+		// the records of an unfinished digest can't be told apart
+		return &report, nil
+	}
+
+	switch diff := report.BlockRecords - report.LedgerRecords; {
+	case diff > 0:
+		report.problem("BLOCKS HAVE", diff, "RECORDS MORE THAN THE LEDGER, THEY ARE DUPLICATED")
+	case diff < 0:
+		report.problem("BLOCKS HAVE", -diff, "RECORDS LESS THAN THE LEDGER, THEY ARE LOST")
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,261 @@
+package sybil
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+
+// BLOCK CHECKS
+// checkBlock reads a block the way a query would, without loading its
+// records: info.db has to decode and have records, every column file has to
+// decode into the column its name says, the record ids of the column have to
+// be below NumRecords (and, for int and str columns, show up once) and its
+// value ids have to be in its string table. Blocks that fail can be moved
+// into the quarantine dir (<table>/quarantine/), where queries and digests
+// don't look for blocks, to be inspected or removed by hand.
+
+var QUARANTINE_DIR = "quarantine"
+
+func (t *Table) quarantineDir() string {
+	return path.Join(FLAGS.DIR, t.Name, QUARANTINE_DIR)
+}
+
+// checkRecordIds checks the record ids of one bin of a bucket encoded column
+// and marks them in seen
+func checkRecordIds(records []uint32, delta_encoded bool, num_records uint32, seen []int) error {
+	prev := uint32(0)
+	for _, r := range records {
+		if delta_encoded {
+			r = prev + r
+		}
+
+		if r >= num_records {
+			return fmt.Errorf("has record id %d, the block has %d records", r, num_records)
+		}
+
+		seen[r]++
+		prev = r
+	}
+
+	return nil
+}
+
+func checkSeenOnce(seen []int) error {
+	for r, count := range seen {
+		if count > 1 {
+			return fmt.Errorf("has %d values for record %d", count, r)
+		}
+	}
+
+	return nil
+}
+
+func checkValueId(value int32, string_table []string) error {
+	if value < 0 || int(value) >= len(string_table) {
+		return fmt.Errorf("has value id %d, its string table has %d strings", value, len(string_table))
+	}
+
+	return nil
+}
+
+func checkIntColumn(filename string, info *SavedColumnInfo) (string, error) {
+	col := SavedIntColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	num_records := uint32(info.NumRecords)
+	if !col.BucketEncoded {
+		if uint32(len(col.Values)) > num_records {
+			return col.Name, fmt.Errorf("has %d values, the block has %d records", len(col.Values), num_records)
+		}
+		return col.Name, nil
+	}
+
+	seen := make([]int, num_records)
+	for _, bucket := range col.Bins {
+		err = checkRecordIds(bucket.Records, col.DeltaEncodedIDs, num_records, seen)
+		if err != nil {
+			return col.Name, err
+		}
+	}
+
+	return col.Name, checkSeenOnce(seen)
+}
+
+func checkStrColumn(filename string, info *SavedColumnInfo) (string, error) {
+	col := SavedStrColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	num_records := uint32(info.NumRecords)
+	if uint32(len(col.StringTable)) > num_records {
+		return col.Name, fmt.Errorf("has %d strings, the block has %d records", len(col.StringTable), num_records)
+	}
+
+	if !col.BucketEncoded {
+		if uint32(len(col.Values)) > num_records {
+			return col.Name, fmt.Errorf("has %d values, the block has %d records", len(col.Values), num_records)
+		}
+
+		for _, v := range col.Values {
+			if err = checkValueId(v, col.StringTable); err != nil {
+				return col.Name, err
+			}
+		}
+		return col.Name, nil
+	}
+
+	seen := make([]int, num_records)
+	for _, bucket := range col.Bins {
+		if err = checkValueId(bucket.Value, col.StringTable); err != nil {
+			return col.Name, err
+		}
+
+		err = checkRecordIds(bucket.Records, col.DeltaEncodedIDs, num_records, seen)
+		if err != nil {
+			return col.Name, err
+		}
+	}
+
+	return col.Name, checkSeenOnce(seen)
+}
+
+func checkSetColumn(filename string, info *SavedColumnInfo) (string, error) {
+	col := SavedSetColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	num_records := uint32(info.NumRecords)
+	if !col.BucketEncoded {
+		if uint32(len(col.Values)) > num_records {
+			return col.Name, fmt.Errorf("has %d values, the block has %d records", len(col.Values), num_records)
+		}
+
+		for _, set := range col.Values {
+			for _, v := range set {
+				if err = checkValueId(v, col.StringTable); err != nil {
+					return col.Name, err
+				}
+			}
+		}
+		return col.Name, nil
+	}
+
+	// a record has a value in every bin of its set's members
+	seen := make([]int, num_records)
+	for _, bucket := range col.Bins {
+		if err = checkValueId(bucket.Value, col.StringTable); err != nil {
+			return col.Name, err
+		}
+
+		err = checkRecordIds(bucket.Records, col.DeltaEncodedIDs, num_records, seen)
+		if err != nil {
+			return col.Name, err
+		}
+	}
+
+	return col.Name, nil
+}
+
+// checkBlock returns what is wrong with the block, nothing when it reads fine
+func (t *Table) checkBlock(blockname string) []string {
+	problems := make([]string, 0)
+
+	// the info is read from disk, the block cache could hide a broken one
+	info := SavedColumnInfo{}
+	err := decodeInto(path.Join(blockname, "info.db"), &info)
+	if err != nil {
+		return append(problems, fmt.Sprint("info.db doesn't decode: ", err))
+	}
+
+	if info.NumRecords <= 0 {
+		return append(problems, fmt.Sprint("info.db has ", info.NumRecords, " records"))
+	}
+
+	files, err := ioutil.ReadDir(blockname)
+	if err != nil {
+		return append(problems, fmt.Sprint("can't list the block: ", err))
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		cname := trimCodecExt(f.Name())
+		filename := path.Join(blockname, f.Name())
+
+		var name string
+		switch {
+		case strings.HasPrefix(cname, "int_"):
+			name, err = checkIntColumn(filename, &info)
+		case strings.HasPrefix(cname, "str_"):
+			name, err = checkStrColumn(filename, &info)
+		case strings.HasPrefix(cname, "set_"):
+			name, err = checkSetColumn(filename, &info)
+		case cname == "values.db":
+			err = decodeInto(filename, &SavedBlockValues{})
+			if err != nil {
+				problems = append(problems, fmt.Sprint(f.Name(), " doesn't decode: ", err))
+			}
+			continue
+		default:
+			continue
+		}
+
+		switch {
+		case err != nil && name == "":
+			problems = append(problems, fmt.Sprint(f.Name(), " doesn't decode: ", err))
+		case err != nil:
+			problems = append(problems, fmt.Sprint(f.Name(), " ", err))
+		case name != strings.TrimSuffix(cname[4:], ".db"):
+			problems = append(problems, fmt.Sprint(f.Name(), " holds column ", name))
+		}
+	}
+
+	return problems
+}
+
+// quarantineBlock moves a corrupt block into the quarantine dir and takes it
+// out of the table. The ledger drops its records, when its info can tell how
+// many it had
+func (t *Table) quarantineBlock(blockname string) error {
+	name := t.tableBlockName(blockname)
+	quarantined := path.Join(t.quarantineDir(), name)
+	os.MkdirAll(path.Dir(quarantined), 0777)
+
+	if _, err := os.Stat(quarantined); err == nil {
+		os.RemoveAll(quarantined)
+	}
+
+	records := int64(0)
+	info := SavedColumnInfo{}
+	if decodeInto(path.Join(blockname, "info.db"), &info) == nil && info.NumRecords > 0 {
+		records = int64(info.NumRecords)
+	}
+
+	err := RenameAndMod(blockname, quarantined)
+	if err != nil {
+		return err
+	}
+
+	// the block is gone already, retiring it only takes it out of the
+	// manifest
+	t.retireBlocks([]string{blockname})
+	t.CommitManifest()
+	t.forgetBlocks([]string{blockname})
+
+	if records > 0 {
+		t.addLedgerEntry("quarantine_"+strings.Replace(name, "/", "_", -1), -records, "quarantine")
+	}
+
+	Debug("QUARANTINED BLOCK", blockname, "INTO", quarantined)
+	return nil
+}
@@ -0,0 +1,138 @@
+package sybil
+
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "testing"
+import "time"
+
+func writeTestColumn(t *testing.T, blockname string, col interface{}) {
+	files, _ := filepath.Glob(path.Join(blockname, "int_age*"))
+	for _, filename := range files {
+		os.Remove(filename)
+	}
+
+	f, err := os.Create(path.Join(blockname, "int_age.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = gob.NewEncoder(f).Encode(col)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFsckBlocks(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.TABLE = tableName // TODO: eliminate global use
+
+	half := CHUNK_SIZE / 2
+	ingestTestRecords(tableName, CHUNK_SIZE)
+	ingestTestRecords(tableName, half)
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+	nt.DigestRecords()
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	checkTestFsck(t, nt, false, int64(CHUNK_SIZE+half))
+
+	block_dirs, _ := nt.listBlockDirs(nil)
+	if len(block_dirs) != 2 {
+		t.Fatal("EXPECTED 2 BLOCKS, GOT", block_dirs)
+	}
+
+	var broken, good string
+	for _, blockname := range block_dirs {
+		if nt.LoadBlockInfo(blockname).NumRecords == int32(half) {
+			broken = blockname
+		} else {
+			good = blockname
+		}
+	}
+
+	// a column with a record id past the end of the block, an orphaned lock
+	// and query results cached before their block was rewritten
+	col := NewSavedIntColumn()
+	col.Name = "age"
+	col.BucketEncoded = true
+	col.Bins = []SavedIntBucket{SavedIntBucket{Value: 10, Records: []uint32{0, uint32(half)}}}
+	writeTestColumn(t, broken, col)
+
+	lockfile := path.Join(FLAGS.DIR, tableName, "orphan.lock")
+	ioutil.WriteFile(lockfile, []byte("2147483647"), 0666)
+
+	cachefile := queryCacheFile(good, "stale")
+	os.MkdirAll(path.Dir(cachefile), 0777)
+	ioutil.WriteFile(cachefile, []byte("stale"), 0666)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(cachefile, past, past)
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	report, err := nt.Fsck(&FsckSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.BrokenBlocks) != 1 || report.BrokenBlocks[0] != broken {
+		t.Error("EXPECTED FSCK TO FIND BROKEN BLOCK", broken, "GOT", report.BrokenBlocks)
+	}
+	if len(report.Locks) != 1 || len(report.StaleCaches) != 1 || len(report.Problems) != 3 {
+		t.Error("EXPECTED AN ORPHANED LOCK AND A STALE CACHE, GOT", report.Problems)
+	}
+
+	// the broken block is moved aside and its records leave the ledger
+	report, err = nt.Fsck(&FsckSpec{Fix: true, Quarantine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Quarantined) != 1 || len(report.Fixed) != 3 {
+		t.Error("EXPECTED FSCK TO QUARANTINE THE BROKEN BLOCK, GOT", report.Fixed, report.Problems)
+	}
+
+	if _, err := os.Stat(path.Join(nt.quarantineDir(), path.Base(broken))); err != nil {
+		t.Error("BROKEN BLOCK ISNT IN THE QUARANTINE DIR", err)
+	}
+	if _, err := os.Stat(lockfile); !os.IsNotExist(err) {
+		t.Error("ORPHANED LOCK WAS LEFT BEHIND")
+	}
+	if _, err := os.Stat(cachefile); !os.IsNotExist(err) {
+		t.Error("STALE CACHE FILE WAS LEFT BEHIND")
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	checkTestFsck(t, nt, false, int64(CHUNK_SIZE))
+
+	// value ids past the string table are found, too
+	problems := nt.checkBlock(good)
+	if len(problems) != 0 {
+		t.Error("GOOD BLOCK HAS PROBLEMS", problems)
+	}
+
+	str_col := NewSavedStrColumn()
+	str_col.Name = "age"
+	str_col.BucketEncoded = true
+	str_col.StringTable = []string{"ten"}
+	str_col.Bins = []SavedStrBucket{SavedStrBucket{Value: 1, Records: []uint32{0}}}
+	writeTestColumn(t, good, str_col)
+	os.Rename(path.Join(good, "int_age.db"), path.Join(good, "str_age.db"))
+
+	problems = nt.checkBlock(good)
+	if len(problems) != 1 {
+		t.Error("EXPECTED A VALUE ID PROBLEM, GOT", problems)
+	}
+}
@@ -0,0 +1,314 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strings"
+
+// TABLE INDEX
+// A table can index some of its columns (Settings.IndexCols). The index is
+// kept in INDEX_FILE next to the table's info.db and maps each value of an
+// indexed str or set column to the blocks that have it, named relative to
+// the table dir like in the manifest. Int columns aren't
+// indexed, the min and max in each block's info.db already rule blocks out.
+// `sybil index` builds the index from scratch, the blocks a digest writes are
+// staged and added with one commitIndex at its end. ShouldLoadBlockFromDir
+// skips the blocks the index rules out, blocks the index doesn't know about
+// are always loaded.
+
+var INDEX_FILE = "index.db"
+var INDEX_LOCK = "index"
+
+type SavedColumnIndex struct {
+	Values map[string]map[string]bool // value -> blocks
+}
+
+type SavedTableIndex struct {
+	IndexCols []string        // the Settings.IndexCols the index was built for
+	Blocks    map[string]bool // blocks the index covers
+	Columns   map[string]*SavedColumnIndex
+}
+
+func (t *Table) newSavedTableIndex() *SavedTableIndex {
+	idx := SavedTableIndex{Blocks: make(map[string]bool), Columns: make(map[string]*SavedColumnIndex)}
+	idx.IndexCols = t.Settings.IndexCols
+
+	return &idx
+}
+
+// SetIndexColumns replaces the indexed columns, the index needs to be rebuilt
+// with BuildIndex afterwards
+func (t *Table) SetIndexColumns(cols []string) {
+	sorted := append([]string{}, cols...)
+	sort.Strings(sorted)
+
+	t.Settings.IndexCols = sorted
+}
+
+func (idx *SavedTableIndex) column(name string) *SavedColumnIndex {
+	col, ok := idx.Columns[name]
+	if !ok {
+		col = &SavedColumnIndex{Values: make(map[string]map[string]bool)}
+		idx.Columns[name] = col
+	}
+
+	return col
+}
+
+func (idx *SavedTableIndex) addBlock(t *Table, blockname string, column_values map[string][]string) {
+	blockname = t.tableBlockName(blockname)
+	idx.Blocks[blockname] = true
+
+	for _, name := range t.Settings.IndexCols {
+		col := idx.column(name)
+		for _, v := range column_values[name] {
+			blocks, ok := col.Values[v]
+			if !ok {
+				blocks = make(map[string]bool)
+				col.Values[v] = blocks
+			}
+			blocks[blockname] = true
+		}
+	}
+}
+
+func (t *Table) loadIndexFile() *SavedTableIndex {
+	idx := SavedTableIndex{}
+	err := decodeInto(path.Join(FLAGS.DIR, t.Name, INDEX_FILE), &idx)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Debug("COULDNT READ TABLE INDEX", err)
+		}
+		return nil
+	}
+
+	return &idx
+}
+
+func (t *Table) saveIndexFile(idx *SavedTableIndex) error {
+	dirname := path.Join(FLAGS.DIR, t.Name)
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(idx)
+	if err != nil {
+		return err
+	}
+
+	tempfile, err := ioutil.TempFile(dirname, INDEX_FILE)
+	if err != nil {
+		return err
+	}
+
+	_, err = network.WriteTo(tempfile)
+	tempfile.Close()
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), path.Join(dirname, INDEX_FILE))
+}
+
+// stageIndexBlock marks a freshly written block for the next commitIndex
+func (t *Table) stageIndexBlock(blockname string, column_values map[string][]string) {
+	if len(t.Settings.IndexCols) == 0 {
+		return
+	}
+
+	t.block_m.Lock()
+	if t.index_staged == nil {
+		t.index_staged = make(map[string]map[string][]string)
+	}
+	t.index_staged[blockname] = column_values
+	t.block_m.Unlock()
+}
+
+// commitIndex adds the blocks staged since the last commit to the table
+// index, loading and saving the index once for all of them
+func (t *Table) commitIndex() {
+	t.block_m.Lock()
+	staged := t.index_staged
+	t.index_staged = nil
+	t.block_m.Unlock()
+
+	if len(staged) == 0 || len(t.Settings.IndexCols) == 0 {
+		return
+	}
+
+	if t.GrabIndexLock() == false {
+		Warn("COULDNT GRAB INDEX LOCK,", len(staged), "BLOCKS WONT BE IN THE INDEX")
+		return
+	}
+	defer t.ReleaseIndexLock()
+
+	idx := t.loadIndexFile()
+	if idx == nil {
+		idx = t.newSavedTableIndex()
+	}
+
+	// the older blocks have nothing for the new columns, adding these blocks
+	// would make the index rule them out
+	if strings.Join(idx.IndexCols, ",") != strings.Join(t.Settings.IndexCols, ",") {
+		Warn("INDEX COLUMNS CHANGED, RUN sybil index TO REBUILD THE INDEX OF", t.Name)
+		return
+	}
+
+	for blockname, column_values := range staged {
+		idx.addBlock(t, blockname, column_values)
+	}
+
+	err := t.saveIndexFile(idx)
+	if err != nil {
+		Warn("COULDNT SAVE TABLE INDEX", err)
+	}
+
+	t.block_m.Lock()
+	t.index, t.index_loaded = idx, true
+	t.block_m.Unlock()
+}
+
+// BuildIndex indexes every block of the table from scratch
+func (t *Table) BuildIndex() error {
+	if t.GrabIndexLock() == false {
+		return os.ErrExist
+	}
+	defer t.ReleaseIndexLock()
+
+	loadSpec := t.NewLoadSpec()
+	for _, name := range t.Settings.IndexCols {
+		switch t.GetColumnType(name) {
+		case STR_VAL:
+			loadSpec.Str(name)
+		case SET_VAL:
+			loadSpec.Set(name)
+		}
+	}
+
+	idx := t.newSavedTableIndex()
+	block_dirs, _ := t.listBlockDirs(nil)
+	for _, filename := range block_dirs {
+		info := t.LoadBlockInfo(filename)
+		if info.NumRecords <= 0 {
+			Debug("SKIPPING BROKEN BLOCK", filename, "FOR INDEX")
+			continue
+		}
+
+		block := t.LoadBlockFromDir(filename, &loadSpec, false)
+		if block == nil {
+			Debug("SKIPPING BROKEN BLOCK", filename, "FOR INDEX")
+			continue
+		}
+
+		column_values := make(map[string][]string)
+		for name := range loadSpec.columns {
+			col := block.GetColumnInfo(t.get_key_id(name))
+			for val := range col.StringTable {
+				column_values[name] = append(column_values[name], val)
+			}
+		}
+
+		t.block_m.Lock()
+		delete(t.BlockList, filename)
+		t.block_m.Unlock()
+
+		idx.addBlock(t, filename, column_values)
+	}
+
+	Debug("INDEXED", len(idx.Blocks), "BLOCKS ON", t.Settings.IndexCols)
+
+	t.block_m.Lock()
+	t.index, t.index_loaded = idx, true
+	t.block_m.Unlock()
+
+	return t.saveIndexFile(idx)
+}
+
+func (t *Table) getIndex() *SavedTableIndex {
+	if len(t.Settings.IndexCols) == 0 {
+		return nil
+	}
+
+	t.block_m.Lock()
+	defer t.block_m.Unlock()
+	if !t.index_loaded {
+		t.index = t.loadIndexFile()
+		t.index_loaded = true
+	}
+
+	return t.index
+}
+
+// returns false when the table index rules out the block for the filters
+func (t *Table) blockInIndex(dirname string, filters []Filter) bool {
+	idx := t.getIndex()
+	if idx == nil {
+		return true
+	}
+
+	blockname := t.tableBlockName(dirname)
+	if !idx.Blocks[blockname] {
+		return true
+	}
+
+	for _, f := range filters {
+		switch fil := f.(type) {
+		case StrFilter:
+			col, ok := idx.Columns[fil.Field]
+			if ok && fil.Op == "eq" && !col.Values[fil.Value][blockname] {
+				return false
+			}
+
+		case SetFilter:
+			col, ok := idx.Columns[fil.Field]
+			if ok && fil.Op == "in" && !col.Values[fil.Value][blockname] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// unindexBlocks takes removed blocks out of the table index
+func (t *Table) unindexBlocks(blocks []string) {
+	if len(blocks) == 0 || len(t.Settings.IndexCols) == 0 {
+		return
+	}
+
+	if t.GrabIndexLock() == false {
+		Warn("COULDNT GRAB INDEX LOCK, INDEX OF", t.Name, "STILL HAS REMOVED BLOCKS")
+		return
+	}
+	defer t.ReleaseIndexLock()
+
+	idx := t.loadIndexFile()
+	if idx == nil {
+		return
+	}
+
+	for _, name := range blocks {
+		blockname := t.tableBlockName(name)
+		delete(idx.Blocks, blockname)
+		for _, col := range idx.Columns {
+			for v, col_blocks := range col.Values {
+				delete(col_blocks, blockname)
+				if len(col_blocks) == 0 {
+					delete(col.Values, v)
+				}
+			}
+		}
+	}
+
+	err := t.saveIndexFile(idx)
+	if err != nil {
+		Warn("COULDNT SAVE TABLE INDEX", err)
+	}
+
+	t.block_m.Lock()
+	t.index, t.index_loaded = idx, true
+	t.block_m.Unlock()
+}
@@ -0,0 +1,99 @@
+package sybil
+
+import "context"
+import "os"
+import "strconv"
+import "testing"
+
+func TestTableIndex(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		block := strconv.Itoa(index / CHUNK_SIZE)
+		r.AddIntField("id", int64(index))
+		r.AddStrField("name", "name_"+block)
+		r.AddSetField("tags", []string{"tag_" + block})
+	}, blockCount)
+
+	// digest indexes the blocks it writes
+	GetTable(tableName).SetIndexColumns([]string{"name", "tags"})
+	saveAndReloadTable(t, tableName, blockCount)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	checkIndex := func() {
+		block_dirs, _ := nt.listBlockDirs(nil)
+		blocks := nt.scheduleBlocks(context.Background(), block_dirs)
+
+		countBlocks := func(f Filter) int {
+			count := 0
+			for _, b := range blocks {
+				if nt.blockInIndex(b, []Filter{f}) {
+					count++
+				}
+			}
+
+			return count
+		}
+
+		if n := countBlocks(nt.StrFilter("name", "eq", "name_1")); n != 1 {
+			t.Error("INDEX HAS", n, "BLOCKS FOR name_1, EXPECTED 1")
+		}
+
+		if n := countBlocks(nt.SetFilter("tags", "in", "tag_3")); n != 1 {
+			t.Error("INDEX HAS", n, "BLOCKS FOR tag_3, EXPECTED 1")
+		}
+
+		if n := countBlocks(nt.StrFilter("name", "neq", "name_1")); n != blockCount {
+			t.Error("INDEX HAS", n, "BLOCKS FOR A NEQ FILTER, EXPECTED", blockCount)
+		}
+	}
+
+	if len(nt.Settings.IndexCols) != 2 {
+		t.Fatal("INDEX COLUMNS WERENT SAVED IN THE TABLE INFO", nt.Settings.IndexCols)
+	}
+
+	checkIndex()
+
+	if idx := nt.loadIndexFile(); idx == nil || len(idx.Blocks) != blockCount {
+		t.Error("DIGEST DIDNT COMMIT ALL ITS BLOCKS TO THE INDEX")
+	}
+
+	// rebuild it from scratch
+	err := nt.BuildIndex()
+	if err != nil {
+		t.Fatal("COULDNT BUILD INDEX", err)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	checkIndex()
+
+	// trimmed blocks leave the index, so a new block that reuses the name
+	// of one isn't pruned with its values
+	block_dirs, _ := nt.listBlockDirs(nil)
+	name_1 := ""
+	for _, b := range block_dirs {
+		if !nt.blockInIndex(b, []Filter{nt.StrFilter("name", "eq", "name_1")}) {
+			continue
+		}
+		name_1 = b
+	}
+
+	nt.DropBlocks([]string{name_1})
+	if idx := nt.loadIndexFile(); idx == nil || len(idx.Blocks) != blockCount-1 || idx.Blocks[nt.tableBlockName(name_1)] {
+		t.Fatal("TRIMMED BLOCK IS STILL IN THE INDEX")
+	}
+
+	os.MkdirAll(name_1, 0777)
+	if !nt.blockInIndex(name_1, []Filter{nt.StrFilter("name", "eq", "name_2")}) {
+		t.Error("NEW BLOCK WITH THE NAME OF A TRIMMED BLOCK WAS PRUNED BY THE INDEX")
+	}
+}
@@ -14,8 +14,14 @@ var READ_ROWS_ONLY = false
 var MIN_FILES_TO_DIGEST = 0
 
 func (t *Table) getNewIngestBlockName() (string, error) {
-	Debug("GETTING INGEST BLOCK NAME", FLAGS.DIR, "TABLE", t.Name)
-	name, err := ioutil.TempDir(path.Join(FLAGS.DIR, t.Name), "block")
+	return t.getNewBlockNameIn(path.Join(FLAGS.DIR, t.Name))
+}
+
+// getNewBlockNameIn makes a new block dir inside dirname, which is the table
+// dir or one of its partitions
+func (t *Table) getNewBlockNameIn(dirname string) (string, error) {
+	Debug("GETTING INGEST BLOCK NAME", dirname, "TABLE", t.Name)
+	name, err := ioutil.TempDir(dirname, "block")
 	return name, err
 }
 
@@ -34,7 +40,13 @@ func (t *Table) IngestRecords(blockname string) {
 	Debug("KEY TABLE", t.KeyTable)
 	Debug("KEY TYPES", t.KeyTypes)
 
-	t.AppendRecordsToLog(t.newRecords[:], blockname)
+	err := t.writeDedupedRecords(t.newRecords, func(records RecordList) error {
+		return t.appendRecordsToLog(records, blockname)
+	})
+	if err != nil {
+		Warn("COULDNT INGEST INTO ROW STORE", err)
+	}
+
 	t.newRecords = make(RecordList, 0)
 	t.SaveTableInfo("info")
 	t.ReleaseRecords()
@@ -203,72 +215,74 @@ func LoadRowBlockCB(digestname string, records RecordList) {
 
 }
 
-var DELETE_BLOCKS = make([]string, 0)
-
 func (t *Table) RestoreUningestedFiles() {
 	if t.GrabDigestLock() == false {
 		Debug("CANT RESTORE UNINGESTED RECORDS WITHOUT DIGEST LOCK")
 		return
 	}
 
-	ingestdir := path.Join(FLAGS.DIR, t.Name, INGEST_DIR)
-	os.MkdirAll(ingestdir, 0777)
-
 	digesting := path.Join(FLAGS.DIR, t.Name)
 	file, _ := os.Open(digesting)
 	dirs, _ := file.Readdir(0)
 
 	for _, dir := range dirs {
 		if strings.HasPrefix(dir.Name(), STOMACHE_DIR) && dir.IsDir() {
-			fname := path.Join(digesting, dir.Name())
-			file, _ := os.Open(fname)
-			files, _ := file.Readdir(0)
-			for _, file := range files {
-				Debug("RESTORING UNINGESTED FILE", file.Name())
-				from := path.Join(fname, file.Name())
-				to := path.Join(ingestdir, file.Name())
-				err := RenameAndMod(from, to)
-				if err != nil {
-					Debug("COULDNT RESTORE UNINGESTED FILE", from, to, err)
-				}
-			}
+			t.restoreStomache(path.Join(digesting, dir.Name()))
+		}
+	}
 
-			err := os.Remove(path.Join(digesting, dir.Name()))
-			if err != nil {
-				Debug("REMOVING STOMACHE FAILED!", err)
-			}
+}
+
+// restoreStomache moves the files in a stomache dir back into the row store
+func (t *Table) restoreStomache(fname string) {
+	ingestdir := path.Join(FLAGS.DIR, t.Name, INGEST_DIR)
+	os.MkdirAll(ingestdir, 0777)
 
+	file, _ := os.Open(fname)
+	files, _ := file.Readdir(0)
+	for _, file := range files {
+		Debug("RESTORING UNINGESTED FILE", file.Name())
+		from := path.Join(fname, file.Name())
+		to := path.Join(ingestdir, file.Name())
+		err := RenameAndMod(from, to)
+		if err != nil {
+			Debug("COULDNT RESTORE UNINGESTED FILE", from, to, err)
 		}
 	}
 
+	err := os.Remove(fname)
+	if err != nil {
+		Debug("REMOVING STOMACHE FAILED!", err)
+	}
 }
 
 type SaveBlockChunkCB struct {
-	digestdir string
 }
 
 func (cb *SaveBlockChunkCB) CB(digestname string, records RecordList) {
 
 	t := GetTable(FLAGS.TABLE)
 	if digestname == NO_MORE_BLOCKS {
+		t.newRecords = t.DedupRecords(t.newRecords)
+		saved := true
 		if len(t.newRecords) > 0 {
-			t.SaveRecordsToColumns()
+			saved = t.SaveRecordsToColumns()
 			t.ReleaseRecords()
 		}
 
-		for _, file := range DELETE_BLOCKS {
-			Debug("REMOVING", file)
-			os.Remove(file)
-		}
-
-		dir, err := os.Open(cb.digestdir)
-		if err == nil {
-			contents, err := dir.Readdir(0)
-
-			if err == nil && len(contents) == 0 {
-				os.RemoveAll(cb.digestdir)
+		if saved {
+			// removes the digested files and the stomache dir
+			t.finishDigest()
+		} else {
+			// puts the digested files back into the row store
+			Warn("DIGEST OF", t.Name, "FAILED, ROLLING IT BACK")
+			journal := t.digest_journal
+			t.digest_journal = nil
+			if journal != nil {
+				t.rollDigestBack(journal)
 			}
 		}
+		t.foldLedger()
 		t.ReleaseDigestLock()
 		return
 	}
@@ -277,7 +291,6 @@ func (cb *SaveBlockChunkCB) CB(digestname string, records RecordList) {
 	if len(records) > 0 {
 		t.newRecords = append(t.newRecords, records...)
 	}
-	DELETE_BLOCKS = append(DELETE_BLOCKS, digestname)
 
 }
 
@@ -293,12 +306,33 @@ func (t *Table) DigestRecords() {
 		return
 	}
 
+	if t.HasUnfinishedAlter() {
+		t.ReleaseDigestLock()
+		Warn("TABLE", t.Name, "HAS AN UNFINISHED ALTER, RUN sybil alter -resume BEFORE DIGESTING")
+		return
+	}
+
+	// a digest that died half way is finished or undone before this one
+	// starts, see table_journal.go
+	state, err := t.RecoverDigest()
+	if err != nil {
+		t.ReleaseDigestLock()
+		Warn("COULDNT READ DIGEST JOURNAL OF", t.Name, err, "NOT DIGESTING")
+		return
+	}
+
+	if state != "" {
+		Debug("RECOVERED UNFINISHED DIGEST, IT WAS", state)
+	}
+
+	if !t.HasLedger() {
+		t.StartLedger()
+	}
+
 	dirname := path.Join(FLAGS.DIR, t.Name)
 	digestfile := path.Join(dirname, INGEST_DIR)
 	digesting, err := ioutil.TempDir(dirname, STOMACHE_DIR)
 
-	// TODO: we need to figure a way out such that the STOMACHE_DIR isn't going
-	// to ruin us if it still exists (bc some proc didn't clean up after itself)
 	if err != nil {
 		t.ReleaseDigestLock()
 		Debug("ERROR CREATING DIGESTION DIR", err)
@@ -311,11 +345,27 @@ func (t *Table) DigestRecords() {
 	files, err := file.Readdir(0)
 	if len(files) < MIN_FILES_TO_DIGEST {
 		Debug("SKIPPING DIGESTION, NOT AS MANY FILES AS WE THOUGHT", len(files), "VS", MIN_FILES_TO_DIGEST)
+		os.Remove(digesting)
 		t.ReleaseDigestLock()
 		return
 	}
 
 	if err == nil {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+
+		// the journal goes first, so a crash while the files are moved
+		// puts them back
+		err = t.startDigestJournal(digesting, names)
+		if err != nil {
+			Warn("COULDNT START DIGEST JOURNAL OF", t.Name, err, "NOT DIGESTING")
+			os.Remove(digesting)
+			t.ReleaseDigestLock()
+			return
+		}
+
 		for _, f := range files {
 			RenameAndMod(path.Join(digestfile, f.Name()), path.Join(digesting, f.Name()))
 		}
@@ -323,9 +373,10 @@ func (t *Table) DigestRecords() {
 		// ingestions...
 		os.MkdirAll(digestfile, 0777)
 		basename := path.Base(digesting)
-		cb := SaveBlockChunkCB{digesting}
+		cb := SaveBlockChunkCB{}
 		t.LoadRowStoreRecords(basename, cb.CB)
 	} else {
+		os.Remove(digesting)
 		t.ReleaseDigestLock()
 	}
 }
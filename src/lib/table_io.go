@@ -4,7 +4,6 @@ import "fmt"
 
 import "os"
 import "path"
-import "sort"
 import "strings"
 import "sync"
 import "time"
@@ -29,6 +28,13 @@ func (t *Table) saveTableInfo(fname string) {
 	}
 
 	defer t.ReleaseInfoLock()
+	err := t.writeTableInfo(fname)
+	if err != nil {
+		Error(err)
+	}
+}
+
+func (t *Table) writeTableInfo(fname string) error {
 	var network bytes.Buffer // Stand-in for the network.
 	dirname := path.Join(FLAGS.DIR, t.Name)
 	filename := path.Join(dirname, fmt.Sprintf("%s.db", fname))
@@ -44,23 +50,31 @@ func (t *Table) saveTableInfo(fname string) {
 	err := enc.Encode(t)
 
 	if err != nil {
-		Error("encode:", err)
+		return fmt.Errorf("encode: %v", err)
 	}
 
 	Debug("SERIALIZED TABLE INFO", fname, "INTO ", network.Len(), "BYTES")
 
 	tempfile, err := ioutil.TempFile(dirname, "info.db")
 	if err != nil {
-		Error("ERROR CREATING TEMP FILE FOR TABLE INFO", err)
+		return fmt.Errorf("ERROR CREATING TEMP FILE FOR TABLE INFO %v", err)
 	}
 
 	_, err = network.WriteTo(tempfile)
+	tempfile.Close()
 	if err != nil {
-		Error("ERROR SAVING TABLE INFO INTO TEMPFILE", err)
+		os.Remove(tempfile.Name())
+		return fmt.Errorf("ERROR SAVING TABLE INFO INTO TEMPFILE %v", err)
 	}
 
 	RenameAndMod(tempfile.Name(), filename)
 	os.Create(flagfile)
+
+	if fname == "info" {
+		return t.writeTableSettings()
+	}
+
+	return nil
 }
 
 func (t *Table) SaveTableInfo(fname string) {
@@ -69,15 +83,34 @@ func (t *Table) SaveTableInfo(fname string) {
 
 }
 
+// WriteTableInfo is SaveTableInfo for callers that can't have the process
+// exit on failure: errors (including a taken info lock) are returned instead
+func (t *Table) WriteTableInfo(fname string) error {
+	save_table := getSaveTable(t)
+	if save_table.GrabInfoLock() == false {
+		return fmt.Errorf("couldn't grab info lock for table %s", t.Name)
+	}
+
+	defer save_table.ReleaseInfoLock()
+	return save_table.writeTableInfo(fname)
+}
+
 func getSaveTable(t *Table) *Table {
 	return &Table{Name: t.Name,
 		KeyTable: t.KeyTable,
 		KeyTypes: t.KeyTypes,
 		IntInfo:  t.IntInfo,
-		StrInfo:  t.StrInfo}
+		StrInfo:  t.StrInfo,
+		Settings: t.Settings}
 }
 
 func (t *Table) saveRecordList(records RecordList) bool {
+	return t.saveRecordListIn(path.Join(FLAGS.DIR, t.Name), records)
+}
+
+// saveRecordListIn saves records into new blocks inside dirname, it returns
+// false when there are no records or a block couldn't be saved
+func (t *Table) saveRecordListIn(dirname string, records RecordList) bool {
 	if len(records) == 0 {
 		return false
 	}
@@ -88,45 +121,68 @@ func (t *Table) saveRecordList(records RecordList) bool {
 	chunks := len(records) / chunk_size
 
 	if chunks == 0 {
-		filename, err := t.getNewIngestBlockName()
+		filename, err := t.getNewBlockNameIn(dirname)
 		if err != nil {
 			Error("ERR SAVING BLOCK", filename, err)
 		}
-		t.SaveRecordsToBlock(records, filename)
-	} else {
-		for j := 0; j < chunks; j++ {
-			filename, err := t.getNewIngestBlockName()
-			if err != nil {
-				Error("ERR SAVING BLOCK", filename, err)
-			}
-			t.SaveRecordsToBlock(records[j*chunk_size:(j+1)*chunk_size], filename)
-		}
+		return t.SaveRecordsToBlock(records, filename)
+	}
 
-		// SAVE THE REMAINDER
-		if len(records) > chunks*chunk_size {
-			filename, err := t.getNewIngestBlockName()
-			if err != nil {
-				Error("Error creating new ingestion block", err)
-			}
+	for j := 0; j < chunks; j++ {
+		filename, err := t.getNewBlockNameIn(dirname)
+		if err != nil {
+			Error("ERR SAVING BLOCK", filename, err)
+		}
+		if !t.SaveRecordsToBlock(records[j*chunk_size:(j+1)*chunk_size], filename) {
+			return false
+		}
+	}
 
-			t.SaveRecordsToBlock(records[chunks*chunk_size:], filename)
+	// SAVE THE REMAINDER
+	if len(records) > chunks*chunk_size {
+		filename, err := t.getNewBlockNameIn(dirname)
+		if err != nil {
+			Error("Error creating new ingestion block", err)
 		}
+
+		return t.SaveRecordsToBlock(records[chunks*chunk_size:], filename)
 	}
 
 	return true
 }
 
+// SaveRecordsToColumns saves the new records into blocks, it returns false
+// when a block couldn't be saved. The digest is then left unsaved in its
+// journal, so it gets rolled back instead of forward
 func (t *Table) SaveRecordsToColumns() bool {
 	os.MkdirAll(path.Join(FLAGS.DIR, t.Name), 0777)
-	sort.Sort(SortRecordsByTime{t.newRecords})
+	t.SortRecords(t.newRecords)
+	records := int64(len(t.newRecords))
 
-	t.FillPartialBlock()
-	ret := t.saveRecordList(t.newRecords)
+	ret := true
+	switch {
+	case len(t.newRecords) == 0:
+	case t.Settings.Partition != "":
+		ret = t.savePartitionedRecords(t.newRecords)
+	default:
+		ret = t.FillPartialBlock()
+		if ret && len(t.newRecords) > 0 {
+			ret = t.saveRecordList(t.newRecords)
+		}
+	}
 	t.newRecords = make(RecordList, 0)
 	t.SaveTableInfo("info")
 
-	return ret
+	if !ret {
+		Warn("COULDNT SAVE", records, "RECORDS OF", t.Name, "INTO BLOCKS")
+		return false
+	}
+
+	t.journalSaved(records)
+	t.CommitManifest()
+	t.commitIndex()
 
+	return true
 }
 
 func (t *Table) LoadTableInfo() bool {
@@ -179,6 +235,8 @@ func (t *Table) LoadTableInfoFrom(filename string) bool {
 		}
 	}
 
+	t.Settings = saved_table.Settings
+
 	// If we are recovering the INFO lock, we won't necessarily have
 	// all fields filled out
 	if t.string_id_m != nil {
@@ -217,10 +275,20 @@ func file_looks_like_block(v os.FileInfo) bool {
 
 	case v.Name() == INGEST_DIR || v.Name() == TEMP_INGEST_DIR:
 		return false
-	case v.Name() == CACHE_DIR:
+	case v.Name() == CACHE_DIR || v.Name() == RESULTS_CACHE_DIR:
+		return false
+	case strings.HasPrefix(v.Name(), LEDGER_DIR):
+		return false
+	case v.Name() == QUARANTINE_DIR:
+		return false
+	case v.Name() == DEDUP_DIR:
+		return false
+	case strings.HasSuffix(v.Name(), REPLACED_BLOCK_EXT):
 		return false
 	case strings.HasPrefix(v.Name(), STOMACHE_DIR):
 		return false
+	case strings.HasPrefix(v.Name(), PARTITION_PREFIX):
+		return false
 	case strings.HasSuffix(v.Name(), "info.db"):
 		return false
 	case strings.HasSuffix(v.Name(), "old"):
@@ -282,6 +350,8 @@ func (t *Table) WriteQueryCache(to_cache_specs map[string]*QuerySpec) {
 	var wg sync.WaitGroup
 
 	saved := 0
+	saved_bytes := int64(0)
+	m := &sync.Mutex{}
 
 	if FLAGS.CACHED_QUERIES {
 		for blockName, blockQuery := range to_cache_specs {
@@ -296,7 +366,10 @@ func (t *Table) WriteQueryCache(to_cache_specs map[string]*QuerySpec) {
 			saved += 1
 			go func() {
 
-				thisQuery.SaveCachedResults(thisName)
+				size := thisQuery.SaveCachedResults(thisName)
+				m.Lock()
+				saved_bytes += size
+				m.Unlock()
 				if FLAGS.DEBUG {
 					fmt.Fprint(os.Stderr, "s")
 				}
@@ -307,6 +380,8 @@ func (t *Table) WriteQueryCache(to_cache_specs map[string]*QuerySpec) {
 
 		wg.Wait()
 
+		t.addQueryCacheBytes(saved_bytes)
+
 		saveend := time.Now()
 
 		if saved > 0 {
@@ -377,15 +452,29 @@ func (t *Table) ChunkAndSave() {
 
 	if len(t.newRecords) >= CHUNK_SIZE {
 		os.MkdirAll(path.Join(FLAGS.DIR, t.Name), 0777)
-		name, err := t.getNewIngestBlockName()
-		if err == nil {
-			t.SaveRecordsToBlock(t.newRecords, name)
+		err := t.writeDedupedRecords(t.newRecords, func(records RecordList) error {
+			name, err := t.getNewIngestBlockName()
+			if err != nil {
+				return err
+			}
+
+			if !t.SaveRecordsToBlock(records, name) {
+				return fmt.Errorf("couldn't save block %s", name)
+			}
+
 			t.SaveTableInfo("info")
-			t.newRecords = make(RecordList, 0)
-			t.ReleaseRecords()
-		} else {
+			t.CommitManifest()
+			t.commitIndex()
+			t.addLedgerEntry("ingest_"+path.Base(name), int64(len(records)), "ingest")
+			return nil
+		})
+
+		if err != nil {
 			Error("ERROR SAVING BLOCK", err)
 		}
+
+		t.newRecords = make(RecordList, 0)
+		t.ReleaseRecords()
 	}
 
 }
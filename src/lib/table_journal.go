@@ -0,0 +1,294 @@
+package sybil
+
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+
+// DIGEST JOURNAL
+// DigestRecords moves the ingest files into a stomache dir and saves their
+// records into new blocks. The digest journal (<table>/journal.db) records
+// which ingest files go into which new blocks, and which partial blocks the
+// new blocks replace, so a digest that died half way is finished or undone by
+// the next one instead of restoring whatever its stomache dir held. Until all
+// of its blocks are saved, a digest is "started" and gets rolled back: its new
+// blocks are removed, the blocks it replaced are put back and its ingest files
+// go back into the row store. Once they are saved it is "saved" and gets
+// rolled forward: the replaced blocks and the ingest files are removed and
+// its records go into the record ledger (table_ledger.go). While a digest is
+// journaled, partial blocks aren't rewritten in place: their records go into
+// a new block and the old one is moved aside (or retired, in tables with a
+// manifest) until the digest is done. Compaction is journaled the same way,
+// as a digest without a stomache dir whose new blocks replace the blocks it
+// compacts.
+
+var DIGEST_JOURNAL = "journal.db"
+var REPLACED_BLOCK_EXT = ".replaced"
+
+const (
+	DIGEST_STARTED = "started"
+	DIGEST_SAVED   = "saved"
+)
+
+// the stomache dir and the blocks are named relative to the table dir
+type SavedDigestJournal struct {
+	Stomache string           // dir the ingest files were moved into
+	Files    []string         // the ingest files, inside Stomache
+	State    string           // DIGEST_STARTED or DIGEST_SAVED
+	Blocks   map[string]int32 // new blocks -> records saved into them
+	Replaced []string         // partial blocks the new blocks replace
+	Records  int64            // records the digest saved
+}
+
+func (t *Table) digestJournalFile() string {
+	return path.Join(FLAGS.DIR, t.Name, DIGEST_JOURNAL)
+}
+
+// LoadDigestJournal reads the journal of the digest in progress, it is nil
+// when no digest is running or was left unfinished
+func (t *Table) LoadDigestJournal() (*SavedDigestJournal, error) {
+	if _, err := os.Stat(t.digestJournalFile()); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	journal := SavedDigestJournal{}
+	err := decodeInto(t.digestJournalFile(), &journal)
+	if err != nil {
+		return nil, err
+	}
+
+	if journal.Blocks == nil {
+		journal.Blocks = make(map[string]int32)
+	}
+
+	return &journal, nil
+}
+
+func (t *Table) saveDigestJournal(journal *SavedDigestJournal) error {
+	tempfile, err := ioutil.TempFile(path.Join(FLAGS.DIR, t.Name), "journal")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(tempfile).Encode(journal)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	tempfile.Close()
+
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), t.digestJournalFile())
+}
+
+// updateDigestJournal saves the journal of the running digest after a
+// change. A digest that can't keep its journal can't go on
+func (t *Table) updateDigestJournal() {
+	err := t.saveDigestJournal(t.digest_journal)
+	if err != nil {
+		Error("COULDNT UPDATE DIGEST JOURNAL OF", t.Name, err)
+	}
+}
+
+// startDigestJournal journals a digest of files, before they are moved
+// into the stomache dir
+func (t *Table) startDigestJournal(stomache string, files []string) error {
+	journal := SavedDigestJournal{
+		Stomache: t.tableBlockName(stomache),
+		Files:    files,
+		State:    DIGEST_STARTED,
+		Blocks:   make(map[string]int32)}
+
+	return t.startJournal(&journal)
+}
+
+// startCompactJournal journals a compaction before its new blocks are saved
+func (t *Table) startCompactJournal() error {
+	journal := SavedDigestJournal{State: DIGEST_STARTED, Blocks: make(map[string]int32)}
+
+	return t.startJournal(&journal)
+}
+
+func (t *Table) startJournal(journal *SavedDigestJournal) error {
+	err := t.saveDigestJournal(journal)
+	if err != nil {
+		return err
+	}
+
+	t.digest_journal = journal
+	return nil
+}
+
+// journalBlock records a new block of the running digest before it is saved
+func (t *Table) journalBlock(blockname string, records int) {
+	if t.digest_journal == nil || t.digest_journal.State != DIGEST_STARTED {
+		return
+	}
+
+	t.digest_journal.Blocks[t.tableBlockName(blockname)] = int32(records)
+	t.updateDigestJournal()
+}
+
+// replaceBlock takes a partial block out of the table once its records were
+// saved into a new block
+func (t *Table) replaceBlock(blockname string) {
+	if t.digest_journal == nil {
+		t.retireBlocks([]string{blockname})
+		return
+	}
+
+	t.digest_journal.Replaced = append(t.digest_journal.Replaced, t.tableBlockName(blockname))
+	t.updateDigestJournal()
+
+	if t.HasManifest() {
+		t.retireBlocks([]string{blockname})
+		return
+	}
+
+	err := RenameAndMod(blockname, blockname+REPLACED_BLOCK_EXT)
+	if err != nil {
+		Error("COULDNT MOVE REPLACED BLOCK", blockname, err)
+	}
+}
+
+// journalSaved marks the blocks of the running digest as saved, from here on
+// the digest is rolled forward
+func (t *Table) journalSaved(records int64) {
+	if t.digest_journal == nil {
+		return
+	}
+
+	t.digest_journal.State = DIGEST_SAVED
+	t.digest_journal.Records += records
+	t.updateDigestJournal()
+}
+
+// finishDigest rolls the running digest forward once its records are saved
+func (t *Table) finishDigest() {
+	journal := t.digest_journal
+	if journal == nil {
+		return
+	}
+
+	if journal.State != DIGEST_SAVED {
+		t.journalSaved(0)
+	}
+
+	t.digest_journal = nil
+	t.rollDigestForward(journal)
+}
+
+func (t *Table) rollDigestForward(journal *SavedDigestJournal) {
+	Debug("ROLLING DIGEST", journal.Stomache, "FORWARD")
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+
+	replaced := make([]string, 0, len(journal.Replaced))
+	for _, name := range journal.Replaced {
+		replaced = append(replaced, path.Join(table_dir, name))
+	}
+
+	if t.HasManifest() {
+		for name := range journal.Blocks {
+			t.stageManifestBlock(path.Join(table_dir, name))
+		}
+		t.retireBlocks(replaced)
+		if t.CommitManifest() == false {
+			Error("COULDNT COMMIT BLOCKS OF DIGEST", journal.Stomache)
+		}
+	} else {
+		for _, blockname := range replaced {
+			os.RemoveAll(blockname + REPLACED_BLOCK_EXT)
+		}
+	}
+	t.unindexBlocks(replaced)
+
+	// compactions don't add records
+	if journal.Stomache != "" {
+		stomache := path.Join(table_dir, journal.Stomache)
+		for _, filename := range journal.Files {
+			Debug("REMOVING", filename)
+			os.Remove(path.Join(stomache, filename))
+		}
+		os.Remove(stomache)
+
+		t.addLedgerEntry("digest_"+path.Base(journal.Stomache), journal.Records, "digest")
+	}
+
+	os.Remove(t.digestJournalFile())
+}
+
+func (t *Table) rollDigestBack(journal *SavedDigestJournal) {
+	Debug("ROLLING DIGEST", journal.Stomache, "BACK")
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+
+	for name := range journal.Blocks {
+		blockname := path.Join(table_dir, name)
+		os.RemoveAll(blockname)
+		os.RemoveAll(blockname + ".partial")
+
+		// blocks this process saved aren't committed to the manifest or
+		// the index anymore
+		t.manifest_m.Lock()
+		delete(t.manifest_added, blockname)
+		t.manifest_m.Unlock()
+
+		t.block_m.Lock()
+		delete(t.index_staged, blockname)
+		t.block_m.Unlock()
+	}
+
+	for _, name := range journal.Replaced {
+		blockname := path.Join(table_dir, name)
+		if _, err := os.Stat(blockname + REPLACED_BLOCK_EXT); err == nil {
+			RenameAndMod(blockname+REPLACED_BLOCK_EXT, blockname)
+		}
+
+		t.manifest_m.Lock()
+		delete(t.manifest_retired, blockname)
+		t.manifest_m.Unlock()
+	}
+
+	if journal.Stomache == "" {
+		os.Remove(t.digestJournalFile())
+		return
+	}
+
+	stomache := path.Join(table_dir, journal.Stomache)
+	ingestdir := path.Join(table_dir, INGEST_DIR)
+	os.MkdirAll(ingestdir, 0777)
+	for _, filename := range journal.Files {
+		from := path.Join(stomache, filename)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+
+		err := RenameAndMod(from, path.Join(ingestdir, filename))
+		if err != nil {
+			Error("COULDNT RESTORE UNINGESTED FILE", from, err)
+		}
+	}
+	os.Remove(stomache)
+
+	os.Remove(t.digestJournalFile())
+}
+
+// RecoverDigest finishes or undoes a digest that died half way, going by its
+// journal. It returns the state the digest was left in, or "" when there was
+// none. The digest lock must be held
+func (t *Table) RecoverDigest() (string, error) {
+	journal, err := t.LoadDigestJournal()
+	if err != nil || journal == nil {
+		return "", err
+	}
+
+	if journal.State == DIGEST_SAVED {
+		t.rollDigestForward(journal)
+	} else {
+		t.rollDigestBack(journal)
+	}
+
+	return journal.State, nil
+}
@@ -0,0 +1,189 @@
+package sybil
+
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "path"
+import "testing"
+
+func ingestTestRecords(tableName string, count int) {
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, 1)
+
+	tbl := GetTable(tableName)
+	tbl.newRecords = tbl.newRecords[:count]
+	tbl.IngestRecords("ingest")
+}
+
+// startTestDigest journals a digest of the row store and loads its records
+func startTestDigest(t *testing.T, tbl *Table) {
+	dirname := path.Join(FLAGS.DIR, tbl.Name)
+	digesting, err := ioutil.TempDir(dirname, STOMACHE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ingestdir := path.Join(dirname, INGEST_DIR)
+	files, _ := ioutil.ReadDir(ingestdir)
+	names := make([]string, 0)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+
+	err = tbl.startDigestJournal(digesting, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		RenameAndMod(path.Join(ingestdir, name), path.Join(digesting, name))
+	}
+
+	tbl.LoadRowStoreRecords(path.Base(digesting), func(name string, records RecordList) {
+		tbl.newRecords = append(tbl.newRecords, records...)
+	})
+}
+
+// crashTestDigest runs the first half of a digest of the row store, up to
+// saving the records when save is set, and then drops it like a digest that
+// died
+func crashTestDigest(t *testing.T, tbl *Table, save bool) {
+	startTestDigest(t, tbl)
+
+	if save {
+		tbl.SaveRecordsToColumns()
+	} else {
+		tbl.FillPartialBlock()
+	}
+
+	tbl.digest_journal = nil
+	tbl.newRecords = make(RecordList, 0)
+}
+
+func checkTestFsck(t *testing.T, tbl *Table, fix bool, records int64) *FsckReport {
+	report, err := tbl.Fsck(&FsckSpec{Fix: fix})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) > 0 {
+		t.Error("FSCK FOUND PROBLEMS", report.Problems)
+	}
+
+	if report.BlockRecords != records || report.LedgerRecords != records {
+		t.Error("EXPECTED", records, "RECORDS, BLOCKS HAVE", report.BlockRecords, "LEDGER HAS", report.LedgerRecords)
+	}
+
+	return report
+}
+
+func TestDigestJournal(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	DELETE_BLOCKS_AFTER_QUERY = false
+	FLAGS.TABLE = tableName // TODO: eliminate global use
+
+	half := CHUNK_SIZE / 2
+	ingestTestRecords(tableName, half)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+	nt.DigestRecords()
+
+	if !nt.HasLedger() {
+		t.Fatal("DIGEST DIDNT START THE RECORD LEDGER")
+	}
+	checkTestFsck(t, nt, false, int64(half))
+
+	// a digest that dies before its blocks are saved is rolled back by the
+	// next one, which digests the records again
+	ingestTestRecords(tableName, half)
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	crashTestDigest(t, nt, false)
+
+	report, _ := nt.Fsck(&FsckSpec{})
+	if report.Digest != DIGEST_STARTED || len(report.Problems) != 1 {
+		t.Error("EXPECTED AN UNFINISHED DIGEST, GOT", report.Digest, report.Problems)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	nt.DigestRecords()
+
+	if _, err := os.Stat(nt.digestJournalFile()); !os.IsNotExist(err) {
+		t.Error("DIGEST JOURNAL WAS LEFT BEHIND")
+	}
+	checkTestFsck(t, nt, false, int64(CHUNK_SIZE))
+
+	// a digest that dies after its blocks are saved is rolled forward and
+	// its ingest files aren't read again
+	ingestTestRecords(tableName, half)
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	crashTestDigest(t, nt, true)
+
+	report, _ = nt.Fsck(&FsckSpec{})
+	if report.Digest != DIGEST_SAVED {
+		t.Error("EXPECTED A SAVED DIGEST, GOT", report.Digest, report.Problems)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	report = checkTestFsck(t, nt, true, int64(CHUNK_SIZE+half))
+	if len(report.Fixed) != 1 {
+		t.Error("EXPECTED FSCK TO ROLL THE DIGEST FORWARD, GOT", report.Fixed)
+	}
+
+	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, tableName, INGEST_DIR))
+	if len(files) != 0 {
+		t.Error("ROLLED FORWARD DIGEST LEFT", len(files), "INGEST FILES")
+	}
+
+	// a digest whose blocks can't be saved isn't marked as saved, so it is
+	// rolled back instead of losing its ingest files
+	ingestTestRecords(tableName, half)
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	startTestDigest(t, nt)
+	old_tries := LOCK_TRIES
+	LOCK_TRIES = 0
+	if nt.SaveRecordsToColumns() {
+		t.Error("SAVED RECORDS WITHOUT GRABBING BLOCK LOCKS")
+	}
+	LOCK_TRIES = old_tries
+	nt.digest_journal = nil
+
+	report, _ = nt.Fsck(&FsckSpec{})
+	if report.Digest != DIGEST_STARTED {
+		t.Error("DIGEST THAT COULDNT SAVE ITS BLOCKS IS", report.Digest)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+	nt.DigestRecords()
+	checkTestFsck(t, nt, false, int64(2*CHUNK_SIZE))
+
+	// records that go missing from the blocks are noticed
+	block_dirs, _ := nt.listBlockDirs(nil)
+	os.RemoveAll(block_dirs[0])
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	report, _ = nt.Fsck(&FsckSpec{})
+	if len(report.Problems) != 1 || report.LedgerRecords-report.BlockRecords != int64(CHUNK_SIZE) {
+		t.Error("EXPECTED FSCK TO FIND", CHUNK_SIZE, "LOST RECORDS, GOT", report.Problems)
+	}
+}
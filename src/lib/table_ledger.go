@@ -0,0 +1,214 @@
+package sybil
+
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+
+// RECORD LEDGER
+// The record ledger (<table>/ledger/) keeps count of the records that should
+// be in the table's blocks, so fsck can tell when records were lost or saved
+// twice. Every write that adds or drops records puts an entry with the change
+// into the ledger dir, under a name that belongs to that write, so writers
+// don't need a lock and redoing a write (like rolling a digest forward again)
+// doesn't count it twice. Digest folds the entries into one now and then: the
+// folded entry lists the entries it replaces, which are ignored from then on
+// and removed. Tables without a ledger dir don't keep count, fsck -fix starts
+// one with the records their blocks have.
+
+var LEDGER_DIR = "ledger"
+var LEDGER_FOLD_AFTER = 64
+
+type SavedLedgerEntry struct {
+	Records int64    // records added (or dropped, when negative)
+	Note    string   // what made the change
+	Folded  []string // entries this one replaces
+}
+
+func (t *Table) ledgerDir() string {
+	return path.Join(FLAGS.DIR, t.Name, LEDGER_DIR)
+}
+
+func (t *Table) HasLedger() bool {
+	_, err := os.Stat(t.ledgerDir())
+	return err == nil
+}
+
+// addLedgerEntry records a change of records in the table's blocks. name
+// identifies the write, an empty name makes up a new one
+func (t *Table) addLedgerEntry(name string, records int64, note string) {
+	if !t.HasLedger() {
+		return
+	}
+
+	t.writeLedgerEntry(name, &SavedLedgerEntry{Records: records, Note: note})
+}
+
+func (t *Table) writeLedgerEntry(name string, entry *SavedLedgerEntry) bool {
+	tempfile, err := ioutil.TempFile(t.ledgerDir(), entry.Note)
+	if err != nil {
+		Warn("COULDNT CREATE LEDGER ENTRY FOR", t.Name, err)
+		return false
+	}
+
+	if name == "" {
+		name = path.Base(tempfile.Name())
+	}
+
+	err = gob.NewEncoder(tempfile).Encode(entry)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	tempfile.Close()
+
+	if err == nil {
+		err = RenameAndMod(tempfile.Name(), path.Join(t.ledgerDir(), name+".db"))
+	}
+
+	if err != nil {
+		Warn("COULDNT SAVE LEDGER ENTRY FOR", t.Name, err)
+		os.Remove(tempfile.Name())
+		return false
+	}
+
+	Debug("LEDGER ENTRY", name, entry.Records, "RECORDS")
+	return true
+}
+
+// readLedger returns the entries that count, the folded ones are left out,
+// and the names of all the entries in the ledger dir
+func (t *Table) readLedger() (map[string]*SavedLedgerEntry, []string) {
+	entries := make(map[string]*SavedLedgerEntry)
+	names := make([]string, 0)
+	files, err := ioutil.ReadDir(t.ledgerDir())
+	if err != nil {
+		return entries, names
+	}
+
+	for _, f := range files {
+		// skips the temp files of entries that are being written
+		if !strings.HasSuffix(f.Name(), ".db") {
+			continue
+		}
+
+		entry := SavedLedgerEntry{}
+		err = decodeInto(path.Join(t.ledgerDir(), f.Name()), &entry)
+		if err != nil {
+			Warn("COULDNT READ LEDGER ENTRY", f.Name(), err)
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), ".db")
+		entries[name] = &entry
+		names = append(names, name)
+	}
+
+	// an entry that is folded stays folded, even when the entry that
+	// folded it was folded in turn
+	folded := make([]string, 0)
+	for _, entry := range entries {
+		folded = append(folded, entry.Folded...)
+	}
+
+	for _, name := range folded {
+		delete(entries, name)
+	}
+
+	return entries, names
+}
+
+// LedgerRecords returns how many records the ledger says the table's blocks
+// hold, ok is false when the table doesn't keep a ledger
+func (t *Table) LedgerRecords() (int64, bool) {
+	if !t.HasLedger() {
+		return 0, false
+	}
+
+	total := int64(0)
+	entries, _ := t.readLedger()
+	for _, entry := range entries {
+		total += entry.Records
+	}
+
+	return total, true
+}
+
+// StartLedger starts counting the records of the table from the ones its
+// blocks have right now. The digest lock should be held, so no digest is
+// saving records in the meantime
+func (t *Table) StartLedger() bool {
+	if t.HasLedger() {
+		return true
+	}
+
+	records, _ := t.CountBlockRecords()
+	tempdir, err := ioutil.TempDir(path.Join(FLAGS.DIR, t.Name), LEDGER_DIR)
+	if err != nil {
+		Warn("COULDNT CREATE LEDGER FOR", t.Name, err)
+		return false
+	}
+
+	entry := SavedLedgerEntry{Records: records, Note: "start"}
+	f, err := os.Create(path.Join(tempdir, "start.db"))
+	if err == nil {
+		err = gob.NewEncoder(f).Encode(&entry)
+		f.Close()
+	}
+
+	if err == nil {
+		err = RenameAndMod(tempdir, t.ledgerDir())
+	}
+
+	if err != nil {
+		Warn("COULDNT START LEDGER FOR", t.Name, err)
+		os.RemoveAll(tempdir)
+		return false
+	}
+
+	Debug("STARTED LEDGER FOR", t.Name, "WITH", records, "RECORDS")
+	return true
+}
+
+// foldLedger replaces the ledger entries with one that sums them up, once
+// there are more than LEDGER_FOLD_AFTER of them
+func (t *Table) foldLedger() {
+	entries, names := t.readLedger()
+	if len(names) <= LEDGER_FOLD_AFTER {
+		return
+	}
+
+	// entries that were folded before are folded again, so they keep
+	// being left out if removing them fails
+	folded := SavedLedgerEntry{Note: "fold", Folded: names}
+	for _, entry := range entries {
+		folded.Records += entry.Records
+	}
+
+	if !t.writeLedgerEntry("", &folded) {
+		return
+	}
+
+	for _, name := range folded.Folded {
+		os.Remove(path.Join(t.ledgerDir(), name+".db"))
+	}
+}
+
+// CountBlockRecords adds up the records in the table's blocks, according to
+// their info.db. Blocks whose info can't be read are returned apart
+func (t *Table) CountBlockRecords() (int64, []string) {
+	block_dirs, _ := t.listBlockDirs(nil)
+	broken := make([]string, 0)
+	total := int64(0)
+	for _, blockname := range block_dirs {
+		info := t.LoadBlockInfo(blockname)
+		if info == nil || info.NumRecords <= 0 {
+			broken = append(broken, blockname)
+			continue
+		}
+
+		total += int64(info.NumRecords)
+	}
+
+	return total, broken
+}
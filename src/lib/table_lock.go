@@ -5,6 +5,7 @@ import "os"
 import "syscall"
 import "fmt"
 import "strconv"
+import "strings"
 import "io/ioutil"
 import "time"
 
@@ -43,6 +44,22 @@ type DigestLock struct {
 	Lock
 }
 
+type DedupLock struct {
+	Lock
+}
+
+type IndexLock struct {
+	Lock
+}
+
+type ManifestLock struct {
+	Lock
+}
+
+type QueryCacheLock struct {
+	Lock
+}
+
 func RecoverLock(lock RecoverableLock) bool {
 	// TODO: log the auto recovery into a recovery file
 	return lock.Recover()
@@ -84,6 +101,14 @@ func (l *DigestLock) Recover() bool {
 	// TODO: understand if any file in particular is messing things up...
 	pid := int64(os.Getpid())
 	l.ForceMakeFile(pid)
+	// the journaled digest is finished or undone first, so its stomache
+	// isn't restored when its records were already saved
+	_, err := t.RecoverDigest()
+	if err != nil {
+		Warn("COULDNT READ DIGEST JOURNAL OF", t.Name, err)
+		l.ForceDeleteFile()
+		return false
+	}
 	t.RestoreUningestedFiles()
 	l.ForceDeleteFile()
 
@@ -142,6 +167,67 @@ func (l *CacheLock) Recover() bool {
 
 }
 
+func (l *DedupLock) Recover() bool {
+	Debug("RECOVERING DEDUP LOCK", l.Name)
+	t := l.Table
+	for _, filename := range t.listDedupSegments(0) {
+		state := SavedDedupState{}
+		err := decodeInto(filename, &state)
+		if err != nil {
+			Debug("DELETING BAD DEDUP SEGMENT", filename)
+			os.RemoveAll(filename)
+		}
+	}
+
+	l.ForceDeleteFile()
+
+	return l.Grab()
+}
+
+func (l *IndexLock) Recover() bool {
+	Debug("RECOVERING INDEX LOCK", l.Name)
+	t := l.Table
+	filename := path.Join(FLAGS.DIR, t.Name, INDEX_FILE)
+
+	index := SavedTableIndex{}
+	err := decodeInto(filename, &index)
+	if err != nil {
+		Debug("DELETING BAD INDEX", filename)
+		os.RemoveAll(filename)
+	}
+
+	l.ForceDeleteFile()
+
+	return l.Grab()
+}
+
+func (l *QueryCacheLock) Recover() bool {
+	Debug("RECOVERING QUERY CACHE LOCK", l.Name)
+
+	// the running size is listed again when results are saved next
+	os.RemoveAll(l.Table.queryCacheSizeFile())
+	l.ForceDeleteFile()
+
+	return l.Grab()
+}
+
+func (l *ManifestLock) Recover() bool {
+	Debug("RECOVERING MANIFEST LOCK", l.Name)
+	t := l.Table
+
+	// the manifest is only ever replaced by a rename, so a crashed commit
+	// leaves the last version in place
+	_, err := t.LoadManifest()
+	if err != nil && t.HasManifest() {
+		Warn("DELETING BAD MANIFEST OF", t.Name, "QUERIES WILL LIST ITS BLOCK DIRS")
+		os.RemoveAll(t.manifestFile())
+	}
+
+	l.ForceDeleteFile()
+
+	return l.Grab()
+}
+
 func (l *Lock) Recover() bool {
 	Debug("UNIMPLEMENTED RECOVERY FOR LOCK", l.Table.Name, l.Name)
 	return false
@@ -201,7 +287,8 @@ func check_if_broken(lockfile string, l *Lock) bool {
 
 	var pid_int = int64(0)
 	if err == nil {
-		pid_int, err = strconv.ParseInt(string(val), 10, 32)
+		// flock owners prefix their PID, see table_lock_flock.go
+		pid_int, err = strconv.ParseInt(strings.TrimPrefix(string(val), FLOCK_OWNER_PREFIX), 10, 32)
 
 		if err != nil {
 			breaks, ok := BREAK_MAP[lockfile]
@@ -285,6 +372,22 @@ func check_pid(lockfile string, l *Lock) bool {
 }
 
 func (l *Lock) Grab() bool {
+	if l.usesFlock() {
+		return l.grabFlock()
+	}
+
+	return l.grabPidFile()
+}
+
+func (l *Lock) Release() bool {
+	if l.heldWithFlock() {
+		return l.releaseFlock()
+	}
+
+	return l.releasePidFile()
+}
+
+func (l *Lock) grabPidFile() bool {
 	t := l.Table
 	digest := l.Name
 
@@ -331,7 +434,7 @@ func (l *Lock) Grab() bool {
 
 }
 
-func (l *Lock) Release() bool {
+func (l *Lock) releasePidFile() bool {
 	t := l.Table
 	digest := l.Name
 
@@ -427,3 +530,71 @@ func (t *Table) ReleaseCacheLock() bool {
 	ret := info.Release()
 	return ret
 }
+
+func (t *Table) GrabDedupLock() bool {
+	lock := Lock{Table: t, Name: DEDUP_LOCK}
+	info := &DedupLock{lock}
+	ret := info.Grab()
+	if !ret && info.broken {
+		ret = RecoverLock(info)
+	}
+	return ret
+}
+
+func (t *Table) ReleaseDedupLock() bool {
+	lock := Lock{Table: t, Name: DEDUP_LOCK}
+	info := &DedupLock{lock}
+	ret := info.Release()
+	return ret
+}
+
+func (t *Table) GrabIndexLock() bool {
+	lock := Lock{Table: t, Name: INDEX_LOCK}
+	info := &IndexLock{lock}
+	ret := info.Grab()
+	if !ret && info.broken {
+		ret = RecoverLock(info)
+	}
+	return ret
+}
+
+func (t *Table) ReleaseIndexLock() bool {
+	lock := Lock{Table: t, Name: INDEX_LOCK}
+	info := &IndexLock{lock}
+	ret := info.Release()
+	return ret
+}
+
+func (t *Table) GrabManifestLock() bool {
+	lock := Lock{Table: t, Name: MANIFEST_LOCK}
+	info := &ManifestLock{lock}
+	ret := info.Grab()
+	if !ret && info.broken {
+		ret = RecoverLock(info)
+	}
+	return ret
+}
+
+func (t *Table) ReleaseManifestLock() bool {
+	lock := Lock{Table: t, Name: MANIFEST_LOCK}
+	info := &ManifestLock{lock}
+	ret := info.Release()
+	return ret
+}
+
+func (t *Table) GrabQueryCacheLock() bool {
+	lock := Lock{Table: t, Name: QUERY_CACHE_LOCK}
+	info := &QueryCacheLock{lock}
+	ret := info.Grab()
+	if !ret && info.broken {
+		ret = RecoverLock(info)
+	}
+	return ret
+}
+
+func (t *Table) ReleaseQueryCacheLock() bool {
+	lock := Lock{Table: t, Name: QUERY_CACHE_LOCK}
+	info := &QueryCacheLock{lock}
+	ret := info.Release()
+	return ret
+}
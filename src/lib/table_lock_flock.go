@@ -0,0 +1,222 @@
+package sybil
+
+import "fmt"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+// FLOCK LOCKS
+// Tables with Settings.LockBackend set to "flock" hold their locks with an
+// flock on the lock file instead of polling PID files. The kernel drops the
+// flock when its owner dies, so there is no need to signal PIDs (which
+// doesn't work across PID namespaces) and waiters block on the flock until
+// it is free or FLOCK_TIMEOUT passes. The owner writes FLOCK_OWNER_PREFIX
+// and its PID into the lock file and removes the file on release. A file
+// with the prefix that we get the flock on was left by an owner that
+// crashed while holding the lock, so the lock goes into recovery without
+// looking at the PID. A file without it is a PID file: its owner is
+// signalled, and a live one is waited for.
+
+const (
+	PID_LOCK_BACKEND   = "pid"
+	FLOCK_LOCK_BACKEND = "flock"
+)
+
+var FLOCK_TIMEOUT = time.Second * 5
+var FLOCK_OWNER_PREFIX = "flock:"
+
+// lock files this process holds an flock on. A process can grab a lock it
+// already holds, like with PID files
+var held_flocks = make(map[string]*os.File)
+var flock_m sync.Mutex
+
+// SetLockBackend picks how the locks of the table are held: "pid" (PID
+// files, the default) or "flock"
+func (t *Table) SetLockBackend(name string) error {
+	switch name {
+	case "", PID_LOCK_BACKEND:
+		t.Settings.LockBackend = ""
+	case FLOCK_LOCK_BACKEND:
+		if !FLOCK_SUPPORTED {
+			return fmt.Errorf("flock locks aren't supported on this platform")
+		}
+		t.Settings.LockBackend = name
+	default:
+		return fmt.Errorf("unknown lock backend %s, use pid or flock", name)
+	}
+
+	return nil
+}
+
+func (l *Lock) usesFlock() bool {
+	return FLOCK_SUPPORTED && l.Table.Settings.LockBackend == FLOCK_LOCK_BACKEND
+}
+
+// heldWithFlock is true when this process holds the lock with an flock. A
+// lock is released with the backend it was grabbed with, not the table's
+// current one: LoadTableInfo loads the backend while it holds the info lock
+func (l *Lock) heldWithFlock() bool {
+	flock_m.Lock()
+	defer flock_m.Unlock()
+
+	_, held := held_flocks[l.lockfile()]
+	return held
+}
+
+func (l *Lock) lockfile() string {
+	return path.Join(FLAGS.DIR, l.Table.Name, fmt.Sprintf("%s.lock", path.Base(l.Name)))
+}
+
+// waitForFlock blocks for up to timeout on an flock on f. If it returns
+// false, f is closed: right away when the flock failed, or once the flock
+// comes through when it timed out
+func waitForFlock(f *os.File, timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() { done <- flockFile(f) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			Debug("FLOCK FAILED", f.Name(), err)
+			f.Close()
+			return false
+		}
+
+		return true
+	case <-timer.C:
+		go func() {
+			<-done
+			f.Close()
+		}()
+
+		return false
+	}
+}
+
+// lockFileIsCurrent is false when the lock file was removed (and maybe made
+// again) by its last owner while we waited for the flock on it
+func lockFileIsCurrent(f *os.File, lockfile string) bool {
+	f_info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	path_info, err := os.Stat(lockfile)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(f_info, path_info)
+}
+
+func pid_is_alive(pid int64) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	process, err := os.FindProcess(int(pid))
+	if err != nil {
+		return false
+	}
+
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+func (l *Lock) grabFlock() bool {
+	lockfile := l.lockfile()
+
+	flock_m.Lock()
+	_, held := held_flocks[lockfile]
+	flock_m.Unlock()
+	if held {
+		return true
+	}
+
+	pid_str := strconv.FormatInt(int64(os.Getpid()), 10)
+	deadline := time.Now().Add(FLOCK_TIMEOUT)
+	for time.Now().Before(deadline) {
+		f, err := os.OpenFile(lockfile, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			Debug("CANT OPEN LOCK FILE", lockfile, err)
+			return false
+		}
+
+		if !waitForFlock(f, deadline.Sub(time.Now())) {
+			break
+		}
+
+		if !lockFileIsCurrent(f, lockfile) {
+			f.Close()
+			continue
+		}
+
+		buf := make([]byte, 32)
+		n, _ := f.ReadAt(buf, 0)
+		owner := strings.TrimSpace(string(buf[:n]))
+
+		if strings.HasPrefix(owner, FLOCK_OWNER_PREFIX) {
+			Debug("FLOCK OWNER DIED HOLDING THE LOCK, MARKING IT FOR RECOVERY", l.Name, owner)
+			l.broken = true
+			f.Close()
+			return false
+		}
+
+		if owner != "" && owner != pid_str {
+			owner_pid, _ := strconv.ParseInt(owner, 10, 64)
+			if pid_is_alive(owner_pid) {
+				Debug("LOCK", lockfile, "IS HELD WITH A PID FILE BY", owner)
+				f.Close()
+				time.Sleep(LOCK_US)
+				continue
+			}
+
+			Debug("OWNER PROCESS IS DEAD, MARKING LOCK FOR RECOVERY", l.Name, owner)
+			l.broken = true
+			f.Close()
+			return false
+		}
+
+		f.Truncate(0)
+		f.WriteAt([]byte(FLOCK_OWNER_PREFIX+pid_str), 0)
+		f.Sync()
+
+		flock_m.Lock()
+		held_flocks[lockfile] = f
+		flock_m.Unlock()
+
+		Debug("LOCKING", lockfile, "WITH FLOCK")
+		return true
+	}
+
+	Debug("LOCK FAIL!", lockfile)
+	return false
+}
+
+func (l *Lock) releaseFlock() bool {
+	lockfile := l.lockfile()
+
+	flock_m.Lock()
+	f, held := held_flocks[lockfile]
+	delete(held_flocks, lockfile)
+	flock_m.Unlock()
+
+	if !held {
+		return true
+	}
+
+	// the file goes before the flock, so whoever gets the flock next sees
+	// that the file is gone and opens the new one
+	Debug("UNLOCKING", lockfile)
+	os.Remove(lockfile)
+	f.Close()
+
+	return true
+}
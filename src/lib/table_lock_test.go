@@ -1,6 +1,10 @@
 package sybil
 
+import "io/ioutil"
+import "os"
+import "strconv"
 import "testing"
+import "time"
 
 // Try out the different situations for lock recovery and see if they behave
 // appropriately
@@ -77,3 +81,140 @@ func TestRecoverDigestLock(t *testing.T) {
 		t.Error("COULD GRAB DIGEST LOCK WHEN IT ARLEADY EXISTS")
 	}
 }
+
+func TestFlockLocks(t *testing.T) {
+	if !FLOCK_SUPPORTED {
+		t.Skip("NO FLOCK ON THIS PLATFORM")
+	}
+
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+	tbl := GetTable(tableName)
+	tbl.MakeDir()
+
+	if err := tbl.SetLockBackend("fcntl"); err == nil {
+		t.Error("UNKNOWN LOCK BACKEND SHOULD BE AN ERROR")
+	}
+	if err := tbl.SetLockBackend(FLOCK_LOCK_BACKEND); err != nil {
+		t.Fatal(err)
+	}
+
+	old_timeout := FLOCK_TIMEOUT
+	FLOCK_TIMEOUT = time.Millisecond * 100
+	defer func() { FLOCK_TIMEOUT = old_timeout }()
+
+	if !tbl.GrabDigestLock() {
+		t.Fatal("COULD NOT GRAB DIGEST LOCK WITH FLOCK")
+	}
+	if !tbl.GrabDigestLock() {
+		t.Error("COULD NOT GRAB A DIGEST LOCK THIS PROCESS ALREADY HOLDS")
+	}
+
+	lock := Lock{Table: tbl, Name: STOMACHE_DIR}
+	lockfile := lock.lockfile()
+	tbl.ReleaseDigestLock()
+	if _, err := os.Stat(lockfile); err == nil {
+		t.Error("RELEASING THE LOCK LEFT ITS FILE BEHIND")
+	}
+
+	// someone else holds the flock: we wait for it and time out
+	other, err := os.OpenFile(lockfile, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitForFlock(other, time.Second) {
+		t.Fatal("COULDNT FLOCK THE LOCK FILE")
+	}
+
+	start := time.Now()
+	if tbl.GrabDigestLock() {
+		t.Error("GRABBED A DIGEST LOCK WHILE SOMEONE ELSE HOLDS ITS FLOCK")
+	}
+	if time.Now().Sub(start) < FLOCK_TIMEOUT {
+		t.Error("DIDNT WAIT FOR THE FLOCK BEFORE GIVING UP")
+	}
+
+	// the owner goes away and the waiter gets the lock
+	go func() {
+		time.Sleep(FLOCK_TIMEOUT / 4)
+		os.Remove(lockfile)
+		other.Close()
+	}()
+	if !tbl.GrabDigestLock() {
+		t.Fatal("COULDNT GRAB THE DIGEST LOCK AFTER ITS OWNER RELEASED IT")
+	}
+	tbl.ReleaseDigestLock()
+
+	// a live process holding the lock with a PID file is waited for
+	lock.ForceMakeFile(int64(os.Getppid()))
+	if tbl.GrabDigestLock() || lock.broken {
+		t.Error("GRABBED A DIGEST LOCK THAT A LIVE PROCESS HOLDS WITH A PID FILE")
+	}
+
+	// a lock file left by a crashed flock owner goes into recovery, even
+	// when its PID is alive here, like one from another PID namespace
+	err = ioutil.WriteFile(lockfile, []byte(FLOCK_OWNER_PREFIX+strconv.Itoa(os.Getppid())), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if lock.Grab() || !lock.broken {
+		t.Error("LOCK OF A CRASHED FLOCK OWNER WASNT MARKED FOR RECOVERY")
+	}
+	if time.Now().Sub(start) >= FLOCK_TIMEOUT {
+		t.Error("WAITED FOR THE LOCK OF A CRASHED FLOCK OWNER")
+	}
+	lock.broken = false
+	if !tbl.GrabDigestLock() {
+		t.Error("COULDNT RECOVER THE DIGEST LOCK OF A CRASHED FLOCK OWNER")
+	}
+	tbl.ReleaseDigestLock()
+
+	// a lock file left by a dead process goes into recovery
+	lock.ForceMakeFile(int64(1 << 30))
+	if !lock.Grab() && !lock.broken {
+		t.Error("LOCK OF A DEAD PROCESS WASNT MARKED FOR RECOVERY")
+	}
+	if !tbl.GrabDigestLock() {
+		t.Error("COULDNT RECOVER THE DIGEST LOCK OF A DEAD PROCESS")
+	}
+	tbl.ReleaseDigestLock()
+}
+
+func TestLoadFlockTableInfo(t *testing.T) {
+	if !FLOCK_SUPPORTED {
+		t.Skip("NO FLOCK ON THIS PLATFORM")
+	}
+
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+	tbl := GetTable(tableName)
+	tbl.MakeDir()
+
+	if err := tbl.SetLockBackend(FLOCK_LOCK_BACKEND); err != nil {
+		t.Fatal(err)
+	}
+	tbl.SaveTableInfo("info")
+
+	// the info lock is grabbed with a PID file before the flock backend is
+	// loaded, and has to be released as one
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	if !nt.LoadTableInfo() || nt.Settings.LockBackend != FLOCK_LOCK_BACKEND {
+		t.Fatal("COULDNT LOAD THE TABLE INFO OF A FLOCK TABLE")
+	}
+
+	lock := Lock{Table: nt, Name: "info"}
+	if _, err := os.Stat(lock.lockfile()); !os.IsNotExist(err) {
+		t.Error("LOADING THE TABLE INFO LEFT THE INFO LOCK BEHIND")
+	}
+
+	if !nt.LoadTableInfo() {
+		t.Error("COULDNT LOAD THE TABLE INFO AGAIN")
+	}
+	if _, err := os.Stat(lock.lockfile()); !os.IsNotExist(err) {
+		t.Error("LOADING THE TABLE INFO WITH FLOCK LEFT THE INFO LOCK BEHIND")
+	}
+}
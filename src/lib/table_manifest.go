@@ -0,0 +1,310 @@
+package sybil
+
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "time"
+
+// TABLE MANIFEST
+// A table with a manifest (<table>/manifest.db) only shows queries the blocks
+// listed in it. Writers save their blocks first and then commit them to the
+// manifest in one step, along with the blocks they replace: the manifest is
+// written to a temp file and renamed over the old one, bumping its version.
+// Queries read the manifest once when they start and only load the blocks of
+// that version, so they never see a half written block, or the old and new
+// blocks of a compaction at the same time. Blocks taken out of the manifest
+// stay on disk for MANIFEST_RETIRE_AFTER, so queries still reading an older
+// version can finish, and are removed by a later commit. Tables without a
+// manifest list their block dirs like before.
+
+var MANIFEST_FILE = "manifest.db"
+var MANIFEST_LOCK = "manifest"
+var MANIFEST_RETIRE_AFTER = time.Minute * 10
+var MANIFEST_COMMIT_TRIES = 10
+
+type SavedManifest struct {
+	Version int64
+	Blocks  []string         // committed blocks, relative to the table dir
+	Retired map[string]int64 // blocks taken out of the manifest -> unix time they were
+}
+
+func (t *Table) manifestFile() string {
+	return path.Join(FLAGS.DIR, t.Name, MANIFEST_FILE)
+}
+
+func (t *Table) HasManifest() bool {
+	_, err := os.Stat(t.manifestFile())
+	return err == nil
+}
+
+// LoadManifest reads the current version of the table's manifest
+func (t *Table) LoadManifest() (*SavedManifest, error) {
+	manifest := SavedManifest{}
+	err := decodeInto(t.manifestFile(), &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Retired == nil {
+		manifest.Retired = make(map[string]int64)
+	}
+
+	return &manifest, nil
+}
+
+func (t *Table) writeManifest(manifest *SavedManifest) error {
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	tempfile, err := ioutil.TempFile(table_dir, MANIFEST_LOCK)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(tempfile).Encode(manifest)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	tempfile.Close()
+
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), t.manifestFile())
+}
+
+// EnableManifest starts keeping a manifest for the table, listing the blocks
+// it has right now
+func (t *Table) EnableManifest() bool {
+	if t.GrabManifestLock() == false {
+		Warn("COULDNT GRAB MANIFEST LOCK FOR", t.Name)
+		return false
+	}
+	defer t.ReleaseManifestLock()
+
+	if t.HasManifest() {
+		return true
+	}
+
+	block_dirs, _ := t.listBlockDirs(nil)
+	manifest := SavedManifest{Version: 1, Retired: make(map[string]int64)}
+	for _, blockname := range block_dirs {
+		manifest.Blocks = append(manifest.Blocks, t.tableBlockName(blockname))
+	}
+	sort.Strings(manifest.Blocks)
+
+	err := t.writeManifest(&manifest)
+	if err != nil {
+		Warn("COULDNT WRITE MANIFEST FOR", t.Name, err)
+		return false
+	}
+
+	Debug("STARTED MANIFEST FOR", t.Name, "WITH", len(manifest.Blocks), "BLOCKS")
+	return true
+}
+
+// DisableManifest removes the table's manifest. Its retired blocks are
+// removed right away, or they would show up in the block dirs again
+func (t *Table) DisableManifest() bool {
+	if t.GrabManifestLock() == false {
+		Warn("COULDNT GRAB MANIFEST LOCK FOR", t.Name)
+		return false
+	}
+	defer t.ReleaseManifestLock()
+
+	manifest, err := t.LoadManifest()
+	if err != nil {
+		return !t.HasManifest()
+	}
+
+	for name := range manifest.Retired {
+		t.removeRetiredBlock(name)
+	}
+
+	return os.Remove(t.manifestFile()) == nil
+}
+
+// listManifestBlocks is listBlockDirs for tables with a manifest, ok is false
+// when the table doesn't have one
+func (t *Table) listManifestBlocks(querySpec *QuerySpec) ([]string, []string, bool) {
+	if !t.HasManifest() {
+		return nil, nil, false
+	}
+
+	manifest, err := t.LoadManifest()
+	if err != nil {
+		Warn("COULDNT READ MANIFEST OF", t.Name, err, "LISTING BLOCK DIRS INSTEAD")
+		return nil, nil, false
+	}
+
+	Debug("READING MANIFEST VERSION", manifest.Version, "WITH", len(manifest.Blocks), "BLOCKS")
+
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	blocks := make([]string, 0, len(manifest.Blocks))
+	pruned := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range manifest.Blocks {
+		blockname := path.Join(table_dir, name)
+		dirname := path.Dir(blockname)
+		if dirname != table_dir && querySpec != nil && !t.partitionMayMatch(dirname, querySpec.Filters) {
+			if !seen[dirname] {
+				seen[dirname] = true
+				pruned = append(pruned, dirname)
+			}
+			continue
+		}
+
+		blocks = append(blocks, blockname)
+	}
+
+	return blocks, pruned, true
+}
+
+// stageManifestBlock marks a newly saved block for the next CommitManifest
+func (t *Table) stageManifestBlock(blockname string) {
+	t.manifest_m.Lock()
+	t.manifest_added[blockname] = true
+	t.manifest_m.Unlock()
+}
+
+// retireBlocks takes blocks out of the table. Without a manifest they are
+// removed right away, otherwise with the next CommitManifest
+func (t *Table) retireBlocks(blocks []string) {
+	if !t.HasManifest() {
+		for _, blockname := range blocks {
+			err := os.RemoveAll(blockname)
+			if err != nil {
+				Warn("COULDNT REMOVE BLOCK", blockname, err)
+			}
+		}
+		return
+	}
+
+	t.manifest_m.Lock()
+	for _, blockname := range blocks {
+		delete(t.manifest_added, blockname)
+		t.manifest_retired[blockname] = true
+	}
+	t.manifest_m.Unlock()
+}
+
+func (t *Table) removeRetiredBlock(name string) {
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	blockname := path.Join(table_dir, name)
+	Debug("REMOVING RETIRED BLOCK", blockname)
+	err := os.RemoveAll(blockname)
+	if err != nil {
+		Warn("COULDNT REMOVE RETIRED BLOCK", blockname, err)
+	}
+
+	// dropped partitions go once their last block does
+	if dirname := path.Dir(blockname); dirname != table_dir {
+		os.Remove(dirname)
+	}
+}
+
+// CommitManifest writes a new version of the table's manifest, with the
+// blocks saved since the last commit and without the retired ones. Retired
+// blocks that are older than MANIFEST_RETIRE_AFTER are removed
+func (t *Table) CommitManifest() bool {
+	t.manifest_m.Lock()
+	added := t.manifest_added
+	retired := t.manifest_retired
+	t.manifest_added = make(map[string]bool)
+	t.manifest_retired = make(map[string]bool)
+	t.manifest_m.Unlock()
+
+	if len(added) == 0 && len(retired) == 0 {
+		return true
+	}
+
+	locked := false
+	for i := 0; i < MANIFEST_COMMIT_TRIES && !locked; i++ {
+		locked = t.GrabManifestLock()
+	}
+
+	if !locked {
+		Warn("COULDNT GRAB MANIFEST LOCK,", len(added), "BLOCKS OF", t.Name, "AREN'T COMMITTED")
+		t.manifest_m.Lock()
+		for blockname := range added {
+			t.manifest_added[blockname] = true
+		}
+		for blockname := range retired {
+			t.manifest_retired[blockname] = true
+		}
+		t.manifest_m.Unlock()
+		return false
+	}
+	defer t.ReleaseManifestLock()
+
+	manifest, err := t.LoadManifest()
+	if err != nil {
+		// the manifest was removed since the blocks were retired
+		for blockname := range retired {
+			t.removeRetiredBlock(t.tableBlockName(blockname))
+		}
+		return !t.HasManifest()
+	}
+
+	blocks := make(map[string]bool)
+	for _, name := range manifest.Blocks {
+		blocks[name] = true
+	}
+
+	// blocks can be committed (or retired) again, like when a digest is
+	// rolled forward after it committed its blocks
+	changed := false
+	for blockname := range added {
+		name := t.tableBlockName(blockname)
+		changed = changed || !blocks[name]
+		blocks[name] = true
+	}
+
+	now := time.Now()
+	for blockname := range retired {
+		name := t.tableBlockName(blockname)
+		if _, ok := manifest.Retired[name]; ok && !blocks[name] {
+			continue
+		}
+
+		changed = true
+		delete(blocks, name)
+		manifest.Retired[name] = now.Unix()
+	}
+
+	if !changed {
+		return true
+	}
+
+	expired := make([]string, 0)
+	for name, when := range manifest.Retired {
+		if now.Sub(time.Unix(when, 0)) >= MANIFEST_RETIRE_AFTER {
+			expired = append(expired, name)
+			delete(manifest.Retired, name)
+		}
+	}
+
+	manifest.Blocks = make([]string, 0, len(blocks))
+	for name := range blocks {
+		manifest.Blocks = append(manifest.Blocks, name)
+	}
+	sort.Strings(manifest.Blocks)
+	manifest.Version++
+
+	err = t.writeManifest(manifest)
+	if err != nil {
+		Warn("COULDNT WRITE MANIFEST FOR", t.Name, err)
+		return false
+	}
+
+	Debug("COMMITTED MANIFEST VERSION", manifest.Version, "ADDED", len(added), "RETIRED", len(retired), "BLOCKS")
+
+	// only once no version of the manifest lists them
+	for _, name := range expired {
+		t.removeRetiredBlock(name)
+	}
+
+	return true
+}
@@ -0,0 +1,171 @@
+package sybil
+
+import "math/rand"
+import "os"
+import "path"
+import "sort"
+import "testing"
+
+func TestTableManifest(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 2
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	nt := saveAndReloadTable(t, tableName, blockCount)
+	if nt.EnableManifest() == false {
+		t.Fatal("COULDNT START MANIFEST")
+	}
+
+	manifest, err := nt.LoadManifest()
+	if err != nil {
+		t.Fatal("COULDNT READ MANIFEST", err)
+	}
+	if manifest.Version != 1 || len(manifest.Blocks) != blockCount {
+		t.Fatal("EXPECTED VERSION 1 WITH", blockCount, "BLOCKS, GOT", manifest.Version, manifest.Blocks)
+	}
+
+	// a block that is saved but not committed isn't read by queries
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, 1)
+	name, err := nt.getNewIngestBlockName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt.SaveRecordsToBlock(records, name)
+	nt.SaveTableInfo("info")
+
+	block_dirs, _ := nt.listBlockDirs(nil)
+	if len(block_dirs) != blockCount {
+		t.Fatal("UNCOMMITTED BLOCK IS LISTED", block_dirs)
+	}
+
+	if len(listTestBlocks(nt)) != blockCount+1 {
+		t.Fatal("EXPECTED", blockCount+1, "BLOCK DIRS, FOUND", len(listTestBlocks(nt)))
+	}
+
+	nt.CommitManifest()
+	block_dirs, _ = nt.listBlockDirs(nil)
+	if len(block_dirs) != blockCount+1 {
+		t.Fatal("COMMITTED BLOCK ISN'T LISTED", block_dirs)
+	}
+
+	// dropped blocks leave the manifest but stay on disk until they are
+	// retired for long enough
+	sort.Strings(block_dirs)
+	dropped := block_dirs[0]
+	nt.DropBlocks([]string{dropped})
+
+	manifest, _ = nt.LoadManifest()
+	if manifest.Version != 3 || len(manifest.Blocks) != blockCount {
+		t.Fatal("EXPECTED VERSION 3 WITH", blockCount, "BLOCKS, GOT", manifest.Version, manifest.Blocks)
+	}
+
+	if _, ok := manifest.Retired[nt.tableBlockName(dropped)]; !ok {
+		t.Fatal("DROPPED BLOCK ISN'T RETIRED", manifest.Retired)
+	}
+
+	if _, err := os.Stat(dropped); err != nil {
+		t.Fatal("RETIRED BLOCK WAS REMOVED TOO EARLY", err)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	count := nt.LoadRecords(&loadSpec)
+	if count != CHUNK_SIZE*blockCount {
+		t.Error("READ", count, "RECORDS, EXPECTED", CHUNK_SIZE*blockCount)
+	}
+
+	old_retire_after := MANIFEST_RETIRE_AFTER
+	MANIFEST_RETIRE_AFTER = 0
+	defer func() { MANIFEST_RETIRE_AFTER = old_retire_after }()
+
+	// any commit removes the expired blocks
+	block_dirs, _ = nt.listBlockDirs(nil)
+	nt.retireBlocks(block_dirs[:1])
+	nt.CommitManifest()
+
+	if _, err := os.Stat(dropped); !os.IsNotExist(err) {
+		t.Error("EXPIRED BLOCK WASN'T REMOVED", err)
+	}
+
+	if nt.DisableManifest() == false || nt.HasManifest() {
+		t.Fatal("COULDNT REMOVE MANIFEST")
+	}
+
+	block_dirs, _ = nt.listBlockDirs(nil)
+	if len(block_dirs) != blockCount-1 {
+		t.Error("EXPECTED", blockCount-1, "BLOCKS WITHOUT A MANIFEST, FOUND", block_dirs)
+	}
+}
+
+func TestManifestCompaction(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, 1)
+
+	tbl := GetTable(tableName)
+	os.MkdirAll(path.Join(FLAGS.DIR, tableName), 0777)
+	tbl.SaveTableInfo("info")
+	if tbl.EnableManifest() == false {
+		t.Fatal("COULDNT START MANIFEST")
+	}
+
+	small := CHUNK_SIZE / 4
+	for i := 0; i < len(records); i += small {
+		name, err := tbl.getNewIngestBlockName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbl.SaveRecordsToBlock(records[i:i+small], name)
+	}
+	tbl.SaveTableInfo("info")
+	tbl.CommitManifest()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	removed := nt.CompactTable(&CompactSpec{MaxBlocks: 64})
+	if removed != 4 {
+		t.Fatal("COMPACTION REMOVED", removed, "BLOCKS, EXPECTED 4")
+	}
+
+	// the compacted blocks are still on disk for queries of the old version,
+	// but the new version only has the compacted block
+	if len(listTestBlocks(nt)) != 5 {
+		t.Error("EXPECTED 5 BLOCK DIRS AFTER COMPACTION, FOUND", len(listTestBlocks(nt)))
+	}
+
+	manifest, _ := nt.LoadManifest()
+	if len(manifest.Blocks) != 1 || len(manifest.Retired) != 4 {
+		t.Fatal("EXPECTED 1 BLOCK AND 4 RETIRED ONES, GOT", manifest.Blocks, manifest.Retired)
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	count := nt.LoadRecords(&loadSpec)
+	if count != CHUNK_SIZE {
+		t.Error("READ", count, "RECORDS AFTER COMPACTION, EXPECTED", CHUNK_SIZE)
+	}
+}
@@ -0,0 +1,233 @@
+package sybil
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "time"
+
+// PARTITIONS
+// A table can partition its blocks by time (Settings.Partition and
+// Settings.PartitionCol). Digest then puts each record into a partition dir
+// named after the day or hour of its PartitionCol value (in UTC), like
+// part_20170102 or part_2017010215, and tops up the partial block inside
+// that partition. Records without the column, and the blocks written before
+// the table was partitioned, stay in the table dir. Queries with int filters
+// on the partition column skip whole partitions by their name and
+// `sybil trim -before` drops old partitions without opening their blocks.
+
+var PARTITION_PREFIX = "part_"
+
+type partitionLayout struct {
+	format string
+	length time.Duration
+}
+
+var PARTITION_LAYOUTS = map[string]partitionLayout{
+	"day":  partitionLayout{"20060102", 24 * time.Hour},
+	"hour": partitionLayout{"2006010215", time.Hour},
+}
+
+// SetPartitioning makes digest put new blocks into "day" or "hour"
+// partitions of the col column, an empty partitioning turns it off
+func (t *Table) SetPartitioning(by string, col string) error {
+	if by != "" {
+		if _, ok := PARTITION_LAYOUTS[by]; !ok {
+			return fmt.Errorf("unknown partitioning %s, use day or hour", by)
+		}
+
+		if col == "" {
+			return fmt.Errorf("partitioning by %s needs a time column", by)
+		}
+	} else {
+		col = ""
+	}
+
+	t.Settings.Partition = by
+	t.Settings.PartitionCol = col
+	return nil
+}
+
+func (t *Table) partitionDir(timestamp int64) string {
+	layout := PARTITION_LAYOUTS[t.Settings.Partition]
+	name := PARTITION_PREFIX + time.Unix(timestamp, 0).UTC().Format(layout.format)
+	return path.Join(FLAGS.DIR, t.Name, name)
+}
+
+// parsePartition returns the time range [start, end) of a partition dir
+func parsePartition(name string) (int64, int64, bool) {
+	name = path.Base(name)
+	if !strings.HasPrefix(name, PARTITION_PREFIX) {
+		return 0, 0, false
+	}
+
+	stamp := name[len(PARTITION_PREFIX):]
+	for _, layout := range PARTITION_LAYOUTS {
+		if len(layout.format) != len(stamp) {
+			continue
+		}
+
+		start, err := time.ParseInLocation(layout.format, stamp, time.UTC)
+		if err != nil {
+			return 0, 0, false
+		}
+
+		return start.Unix(), start.Add(layout.length).Unix(), true
+	}
+
+	return 0, 0, false
+}
+
+// returns false when the filters rule out every record the partition can hold
+func (t *Table) partitionMayMatch(name string, filters []Filter) bool {
+	start, end, ok := parsePartition(name)
+	if !ok || t.Settings.PartitionCol == "" {
+		return true
+	}
+
+	for _, f := range filters {
+		fil, ok := f.(IntFilter)
+		if !ok || fil.Field != t.Settings.PartitionCol {
+			continue
+		}
+
+		value := int64(fil.Value)
+		switch {
+		case fil.Op == "eq" && (value < start || value >= end):
+			return false
+		case fil.Op == "lt" && start >= value:
+			return false
+		case fil.Op == "gt" && end-1 <= value:
+			return false
+		}
+	}
+
+	return true
+}
+
+func listBlocksIn(dirname string) []string {
+	ret := make([]string, 0)
+	files, _ := ioutil.ReadDir(dirname)
+	for _, v := range files {
+		if v.IsDir() && file_looks_like_block(v) {
+			ret = append(ret, path.Join(dirname, v.Name()))
+		}
+	}
+
+	return ret
+}
+
+func (t *Table) listPartitions() []string {
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	ret := make([]string, 0)
+	files, _ := ioutil.ReadDir(table_dir)
+	for _, v := range files {
+		if _, _, ok := parsePartition(v.Name()); ok && v.IsDir() {
+			ret = append(ret, path.Join(table_dir, v.Name()))
+		}
+	}
+
+	return ret
+}
+
+// listBlockDirs returns the block dirs of the table, including the ones in
+// its partitions. With a querySpec, the partitions its filters rule out are
+// skipped and returned separately. Tables with a manifest only list the
+// blocks of its current version, see table_manifest.go
+func (t *Table) listBlockDirs(querySpec *QuerySpec) ([]string, []string) {
+	if blocks, pruned, ok := t.listManifestBlocks(querySpec); ok {
+		return blocks, pruned
+	}
+
+	blocks := listBlocksIn(path.Join(FLAGS.DIR, t.Name))
+	pruned := make([]string, 0)
+
+	for _, partition := range t.listPartitions() {
+		if querySpec != nil && !t.partitionMayMatch(partition, querySpec.Filters) {
+			pruned = append(pruned, partition)
+			continue
+		}
+
+		blocks = append(blocks, listBlocksIn(partition)...)
+	}
+
+	return blocks, pruned
+}
+
+// findPartialBlockIn returns a block in dirname that isn't full yet
+func (t *Table) findPartialBlockIn(dirname string) string {
+	partial := ""
+	for _, filename := range listBlocksIn(dirname) {
+		info := t.LoadBlockInfo(filename)
+		if info.NumRecords > 0 && info.NumRecords < int32(CHUNK_SIZE) && filename > partial {
+			partial = filename
+		}
+	}
+
+	return partial
+}
+
+// savePartitionedRecords is digest's saveRecordList for partitioned tables
+func (t *Table) savePartitionedRecords(records RecordList) bool {
+	t.string_id_m.RLock()
+	col_id, has_col := t.KeyTable[t.Settings.PartitionCol]
+	t.string_id_m.RUnlock()
+
+	table_dir := path.Join(FLAGS.DIR, t.Name)
+	partitions := make(map[string]RecordList)
+	for _, r := range records {
+		dirname := table_dir
+		if has_col && int(col_id) < len(r.Populated) && r.Populated[col_id] == INT_VAL {
+			dirname = t.partitionDir(int64(r.Ints[col_id]))
+		}
+
+		partitions[dirname] = append(partitions[dirname], r)
+	}
+
+	dirs := make([]string, 0, len(partitions))
+	for dirname := range partitions {
+		dirs = append(dirs, dirname)
+	}
+	sort.Strings(dirs)
+
+	for _, dirname := range dirs {
+		os.MkdirAll(dirname, 0777)
+
+		left := partitions[dirname]
+		partial := t.findPartialBlockIn(dirname)
+		if partial != "" {
+			var ok bool
+			left, ok = t.fillPartialBlock(partial, left)
+			if !ok {
+				return false
+			}
+		}
+
+		Debug("SAVING", len(partitions[dirname]), "RECORDS INTO PARTITION", path.Base(dirname))
+		if len(left) > 0 && !t.saveRecordListIn(dirname, left) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TrimPartitions lists the partitions that only hold records from before
+// trimSpec.DeleteBefore, so trim can drop them wholesale
+func (t *Table) TrimPartitions(trimSpec *TrimSpec) []string {
+	ret := make([]string, 0)
+	if trimSpec.DeleteBefore <= 0 || t.Settings.PartitionCol == "" || t.Settings.PartitionCol != FLAGS.TIME_COL {
+		return ret
+	}
+
+	for _, partition := range t.listPartitions() {
+		_, end, _ := parsePartition(partition)
+		if end <= trimSpec.DeleteBefore {
+			ret = append(ret, partition)
+		}
+	}
+
+	return ret
+}
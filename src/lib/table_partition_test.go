@@ -0,0 +1,96 @@
+package sybil
+
+import "path"
+import "testing"
+
+func TestPartitionedDigest(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	day := int64(24 * 60 * 60)
+	start := int64(1500000000) / day * day
+
+	// records spread over 4 days, some without a time
+	blockCount := 3
+	records := addRecords(tableName, func(r *Record, index int) {
+		if index%100 == 0 {
+			return
+		}
+		r.AddIntField("time", start+int64(index%4)*day+int64(index%1000))
+	}, blockCount)
+
+	tbl := GetTable(tableName)
+	err := tbl.SetPartitioning("week", "time")
+	if err == nil {
+		t.Fatal("UNKNOWN PARTITIONING SHOULD BE AN ERROR")
+	}
+
+	err = tbl.SetPartitioning("day", "time")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbl.SaveRecordsToColumns()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	if nt.Settings.Partition != "day" || nt.Settings.PartitionCol != "time" {
+		t.Fatal("PARTITIONING WASNT SAVED IN THE TABLE INFO", nt.Settings)
+	}
+
+	partitions := nt.listPartitions()
+	if len(partitions) != 4 {
+		t.Fatal("EXPECTED 4 DAY PARTITIONS, FOUND", len(partitions))
+	}
+
+	for _, partition := range partitions {
+		p_start, p_end, ok := parsePartition(partition)
+		if !ok || p_end-p_start != day {
+			t.Fatal("PARTITION", partition, "DOESNT COVER A DAY")
+		}
+
+		for _, block := range listBlocksIn(partition) {
+			info := nt.LoadBlockInfo(block).IntInfoMap["time"]
+			if info.Min < p_start || info.Max >= p_end {
+				t.Error("BLOCK", block, "HAS RECORDS OUTSIDE OF ITS PARTITION", path.Base(partition))
+			}
+		}
+	}
+
+	if len(listBlocksIn(path.Join(FLAGS.DIR, tableName))) != 1 {
+		t.Error("RECORDS WITHOUT A TIME SHOULD BE IN ONE BLOCK IN THE TABLE DIR")
+	}
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.LoadAllColumns = true
+	count := nt.LoadRecords(&loadSpec)
+	if count != len(records) {
+		t.Fatal("PARTITIONED TABLE HAS", count, "RECORDS, EXPECTED", len(records))
+	}
+
+	querySpec := newQuerySpec()
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("time", "gt", int(start+2*day)))
+	_, pruned := nt.listBlockDirs(querySpec)
+	if len(pruned) != 2 {
+		t.Error("EXPECTED THE FIRST 2 PARTITIONS TO BE SKIPPED, SKIPPED", len(pruned))
+	}
+
+	querySpec = newQuerySpec()
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("time", "eq", int(start+day+5)))
+	_, pruned = nt.listBlockDirs(querySpec)
+	if len(pruned) != 3 {
+		t.Error("EXPECTED 3 PARTITIONS TO BE SKIPPED, SKIPPED", len(pruned))
+	}
+
+	old_time_col := FLAGS.TIME_COL
+	FLAGS.TIME_COL = "time"
+	defer func() { FLAGS.TIME_COL = old_time_col }()
+
+	to_drop := nt.TrimPartitions(&TrimSpec{DeleteBefore: start + 2*day})
+	if len(to_drop) != 2 {
+		t.Error("EXPECTED TRIM TO DROP 2 PARTITIONS, GOT", to_drop)
+	}
+}
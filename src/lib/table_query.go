@@ -1,10 +1,9 @@
 package sybil
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path"
 	"runtime"
 	"runtime/debug"
 	"strings"
@@ -16,14 +15,25 @@ var MAX_MEM = uint64(1024)
 var FREE_MEM_AFTER = uint64(1024)
 
 func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) int {
+	return t.LoadAndQueryRecordsContext(context.Background(), loadSpec, querySpec)
+}
+
+// LoadAndQueryRecordsContext stops loading blocks once ctx is done. Blocks
+// that were already queried are still combined into the results, but the
+// querySpec is marked as Incomplete. So is a query that skips blocks that
+// are bigger than FLAGS.MEM_BUDGET
+func (t *Table) LoadAndQueryRecordsContext(ctx context.Context, loadSpec *LoadSpec, querySpec *QuerySpec) int {
 	waystart := time.Now()
 	Debug("LOADING", FLAGS.DIR, t.Name)
 
-	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, t.Name))
+	block_dirs, pruned_partitions := t.listBlockDirs(querySpec)
+	if len(pruned_partitions) > 0 {
+		Debug("SKIPPING", len(pruned_partitions), "PARTITIONS")
+	}
 
 	if READ_ROWS_ONLY {
 		Debug("ONLY READING RECORDS FROM ROW STORE")
-		files = nil
+		block_dirs = nil
 	}
 
 	if querySpec != nil {
@@ -67,6 +77,12 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 		t.StrInfo = make(StrInfoTable)
 	}
 
+	var results_cache *tableResultsCache
+	if t.useResultsCache(querySpec) {
+		results_cache = t.openResultsCache(querySpec, block_dirs)
+		block_dirs = results_cache.uncachedBlocks(block_dirs)
+	}
+
 	m := &sync.Mutex{}
 
 	load_all := false
@@ -80,6 +96,7 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 	loaded_count := 0
 	skipped := 0
 	broken_count := 0
+	over_budget := 0
 	this_block := 0
 	block_gc_time := time.Now().Sub(time.Now())
 	combine_time := time.Now().Sub(time.Now())
@@ -87,235 +104,320 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 
 	all_results := make([]*QuerySpec, 0)
 
+	if results_cache != nil && results_cache.saved != nil {
+		cached_blocks += len(results_cache.saved.Blocks)
+		cached_count += results_cache.saved.Results.MatchedCount
+	}
+
 	broken_mutex := sync.Mutex{}
 	broken_blocks := make([]string, 0)
 
 	var memstats runtime.MemStats
 	var max_alloc = uint64(0)
 
-	for f := range files {
+	budget := newMemBudget(FLAGS.MEM_BUDGET)
+	stats := QueryStats{}
+
+	incomplete := false
+	cancelled := func() bool {
+		if ctx.Err() == nil {
+			return false
+		}
+
+		m.Lock()
+		incomplete = true
+		m.Unlock()
+		return true
+	}
+
+	release_block := func(block *TableBlock) {
+		// don't delete when testing so we can verify block
+		// loading results
+		if loadSpec != nil && DELETE_BLOCKS_AFTER_QUERY && TEST_MODE == false {
+			t.block_m.Lock()
+			tb, ok := t.BlockList[block.Name]
+			if ok {
+				tb.RecycleSlab(loadSpec)
+
+				delete(t.BlockList, block.Name)
+			}
+			t.block_m.Unlock()
 
-		// TODO: decide more formally on order of block loading
-		// SAMPLES: reverse chronological order
-		// EVERYTHING ELSE: chronological order
-		v := files[f]
-		if querySpec != nil && querySpec.Samples {
-			v = files[len(files)-f-1]
 		}
+	}
+
+	workers := make(chan bool, queryWorkers())
+	Debug("QUERYING WITH", cap(workers), "WORKERS")
+
+	for _, block_dir := range t.scheduleBlocks(ctx, block_dirs) {
+		if cancelled() {
+			Debug("QUERY CANCELLED, NOT LOADING ANY MORE BLOCKS:", ctx.Err())
+			break
+		}
+
+		filename := block_dir
+		this_block++
 
-		if v.IsDir() && file_looks_like_block(v) {
-			filename := path.Join(FLAGS.DIR, t.Name, v.Name())
-			this_block++
+		wg.Add(1)
+		workers <- true
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if cancelled() {
+				return
+			}
 
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+			start := time.Now()
+
+			should_load := t.ShouldLoadBlockFromDir(filename, querySpec)
+
+			if !should_load {
+				m.Lock()
+				skipped++
+				m.Unlock()
+				return
+			}
 
-				start := time.Now()
+			var cachedSpec *QuerySpec
+			var cachedBlock *TableBlock
 
-				should_load := t.ShouldLoadBlockFromDir(filename, querySpec)
+			if querySpec != nil {
+				cachedBlock, cachedSpec = t.getCachedQueryForBlock(filename, querySpec)
+			}
 
-				if !should_load {
-					skipped++
+			var block *TableBlock
+			if cachedSpec == nil {
+				block_mem := t.estimateBlockMemory(filename, loadSpec, load_all)
+				if !budget.acquire(block_mem) {
+					Debug("BLOCK", filename, "NEEDS", block_mem, "BYTES, MORE THAN THE WHOLE MEMORY BUDGET, SKIPPING IT")
+					m.Lock()
+					over_budget++
+					incomplete = true
+					m.Unlock()
 					return
 				}
+				defer budget.release(block_mem)
 
-				var cachedSpec *QuerySpec
-				var cachedBlock *TableBlock
-
-				if querySpec != nil {
-					cachedBlock, cachedSpec = t.getCachedQueryForBlock(filename, querySpec)
+				if cancelled() {
+					return
 				}
 
-				var block *TableBlock
-				if cachedSpec == nil {
-					// couldnt load the cached query results
-					block = t.LoadBlockFromDir(filename, loadSpec, load_all)
-					if block == nil {
-						broken_mutex.Lock()
-						broken_blocks = append(broken_blocks, filename)
-						broken_mutex.Unlock()
-						return
-					}
-				} else {
-					// we are using cached query results
-					block = cachedBlock
+				// couldnt load the cached query results
+				block = t.LoadBlockFromDirContext(ctx, filename, loadSpec, load_all)
+				if block == nil && cancelled() {
+					return
+				}
+				if block == nil {
+					broken_mutex.Lock()
+					broken_blocks = append(broken_blocks, filename)
+					broken_mutex.Unlock()
+					return
 				}
+			} else {
+				// we are using cached query results
+				block = cachedBlock
+			}
 
-				if FLAGS.DEBUG {
-					if cachedSpec != nil {
-						fmt.Fprint(os.Stderr, "c")
-					} else {
-						fmt.Fprint(os.Stderr, ".")
+			// the block was loaded after the query was cancelled, so we
+			// give its memory back instead of querying it
+			if cachedSpec == nil && cancelled() {
+				release_block(block)
+				return
+			}
 
-					}
+			load_end := time.Now()
+			if DEBUG_TIMING {
+				if loadSpec != nil {
+					Debug("LOADED BLOCK FROM DIR", filename, "TOOK", load_end.Sub(start))
+				} else {
+					Debug("LOADED INFO FOR BLOCK", filename, "TOOK", load_end.Sub(start))
 				}
+			}
 
-				end := time.Now()
-				if DEBUG_TIMING {
-					if loadSpec != nil {
-						Debug("LOADED BLOCK FROM DIR", filename, "TOOK", end.Sub(start))
-					} else {
-						Debug("LOADED INFO FOR BLOCK", filename, "TOOK", end.Sub(start))
-					}
-				}
+			if cachedSpec == nil {
+				m.Lock()
+				stats.LoadTime += load_end.Sub(start)
+				stats.RecordsScanned += int64(len(block.RecordList))
+				stats.BytesRead += block.BytesRead
+				m.Unlock()
+			}
+
+			if len(block.RecordList) > 0 || cachedSpec != nil {
+				if querySpec == nil {
+					m.Lock()
+					count += len(block.RecordList)
+					m.Unlock()
+				} else { // Load and Query
+					blockQuery := cachedSpec
+					if blockQuery == nil {
+						filter_start := time.Now()
+						blockQuery = CopyQuerySpec(querySpec)
+						blockQuery.MatchedCount = FilterAndAggRecords(blockQuery, &block.RecordList)
 
-				if len(block.RecordList) > 0 || cachedSpec != nil {
-					if querySpec == nil {
 						m.Lock()
-						count += len(block.RecordList)
+						stats.FilterTime += time.Now().Sub(filter_start)
 						m.Unlock()
-					} else { // Load and Query
-						blockQuery := cachedSpec
-						if blockQuery == nil {
-							blockQuery = CopyQuerySpec(querySpec)
-							blockQuery.MatchedCount = FilterAndAggRecords(blockQuery, &block.RecordList)
-
-							if HOLD_MATCHES {
-								block.Matched = blockQuery.Matched
-							}
 
+						if HOLD_MATCHES {
+							block.Matched = blockQuery.Matched
 						}
 
-						if blockQuery != nil {
-							m.Lock()
-							if cachedSpec != nil {
-								cached_count += blockQuery.MatchedCount
-								cached_blocks += 1
-
-							} else {
-								count += blockQuery.MatchedCount
-								loaded_count += 1
-								if block.Info.NumRecords == int32(CHUNK_SIZE) {
-									to_cache_specs[block.Name] = blockQuery
-								}
-							}
-							block_specs[block.Name] = blockQuery
-							m.Unlock()
-						}
 					}
 
+					if blockQuery != nil {
+						m.Lock()
+						if cachedSpec != nil {
+							cached_count += blockQuery.MatchedCount
+							cached_blocks += 1
+
+						} else {
+							count += blockQuery.MatchedCount
+							loaded_count += 1
+							to_cache_specs[block.Name] = blockQuery
+						}
+						block_specs[block.Name] = blockQuery
+						m.Unlock()
+					}
 				}
 
-				if OPTS.WRITE_BLOCK_INFO {
-					block.SaveInfoToColumns(block.Name)
-				}
-
-				if FLAGS.EXPORT {
-					block.ExportBlockData()
-				}
-				// don't delete when testing so we can verify block
-				// loading results
-				if loadSpec != nil && DELETE_BLOCKS_AFTER_QUERY && TEST_MODE == false {
-					t.block_m.Lock()
-					tb, ok := t.BlockList[block.Name]
-					if ok {
-						tb.RecycleSlab(loadSpec)
-
-						delete(t.BlockList, block.Name)
-					}
-					t.block_m.Unlock()
+			}
 
+			if FLAGS.DEBUG {
+				if cachedSpec != nil {
+					Debug("BLOCK", block.Name, "CACHED, TOOK", load_end.Sub(start))
+				} else {
+					Debug("BLOCK", block.Name, "LOAD", load_end.Sub(start), "QUERY", time.Now().Sub(load_end), "RECORDS", len(block.RecordList))
 				}
-			}()
+			}
 
-			if FLAGS.SAMPLES {
-				wg.Wait()
+			if OPTS.WRITE_BLOCK_INFO {
+				block.SaveInfoToColumns(block.Name)
+			}
 
-				if count > FLAGS.LIMIT {
-					break
-				}
+			if FLAGS.EXPORT {
+				block.ExportBlockData()
 			}
 
-			if DELETE_BLOCKS_AFTER_QUERY && this_block%CHUNKS_BEFORE_GC == 0 && FLAGS.GC {
-				wg.Wait()
-				start := time.Now()
+			release_block(block)
+		}()
 
-				if FLAGS.RECYCLE_MEM == false {
-					m.Lock()
-					old_percent := debug.SetGCPercent(100)
-					debug.SetGCPercent(old_percent)
-					m.Unlock()
-				}
+		// blocks that are still loading can push the count past the
+		// limit, the extra samples are trimmed when printing
+		if FLAGS.SAMPLES {
+			m.Lock()
+			enough := count+cached_count > FLAGS.LIMIT
+			m.Unlock()
 
-				end := time.Now()
-				block_gc_time += end.Sub(start)
+			if enough {
+				break
+			}
+		}
 
-				if querySpec != nil {
+		if DELETE_BLOCKS_AFTER_QUERY && this_block%CHUNKS_BEFORE_GC == 0 && FLAGS.GC {
+			wg.Wait()
+			start := time.Now()
 
-					t.WriteQueryCache(to_cache_specs)
-					to_cache_specs = make(map[string]*QuerySpec)
+			if FLAGS.RECYCLE_MEM == false {
+				m.Lock()
+				old_percent := debug.SetGCPercent(100)
+				debug.SetGCPercent(old_percent)
+				m.Unlock()
+			}
 
-					combine_start := time.Now()
-					resultSpec := MultiCombineResults(querySpec, block_specs)
-					combine_time += (time.Now().Sub(combine_start))
+			end := time.Now()
+			block_gc_time += end.Sub(start)
 
-					block_specs = make(map[string]*QuerySpec)
+			if querySpec != nil {
 
-					m.Lock()
-					all_results = append(all_results, resultSpec)
-					m.Unlock()
+				t.WriteQueryCache(to_cache_specs)
+				to_cache_specs = make(map[string]*QuerySpec)
 
-					// {{{ LOGIC FOR EARLY EXIT WHEN DOING A NUM DISTINCT QUERY
-					// sometimes we just want to find x samples that fit some filter set and exit early
-					// we can't use a samples query because samples doesn't give us distinct results,
-					// instead we issue a query with a group by and once the group by goes above NUM_DISTINCT, we exit
-					if FLAGS.NUM_DISTINCT > 0 {
-						// We need to force the evaluation to figure out the number of distinct results.
-						m.Lock()
-						for k, v := range all_results {
-							block_specs[fmt.Sprintf("result_%v", k)] = v
-						}
+				combine_start := time.Now()
+				resultSpec := MultiCombineResults(querySpec, block_specs)
+				combine_time += (time.Now().Sub(combine_start))
 
-						resultSpec := MultiCombineResults(querySpec, block_specs)
-						all_results = all_results[:0]
-						all_results = append(all_results, resultSpec)
-						m.Unlock()
-						block_specs = make(map[string]*QuerySpec)
+				block_specs = make(map[string]*QuerySpec)
 
-						if len(resultSpec.Results) >= FLAGS.NUM_DISTINCT {
-							break
-						}
-					}
-					// }}}
-
-					// {{{ Freeing memory back to the OS
-					// We defer the free so that not all threads are halted while we
-					// free. We also schedule the next collection at alloced_mem +
-					// allowed overhead
-					runtime.ReadMemStats(&memstats)
-					alloced := memstats.Alloc / 1024 / 1024
-					if alloced > max_alloc {
-						max_alloc = alloced
+				m.Lock()
+				all_results = append(all_results, resultSpec)
+				m.Unlock()
+
+				// {{{ LOGIC FOR EARLY EXIT WHEN DOING A NUM DISTINCT QUERY
+				// sometimes we just want to find x samples that fit some filter set and exit early
+				// we can't use a samples query because samples doesn't give us distinct results,
+				// instead we issue a query with a group by and once the group by goes above NUM_DISTINCT, we exit
+				if FLAGS.NUM_DISTINCT > 0 {
+					// We need to force the evaluation to figure out the number of distinct results.
+					m.Lock()
+					for k, v := range all_results {
+						block_specs[fmt.Sprintf("result_%v", k)] = v
 					}
 
-					if alloced > MAX_MEM {
-						wg.Add(1)
-						go func() {
-							os_free_start := time.Now()
-							debug.FreeOSMemory()
-							runtime.ReadMemStats(&memstats)
-							after_free := memstats.Alloc / 1024 / 1024
-							MAX_MEM = after_free + FREE_MEM_AFTER
-							os_free_time += time.Now().Sub(os_free_start)
-							wg.Done()
-						}()
+					resultSpec := MultiCombineResults(querySpec, block_specs)
+					all_results = all_results[:0]
+					all_results = append(all_results, resultSpec)
+					m.Unlock()
+					block_specs = make(map[string]*QuerySpec)
+
+					if len(resultSpec.Results) >= FLAGS.NUM_DISTINCT {
+						break
 					}
-					// }}} end free memory
+				}
+				// }}}
+
+				// {{{ Freeing memory back to the OS
+				// We defer the free so that not all threads are halted while we
+				// free. We also schedule the next collection at alloced_mem +
+				// allowed overhead
+				runtime.ReadMemStats(&memstats)
+				alloced := memstats.Alloc / 1024 / 1024
+				if alloced > max_alloc {
+					max_alloc = alloced
 				}
 
-				if FLAGS.DEBUG {
-					fmt.Fprint(os.Stderr, ",")
+				if alloced > MAX_MEM {
+					wg.Add(1)
+					go func() {
+						os_free_start := time.Now()
+						debug.FreeOSMemory()
+						runtime.ReadMemStats(&memstats)
+						after_free := memstats.Alloc / 1024 / 1024
+						MAX_MEM = after_free + FREE_MEM_AFTER
+						os_free_time += time.Now().Sub(os_free_start)
+						wg.Done()
+					}()
 				}
+				// }}} end free memory
 			}
-		}
 
+			if FLAGS.DEBUG {
+				fmt.Fprint(os.Stderr, ",")
+			}
+		}
 	}
 
 	rowStoreQuery := AfterLoadQueryCB{}
 	var logend time.Time
 	logstart := time.Now()
-	if FLAGS.READ_INGESTION_LOG {
+	read_log := FLAGS.READ_INGESTION_LOG
+	if read_log && cancelled() {
+		Debug("QUERY CANCELLED, NOT READING INGESTION LOG")
+		read_log = false
+	}
+
+	if read_log && results_cache != nil {
+		if row_spec := results_cache.rowStoreResults(querySpec); row_spec != nil {
+			Debug("ROW STORE RESULTS ARE CACHED")
+			m.Lock()
+			block_specs[INGEST_DIR] = row_spec
+			cached_count += row_spec.MatchedCount
+			m.Unlock()
+			read_log = false
+		}
+	}
+
+	if read_log {
 		if querySpec == nil {
 			rowStoreQuery.querySpec = &QuerySpec{}
 			rowStoreQuery.querySpec.Table = t
@@ -350,12 +452,14 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 		Debug("BLOCK", broken_block_name, "IS BROKEN, SKIPPING")
 	}
 
-	if FLAGS.READ_INGESTION_LOG {
+	if read_log {
 		m.Lock()
 		Debug("LOADING & QUERYING INGESTION LOG TOOK", logend.Sub(logstart))
 		Debug("INGESTION LOG RECORDS MATCHED", rowStoreQuery.count)
+		stats.LoadTime += logend.Sub(logstart)
 		m.Unlock()
 		count += rowStoreQuery.count
+		stats.RecordsScanned += int64(rowStoreQuery.scanned)
 
 		if DELETE_BLOCKS_AFTER_QUERY == false && t.RowBlock != nil {
 			Debug("ROW STORE RECORD LENGTH IS", len(rowStoreQuery.records))
@@ -401,10 +505,16 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 			block_specs[fmt.Sprintf("result_%v", k)] = v
 		}
 
-		resultSpec := MultiCombineResults(querySpec, block_specs)
+		var resultSpec *QuerySpec
+		if results_cache != nil {
+			resultSpec = results_cache.combine(querySpec, block_specs, broken_blocks, incomplete)
+		} else {
+			resultSpec = MultiCombineResults(querySpec, block_specs)
+		}
 
 		aend := time.Now()
 		Debug("AGGREGATING RESULT BLOCKS TOOK", aend.Sub(astart))
+		combine_time += aend.Sub(astart)
 
 		querySpec.Cumulative = resultSpec.Cumulative
 
@@ -415,6 +525,31 @@ func (t *Table) LoadAndQueryRecords(loadSpec *LoadSpec, querySpec *QuerySpec) in
 		querySpec.SortResults(querySpec.OrderBy, querySpec.OrderAsc)
 	}
 
+	if incomplete {
+		Debug("RESULTS ARE INCOMPLETE, CANCELLED:", ctx.Err() != nil, "BLOCKS OVER MEMORY BUDGET:", over_budget)
+	}
+
+	stats.PeakMemory = budget.peakUsage()
+	stats.BlocksOverBudget = over_budget
+	Debug("PEAK ESTIMATED BLOCK MEMORY", stats.PeakMemory, "BYTES")
+
+	if querySpec != nil {
+		stats.BlocksConsidered = this_block
+		stats.BlocksPruned = skipped
+		stats.BlocksCached = cached_blocks
+		stats.RecordsMatched = int64(count + cached_count)
+		stats.CombineTime = combine_time
+		if load_all {
+			stats.ColumnsLoaded = len(t.KeyTable)
+		} else if loadSpec != nil {
+			stats.ColumnsLoaded = len(loadSpec.columns)
+		}
+		stats.QueryTime = time.Now().Sub(waystart)
+
+		querySpec.Incomplete = incomplete
+		querySpec.Stats = stats
+	}
+
 	t.WriteBlockCache()
 
 	return count
@@ -1,5 +1,6 @@
 package sybil
 
+import "context"
 import "testing"
 import "math/rand"
 import "strconv"
@@ -216,3 +217,246 @@ func TestShortenKeyTable(t *testing.T) {
 	deleteTestDb(tableName)
 
 }
+
+func TestCancelledQuery(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 3
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	nt := saveAndReloadTable(t, tableName, blockCount)
+
+	querySpec := newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	nt.MatchAndAggregateContext(ctx, querySpec)
+	if !querySpec.Incomplete {
+		t.Error("CANCELLED SEARCH WAS NOT MARKED INCOMPLETE")
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	querySpec = newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	count := nt.LoadAndQueryRecordsContext(ctx, &loadSpec, querySpec)
+	if count != 0 || !querySpec.Incomplete {
+		t.Error("CANCELLED QUERY LOADED", count, "RECORDS, INCOMPLETE:", querySpec.Incomplete)
+	}
+
+	// a block that is being loaded stops before its next column and gives
+	// its records back to the slab
+	old_recycle := FLAGS.RECYCLE_MEM
+	FLAGS.RECYCLE_MEM = true
+	block_dirs, _ := nt.listBlockDirs(nil)
+	block := nt.LoadBlockFromDirContext(ctx, block_dirs[0], &loadSpec, false)
+	if block != nil || nt.BlockList[block_dirs[0]] != nil {
+		t.Error("CANCELLED BLOCK LOAD WASNT ABORTED")
+	}
+	if len(loadSpec.slabs) != 1 {
+		t.Error("CANCELLED BLOCK LOAD LEFT", len(loadSpec.slabs), "RECYCLED SLABS, EXPECTED 1")
+	}
+	FLAGS.RECYCLE_MEM = old_recycle
+
+	querySpec = newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+	count = nt.LoadAndQueryRecordsContext(context.Background(), &loadSpec, querySpec)
+	if count != CHUNK_SIZE*blockCount || querySpec.Incomplete {
+		t.Error("QUERY WITHOUT CANCELLATION LOADED", count, "RECORDS, INCOMPLETE:", querySpec.Incomplete)
+	}
+}
+
+func TestQueryMemoryBudget(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+
+	// every block is estimated at ~0.6MB, so a 1MB budget only fits one
+	old_bytes := BYTES_PER_RECORD
+	BYTES_PER_RECORD = int64(600 * 1024 / CHUNK_SIZE)
+	FLAGS.MEM_BUDGET = 1
+	defer func() {
+		BYTES_PER_RECORD = old_bytes
+		FLAGS.MEM_BUDGET = 0
+	}()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	querySpec := newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	count := nt.LoadAndQueryRecords(&loadSpec, querySpec)
+	if count != CHUNK_SIZE*blockCount {
+		t.Error("QUERY WITH MEMORY BUDGET LOADED", count, "RECORDS")
+	}
+
+	peak := querySpec.Stats.PeakMemory
+	if peak == 0 || peak > 1024*1024 {
+		t.Error("PEAK MEMORY", peak, "IS OUTSIDE OF THE MEMORY BUDGET")
+	}
+
+	if querySpec.Incomplete || querySpec.Stats.BlocksOverBudget != 0 {
+		t.Error("QUERY WITHIN THE MEMORY BUDGET IS INCOMPLETE")
+	}
+
+	// blocks of ~1.2MB don't fit at all and are skipped
+	BYTES_PER_RECORD = int64(1200 * 1024 / CHUNK_SIZE)
+
+	querySpec = newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	count = nt.LoadAndQueryRecords(&loadSpec, querySpec)
+	if count != 0 || querySpec.Stats.PeakMemory != 0 {
+		t.Error("QUERY LOADED", count, "RECORDS OF BLOCKS OVER THE MEMORY BUDGET")
+	}
+
+	if !querySpec.Incomplete || querySpec.Stats.BlocksOverBudget != blockCount {
+		t.Error("SKIPPED", querySpec.Stats.BlocksOverBudget, "BLOCKS OVER THE MEMORY BUDGET, INCOMPLETE:", querySpec.Incomplete)
+	}
+}
+
+func TestBlocksScheduledNewestFirst(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+
+	old_time_col := FLAGS.TIME_COL
+	FLAGS.TIME_COL = "time"
+	FLAGS.WORKERS = 1
+	defer func() {
+		FLAGS.TIME_COL = old_time_col
+		FLAGS.WORKERS = 0
+	}()
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	block_dirs, _ := nt.listBlockDirs(nil)
+	blocks := nt.scheduleBlocks(context.Background(), block_dirs)
+	if len(blocks) != blockCount {
+		t.Fatal("SCHEDULED", len(blocks), "BLOCKS, EXPECTED", blockCount)
+	}
+
+	prev := int64(math.MaxInt64)
+	for _, filename := range blocks {
+		newest := nt.LoadBlockInfo(filename).IntInfoMap["time"].Max
+		if newest > prev {
+			t.Error("BLOCK", filename, "WITH MAX TIME", newest, "WAS SCHEDULED AFTER AN OLDER BLOCK")
+		}
+		prev = newest
+	}
+
+	// a cancelled query doesn't read any more block infos
+	unloadTestTable(tableName)
+	ct := GetTable(tableName)
+	ct.LoadTableInfo()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if blocks := ct.scheduleBlocks(ctx, block_dirs); len(blocks) != blockCount {
+		t.Error("SCHEDULED", len(blocks), "BLOCKS FOR A CANCELLED QUERY, EXPECTED", blockCount)
+	}
+	if len(ct.BlockInfoCache) != 0 {
+		t.Error("SCHEDULING A CANCELLED QUERY READ", len(ct.BlockInfoCache), "BLOCK INFOS")
+	}
+
+	unloadTestTable(tableName)
+	nt = GetTable(tableName)
+	nt.LoadTableInfo()
+
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	querySpec := newQuerySpec()
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	count := nt.LoadAndQueryRecords(&loadSpec, querySpec)
+	if count != CHUNK_SIZE*blockCount {
+		t.Error("QUERY WITH ONE WORKER LOADED", count, "RECORDS")
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("id", int64(index))
+		r.AddIntField("age", int64(index%20)+10)
+	}, blockCount)
+
+	saveAndReloadTable(t, tableName, blockCount)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	// only the first block has ids below CHUNK_SIZE, the rest get pruned
+	loadSpec := nt.NewLoadSpec()
+	loadSpec.Int("age")
+	loadSpec.Int("id")
+	querySpec := newQuerySpec()
+	querySpec.Filters = append(querySpec.Filters, nt.IntFilter("id", "lt", CHUNK_SIZE/2))
+	querySpec.Aggregations = append(querySpec.Aggregations, nt.Aggregation("age", "avg"))
+
+	nt.LoadAndQueryRecords(&loadSpec, querySpec)
+
+	stats := querySpec.Stats
+	if stats.BlocksConsidered != blockCount {
+		t.Error("QUERY CONSIDERED", stats.BlocksConsidered, "BLOCKS, EXPECTED", blockCount)
+	}
+
+	if stats.BlocksPruned != blockCount-1 {
+		t.Error("QUERY PRUNED", stats.BlocksPruned, "BLOCKS, EXPECTED", blockCount-1)
+	}
+
+	if stats.RecordsScanned != int64(CHUNK_SIZE) {
+		t.Error("QUERY SCANNED", stats.RecordsScanned, "RECORDS, EXPECTED", CHUNK_SIZE)
+	}
+
+	if stats.RecordsMatched != int64(CHUNK_SIZE/2) {
+		t.Error("QUERY MATCHED", stats.RecordsMatched, "RECORDS, EXPECTED", CHUNK_SIZE/2)
+	}
+
+	if stats.ColumnsLoaded != 2 {
+		t.Error("QUERY LOADED", stats.ColumnsLoaded, "COLUMNS, EXPECTED 2")
+	}
+
+	if stats.BytesRead <= 0 || stats.LoadTime <= 0 || stats.QueryTime <= 0 {
+		t.Error("QUERY STATS ARE MISSING BYTES READ OR TIMINGS", stats)
+	}
+}
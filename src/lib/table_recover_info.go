@@ -1,8 +1,6 @@
 package sybil
 
 import "fmt"
-import "io/ioutil"
-import "path"
 import "os"
 import "sync"
 import "strings"
@@ -46,7 +44,7 @@ func (t *Table) ReadBlockInfoFromDir(dirname string) *SavedColumnInfo {
 		col_name := fname
 		col_type := _NO_VAL
 
-		col_name = strings.TrimRight(col_name, ".gz")
+		col_name = trimCodecExt(col_name)
 		col_name = strings.TrimRight(col_name, ".db")
 
 		switch {
@@ -90,7 +88,7 @@ func (t *Table) ReadBlockInfoFromDir(dirname string) *SavedColumnInfo {
 // I think I go through each block and load the block, verifying the different
 // column types
 func (t *Table) DeduceTableInfoFromBlocks() {
-	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, t.Name))
+	block_dirs, _ := t.listBlockDirs(nil)
 
 	var wg sync.WaitGroup
 	t.init_data_structures()
@@ -98,6 +96,9 @@ func (t *Table) DeduceTableInfoFromBlocks() {
 	saved_table := Table{Name: t.Name}
 	saved_table.init_data_structures()
 
+	// the settings can't be deduced from the blocks
+	t.loadTableSettings()
+
 	this_block := 0
 	m := &sync.Mutex{}
 
@@ -105,44 +106,40 @@ func (t *Table) DeduceTableInfoFromBlocks() {
 
 	broken_mutex := sync.Mutex{}
 	broken_blocks := make([]string, 0)
-	for f := range files {
-
-		v := files[f]
-		if v.IsDir() && file_looks_like_block(v) {
-			filename := path.Join(FLAGS.DIR, t.Name, v.Name())
-			this_block++
-
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-
-				info := t.ReadBlockInfoFromDir(filename)
-				if info == nil {
-					broken_mutex.Lock()
-					broken_blocks = append(broken_blocks, filename)
-					broken_mutex.Unlock()
-					return
-				}
+	for _, filename := range block_dirs {
+		filename := filename
+		this_block++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			info := t.ReadBlockInfoFromDir(filename)
+			if info == nil {
+				broken_mutex.Lock()
+				broken_blocks = append(broken_blocks, filename)
+				broken_mutex.Unlock()
+				return
+			}
 
-				m.Lock()
-				for col := range info.IntInfoMap {
-					_, ok := type_counts[col]
-					if !ok {
-						type_counts[col] = make(map[int]int)
-					}
-					type_counts[col][INT_VAL]++
+			m.Lock()
+			for col := range info.IntInfoMap {
+				_, ok := type_counts[col]
+				if !ok {
+					type_counts[col] = make(map[int]int)
 				}
-				for col := range info.StrInfoMap {
-					_, ok := type_counts[col]
-					if !ok {
-						type_counts[col] = make(map[int]int)
-					}
-					type_counts[col][STR_VAL]++
+				type_counts[col][INT_VAL]++
+			}
+			for col := range info.StrInfoMap {
+				_, ok := type_counts[col]
+				if !ok {
+					type_counts[col] = make(map[int]int)
 				}
-				m.Unlock()
+				type_counts[col][STR_VAL]++
+			}
+			m.Unlock()
 
-			}()
-		}
+		}()
 	}
 
 	wg.Wait()
@@ -0,0 +1,231 @@
+package sybil
+
+import "bytes"
+import "compress/gzip"
+import "crypto/md5"
+import "encoding/gob"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+
+// TABLE RESULTS CACHE
+// With FLAGS.CACHED_RESULTS, the combined results of a query are saved in
+// <table>/results/<key>.db.gz, keyed by QueryParams.cacheKey(). An entry
+// remembers the blocks it covers (by name and the mtime of their info.db)
+// and keeps the row store results apart, along with the names, sizes and
+// mtimes of the row store files they were read from. When the query runs
+// again, the covered blocks aren't read and their saved results are merged
+// with the results of the blocks that were added since, and the row store is
+// only read again when it changed. An entry that covers a block that was
+// rewritten or removed isn't used. Cancelled queries are never saved.
+
+var RESULTS_CACHE_DIR = "results"
+
+type savedTableResults struct {
+	Blocks  map[string]int64 // block name (inside the table dir) -> info.db mtime
+	Results QueryResults     // combined results of Blocks
+
+	RowStore        string // signature of the row store, empty when it wasn't read
+	RowStoreResults QueryResults
+}
+
+type tableResultsCache struct {
+	table    *Table
+	filename string
+
+	blocks    map[string]int64 // the blocks the query runs over right now
+	row_store string
+
+	saved *savedTableResults // nil when nothing usable was saved
+}
+
+func (t *Table) resultsCacheDir() string {
+	return path.Join(FLAGS.DIR, t.Name, RESULTS_CACHE_DIR)
+}
+
+func (t *Table) useResultsCache(querySpec *QuerySpec) bool {
+	// samples, matches and NUM_DISTINCT queries stop early or keep records,
+	// neither of which can be saved as results
+	return querySpec != nil && FLAGS.CACHED_RESULTS && FLAGS.LOAD_AND_QUERY &&
+		!FLAGS.SAMPLES && !HOLD_MATCHES && FLAGS.NUM_DISTINCT <= 0
+}
+
+// tableBlockName is the name of a block inside the table dir
+func (t *Table) tableBlockName(blockname string) string {
+	return strings.TrimPrefix(blockname, path.Join(FLAGS.DIR, t.Name)+"/")
+}
+
+func blockStamp(blockname string) int64 {
+	info, err := os.Stat(path.Join(blockname, "info.db"))
+	if err != nil {
+		return -1
+	}
+
+	return info.ModTime().UnixNano()
+}
+
+// rowStoreSignature sums up the files of the row store, so cached row store
+// results can be told apart from the current ones
+func (t *Table) rowStoreSignature() string {
+	if !FLAGS.READ_INGESTION_LOG {
+		return ""
+	}
+
+	h := md5.New()
+	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, t.Name, INGEST_DIR))
+	for _, f := range files {
+		fmt.Fprintf(h, "%s:%d:%d\n", f.Name(), f.Size(), f.ModTime().UnixNano())
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// openResultsCache loads the saved results of the query, if they are still
+// good for the blocks in block_dirs
+func (t *Table) openResultsCache(querySpec *QuerySpec, block_dirs []string) *tableResultsCache {
+	rc := tableResultsCache{table: t}
+	rc.filename = path.Join(t.resultsCacheDir(), querySpec.QueryParams.cacheKey()+QUERY_CACHE_EXT)
+	rc.row_store = t.rowStoreSignature()
+
+	rc.blocks = make(map[string]int64)
+	for _, blockname := range block_dirs {
+		rc.blocks[t.tableBlockName(blockname)] = blockStamp(blockname)
+	}
+
+	saved := savedTableResults{}
+	err := decodeInto(rc.filename, &saved)
+	if err != nil {
+		return &rc
+	}
+
+	for name, stamp := range saved.Blocks {
+		if current, ok := rc.blocks[name]; !ok || current != stamp {
+			Debug("CACHED RESULTS ARE STALE, BLOCK", name, "CHANGED")
+			return &rc
+		}
+	}
+
+	Debug("RESULTS OF", len(saved.Blocks), "BLOCKS ARE CACHED")
+	rc.saved = &saved
+	touchQueryCache(rc.filename)
+	return &rc
+}
+
+// uncachedBlocks returns the blocks the cached results don't cover
+func (rc *tableResultsCache) uncachedBlocks(block_dirs []string) []string {
+	if rc.saved == nil {
+		return block_dirs
+	}
+
+	ret := make([]string, 0)
+	for _, blockname := range block_dirs {
+		if _, ok := rc.saved.Blocks[rc.table.tableBlockName(blockname)]; !ok {
+			ret = append(ret, blockname)
+		}
+	}
+
+	return ret
+}
+
+// rowStoreResults returns the cached results of the row store when it hasn't
+// changed since they were saved
+func (rc *tableResultsCache) rowStoreResults(querySpec *QuerySpec) *QuerySpec {
+	if rc.saved == nil || rc.row_store == "" || rc.saved.RowStore != rc.row_store {
+		return nil
+	}
+
+	spec := CopyQuerySpec(querySpec)
+	spec.QueryResults = rc.saved.RowStoreResults
+	return spec
+}
+
+// combine is MultiCombineResults for queries that use the results cache: the
+// block results are combined with the cached ones and saved before the row
+// store results are added in
+func (rc *tableResultsCache) combine(querySpec *QuerySpec, block_specs map[string]*QuerySpec, broken []string, incomplete bool) *QuerySpec {
+	row_spec := block_specs[INGEST_DIR]
+	delete(block_specs, INGEST_DIR)
+
+	if rc.saved != nil {
+		cached := CopyQuerySpec(querySpec)
+		cached.QueryResults = rc.saved.Results
+		block_specs["result_cached"] = cached
+	}
+
+	blockSpec := MultiCombineResults(querySpec, block_specs)
+
+	// combining results isn't idempotent, so they are saved before the row
+	// store results are combined in
+	if !incomplete {
+		rc.save(blockSpec, row_spec, broken)
+	}
+
+	if row_spec == nil {
+		return blockSpec
+	}
+
+	return CombineResults(querySpec, map[string]*QuerySpec{"result_blocks": blockSpec, INGEST_DIR: row_spec})
+}
+
+func (rc *tableResultsCache) save(blockSpec *QuerySpec, row_spec *QuerySpec, broken []string) {
+	t := rc.table
+	saved := savedTableResults{Blocks: rc.blocks, Results: blockSpec.QueryResults}
+
+	// broken blocks are read again next time
+	for _, blockname := range broken {
+		delete(saved.Blocks, t.tableBlockName(blockname))
+	}
+
+	if row_spec != nil {
+		saved.RowStore = rc.row_store
+		saved.RowStoreResults = row_spec.QueryResults
+	}
+	saved.Results.Matched = nil
+	saved.RowStoreResults.Matched = nil
+
+	cache_dir := path.Dir(rc.filename)
+	err := os.MkdirAll(cache_dir, 0777)
+	if err != nil {
+		Debug("COULDNT CREATE RESULTS CACHE DIR", err, "NOT CACHING RESULTS")
+		return
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	err = gob.NewEncoder(w).Encode(saved)
+	w.Close()
+	if err != nil {
+		Warn("CACHED RESULTS ENCODING ERROR:", err)
+		return
+	}
+
+	tempfile, err := ioutil.TempFile(cache_dir, path.Base(rc.filename))
+	if err != nil {
+		Warn("ERROR CREATING TEMP FILE FOR CACHED RESULTS", err)
+		return
+	}
+
+	size := int64(buf.Len())
+	if old, err := os.Stat(rc.filename); err == nil {
+		size -= old.Size()
+	}
+
+	_, err = buf.WriteTo(tempfile)
+	tempfile.Close()
+	if err != nil {
+		Warn("ERROR SAVING CACHED RESULTS INTO TEMPFILE", err)
+		os.Remove(tempfile.Name())
+		return
+	}
+
+	err = RenameAndMod(tempfile.Name(), rc.filename)
+	if err != nil {
+		Warn("ERROR RENAMING", tempfile.Name())
+		return
+	}
+
+	Debug("SAVED RESULTS OF", len(saved.Blocks), "BLOCKS TO", rc.filename)
+	t.addQueryCacheBytes(size)
+}
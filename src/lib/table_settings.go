@@ -0,0 +1,75 @@
+package sybil
+
+import "bytes"
+import "encoding/gob"
+import "io/ioutil"
+import "os"
+import "path"
+
+// TableSettings are options that belong to a table rather than to a single
+// command invocation. They are saved into the table's info.db, so once a
+// setting is made by one command, every later ingest, digest and query on
+// the table picks it up. A copy is kept in SETTINGS_FILE, so a table info
+// that is rebuilt from the blocks (sybil rebuild) gets them back.
+var SETTINGS_FILE = "settings.db"
+
+type TableSettings struct {
+	// columns that make up the dedup key, see table_dedup.go
+	DedupKey []string
+	// how long (in seconds) a dedup key is remembered
+	DedupWindow int64
+	// columns kept in the table index, see table_index.go
+	IndexCols []string
+	// columns digest orders records by, see table_sort_key.go
+	SortKey []string
+	// time partitioning of the blocks ("day" or "hour") and the int column
+	// it goes by, see table_partition.go
+	Partition    string
+	PartitionCol string
+	// compression codec of new column files, see file_codec.go
+	Codec string
+	// bytes the per block query cache of the table can use (0 is no
+	// limit), see query_cache_store.go
+	QueryCacheBytes int64
+	// how the table's locks are held, "" (PID files) or "flock", see
+	// table_lock_flock.go
+	LockBackend string
+}
+
+func (t *Table) writeTableSettings() error {
+	dirname := path.Join(FLAGS.DIR, t.Name)
+
+	var network bytes.Buffer
+	enc := gob.NewEncoder(&network)
+	err := enc.Encode(t.Settings)
+	if err != nil {
+		return err
+	}
+
+	tempfile, err := ioutil.TempFile(dirname, SETTINGS_FILE)
+	if err != nil {
+		return err
+	}
+
+	_, err = network.WriteTo(tempfile)
+	tempfile.Close()
+	if err != nil {
+		os.Remove(tempfile.Name())
+		return err
+	}
+
+	return RenameAndMod(tempfile.Name(), path.Join(dirname, SETTINGS_FILE))
+}
+
+// loadTableSettings reads the table's settings from SETTINGS_FILE
+func (t *Table) loadTableSettings() bool {
+	settings := TableSettings{}
+	err := decodeInto(path.Join(FLAGS.DIR, t.Name, SETTINGS_FILE), &settings)
+	if err != nil {
+		Debug("COULDNT READ TABLE SETTINGS", err)
+		return false
+	}
+
+	t.Settings = settings
+	return true
+}
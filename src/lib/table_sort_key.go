@@ -0,0 +1,87 @@
+package sybil
+
+import "sort"
+
+// CLUSTERING
+// A table can have a sort key (Settings.SortKey). Digest orders the records
+// it writes by the sort key columns and then by time, so each block covers
+// a tight range of the sort key, which makes block pruning on those columns
+// work and gives the column encoders longer runs of the same value. Records
+// without a value for a sort key column go first. Tables without a sort key
+// keep sorting by time only.
+
+func (t *Table) SetSortKey(cols []string) {
+	t.Settings.SortKey = cols
+}
+
+type sortKeyCol struct {
+	id       int16
+	col_type int8
+}
+
+type SortRecordsByKey struct {
+	RecordList
+	cols []sortKeyCol
+}
+
+func (a SortRecordsByKey) Less(i, j int) bool {
+	ri := a.RecordList[i]
+	rj := a.RecordList[j]
+
+	for _, c := range a.cols {
+		pi := int(c.id) < len(ri.Populated) && ri.Populated[c.id] == c.col_type
+		pj := int(c.id) < len(rj.Populated) && rj.Populated[c.id] == c.col_type
+		if pi != pj {
+			return pj
+		}
+		if !pi {
+			continue
+		}
+
+		switch c.col_type {
+		case INT_VAL:
+			if ri.Ints[c.id] != rj.Ints[c.id] {
+				return ri.Ints[c.id] < rj.Ints[c.id]
+			}
+		case STR_VAL:
+			// the records can come from different blocks, so we compare the
+			// strings instead of their ids
+			si := ri.block.GetColumnInfo(c.id).get_string_for_val(int32(ri.Strs[c.id]))
+			sj := rj.block.GetColumnInfo(c.id).get_string_for_val(int32(rj.Strs[c.id]))
+			if si != sj {
+				return si < sj
+			}
+		}
+	}
+
+	return ri.Timestamp < rj.Timestamp
+}
+
+// SortRecords orders records for saving them into blocks
+func (t *Table) SortRecords(records RecordList) {
+	cols := make([]sortKeyCol, 0)
+	for _, name := range t.Settings.SortKey {
+		t.string_id_m.RLock()
+		id, ok := t.KeyTable[name]
+		col_type := t.KeyTypes[id]
+		t.string_id_m.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		if col_type != INT_VAL && col_type != STR_VAL {
+			Debug("CANT SORT BY", name, "ONLY INT AND STR COLUMNS CAN BE IN THE SORT KEY")
+			continue
+		}
+
+		cols = append(cols, sortKeyCol{id, col_type})
+	}
+
+	if len(cols) == 0 {
+		sort.Sort(SortRecordsByTime{records})
+		return
+	}
+
+	sort.Stable(SortRecordsByKey{records, cols})
+}
@@ -0,0 +1,100 @@
+package sybil
+
+import "io/ioutil"
+import "math/rand"
+import "path"
+import "sort"
+import "strconv"
+import "testing"
+
+func TestSortKeyClustersBlocks(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 4
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("customer_id", int64(rand.Intn(1000)))
+		r.AddIntField("age", int64(rand.Intn(20))+10)
+	}, blockCount)
+
+	GetTable(tableName).SetSortKey([]string{"customer_id"})
+	saveAndReloadTable(t, tableName, blockCount)
+
+	unloadTestTable(tableName)
+	nt := GetTable(tableName)
+	nt.LoadTableInfo()
+
+	if len(nt.Settings.SortKey) != 1 {
+		t.Fatal("SORT KEY WASNT SAVED IN THE TABLE INFO", nt.Settings.SortKey)
+	}
+
+	files, _ := ioutil.ReadDir(path.Join(FLAGS.DIR, nt.Name))
+	ranges := make([]*IntInfo, 0)
+	for _, v := range files {
+		if v.IsDir() && file_looks_like_block(v) {
+			info := nt.LoadBlockInfo(path.Join(FLAGS.DIR, nt.Name, v.Name()))
+			ranges = append(ranges, info.IntInfoMap["customer_id"])
+		}
+	}
+
+	if len(ranges) != blockCount {
+		t.Fatal("FOUND", len(ranges), "BLOCKS, EXPECTED", blockCount)
+	}
+
+	sort.Sort(intInfosByMin(ranges))
+	for i := 1; i < len(ranges); i++ {
+		// blocks can share the value on their boundary, but not more
+		if ranges[i].Min < ranges[i-1].Max {
+			t.Error("BLOCKS OVERLAP ON THE SORT KEY", ranges[i-1].Min, ranges[i-1].Max, ranges[i].Min, ranges[i].Max)
+		}
+	}
+}
+
+type intInfosByMin []*IntInfo
+
+func (a intInfosByMin) Len() int           { return len(a) }
+func (a intInfosByMin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a intInfosByMin) Less(i, j int) bool { return a[i].Min < a[j].Min }
+
+func TestSortRecordsByStrKey(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	records := addRecords(tableName, func(r *Record, index int) {
+		r.Timestamp = int64(index)
+		r.AddStrField("name", "name_"+strconv.Itoa(rand.Intn(50)))
+		if index%10 == 0 {
+			return
+		}
+		r.AddIntField("age", int64(index%7))
+	}, 1)
+
+	nt := GetTable(tableName)
+	nt.SetSortKey([]string{"name", "age"})
+	nt.SortRecords(records)
+
+	name_id := nt.KeyTable["name"]
+	age_id := nt.KeyTable["age"]
+	has_age := func(r *Record) bool {
+		return int(age_id) < len(r.Populated) && r.Populated[age_id] == INT_VAL
+	}
+
+	for i := 1; i < len(records); i++ {
+		prev, cur := records[i-1], records[i]
+		prev_name := prev.block.GetColumnInfo(name_id).get_string_for_val(int32(prev.Strs[name_id]))
+		cur_name := cur.block.GetColumnInfo(name_id).get_string_for_val(int32(cur.Strs[name_id]))
+		if prev_name > cur_name {
+			t.Fatal("RECORDS ARE NOT SORTED BY NAME", prev_name, cur_name)
+		}
+
+		if prev_name == cur_name && has_age(prev) && has_age(cur) && prev.Ints[age_id] > cur.Ints[age_id] {
+			t.Fatal("RECORDS WITH THE SAME NAME ARE NOT SORTED BY AGE", prev_name)
+		}
+
+		if prev_name == cur_name && has_age(prev) && !has_age(cur) {
+			t.Fatal("RECORDS WITHOUT AN AGE SHOULD COME FIRST", prev_name)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package sybil
+
+import "io/ioutil"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+
+// COLUMN STATS
+// TableStats reads every column file of the table's blocks and adds up, per
+// column, the bytes it takes on disk, how it was encoded, how many distinct
+// values it has, how many records don't have a value and how big its string
+// tables are. Distinct values are only counted up to STATS_MAX_CARDINALITY
+// per column, so a table's timestamps don't have to fit into memory.
+
+var STATS_MAX_CARDINALITY = 1 << 16
+
+type BlockColumnStats struct {
+	Block           string  `json:"block"` // inside the table dir
+	Bytes           int64   `json:"bytes"`
+	BucketEncoded   bool    `json:"bucketEncoded"`
+	ValueEncoded    bool    `json:"valueEncoded"`
+	DeltaEncodedIDs bool    `json:"deltaEncodedIds"`
+	Records         int     `json:"records"`
+	NullRatio       float64 `json:"nullRatio"`
+	Cardinality     int     `json:"cardinality"`
+	StringTable     int     `json:"stringTable"`
+}
+
+type ColumnStats struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"` // int, str or set
+	Bytes  int64  `json:"bytes"`
+	Blocks int    `json:"blocks"` // blocks that have the column
+
+	// blocks the column is encoded that way in
+	BucketEncoded   int `json:"bucketEncoded"`
+	ValueEncoded    int `json:"valueEncoded"`
+	DeltaEncodedIDs int `json:"deltaEncodedIds"`
+
+	Records           int64   `json:"records"`
+	NullRatio         float64 `json:"nullRatio"`
+	Cardinality       int     `json:"cardinality"`
+	CardinalityCapped bool    `json:"cardinalityCapped"` // it has more than STATS_MAX_CARDINALITY values
+	StringTable       int64   `json:"stringTable"`       // strings in the string tables of all its blocks
+
+	PerBlock []*BlockColumnStats `json:"perBlock,omitempty"`
+
+	distinct map[string]bool
+}
+
+type TableStats struct {
+	TableInfo
+	Blocks      int            `json:"blocks"`
+	ColumnStats []*ColumnStats `json:"columnStats"` // biggest first
+}
+
+type columnStatsByBytes []*ColumnStats
+
+func (a columnStatsByBytes) Len() int      { return len(a) }
+func (a columnStatsByBytes) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a columnStatsByBytes) Less(i, j int) bool {
+	if a[i].Bytes != a[j].Bytes {
+		return a[i].Bytes > a[j].Bytes
+	}
+
+	return a[i].Name < a[j].Name
+}
+
+func (cs *ColumnStats) addDistinct(value string) {
+	if cs.distinct[value] {
+		return
+	}
+
+	if len(cs.distinct) >= STATS_MAX_CARDINALITY {
+		cs.CardinalityCapped = true
+		return
+	}
+
+	cs.distinct[value] = true
+}
+
+// the column stats functions fill in bs and add the distinct values of the
+// column to cs. They return the name of the column inside the file
+func intColumnStats(filename string, cs *ColumnStats, bs *BlockColumnStats) (string, error) {
+	col := SavedIntColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	bs.BucketEncoded = col.BucketEncoded
+	bs.ValueEncoded = col.ValueEncoded
+	bs.DeltaEncodedIDs = col.DeltaEncodedIDs
+
+	if col.BucketEncoded {
+		bs.Cardinality = len(col.Bins)
+		for _, bucket := range col.Bins {
+			bs.Records += len(bucket.Records)
+			cs.addDistinct(strconv.FormatInt(bucket.Value, 10))
+		}
+		return col.Name, nil
+	}
+
+	bs.Records = len(col.Values)
+	distinct := make(map[int64]bool)
+	prev := int64(0)
+	for _, v := range col.Values {
+		if col.ValueEncoded {
+			v = v + prev
+			prev = v
+		}
+
+		if !distinct[v] {
+			distinct[v] = true
+			cs.addDistinct(strconv.FormatInt(v, 10))
+		}
+	}
+	bs.Cardinality = len(distinct)
+
+	return col.Name, nil
+}
+
+func strColumnStats(filename string, cs *ColumnStats, bs *BlockColumnStats) (string, error) {
+	col := SavedStrColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	bs.BucketEncoded = col.BucketEncoded
+	bs.DeltaEncodedIDs = col.DeltaEncodedIDs
+	bs.StringTable = len(col.StringTable)
+
+	distinct := make(map[int32]bool)
+	if col.BucketEncoded {
+		for _, bucket := range col.Bins {
+			bs.Records += len(bucket.Records)
+			distinct[bucket.Value] = true
+		}
+	} else {
+		bs.Records = len(col.Values)
+		for _, v := range col.Values {
+			distinct[v] = true
+		}
+	}
+
+	bs.Cardinality = len(distinct)
+	for id := range distinct {
+		cs.addDistinct(lookupString(col.StringTable, id))
+	}
+
+	return col.Name, nil
+}
+
+func setColumnStats(filename string, cs *ColumnStats, bs *BlockColumnStats) (string, error) {
+	col := SavedSetColumn{}
+	err := decodeInto(filename, &col)
+	if err != nil {
+		return "", err
+	}
+
+	bs.BucketEncoded = col.BucketEncoded
+	bs.DeltaEncodedIDs = col.DeltaEncodedIDs
+	bs.StringTable = len(col.StringTable)
+
+	distinct := make(map[int32]bool)
+	if col.BucketEncoded {
+		// a record is in the bucket of every member of its set
+		seen := make(map[uint32]bool)
+		for _, bucket := range col.Bins {
+			countRecordIds(bucket.Records, col.DeltaEncodedIDs, seen)
+			distinct[bucket.Value] = true
+		}
+		bs.Records = len(seen)
+	} else {
+		for _, set := range col.Values {
+			if len(set) > 0 {
+				bs.Records++
+			}
+			for _, v := range set {
+				distinct[v] = true
+			}
+		}
+	}
+
+	bs.Cardinality = len(distinct)
+	for id := range distinct {
+		cs.addDistinct(lookupString(col.StringTable, id))
+	}
+
+	return col.Name, nil
+}
+
+// addBlockStats adds the column files of one block to columns
+func (t *Table) addBlockStats(blockname string, stats *TableStats, columns map[string]*ColumnStats, per_block bool) {
+	info := t.LoadBlockInfo(blockname)
+	if info == nil || info.NumRecords <= 0 {
+		Warn("SKIPPING BLOCK WITHOUT INFO", blockname)
+		return
+	}
+
+	files, err := ioutil.ReadDir(blockname)
+	if err != nil {
+		Warn("COULDNT LIST BLOCK", blockname, err)
+		return
+	}
+
+	stats.Blocks++
+	stats.Count += int64(info.NumRecords)
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		stats.Size += f.Size()
+
+		filename := path.Join(blockname, f.Name())
+		cname := trimCodecExt(f.Name())
+		var col_type string
+		var column_stats func(string, *ColumnStats, *BlockColumnStats) (string, error)
+		switch {
+		case strings.HasPrefix(cname, "int_"):
+			col_type, column_stats = "int", intColumnStats
+		case strings.HasPrefix(cname, "str_"):
+			col_type, column_stats = "str", strColumnStats
+		case strings.HasPrefix(cname, "set_"):
+			col_type, column_stats = "set", setColumnStats
+		default:
+			continue
+		}
+
+		// the stats are kept by the name of the column file, a file that
+		// holds another column is only warned about
+		name := strings.TrimSuffix(cname[4:], ".db")
+		cs, ok := columns[name]
+		if !ok {
+			cs = &ColumnStats{Name: name, Type: col_type, distinct: make(map[string]bool)}
+			columns[name] = cs
+		}
+
+		bs := BlockColumnStats{Block: t.tableBlockName(blockname), Bytes: f.Size()}
+		saved_name, err := column_stats(filename, cs, &bs)
+		if err != nil {
+			Warn("COULDNT READ COLUMN FILE", filename, err)
+			continue
+		}
+
+		if saved_name != name {
+			Warn("COLUMN FILE", filename, "HOLDS COLUMN", saved_name)
+		}
+
+		bs.NullRatio = 1 - float64(bs.Records)/float64(info.NumRecords)
+
+		cs.Blocks++
+		cs.Bytes += bs.Bytes
+		cs.Records += int64(bs.Records)
+		cs.StringTable += int64(bs.StringTable)
+		if bs.BucketEncoded {
+			cs.BucketEncoded++
+		}
+		if bs.ValueEncoded {
+			cs.ValueEncoded++
+		}
+		if bs.DeltaEncodedIDs {
+			cs.DeltaEncodedIDs++
+		}
+
+		if per_block {
+			cs.PerBlock = append(cs.PerBlock, &bs)
+		}
+	}
+}
+
+// TableStats adds up the storage stats of every column in the table's
+// blocks. With per_block, the stats of each block are kept, too
+func (t *Table) TableStats(per_block bool) *TableStats {
+	stats := TableStats{}
+	columns := make(map[string]*ColumnStats)
+
+	block_dirs, _ := t.listBlockDirs(nil)
+	sort.Strings(block_dirs)
+	for _, blockname := range block_dirs {
+		t.addBlockStats(blockname, &stats, columns, per_block)
+	}
+
+	if stats.Count > 0 {
+		stats.AverageObjectSize = float64(stats.Size) / float64(stats.Count)
+	}
+	stats.Columns.Strs = t.getColsOfType(STR_VAL)
+	stats.Columns.Ints = t.getColsOfType(INT_VAL)
+	stats.Columns.Sets = t.getColsOfType(SET_VAL)
+
+	stats.ColumnStats = make([]*ColumnStats, 0, len(columns))
+	for _, cs := range columns {
+		cs.Cardinality = len(cs.distinct)
+		if stats.Count > 0 {
+			cs.NullRatio = 1 - float64(cs.Records)/float64(stats.Count)
+		}
+
+		stats.ColumnStats = append(stats.ColumnStats, cs)
+	}
+	sort.Sort(columnStatsByBytes(stats.ColumnStats))
+
+	return &stats
+}
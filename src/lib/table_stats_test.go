@@ -0,0 +1,76 @@
+package sybil
+
+import "math"
+import "strconv"
+import "testing"
+
+func TestTableStats(t *testing.T) {
+	tableName := getTestTableName(t)
+	deleteTestDb(tableName)
+	defer deleteTestDb(tableName)
+
+	blockCount := 2
+	addRecords(tableName, func(r *Record, index int) {
+		r.AddIntField("time", int64(index))
+		r.AddStrField("age_str", strconv.FormatInt(int64(index%5), 10))
+		if index%2 == 1 {
+			r.AddIntField("odd", int64(index%3))
+		}
+	}, blockCount)
+
+	nt := saveAndReloadTable(t, tableName, blockCount)
+	stats := nt.TableStats(true)
+
+	records := int64(CHUNK_SIZE * blockCount)
+	if stats.Blocks != blockCount || stats.Count != records || stats.Size <= 0 {
+		t.Error("EXPECTED", blockCount, "BLOCKS WITH", records, "RECORDS, GOT", stats.Blocks, stats.Count, stats.Size)
+	}
+
+	columns := make(map[string]*ColumnStats)
+	total := int64(0)
+	for i, cs := range stats.ColumnStats {
+		columns[cs.Name] = cs
+		total += cs.Bytes
+		if i > 0 && cs.Bytes > stats.ColumnStats[i-1].Bytes {
+			t.Error("COLUMN STATS ARENT SORTED BY SIZE")
+		}
+		if cs.Blocks != blockCount || len(cs.PerBlock) != blockCount {
+			t.Error("EXPECTED", cs.Name, "IN", blockCount, "BLOCKS, GOT", cs.Blocks, len(cs.PerBlock))
+		}
+	}
+
+	if total > stats.Size {
+		t.Error("COLUMNS TAKE", total, "BYTES, MORE THAN THE TABLE'S", stats.Size)
+	}
+
+	time_col := columns["time"]
+	if time_col == nil || time_col.Cardinality != int(records) || time_col.NullRatio != 0 {
+		t.Error("WRONG STATS FOR TIME COLUMN", time_col)
+	}
+
+	// high cardinality int columns are saved as delta encoded values
+	if CHUNK_SIZE > CARDINALITY_THRESHOLD && time_col.ValueEncoded != blockCount {
+		t.Error("EXPECTED TIME COLUMN TO BE VALUE ENCODED", time_col)
+	}
+
+	age_str := columns["age_str"]
+	if age_str == nil || age_str.Cardinality != 5 || age_str.StringTable != int64(5*blockCount) || age_str.BucketEncoded != blockCount {
+		t.Error("WRONG STATS FOR STR COLUMN", age_str)
+	}
+
+	odd := columns["odd"]
+	if odd == nil || math.Abs(odd.NullRatio-0.5) > 0.001 || odd.Cardinality != 3 {
+		t.Error("EXPECTED HALF OF ODD TO BE NULL, GOT", odd)
+	}
+
+	old_max := STATS_MAX_CARDINALITY
+	STATS_MAX_CARDINALITY = 10
+	defer func() { STATS_MAX_CARDINALITY = old_max }()
+
+	stats = nt.TableStats(false)
+	for _, cs := range stats.ColumnStats {
+		if cs.Name == "time" && (!cs.CardinalityCapped || cs.Cardinality != 10 || cs.PerBlock != nil) {
+			t.Error("EXPECTED CAPPED CARDINALITY FOR TIME, GOT", cs)
+		}
+	}
+}
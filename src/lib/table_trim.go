@@ -1,5 +1,7 @@
 package sybil
 
+import "os"
+import "path"
 import "sort"
 
 type TrimSpec struct {
@@ -16,8 +18,14 @@ func (t *Table) TrimTable(trimSpec *TrimSpec) []*TableBlock {
 	blocks := make([]*TableBlock, 0)
 	to_trim := make([]*TableBlock, 0)
 
+	// blocks in partitions that get dropped wholesale aren't listed
+	dropped := make(map[string]bool)
+	for _, partition := range t.TrimPartitions(trimSpec) {
+		dropped[partition] = true
+	}
+
 	for _, b := range t.BlockList {
-		if b.Name == ROW_STORE_BLOCK {
+		if b.Name == ROW_STORE_BLOCK || dropped[path.Dir(b.Name)] {
 			continue
 		}
 
@@ -56,3 +64,38 @@ func (t *Table) TrimTable(trimSpec *TrimSpec) []*TableBlock {
 
 	return to_trim
 }
+
+// DropBlocks deletes trimmed blocks. Tables with a manifest retire them
+// instead, so queries that are reading them can finish
+func (t *Table) DropBlocks(blocks []string) {
+	if len(blocks) == 0 {
+		return
+	}
+
+	records := int64(0)
+	for _, blockname := range blocks {
+		records += int64(t.LoadBlockInfo(blockname).NumRecords)
+	}
+
+	t.retireBlocks(blocks)
+	t.CommitManifest()
+	t.forgetBlocks(blocks)
+	t.addLedgerEntry("", -records, "trim")
+}
+
+// DropPartitions deletes trimmed partitions along with all their blocks
+func (t *Table) DropPartitions(partitions []string) {
+	blocks := make([]string, 0)
+	for _, partition := range partitions {
+		blocks = append(blocks, listBlocksIn(partition)...)
+	}
+
+	t.DropBlocks(blocks)
+
+	// retired blocks take their partition with them once they are removed
+	if !t.HasManifest() {
+		for _, partition := range partitions {
+			os.RemoveAll(partition)
+		}
+	}
+}